@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"flag"
 	"log"
 	"net/http"
 	_ "net/http/pprof" // Register pprof handlers when enabled
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/example/mautrix-viber/internal/api"
@@ -19,7 +21,9 @@ import (
 	"github.com/example/mautrix-viber/internal/database"
 	"github.com/example/mautrix-viber/internal/logger"
 	imatrix "github.com/example/mautrix-viber/internal/matrix"
+	"github.com/example/mautrix-viber/internal/media"
 	"github.com/example/mautrix-viber/internal/middleware"
+	"github.com/example/mautrix-viber/internal/ratelimit"
 	"github.com/example/mautrix-viber/internal/viber"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -29,20 +33,71 @@ func main() {
 		"version", "dev",
 	)
 
+	generateRegistration := flag.Bool("generate-registration", false, "Generate the appservice registration file and exit")
+	flag.Parse()
+
 	env := config.FromEnv()
 
+	registrationCfg := imatrix.RegistrationConfig{
+		URL:          env.AppServiceURL,
+		ServerName:   env.MatrixServerName,
+		BotLocalpart: env.AppServiceBotLocalpart,
+	}
+	if *generateRegistration {
+		if _, _, err := imatrix.LoadOrGenerateRegistration(env.AppServiceRegistrationPath, registrationCfg); err != nil {
+			log.Fatalf("failed to generate appservice registration: %v", err)
+		}
+		logger.Info("appservice registration written; add it to your homeserver configuration",
+			"path", env.AppServiceRegistrationPath,
+		)
+		return
+	}
+
 	// Validate configuration before proceeding
 	if err := env.Validate(); err != nil {
 		log.Fatalf("configuration validation failed: %v", err)
 	}
 
+	// Matrix listeners and periodic cleanups run until shutdown
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+
 	// Init Matrix client (optional: only if fully configured)
 	var mxClient *imatrix.Client
-	if env.MatrixHomeserverURL != "" && env.MatrixAccessToken != "" && env.MatrixDefaultRoomID != "" {
+	if env.MatrixMode == imatrix.ModeAppService {
+		reg, created, err := imatrix.LoadOrGenerateRegistration(env.AppServiceRegistrationPath, registrationCfg)
+		if err != nil {
+			log.Fatalf("failed to load appservice registration: %v", err)
+		}
+		if created {
+			logger.Warn("generated new appservice registration; add it to your homeserver configuration and restart it",
+				"path", env.AppServiceRegistrationPath,
+			)
+		}
+		mc, err := imatrix.NewClient(imatrix.Config{
+			HomeserverURL: env.MatrixHomeserverURL,
+			DefaultRoomID: env.MatrixDefaultRoomID,
+			Mode:          imatrix.ModeAppService,
+			ServerName:    env.MatrixServerName,
+			Registration:  reg,
+		})
+		if err != nil {
+			log.Fatalf("failed to initialize matrix appservice: %v", err)
+		}
+		mxClient = mc
+		// Start consuming transactions even if no message listener is attached,
+		// so homeserver pushes never block on a full event buffer
+		mxClient.AppService().Start(runCtx)
+		logger.Info("matrix appservice mode enabled",
+			"bot_user_id", mxClient.UserID(),
+		)
+	} else if env.MatrixHomeserverURL != "" && env.MatrixAccessToken != "" {
 		mc, err := imatrix.NewClient(imatrix.Config{
 			HomeserverURL: env.MatrixHomeserverURL,
 			AccessToken:   env.MatrixAccessToken,
 			DefaultRoomID: env.MatrixDefaultRoomID,
+			Mode:          imatrix.ModeSync,
+			UserID:        env.MatrixUserID,
 		})
 		if err != nil {
 			log.Fatalf("failed to initialize matrix client: %v", err)
@@ -71,49 +126,110 @@ func main() {
 	}
 	defer func() { _ = db.Close() }()
 
+	portalInvites := make([]id.UserID, 0, len(env.MatrixPortalInvites))
+	for _, userID := range env.MatrixPortalInvites {
+		portalInvites = append(portalInvites, id.UserID(userID))
+	}
+
 	cfg := viber.Config{
-		APIToken:        env.APIToken,
-		WebhookURL:      env.WebhookURL,
-		ViberAPIBaseURL: env.ViberAPIBaseURL,
-		ListenAddress:   env.ListenAddress,
-		HTTPTimeout:     env.HTTPClientTimeout,
+		APIToken:             env.APIToken,
+		WebhookURL:           env.WebhookURL,
+		ViberAPIBaseURL:      env.ViberAPIBaseURL,
+		ListenAddress:        env.ListenAddress,
+		HTTPTimeout:          env.HTTPClientTimeout,
+		PortalInvites:        portalInvites,
+		DedupRetention:       env.WebhookDedupRetention,
+		InboxWorkers:         env.InboxWorkers,
+		InboxMaxRetries:      env.InboxMaxRetries,
+		MaxMediaSize:         env.MaxMediaSize,
+		MediaCacheTTL:        env.MediaCacheTTL,
+		MediaCacheMaxEntries: env.MediaCacheMaxEntries,
+		SendLimit: ratelimit.Config{
+			Rate:     env.SendRate,
+			Burst:    env.SendBurst,
+			KeyRate:  env.ReceiverSendRate,
+			KeyBurst: env.ReceiverSendBurst,
+			MaxWait:  env.SendMaxWait,
+		},
+		SenderNameTemplate:    env.SenderNameTemplate,
+		MapURLTemplate:        env.MapURLTemplate,
+		DisableSenderOverride: !env.SenderOverride,
 	}
 
 	v := viber.NewClient(cfg, mxClient, db)
+	if cacheClient != nil {
+		// Share deduplication state across replicas behind the same webhook
+		v.SetDedupStore(cacheClient)
+	}
+	// Convert voice messages and inspect videos with ffmpeg when it is installed
+	if ffmpeg, err := media.DetectFFmpeg(context.Background()); err == nil {
+		v.SetTranscoder(ffmpeg)
+		logger.Info("ffmpeg transcoder enabled",
+			"capabilities", ffmpeg.Capabilities(),
+		)
+	} else {
+		logger.Info("ffmpeg not available; voice messages are sent to Viber as files and video thumbnails are not generated",
+			"error", err,
+		)
+	}
+	v.StartMediaCachePruning(runCtx)
+	// Process webhooks asynchronously, resuming anything left over from the last run
+	if err := v.StartInbox(context.Background()); err != nil {
+		log.Fatalf("failed to start webhook inbox: %v", err)
+	}
 	if err := v.EnsureWebhook(context.Background()); err != nil {
 		log.Fatalf("failed to ensure webhook: %v", err)
 	}
 
-	// If Matrix is configured, start listener to forward Matrix -> Viber
-	if mxClient != nil && env.ViberDefaultReceiverID != "" {
-		if err := mxClient.StartMessageListener(context.Background(), func(ctx context.Context, msg *event.MessageEventContent, roomID id.RoomID, sender id.UserID) {
-			// Forward plain text messages to a default Viber receiver for demo purposes
-			if msg.MsgType == event.MsgText || msg.MsgType == event.MsgNotice {
-				// best-effort: include sender localpart
-				text := msg.Body
-				if text != "" {
-					_, err := v.SendText(ctx, env.ViberDefaultReceiverID, text)
-					if err != nil {
-						logger.Warn("failed to forward message to Viber",
-							"error", err,
-							"receiver", env.ViberDefaultReceiverID,
-						)
-					}
-				}
-			}
-		}); err != nil {
+	// If Matrix is configured, forward messages from bridged portal rooms to Viber
+	if mxClient != nil {
+		// Messages are persisted before they are acknowledged and forwarded by the outbox workers,
+		// resuming anything left over from the last run
+		if err := v.StartOutbox(context.Background()); err != nil {
+			log.Fatalf("failed to start matrix outbox: %v", err)
+		}
+		if err := mxClient.StartMessageListener(runCtx, v.QueueMatrixMessage); err != nil {
 			logger.Error("matrix listener error",
 				"error", err,
 			)
 		}
 	}
 
+	// Serve Matrix attachments to Viber over signed links, since Viber cannot authenticate to the homeserver
+	var mediaProxy *imatrix.MediaProxy
+	if mxClient != nil {
+		secret := []byte(env.MediaProxySecret)
+		if len(secret) == 0 {
+			secret = make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				log.Fatalf("failed to generate media proxy secret: %v", err)
+			}
+			logger.Info("MEDIA_PROXY_SECRET not set; media links will stop working after a restart")
+		}
+		mediaProxy, err = imatrix.NewMediaProxy(mxClient, env.MediaProxyBaseURL, secret, env.MediaProxyTTL)
+		if err != nil {
+			log.Fatalf("failed to initialize media proxy: %v", err)
+		}
+		v.SetMediaLinker(mediaProxy)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", healthHandler(db, v))
 	mux.HandleFunc("/readyz", readinessHandler(db, v, mxClient))
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.HandleFunc("/api/info", api.InfoHandler)
+	if env.AdminAPIToken != "" {
+		api.NewServer(db, env.AdminAPIToken).RegisterRoutes(mux)
+	} else {
+		logger.Info("ADMIN_API_TOKEN not set; the /api/v1 management API is disabled")
+	}
 	mux.HandleFunc("/viber/webhook", v.WebhookHandler)
+	if mediaProxy != nil {
+		mux.Handle(imatrix.MediaProxyPath, mediaProxy)
+	}
+	if mxClient != nil && mxClient.IsAppService() {
+		mxClient.AppService().RegisterRoutes(mux)
+	}
 
 	// pprof endpoints are automatically registered via blank import above
 	// Access at /debug/pprof/ when ENABLE_PPROF=true
@@ -125,6 +241,7 @@ func main() {
 	// Build middleware chain: recovery -> request ID -> body logging (optional) -> logging -> rate limit -> body size
 	middlewareChain := withServerMiddleware(
 		withRateLimit(
+			mediaProxy,
 			withOptionalBodyLogging(
 				env.EnableRequestLogging,
 				middleware.LoggingMiddleware(
@@ -169,6 +286,19 @@ func main() {
 			"error", err,
 		)
 	}
+	// Stop consuming Matrix events, whose unacknowledged transactions the homeserver resends, and cleanups
+	stopRunning()
+	// Let in-flight webhooks and messages finish; anything still queued resumes on the next start
+	if err := v.StopInbox(shutdownCtx); err != nil {
+		logger.Error("webhook inbox shutdown failed",
+			"error", err,
+		)
+	}
+	if err := v.StopOutbox(shutdownCtx); err != nil {
+		logger.Error("matrix outbox shutdown failed",
+			"error", err,
+		)
+	}
 	logger.Info("shutdown complete")
 }
 
@@ -182,9 +312,16 @@ func withServerMiddleware(next http.Handler) http.Handler {
 }
 
 // withRateLimit applies a simple token-bucket rate limiter per client IP.
-func withRateLimit(next http.Handler) http.Handler {
+// Appservice transaction routes and media links with a valid signature (mediaProxy may be nil) are exempt.
+func withRateLimit(mediaProxy *imatrix.MediaProxy, next http.Handler) http.Handler {
 	limiter := newIPRateLimiter(5, 10) // 5 req/sec, burst 10
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Homeserver appservice pushes are authenticated with hs_token and must not be throttled,
+		// nor media downloads by Viber whose signature verifies
+		if strings.HasPrefix(r.URL.Path, "/_matrix/app/") || (mediaProxy != nil && mediaProxy.Authorized(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
 		ip := clientIP(r)
 		if !limiter.Allow(ip) {
 			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
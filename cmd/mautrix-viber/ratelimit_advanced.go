@@ -4,93 +4,31 @@ package main
 import (
 	"net/http"
 	"sync"
-	"time"
+
+	"github.com/example/mautrix-viber/internal/ratelimit"
 )
 
 // AdvancedRateLimiter provides per-user, per-room rate limiting with adaptive limits.
 type AdvancedRateLimiter struct {
 	mu            sync.RWMutex
-	userLimiters  map[string]*AdaptiveLimiter
-	roomLimiters  map[string]*AdaptiveLimiter
-	globalLimiter *AdaptiveLimiter
+	userLimiters  map[string]*ratelimit.AdaptiveLimiter
+	roomLimiters  map[string]*ratelimit.AdaptiveLimiter
+	globalLimiter *ratelimit.AdaptiveLimiter
 	baseRate      float64
 	burstSize     float64
 }
 
-// AdaptiveLimiter is a token bucket with adaptive rate adjustment.
-type AdaptiveLimiter struct {
-	mu         sync.Mutex
-	tokens     float64
-	rate       float64
-	burst      float64
-	lastRefill time.Time
-	requests   int
-	errors     int
-}
-
 // NewAdvancedRateLimiter creates a new advanced rate limiter.
 func NewAdvancedRateLimiter(baseRate, burstSize float64) *AdvancedRateLimiter {
 	return &AdvancedRateLimiter{
-		userLimiters:  make(map[string]*AdaptiveLimiter),
-		roomLimiters:  make(map[string]*AdaptiveLimiter),
-		globalLimiter: NewAdaptiveLimiter(baseRate, burstSize),
+		userLimiters:  make(map[string]*ratelimit.AdaptiveLimiter),
+		roomLimiters:  make(map[string]*ratelimit.AdaptiveLimiter),
+		globalLimiter: ratelimit.NewAdaptiveLimiter(baseRate, burstSize),
 		baseRate:      baseRate,
 		burstSize:     burstSize,
 	}
 }
 
-// NewAdaptiveLimiter creates a new adaptive limiter.
-func NewAdaptiveLimiter(rate, burst float64) *AdaptiveLimiter {
-	return &AdaptiveLimiter{
-		tokens:     burst,
-		rate:       rate,
-		burst:      burst,
-		lastRefill: time.Now(),
-	}
-}
-
-// Allow checks if a request is allowed.
-func (al *AdaptiveLimiter) Allow() bool {
-	al.mu.Lock()
-	defer al.mu.Unlock()
-
-	now := time.Now()
-	elapsed := now.Sub(al.lastRefill).Seconds()
-
-	// Refill tokens
-	al.tokens = min(al.burst, al.tokens+elapsed*al.rate)
-	al.lastRefill = now
-
-	// Adaptive rate adjustment based on error rate
-	if al.requests > 10 {
-		errorRate := float64(al.errors) / float64(al.requests)
-		if errorRate > 0.1 {
-			// High error rate - reduce rate by 20%
-			al.rate = al.rate * 0.8
-		} else if errorRate < 0.01 {
-			// Low error rate - increase rate by 10%
-			al.rate = min(al.burst/10, al.rate*1.1)
-		}
-		al.requests = 0
-		al.errors = 0
-	}
-
-	if al.tokens < 1 {
-		return false
-	}
-
-	al.tokens--
-	al.requests++
-	return true
-}
-
-// RecordError records an error for adaptive rate adjustment.
-func (al *AdaptiveLimiter) RecordError() {
-	al.mu.Lock()
-	defer al.mu.Unlock()
-	al.errors++
-}
-
 // AllowUser checks if a request is allowed for a specific user.
 func (arl *AdvancedRateLimiter) AllowUser(userID string) bool {
 	arl.mu.RLock()
@@ -99,7 +37,7 @@ func (arl *AdvancedRateLimiter) AllowUser(userID string) bool {
 
 	if !exists {
 		arl.mu.Lock()
-		limiter = NewAdaptiveLimiter(arl.baseRate, arl.burstSize)
+		limiter = ratelimit.NewAdaptiveLimiter(arl.baseRate, arl.burstSize)
 		arl.userLimiters[userID] = limiter
 		arl.mu.Unlock()
 	}
@@ -116,7 +54,7 @@ func (arl *AdvancedRateLimiter) AllowRoom(roomID string) bool {
 
 	if !exists {
 		arl.mu.Lock()
-		limiter = NewAdaptiveLimiter(arl.baseRate*2, arl.burstSize*2) // Rooms get higher limits
+		limiter = ratelimit.NewAdaptiveLimiter(arl.baseRate*2, arl.burstSize*2) // Rooms get higher limits
 		arl.roomLimiters[roomID] = limiter
 		arl.mu.Unlock()
 	}
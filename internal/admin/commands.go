@@ -1,10 +1,11 @@
 // Package admin provides bridge administration commands for Matrix rooms.
-// Commands like !bridge link, !bridge status are handled here.
+// Commands like !bridge link, !bridge status and !bridge dlq are handled here.
 package admin
 
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
 
 	mautrix "maunium.net/go/mautrix"
@@ -58,6 +59,11 @@ func (h *Handler) registerDefaultCommands() {
 		Description: "Show bridge status and connection info",
 		Handler:     h.handleStatus,
 	})
+	h.RegisterCommand(Command{
+		Name:        "dlq",
+		Description: "List, retry or purge failed bridge jobs (list [page] [type] | retry <id|all> | purge <id|all>)",
+		Handler:     h.handleDeadLetters,
+	})
 	h.RegisterCommand(Command{
 		Name:        "help",
 		Description: "Show available bridge commands",
@@ -122,12 +128,13 @@ func (h *Handler) isAllowed(userID id.UserID) bool {
 	if len(h.allowedUsers) == 0 {
 		return true // No restrictions
 	}
-	for _, allowed := range h.allowedUsers {
-		if allowed == userID {
-			return true
-		}
-	}
-	return false
+	return h.isAdmin(userID)
+}
+
+// isAdmin checks if a user is explicitly listed in allowedUsers.
+// Destructive commands require it, so nobody may run them when the list is empty.
+func (h *Handler) isAdmin(userID id.UserID) bool {
+	return slices.Contains(h.allowedUsers, userID)
 }
 
 // reply sends a message to a Matrix room.
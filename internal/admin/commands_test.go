@@ -0,0 +1,123 @@
+// Package admin tests - unit tests for bridge admin commands.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	mautrix "maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/database"
+)
+
+const (
+	testRoom  = id.RoomID("!admin:example.com")
+	testAdmin = id.UserID("@admin:example.com")
+	testUser  = id.UserID("@user:example.com")
+)
+
+// newTestHandler returns a handler whose replies are collected from a fake homeserver,
+// and a database holding one dead letter.
+func newTestHandler(t *testing.T, dbPath string, allowedUsers []id.UserID) (*Handler, *database.DB, func() []string) {
+	t.Helper()
+	var (
+		mu      sync.Mutex
+		replies []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var content event.MessageEventContent
+		_ = json.NewDecoder(r.Body).Decode(&content)
+		mu.Lock()
+		replies = append(replies, content.Body)
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"event_id":"$reply"}`))
+	}))
+	t.Cleanup(srv.Close)
+	mxClient, err := mautrix.NewClient(srv.URL, "@bot:example.com", "token")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	_ = os.Remove(dbPath)
+	t.Cleanup(func() { _ = os.Remove(dbPath) })
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	ctx := context.Background()
+	jobID, err := db.EnqueueJob(ctx, database.QueueJob{Queue: "viber_webhooks", Type: "viber_to_matrix", Payload: []byte("{}")})
+	if err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+	if err := db.DeadLetterJob(ctx, jobID, "failed"); err != nil {
+		t.Fatalf("Failed to dead-letter job: %v", err)
+	}
+
+	return NewHandler(mxClient, db, allowedUsers), db, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), replies...)
+	}
+}
+
+func TestHandleMessage_DeadLetterPermissions(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowedUsers []id.UserID
+		sender       id.UserID
+		command      string
+		wantReply    string
+		wantLetters  int
+	}{
+		{"list without allow-list", nil, testUser, "!bridge dlq list", "Dead letters", 1},
+		{"purge without allow-list", nil, testUser, "!bridge dlq purge all", "only bridge admins may purge", 1},
+		{"retry without allow-list", nil, testUser, "!bridge dlq retry all", "only bridge admins may retry", 1},
+		{"purge by other user", []id.UserID{testAdmin}, testUser, "!bridge dlq purge all", "don't have permission", 1},
+		{"purge by admin", []id.UserID{testAdmin}, testAdmin, "!bridge dlq purge all", "Purged 1 dead letters", 0},
+		{"retry by admin", []id.UserID{testAdmin}, testAdmin, "!bridge dlq retry all", "Requeued 1 dead letters", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db, replies := newTestHandler(t, "/tmp/test_admin_dlq.db", tt.allowedUsers)
+			evt := &event.Event{RoomID: testRoom, Sender: tt.sender}
+			_ = h.HandleMessage(context.Background(), evt, &event.MessageEventContent{MsgType: event.MsgText, Body: tt.command})
+
+			got := replies()
+			if len(got) != 1 || !strings.Contains(got[0], tt.wantReply) {
+				t.Errorf("Expected a reply containing %q, got %q", tt.wantReply, got)
+			}
+			if n, err := db.CountDeadLetters(context.Background(), ""); err != nil || n != tt.wantLetters {
+				t.Errorf("CountDeadLetters() = %d, %v; want %d", n, err, tt.wantLetters)
+			}
+		})
+	}
+}
+
+func TestParseDeadLetterID(t *testing.T) {
+	tests := []struct {
+		arg     string
+		want    int64
+		wantErr bool
+	}{
+		{"12", 12, false},
+		{"#12", 12, false},
+		{"0", 0, true},
+		{"-3", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDeadLetterID(tt.arg)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDeadLetterID(%q) = %d, %v; want %d (error %v)", tt.arg, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
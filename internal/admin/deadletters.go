@@ -0,0 +1,157 @@
+// Package admin deadletters implements the !bridge dlq command for parked bridge jobs.
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/database"
+)
+
+// dlqPageSize is the number of dead letters shown per page by !bridge dlq list.
+const dlqPageSize = 10
+
+// dlqUsage documents the dlq subcommands.
+const dlqUsage = "usage: !bridge dlq list [page] [type] | retry <id|all> | purge <id|all>"
+
+// handleDeadLetters dispatches the dlq subcommands.
+// Retrying and purging are reserved for users listed as bridge admins.
+func (h *Handler) handleDeadLetters(ctx context.Context, args []string, roomID id.RoomID, userID id.UserID) (string, error) {
+	if h.db == nil {
+		return "", fmt.Errorf("database not configured")
+	}
+	if len(args) < 1 {
+		return "", errors.New(dlqUsage)
+	}
+
+	subcommand := strings.ToLower(args[0])
+	if (subcommand == "retry" || subcommand == "purge") && !h.isAdmin(userID) {
+		return "", fmt.Errorf("only bridge admins may %s dead letters", subcommand)
+	}
+	switch subcommand {
+	case "list":
+		return h.listDeadLetters(ctx, args[1:])
+	case "retry":
+		return h.retryDeadLetters(ctx, args[1:])
+	case "purge":
+		return h.purgeDeadLetters(ctx, args[1:])
+	default:
+		return "", errors.New(dlqUsage)
+	}
+}
+
+// listDeadLetters shows one page of dead letters, optionally filtered by job type.
+func (h *Handler) listDeadLetters(ctx context.Context, args []string) (string, error) {
+	page := 1
+	filter := database.DeadLetterFilter{Limit: dlqPageSize}
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			if n < 1 {
+				return "", fmt.Errorf("page must be at least 1")
+			}
+			page = n
+			continue
+		}
+		filter.Type = arg
+	}
+	filter.Offset = (page - 1) * dlqPageSize
+
+	letters, total, err := h.db.ListDeadLetters(ctx, filter)
+	if err != nil {
+		return "", fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	if total == 0 {
+		return "✅ Dead letter queue is empty", nil
+	}
+
+	pages := (total + dlqPageSize - 1) / dlqPageSize
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("**Dead letters** (%d total, page %d/%d)\n\n", total, page, pages))
+	for _, letter := range letters {
+		out.WriteString(fmt.Sprintf("#%d %s %s - %d attempts, failed %s\n    %s\n",
+			letter.ID, letter.Type, letter.ConversationKey, letter.Attempts,
+			letter.FailedAt.Format(time.RFC3339), truncate(letter.LastError, 120)))
+	}
+	if page < pages {
+		out.WriteString(fmt.Sprintf("\nNext page: !bridge dlq list %d", page+1))
+	}
+	return out.String(), nil
+}
+
+// retryDeadLetters moves one or all dead letters back into the queue.
+func (h *Handler) retryDeadLetters(ctx context.Context, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: !bridge dlq retry <id|all>")
+	}
+	if strings.EqualFold(args[0], "all") {
+		n, err := h.db.RequeueDeadLetters(ctx, database.DeadLetterFilter{})
+		if err != nil {
+			return "", fmt.Errorf("failed to retry dead letters: %w", err)
+		}
+		return fmt.Sprintf("✅ Requeued %d dead letters", n), nil
+	}
+
+	deadLetterID, err := parseDeadLetterID(args[0])
+	if err != nil {
+		return "", err
+	}
+	jobID, err := h.db.RequeueDeadLetter(ctx, deadLetterID)
+	if errors.Is(err, database.ErrNotFound) {
+		return "", fmt.Errorf("dead letter #%d not found", deadLetterID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to retry dead letter: %w", err)
+	}
+	return fmt.Sprintf("✅ Requeued dead letter #%d as job %d", deadLetterID, jobID), nil
+}
+
+// purgeDeadLetters permanently removes one or all dead letters.
+func (h *Handler) purgeDeadLetters(ctx context.Context, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: !bridge dlq purge <id|all>")
+	}
+	if strings.EqualFold(args[0], "all") {
+		n, err := h.db.PurgeDeadLetters(ctx, database.DeadLetterFilter{})
+		if err != nil {
+			return "", fmt.Errorf("failed to purge dead letters: %w", err)
+		}
+		return fmt.Sprintf("🗑️ Purged %d dead letters", n), nil
+	}
+
+	deadLetterID, err := parseDeadLetterID(args[0])
+	if err != nil {
+		return "", err
+	}
+	err = h.db.DeleteDeadLetter(ctx, deadLetterID)
+	if errors.Is(err, database.ErrNotFound) {
+		return "", fmt.Errorf("dead letter #%d not found", deadLetterID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to purge dead letter: %w", err)
+	}
+	return fmt.Sprintf("🗑️ Purged dead letter #%d", deadLetterID), nil
+}
+
+// parseDeadLetterID parses a dead letter ID, accepting an optional leading '#'.
+func parseDeadLetterID(arg string) (int64, error) {
+	deadLetterID, err := strconv.ParseInt(strings.TrimPrefix(arg, "#"), 10, 64)
+	if err != nil || deadLetterID <= 0 {
+		return 0, fmt.Errorf("invalid dead letter id %q", arg)
+	}
+	return deadLetterID, nil
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
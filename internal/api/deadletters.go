@@ -0,0 +1,286 @@
+// Package api deadletters provides REST endpoints to inspect, retry and purge dead-lettered bridge jobs.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/mautrix-viber/internal/database"
+	"github.com/example/mautrix-viber/internal/queue"
+)
+
+const (
+	defaultDeadLetterPageSize = 50
+	maxDeadLetterPageSize     = 500
+)
+
+// registerDeadLetterRoutes registers the dead-letter queue endpoints:
+//
+//	GET    /api/v1/deadletters            list (?type=&room=&limit=&offset=)
+//	DELETE /api/v1/deadletters            purge matching (?type=&room=, or ?all=true)
+//	POST   /api/v1/deadletters/retry      retry matching (?type=&room=, or ?all=true)
+//	GET    /api/v1/deadletters/{id}       inspect payload and last error
+//	DELETE /api/v1/deadletters/{id}       purge one
+//	POST   /api/v1/deadletters/{id}/retry retry one
+func (s *Server) registerDeadLetterRoutes(mux *http.ServeMux) {
+	s.handle(mux, "GET /api/v1/deadletters", s.handleListDeadLetters)
+	s.handle(mux, "DELETE /api/v1/deadletters", s.handlePurgeDeadLetters)
+	s.handle(mux, "POST /api/v1/deadletters/retry", s.handleRetryDeadLetters)
+	s.handle(mux, "GET /api/v1/deadletters/{id}", s.handleGetDeadLetter)
+	s.handle(mux, "DELETE /api/v1/deadletters/{id}", s.handleDeleteDeadLetter)
+	s.handle(mux, "POST /api/v1/deadletters/{id}/retry", s.handleRetryDeadLetter)
+}
+
+// handleListDeadLetters lists dead letters with pagination and filters.
+func (s *Server) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if s.db == nil {
+		http.Error(w, "database not configured", http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := s.deadLetterFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = defaultDeadLetterPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = min(limit, maxDeadLetterPageSize)
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = offset
+	}
+
+	letters, total, err := s.db.ListDeadLetters(r.Context(), filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list dead letters: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]map[string]interface{}, 0, len(letters))
+	for _, letter := range letters {
+		entry := deadLetterJSON(letter)
+		entry["payload_size"] = len(letter.Payload)
+		list = append(list, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"deadletters": list,
+		"total":       total,
+		"limit":       filter.Limit,
+		"offset":      filter.Offset,
+	})
+}
+
+// handleGetDeadLetter returns a single dead letter including its payload.
+func (s *Server) handleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.deadLetterID(w, r)
+	if !ok {
+		return
+	}
+
+	letter, err := s.db.GetDeadLetter(r.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get dead letter: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if letter == nil {
+		http.Error(w, "dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	entry := deadLetterJSON(*letter)
+	if json.Valid(letter.Payload) {
+		entry["payload"] = json.RawMessage(letter.Payload)
+	} else {
+		entry["payload"] = string(letter.Payload)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entry)
+}
+
+// handleRetryDeadLetter moves a single dead letter back into the queue.
+func (s *Server) handleRetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.deadLetterID(w, r)
+	if !ok {
+		return
+	}
+
+	jobID, err := s.db.RequeueDeadLetter(r.Context(), id)
+	if errors.Is(err, database.ErrNotFound) {
+		http.Error(w, "dead letter not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to retry dead letter: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "requeued",
+		"id":     id,
+		"job_id": jobID,
+	})
+}
+
+// handleDeleteDeadLetter permanently removes a single dead letter.
+func (s *Server) handleDeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.deadLetterID(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.db.DeleteDeadLetter(r.Context(), id)
+	if errors.Is(err, database.ErrNotFound) {
+		http.Error(w, "dead letter not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to purge dead letter: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "purged",
+		"id":     id,
+	})
+}
+
+// handleRetryDeadLetters moves all matching dead letters back into the queue.
+func (s *Server) handleRetryDeadLetters(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.bulkDeadLetterFilter(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := s.db.RequeueDeadLetters(r.Context(), filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to retry dead letters: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "requeued",
+		"count":  n,
+	})
+}
+
+// handlePurgeDeadLetters permanently removes all matching dead letters.
+func (s *Server) handlePurgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	filter, ok := s.bulkDeadLetterFilter(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := s.db.PurgeDeadLetters(r.Context(), filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to purge dead letters: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "purged",
+		"count":  n,
+	})
+}
+
+// deadLetterID parses the {id} path value, writing an error response on failure.
+func (s *Server) deadLetterID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	if s.db == nil {
+		http.Error(w, "database not configured", http.StatusInternalServerError)
+		return 0, false
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid dead letter id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// bulkDeadLetterFilter parses the filter of a bulk operation.
+// An unfiltered bulk operation must be confirmed with all=true.
+func (s *Server) bulkDeadLetterFilter(w http.ResponseWriter, r *http.Request) (database.DeadLetterFilter, bool) {
+	if s.db == nil {
+		http.Error(w, "database not configured", http.StatusInternalServerError)
+		return database.DeadLetterFilter{}, false
+	}
+	filter, err := s.deadLetterFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return database.DeadLetterFilter{}, false
+	}
+	if filter.Type == "" && len(filter.ConversationKeys) == 0 && r.URL.Query().Get("all") != "true" {
+		http.Error(w, "type or room filter required (use all=true to match every dead letter)", http.StatusBadRequest)
+		return database.DeadLetterFilter{}, false
+	}
+	return filter, true
+}
+
+// deadLetterFilter builds a filter from the type and room query parameters.
+// room accepts a Matrix room ID or a Viber chat/user ID.
+func (s *Server) deadLetterFilter(r *http.Request) (database.DeadLetterFilter, error) {
+	query := r.URL.Query()
+	filter := database.DeadLetterFilter{Type: query.Get("type")}
+	if room := query.Get("room"); room != "" {
+		keys, err := s.conversationKeys(r.Context(), room)
+		if err != nil {
+			return filter, err
+		}
+		filter.ConversationKeys = keys
+	}
+	return filter, nil
+}
+
+// conversationKeys returns the queue conversation keys of a Matrix room or Viber chat.
+// A Matrix portal room also matches the jobs of its Viber conversation.
+func (s *Server) conversationKeys(ctx context.Context, room string) ([]string, error) {
+	if !strings.HasPrefix(room, "!") {
+		return []string{queue.ViberKey(room)}, nil
+	}
+	keys := []string{queue.MatrixKey(room)}
+	chatID, err := s.db.GetViberChatID(ctx, room)
+	if err != nil {
+		return nil, fmt.Errorf("resolve room %s: %w", room, err)
+	}
+	if chatID != "" {
+		keys = append(keys, queue.ViberKey(chatID))
+	}
+	return keys, nil
+}
+
+// deadLetterJSON returns the common JSON fields of a dead letter.
+func deadLetterJSON(letter database.DeadLetter) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               letter.ID,
+		"job_id":           letter.JobID,
+		"type":             letter.Type,
+		"conversation_key": letter.ConversationKey,
+		"attempts":         letter.Attempts,
+		"last_error":       letter.LastError,
+		"created_at":       letter.CreatedAt.Format(time.RFC3339),
+		"failed_at":        letter.FailedAt.Format(time.RFC3339),
+	}
+}
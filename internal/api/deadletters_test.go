@@ -0,0 +1,153 @@
+// Package api tests - unit tests for the dead letter endpoints.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/example/mautrix-viber/internal/database"
+)
+
+const testAdminToken = "test-admin-token-0123456789"
+
+// openDeadLetterDB opens a database holding one dead letter for each payload.
+func openDeadLetterDB(t *testing.T, path string, payloads ...string) *database.DB {
+	t.Helper()
+	_ = os.Remove(path)
+	t.Cleanup(func() { _ = os.Remove(path) })
+
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	ctx := context.Background()
+	for _, payload := range payloads {
+		id, err := db.EnqueueJob(ctx, database.QueueJob{Queue: "viber_webhooks", Type: "viber_to_matrix", ConversationKey: "viber:chat", Payload: []byte(payload)})
+		if err != nil {
+			t.Fatalf("Failed to enqueue job: %v", err)
+		}
+		if err := db.DeadLetterJob(ctx, id, "failed"); err != nil {
+			t.Fatalf("Failed to dead-letter job: %v", err)
+		}
+	}
+	return db
+}
+
+func TestServer_Auth(t *testing.T) {
+	db := openDeadLetterDB(t, "/tmp/test_api_auth.db", `{"event":"message"}`)
+
+	tests := []struct {
+		name   string
+		token  string // Server token
+		header string // Authorization header
+		want   int
+	}{
+		{"missing header", testAdminToken, "", http.StatusUnauthorized},
+		{"wrong token", testAdminToken, "Bearer wrong-token", http.StatusUnauthorized},
+		{"wrong scheme", testAdminToken, "Basic " + testAdminToken, http.StatusUnauthorized},
+		{"no token configured", "", "Bearer ", http.StatusForbidden},
+		{"valid token", testAdminToken, "Bearer " + testAdminToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			NewServer(db, tt.token).RegisterRoutes(mux)
+			for _, target := range []string{"/api/v1/deadletters", "/api/v1/users"} {
+				req := httptest.NewRequest(http.MethodGet, target, nil)
+				if tt.header != "" {
+					req.Header.Set("Authorization", tt.header)
+				}
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, req)
+				if rec.Code != tt.want {
+					t.Errorf("GET %s: expected %d, got %d", target, tt.want, rec.Code)
+				}
+			}
+
+			// Refused destructive requests must not touch the dead letters
+			if tt.want == http.StatusOK {
+				return
+			}
+			req := httptest.NewRequest(http.MethodDelete, "/api/v1/deadletters?all=true", nil)
+			req.Header.Set("Authorization", tt.header)
+			mux.ServeHTTP(httptest.NewRecorder(), req)
+			if n, err := db.CountDeadLetters(context.Background(), ""); err != nil || n != 1 {
+				t.Errorf("Expected the dead letter to survive a refused purge, got %d (%v)", n, err)
+			}
+		})
+	}
+}
+
+func TestServer_DeadLetters(t *testing.T) {
+	db := openDeadLetterDB(t, "/tmp/test_api_dead_letters.db", `{"event":"message"}`, "not json", `{"event":"seen"}`)
+	mux := http.NewServeMux()
+	NewServer(db, testAdminToken).RegisterRoutes(mux)
+
+	do := func(method, target string) (int, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var body map[string]interface{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	code, body := do(http.MethodGet, "/api/v1/deadletters?limit=2")
+	if code != http.StatusOK || body["total"] != float64(3) || len(body["deadletters"].([]interface{})) != 2 {
+		t.Fatalf("List: expected 2 of 3 dead letters, got %d %v", code, body)
+	}
+	letters, _, _ := db.ListDeadLetters(context.Background(), database.DeadLetterFilter{})
+	first, second := letters[2], letters[1] // Listed most recent first
+
+	if code, body := do(http.MethodGet, "/api/v1/deadletters/"+strconv.FormatInt(first.ID, 10)); code != http.StatusOK || body["payload"].(map[string]interface{})["event"] != "message" {
+		t.Errorf("Get: expected the JSON payload, got %d %v", code, body)
+	}
+	if code, body := do(http.MethodGet, "/api/v1/deadletters/"+strconv.FormatInt(second.ID, 10)); code != http.StatusOK || body["payload"] != "not json" {
+		t.Errorf("Get: expected the raw payload, got %d %v", code, body)
+	}
+	if code, _ := do(http.MethodGet, "/api/v1/deadletters/9999"); code != http.StatusNotFound {
+		t.Errorf("Get: expected 404 for unknown dead letter, got %d", code)
+	}
+	if code, _ := do(http.MethodGet, "/api/v1/deadletters/abc"); code != http.StatusBadRequest {
+		t.Errorf("Get: expected 400 for invalid id, got %d", code)
+	}
+
+	// Retrying keeps the original job ID
+	code, body = do(http.MethodPost, "/api/v1/deadletters/"+strconv.FormatInt(first.ID, 10)+"/retry")
+	if code != http.StatusOK || body["job_id"] != float64(first.JobID) {
+		t.Errorf("Retry: expected job %d, got %d %v", first.JobID, code, body)
+	}
+	if code, _ := do(http.MethodPost, "/api/v1/deadletters/"+strconv.FormatInt(first.ID, 10)+"/retry"); code != http.StatusNotFound {
+		t.Errorf("Retry: expected 404 when retrying twice, got %d", code)
+	}
+
+	if code, _ := do(http.MethodDelete, "/api/v1/deadletters/"+strconv.FormatInt(second.ID, 10)); code != http.StatusOK {
+		t.Errorf("Delete: expected 200, got %d", code)
+	}
+	if code, _ := do(http.MethodDelete, "/api/v1/deadletters/"+strconv.FormatInt(second.ID, 10)); code != http.StatusNotFound {
+		t.Errorf("Delete: expected 404 when deleting twice, got %d", code)
+	}
+
+	// Bulk operations need a filter or all=true
+	if code, _ := do(http.MethodPost, "/api/v1/deadletters/retry"); code != http.StatusBadRequest {
+		t.Errorf("Bulk retry: expected 400 without a filter, got %d", code)
+	}
+	if code, body := do(http.MethodPost, "/api/v1/deadletters/retry?room=other"); code != http.StatusOK || body["count"] != float64(0) {
+		t.Errorf("Bulk retry: expected no match for another chat, got %d %v", code, body)
+	}
+	if code, body := do(http.MethodDelete, "/api/v1/deadletters?room=chat"); code != http.StatusOK || body["count"] != float64(1) {
+		t.Errorf("Bulk purge: expected 1 purged, got %d %v", code, body)
+	}
+	if n, err := db.CountJobs(context.Background(), "viber_webhooks"); err != nil || n != 1 {
+		t.Errorf("CountJobs() = %d, %v; want the 1 retried job", n, err)
+	}
+}
@@ -2,9 +2,11 @@
 package api
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/example/mautrix-viber/internal/database"
 )
@@ -12,27 +14,47 @@ import (
 // Server provides REST API endpoints for bridge management.
 // Renamed from APIServer to avoid stuttering (api.APIServer).
 type Server struct {
-	db *database.DB
+	db         *database.DB
+	adminToken string // Bearer token required by every endpoint; empty refuses all requests
 }
 
-// NewAPIServer creates a new API server.
+// NewAPIServer creates a new API server that refuses all requests.
 // Deprecated: use NewServer instead to avoid stuttering (api.APIServer -> api.Server).
 func NewAPIServer(db *database.DB) *Server {
 	return &Server{db: db}
 }
 
-// NewServer creates a new API server.
-func NewServer(db *database.DB) *Server {
-	return &Server{db: db}
+// NewServer creates a new API server. Every endpoint requires the header
+// "Authorization: Bearer <adminToken>"; with an empty adminToken all requests are refused.
+func NewServer(db *database.DB, adminToken string) *Server {
+	return &Server{db: db, adminToken: adminToken}
 }
 
 // RegisterRoutes registers API routes.
 func (s *Server) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/api/v1/users", s.handleUsers)
-	mux.HandleFunc("/api/v1/rooms", s.handleRooms)
-	mux.HandleFunc("/api/v1/link", s.handleLink)
-	mux.HandleFunc("/api/v1/unlink", s.handleUnlink)
-	mux.HandleFunc("/api/v1/status", s.handleStatus)
+	s.handle(mux, "/api/v1/users", s.handleUsers)
+	s.handle(mux, "/api/v1/rooms", s.handleRooms)
+	s.handle(mux, "/api/v1/link", s.handleLink)
+	s.handle(mux, "/api/v1/unlink", s.handleUnlink)
+	s.handle(mux, "/api/v1/status", s.handleStatus)
+	s.registerDeadLetterRoutes(mux)
+}
+
+// handle registers a handler that only runs for requests carrying the admin token.
+func (s *Server) handle(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.Error(w, "admin API disabled", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	})
 }
 
 // handleUsers handles user management API.
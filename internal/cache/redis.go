@@ -95,6 +95,34 @@ func (c *Cache) SetJSON(ctx context.Context, key string, v interface{}) error {
 	return c.Set(ctx, key, data)
 }
 
+// MarkWebhookProcessed records a webhook callback for retention and reports whether it is new.
+// Uses SETNX so concurrent replicas agree on which one processes the callback.
+func (c *Cache) MarkWebhookProcessed(ctx context.Context, messageToken int64, event string, retention time.Duration) (bool, error) {
+	if c == nil || c.client == nil {
+		return false, fmt.Errorf("cache not configured")
+	}
+
+	key := fmt.Sprintf("webhook:processed:%s:%d", event, messageToken)
+	first, err := c.client.SetNX(ctx, key, time.Now().Unix(), retention).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis setnx: %w", err)
+	}
+	return first, nil
+}
+
+// UnmarkWebhookProcessed forgets a recorded webhook callback, so that its next delivery is processed.
+func (c *Cache) UnmarkWebhookProcessed(ctx context.Context, messageToken int64, event string) error {
+	if c == nil || c.client == nil {
+		return fmt.Errorf("cache not configured")
+	}
+
+	key := fmt.Sprintf("webhook:processed:%s:%d", event, messageToken)
+	if err := c.client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("redis del: %w", err)
+	}
+	return nil
+}
+
 // Close closes the cache connection.
 func (c *Cache) Close() error {
 	if c == nil || c.client == nil {
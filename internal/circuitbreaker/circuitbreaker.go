@@ -26,6 +26,20 @@ const (
 	StateHalfOpen
 )
 
+// String returns the lower-case name of the state.
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
 // CircuitBreaker implements circuit breaker pattern.
 type CircuitBreaker struct {
 	mu              sync.RWMutex
@@ -49,23 +63,17 @@ func NewCircuitBreaker(maxFailures, maxSuccesses int, timeout time.Duration) *Ci
 }
 
 // Execute executes a function with circuit breaker protection.
+// fn runs without holding the breaker's lock, so concurrent calls are not serialized.
 func (cb *CircuitBreaker) Execute(fn func() error) error {
-	cb.mu.Lock()
-	defer cb.mu.Unlock()
-
-	// Check if circuit should transition from open to half-open
-	if cb.state == StateOpen {
-		if time.Since(cb.lastFailureTime) > cb.timeout {
-			cb.state = StateHalfOpen
-			cb.successCount = 0
-		} else {
-			return ErrCircuitOpen
-		}
+	if err := cb.allow(); err != nil {
+		return err
 	}
 
 	// Execute function
 	err := fn()
 
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
 	if err != nil {
 		cb.onFailure()
 		return err
@@ -75,6 +83,23 @@ func (cb *CircuitBreaker) Execute(fn func() error) error {
 	return nil
 }
 
+// allow reports whether a call may proceed, moving an open circuit to
+// half-open once the timeout has elapsed.
+func (cb *CircuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	// Check if circuit should transition from open to half-open
+	if cb.state == StateOpen {
+		if time.Since(cb.lastFailureTime) <= cb.timeout {
+			return ErrCircuitOpen
+		}
+		cb.state = StateHalfOpen
+		cb.successCount = 0
+	}
+	return nil
+}
+
 // onFailure handles a failure.
 func (cb *CircuitBreaker) onFailure() {
 	cb.failureCount++
@@ -106,3 +106,32 @@ func TestCircuitBreaker_Reset(t *testing.T) {
 		t.Errorf("Expected state Closed after reset, got %v", cb.GetState())
 	}
 }
+
+func TestCircuitBreaker_ConcurrentExecute(t *testing.T) {
+	cb := NewCircuitBreaker(3, 2, 1*time.Second)
+
+	// Each call waits for the other to start, which deadlocks if calls are serialized
+	started := make(chan struct{}, 2)
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- cb.Execute(func() error {
+				started <- struct{}{}
+				deadline := time.After(time.Second)
+				for len(started) < 2 {
+					select {
+					case <-deadline:
+						return errors.New("calls were serialized")
+					case <-time.After(time.Millisecond):
+					}
+				}
+				return nil
+			})
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/example/mautrix-viber/internal/utils"
@@ -24,17 +25,43 @@ type Config struct {
 	ListenAddress   string // HTTP server listen address (default: ":8080")
 
 	// Matrix client configuration
-	MatrixHomeserverURL string // Matrix homeserver base URL (required if bridging)
-	MatrixAccessToken   string // Matrix access token (required if bridging)
-	MatrixDefaultRoomID string // Default Matrix room for bridged messages (required if bridging)
+	MatrixHomeserverURL string   // Matrix homeserver base URL (required if bridging)
+	MatrixAccessToken   string   // Matrix access token (required if bridging)
+	MatrixDefaultRoomID string   // Fallback Matrix room when a portal room cannot be resolved (optional)
+	MatrixPortalInvites []string // Matrix users invited to every new portal room (optional)
+	MatrixMode          string   // "sync" (default) or "appservice"
+	MatrixUserID        string   // Bridge user ID in sync mode (optional, resolved via /whoami)
+	MatrixServerName    string   // Homeserver domain for ghost user IDs (required in appservice mode)
+
+	// Matrix appservice configuration (MatrixMode == "appservice")
+	AppServiceRegistrationPath string // Path of registration.yaml (default: "./data/registration.yaml")
+	AppServiceURL              string // URL the homeserver uses to reach the bridge (required in appservice mode)
+	AppServiceBotLocalpart     string // Localpart of the bridge bot user (default: "viberbot")
 
 	// Optional features
-	ViberDefaultReceiverID string        // Default Viber user ID for Matrix → Viber forwarding (optional)
-	DatabasePath           string        // SQLite database path (default: "./data/bridge.db")
-	HTTPClientTimeout      time.Duration // HTTP client timeout for API calls (default: 15s)
-	RedisURL               string        // Redis URL for caching (optional)
-	CacheTTL               time.Duration // Cache TTL duration (default: 5 minutes)
-	EnableRequestLogging   bool          // Enable request/response body logging (default: false, debug only)
+	DatabasePath          string        // SQLite database path (default: "./data/bridge.db")
+	HTTPClientTimeout     time.Duration // HTTP client timeout for API calls (default: 15s)
+	RedisURL              string        // Redis URL for caching (optional)
+	CacheTTL              time.Duration // Cache TTL duration (default: 5 minutes)
+	WebhookDedupRetention time.Duration // How long processed webhook tokens are remembered (default: 24 hours)
+	InboxWorkers          int           // Workers processing queued webhooks (default: 4)
+	InboxMaxRetries       int           // Processing retries before a queued webhook is dead-lettered (default: 5)
+	SendRate              float64       // Outbound Viber messages per second across all receivers (default: 10, 0 disables)
+	SendBurst             int           // Outbound burst across all receivers (default: 20)
+	ReceiverSendRate      float64       // Outbound Viber messages per second to one receiver (default: 1, 0 disables)
+	ReceiverSendBurst     int           // Outbound burst to one receiver (default: 5)
+	SendMaxWait           time.Duration // How long a rate-limited send waits before failing (default: 10s, 0 fails fast)
+	SenderNameTemplate    string        // Go template for Matrix sender names shown in Viber (default: "{{.DisplayName}}")
+	SenderOverride        bool          // Show Matrix senders' names and avatars on Viber messages (default: true)
+	MediaProxyBaseURL     string        // Public bridge URL for signed Matrix media links (default: origin of WebhookURL)
+	MediaProxySecret      string        // HMAC key for media links (default: random per start)
+	MediaProxyTTL         time.Duration // How long media links stay valid (default: 24 hours)
+	MaxMediaSize          int64         // Largest Viber media bridged to Matrix, in bytes (default: 50 MiB)
+	MediaCacheTTL         time.Duration // How long unused media cache entries are kept (default: 30 days)
+	MediaCacheMaxEntries  int           // Media cache entries kept before the least recently used are evicted (default: 10000)
+	MapURLTemplate        string        // Go template for map links in bridged locations (default: OpenStreetMap)
+	AdminAPIToken         string        // Bearer token of the /api/v1 management API (optional, API disabled if unset)
+	EnableRequestLogging  bool          // Enable request/response body logging (default: false, debug only)
 }
 
 // FromEnv loads configuration from environment variables.
@@ -70,7 +97,28 @@ func FromEnv() Config {
 	cfg.MatrixHomeserverURL = os.Getenv("MATRIX_HOMESERVER_URL")
 	cfg.MatrixAccessToken = os.Getenv("MATRIX_ACCESS_TOKEN")
 	cfg.MatrixDefaultRoomID = os.Getenv("MATRIX_DEFAULT_ROOM_ID")
-	cfg.ViberDefaultReceiverID = os.Getenv("VIBER_DEFAULT_RECEIVER_ID")
+	if invites := os.Getenv("MATRIX_PORTAL_INVITES"); invites != "" {
+		for _, userID := range strings.Split(invites, ",") {
+			if userID = strings.TrimSpace(userID); userID != "" {
+				cfg.MatrixPortalInvites = append(cfg.MatrixPortalInvites, userID)
+			}
+		}
+	}
+	cfg.MatrixMode = os.Getenv("MATRIX_MODE")
+	if cfg.MatrixMode == "" {
+		cfg.MatrixMode = "sync"
+	}
+	cfg.MatrixUserID = os.Getenv("MATRIX_USER_ID")
+	cfg.MatrixServerName = os.Getenv("MATRIX_SERVER_NAME")
+	cfg.AppServiceRegistrationPath = os.Getenv("APPSERVICE_REGISTRATION_PATH")
+	if cfg.AppServiceRegistrationPath == "" {
+		cfg.AppServiceRegistrationPath = "./data/registration.yaml"
+	}
+	cfg.AppServiceURL = os.Getenv("APPSERVICE_URL")
+	cfg.AppServiceBotLocalpart = os.Getenv("APPSERVICE_BOT_LOCALPART")
+	if cfg.AppServiceBotLocalpart == "" {
+		cfg.AppServiceBotLocalpart = "viberbot"
+	}
 	cfg.DatabasePath = os.Getenv("DATABASE_PATH")
 	if cfg.DatabasePath == "" {
 		cfg.DatabasePath = "./data/bridge.db"
@@ -98,12 +146,117 @@ func FromEnv() Config {
 		cfg.CacheTTL = 5 * time.Minute // Default
 	}
 
+	// Webhook deduplication retention (in hours)
+	if retentionStr := os.Getenv("WEBHOOK_DEDUP_RETENTION"); retentionStr != "" {
+		if retentionHours, err := strconv.Atoi(retentionStr); err == nil && retentionHours > 0 {
+			cfg.WebhookDedupRetention = time.Duration(retentionHours) * time.Hour
+		} else {
+			cfg.WebhookDedupRetention = 24 * time.Hour // Default on parse error
+		}
+	} else {
+		cfg.WebhookDedupRetention = 24 * time.Hour // Default
+	}
+
+	// Webhook inbox worker pool
+	cfg.InboxWorkers = 4 // Default
+	if workersStr := os.Getenv("INBOX_WORKERS"); workersStr != "" {
+		if workers, err := strconv.Atoi(workersStr); err == nil && workers > 0 {
+			cfg.InboxWorkers = workers
+		}
+	}
+	cfg.InboxMaxRetries = 5 // Default
+	if retriesStr := os.Getenv("INBOX_MAX_RETRIES"); retriesStr != "" {
+		if retries, err := strconv.Atoi(retriesStr); err == nil && retries > 0 {
+			cfg.InboxMaxRetries = retries
+		}
+	}
+
+	// Outbound Viber send pacing
+	cfg.SendRate = envFloat("VIBER_SEND_RATE", 10)
+	cfg.SendBurst = 20 // Default
+	if burstStr := os.Getenv("VIBER_SEND_BURST"); burstStr != "" {
+		if burst, err := strconv.Atoi(burstStr); err == nil && burst > 0 {
+			cfg.SendBurst = burst
+		}
+	}
+	cfg.ReceiverSendRate = envFloat("VIBER_RECEIVER_SEND_RATE", 1)
+	cfg.ReceiverSendBurst = 5 // Default
+	if burstStr := os.Getenv("VIBER_RECEIVER_SEND_BURST"); burstStr != "" {
+		if burst, err := strconv.Atoi(burstStr); err == nil && burst > 0 {
+			cfg.ReceiverSendBurst = burst
+		}
+	}
+	// Maximum send queueing delay (in seconds)
+	cfg.SendMaxWait = 10 * time.Second // Default
+	if waitStr := os.Getenv("VIBER_SEND_MAX_WAIT"); waitStr != "" {
+		if waitSec, err := strconv.Atoi(waitStr); err == nil && waitSec >= 0 {
+			cfg.SendMaxWait = time.Duration(waitSec) * time.Second
+		}
+	}
+
+	// Matrix sender identity on Viber messages
+	cfg.SenderNameTemplate = os.Getenv("VIBER_SENDER_NAME_TEMPLATE")
+	cfg.SenderOverride = os.Getenv("VIBER_SENDER_OVERRIDE") != "false"
+
+	// Map links in the fallback text of bridged locations
+	cfg.MapURLTemplate = os.Getenv("MAP_URL_TEMPLATE")
+
+	// Signed media proxy for Matrix attachments sent to Viber
+	cfg.MediaProxyBaseURL = os.Getenv("MEDIA_PROXY_BASE_URL")
+	if cfg.MediaProxyBaseURL == "" && cfg.WebhookURL != "" {
+		if u, err := url.Parse(cfg.WebhookURL); err == nil && u.Host != "" {
+			cfg.MediaProxyBaseURL = u.Scheme + "://" + u.Host
+		}
+	}
+	cfg.MediaProxySecret = os.Getenv("MEDIA_PROXY_SECRET")
+	// Media link lifetime (in hours)
+	cfg.MediaProxyTTL = 24 * time.Hour // Default
+	if ttlStr := os.Getenv("MEDIA_PROXY_TTL"); ttlStr != "" {
+		if ttlHours, err := strconv.Atoi(ttlStr); err == nil && ttlHours > 0 {
+			cfg.MediaProxyTTL = time.Duration(ttlHours) * time.Hour
+		}
+	}
+
+	// Maximum size of Viber media bridged to Matrix (in MiB)
+	cfg.MaxMediaSize = 50 << 20 // Default, matches Synapse's max_upload_size
+	if sizeStr := os.Getenv("MAX_MEDIA_SIZE"); sizeStr != "" {
+		if sizeMiB, err := strconv.Atoi(sizeStr); err == nil && sizeMiB > 0 {
+			cfg.MaxMediaSize = int64(sizeMiB) << 20
+		}
+	}
+
+	// Media deduplication cache (TTL in days)
+	cfg.MediaCacheTTL = 30 * 24 * time.Hour // Default
+	if ttlStr := os.Getenv("MEDIA_CACHE_TTL"); ttlStr != "" {
+		if ttlDays, err := strconv.Atoi(ttlStr); err == nil && ttlDays > 0 {
+			cfg.MediaCacheTTL = time.Duration(ttlDays) * 24 * time.Hour
+		}
+	}
+	cfg.MediaCacheMaxEntries = 10000 // Default
+	if entriesStr := os.Getenv("MEDIA_CACHE_MAX_ENTRIES"); entriesStr != "" {
+		if entries, err := strconv.Atoi(entriesStr); err == nil && entries > 0 {
+			cfg.MediaCacheMaxEntries = entries
+		}
+	}
+
+	cfg.AdminAPIToken = os.Getenv("ADMIN_API_TOKEN")
+
 	// Enable request logging (for debugging only - should be disabled in production)
 	cfg.EnableRequestLogging = os.Getenv("ENABLE_REQUEST_LOGGING") == "true"
 
 	return cfg
 }
 
+// envFloat returns a non-negative float environment variable, or def when unset or invalid.
+func envFloat(name string, def float64) float64 {
+	if v := os.Getenv(name); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 {
+			return f
+		}
+	}
+	return def
+}
+
 // Validate checks if the configuration is valid.
 // It returns an error if any required fields are missing or invalid.
 func (c *Config) Validate() error {
@@ -129,29 +282,81 @@ func (c *Config) Validate() error {
 		c.ListenAddress = ":8080" // Use default if not set
 	}
 
-	// Matrix configuration validation (required if bridging)
-	hasMatrixConfig := c.MatrixHomeserverURL != "" || c.MatrixAccessToken != "" || c.MatrixDefaultRoomID != ""
-	if hasMatrixConfig {
-		if c.MatrixHomeserverURL == "" {
-			errors = append(errors, "MATRIX_HOMESERVER_URL is required when Matrix bridging is enabled")
-		} else {
-			if _, err := url.Parse(c.MatrixHomeserverURL); err != nil {
-				errors = append(errors, fmt.Sprintf("MATRIX_HOMESERVER_URL is invalid: %v", err))
-			}
+	if c.MediaProxySecret != "" && len(c.MediaProxySecret) < 16 {
+		errors = append(errors, "MEDIA_PROXY_SECRET must be at least 16 characters")
+	}
+
+	if c.AdminAPIToken != "" && len(c.AdminAPIToken) < 16 {
+		errors = append(errors, "ADMIN_API_TOKEN must be at least 16 characters")
+	}
+
+	if c.SenderNameTemplate != "" {
+		if _, err := template.New("sender_name").Parse(c.SenderNameTemplate); err != nil {
+			errors = append(errors, fmt.Sprintf("VIBER_SENDER_NAME_TEMPLATE is invalid: %v", err))
 		}
+	}
 
-		if c.MatrixAccessToken == "" {
-			errors = append(errors, "MATRIX_ACCESS_TOKEN is required when Matrix bridging is enabled")
+	if c.MapURLTemplate != "" {
+		if _, err := template.New("map_url").Parse(c.MapURLTemplate); err != nil {
+			errors = append(errors, fmt.Sprintf("MAP_URL_TEMPLATE is invalid: %v", err))
 		}
+	}
 
-		if c.MatrixDefaultRoomID == "" {
-			errors = append(errors, "MATRIX_DEFAULT_ROOM_ID is required when Matrix bridging is enabled")
-		} else {
-			// Validate Matrix room ID format using regex
+	for _, userID := range c.MatrixPortalInvites {
+		if err := utils.ValidateMatrixUserID(userID); err != nil {
+			errors = append(errors, fmt.Sprintf("MATRIX_PORTAL_INVITES contains invalid user ID %q: %v", userID, err))
+		}
+	}
+
+	// Matrix configuration validation (required if bridging)
+	switch c.MatrixMode {
+	case "", "sync":
+		hasMatrixConfig := c.MatrixHomeserverURL != "" || c.MatrixAccessToken != "" || c.MatrixDefaultRoomID != ""
+		if hasMatrixConfig {
+			if c.MatrixHomeserverURL == "" {
+				errors = append(errors, "MATRIX_HOMESERVER_URL is required when Matrix bridging is enabled")
+			} else {
+				if _, err := url.Parse(c.MatrixHomeserverURL); err != nil {
+					errors = append(errors, fmt.Sprintf("MATRIX_HOMESERVER_URL is invalid: %v", err))
+				}
+			}
+
+			if c.MatrixAccessToken == "" {
+				errors = append(errors, "MATRIX_ACCESS_TOKEN is required when Matrix bridging is enabled")
+			}
+
+			// Messages go to per-conversation portal rooms; the default room is only a fallback
+			if c.MatrixDefaultRoomID != "" {
+				// Validate Matrix room ID format using regex
+				if err := utils.ValidateMatrixRoomID(c.MatrixDefaultRoomID); err != nil {
+					errors = append(errors, fmt.Sprintf("MATRIX_DEFAULT_ROOM_ID has invalid format: %v", err))
+				}
+			}
+		}
+	case "appservice":
+		if c.MatrixHomeserverURL == "" {
+			errors = append(errors, "MATRIX_HOMESERVER_URL is required in appservice mode")
+		} else if _, err := url.Parse(c.MatrixHomeserverURL); err != nil {
+			errors = append(errors, fmt.Sprintf("MATRIX_HOMESERVER_URL is invalid: %v", err))
+		}
+		if c.MatrixServerName == "" {
+			errors = append(errors, "MATRIX_SERVER_NAME is required in appservice mode")
+		}
+		if c.AppServiceURL == "" {
+			errors = append(errors, "APPSERVICE_URL is required in appservice mode")
+		} else if _, err := url.Parse(c.AppServiceURL); err != nil {
+			errors = append(errors, fmt.Sprintf("APPSERVICE_URL is invalid: %v", err))
+		}
+		if c.AppServiceRegistrationPath == "" {
+			c.AppServiceRegistrationPath = "./data/registration.yaml" // Use default if not set
+		}
+		if c.MatrixDefaultRoomID != "" {
 			if err := utils.ValidateMatrixRoomID(c.MatrixDefaultRoomID); err != nil {
 				errors = append(errors, fmt.Sprintf("MATRIX_DEFAULT_ROOM_ID has invalid format: %v", err))
 			}
 		}
+	default:
+		errors = append(errors, fmt.Sprintf("MATRIX_MODE must be \"sync\" or \"appservice\", got %q", c.MatrixMode))
 	}
 
 	if len(errors) > 0 {
@@ -93,6 +93,62 @@ func TestConfigValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "sync mode without default room",
+			config: Config{
+				APIToken:            "token",
+				WebhookURL:          "https://test.com/webhook",
+				ListenAddress:       ":8080",
+				MatrixHomeserverURL: "https://matrix.test.com",
+				MatrixAccessToken:   "access-token",
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid portal invite",
+			config: Config{
+				APIToken:            "token",
+				WebhookURL:          "https://test.com/webhook",
+				ListenAddress:       ":8080",
+				MatrixPortalInvites: []string{"alice"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "appservice mode without access token",
+			config: Config{
+				APIToken:            "token",
+				WebhookURL:          "https://test.com/webhook",
+				ListenAddress:       ":8080",
+				MatrixMode:          "appservice",
+				MatrixHomeserverURL: "https://matrix.test.com",
+				MatrixServerName:    "test.com",
+				AppServiceURL:       "http://bridge:8080",
+			},
+			wantErr: false,
+		},
+		{
+			name: "appservice mode missing server name",
+			config: Config{
+				APIToken:            "token",
+				WebhookURL:          "https://test.com/webhook",
+				ListenAddress:       ":8080",
+				MatrixMode:          "appservice",
+				MatrixHomeserverURL: "https://matrix.test.com",
+				AppServiceURL:       "http://bridge:8080",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown matrix mode",
+			config: Config{
+				APIToken:      "token",
+				WebhookURL:    "https://test.com/webhook",
+				ListenAddress: ":8080",
+				MatrixMode:    "bogus",
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -103,6 +103,9 @@ type ViberUser struct {
 	ViberID      string
 	ViberName    string
 	MatrixUserID *string
+	AvatarURL    string // Last seen Viber avatar URL
+	AvatarHash   string // SHA-256 of the last uploaded avatar content
+	AvatarMXC    string // mxc:// URI of the uploaded avatar
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 }
@@ -143,15 +146,135 @@ func (d *DB) migrate() error {
 		FOREIGN KEY (viber_chat_id) REFERENCES room_mappings(viber_chat_id)
 	);
 
+	CREATE TABLE IF NOT EXISTS processed_webhooks (
+		message_token INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		processed_at INTEGER NOT NULL,
+		PRIMARY KEY (message_token, event)
+	);
+
+	CREATE TABLE IF NOT EXISTS queue_jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		available_at INTEGER NOT NULL,
+		locked_until INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS dead_letters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		job_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		failed_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS media_cache (
+		source_url TEXT PRIMARY KEY,
+		content_hash TEXT NOT NULL,
+		mxc_uri TEXT NOT NULL,
+		info BLOB,
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS viber_stickers (
+		sticker_id INTEGER PRIMARY KEY,
+		mxc_uri TEXT NOT NULL,
+		mime_type TEXT NOT NULL DEFAULT '',
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		size INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_room_mappings_viber ON room_mappings(viber_chat_id);
 	CREATE INDEX IF NOT EXISTS idx_room_mappings_matrix ON room_mappings(matrix_room_id);
 	CREATE INDEX IF NOT EXISTS idx_message_mappings_viber ON message_mappings(viber_message_id);
 	CREATE INDEX IF NOT EXISTS idx_message_mappings_matrix ON message_mappings(matrix_event_id);
+	CREATE INDEX IF NOT EXISTS idx_processed_webhooks_time ON processed_webhooks(processed_at);
+	CREATE INDEX IF NOT EXISTS idx_queue_jobs_available ON queue_jobs(available_at, locked_until);
+	CREATE INDEX IF NOT EXISTS idx_dead_letters_type ON dead_letters(type, failed_at);
+	CREATE INDEX IF NOT EXISTS idx_media_cache_hash ON media_cache(content_hash, last_used_at);
+	CREATE INDEX IF NOT EXISTS idx_media_cache_used ON media_cache(last_used_at);
+	CREATE INDEX IF NOT EXISTS idx_viber_stickers_mxc ON viber_stickers(mxc_uri);
 	`
 
 	if _, err := d.db.Exec(schema); err != nil {
 		return fmt.Errorf("execute migration: %w", err)
 	}
+
+	// Columns added after the initial schema; existing databases are upgraded in place
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"viber_users", "avatar_url", "TEXT NOT NULL DEFAULT ''"},
+		{"viber_users", "avatar_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"viber_users", "avatar_mxc", "TEXT NOT NULL DEFAULT ''"},
+		{"message_mappings", "matrix_room_id", "TEXT NOT NULL DEFAULT ''"},
+		{"message_mappings", "sender", "TEXT NOT NULL DEFAULT ''"},
+		{"message_mappings", "direction", "TEXT NOT NULL DEFAULT ''"},
+		{"message_mappings", "timestamp_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"queue_jobs", "conversation_key", "TEXT NOT NULL DEFAULT ''"},
+		{"dead_letters", "conversation_key", "TEXT NOT NULL DEFAULT ''"},
+		{"queue_jobs", "queue", "TEXT NOT NULL DEFAULT ''"},
+		{"dead_letters", "queue", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, col := range columns {
+		if err := d.addColumnIfMissing(col.table, col.column, col.definition); err != nil {
+			return err
+		}
+	}
+
+	// Indexes on upgraded columns must be created after the columns exist
+	if _, err := d.db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_message_mappings_room ON message_mappings(matrix_room_id, timestamp_ms);
+		CREATE INDEX IF NOT EXISTS idx_queue_jobs_conversation ON queue_jobs(conversation_key, id);
+		CREATE INDEX IF NOT EXISTS idx_queue_jobs_queue ON queue_jobs(queue, available_at, locked_until);
+	`); err != nil {
+		return fmt.Errorf("create upgraded column indexes: %w", err)
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already present.
+func (d *DB) addColumnIfMissing(table, column, definition string) error {
+	rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("inspect table %s: %w", table, err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return fmt.Errorf("scan column of table %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate columns of table %s: %w", table, err)
+	}
+	_ = rows.Close()
+
+	if _, err := d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -206,10 +329,10 @@ func (d *DB) GetViberUser(ctx context.Context, viberID string) (*ViberUser, erro
 	var user ViberUser
 	var matrixUserID sql.NullString
 	err := d.db.QueryRowContext(ctx, `
-		SELECT viber_id, viber_name, matrix_user_id, created_at, updated_at
+		SELECT viber_id, viber_name, matrix_user_id, avatar_url, avatar_hash, avatar_mxc, created_at, updated_at
 		FROM viber_users
 		WHERE viber_id = ?
-	`, viberID).Scan(&user.ViberID, &user.ViberName, &matrixUserID, &user.CreatedAt, &user.UpdatedAt)
+	`, viberID).Scan(&user.ViberID, &user.ViberName, &matrixUserID, &user.AvatarURL, &user.AvatarHash, &user.AvatarMXC, &user.CreatedAt, &user.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("%w: viber user %s", ErrNotFound, viberID)
@@ -259,6 +382,52 @@ func (d *DB) LinkViberUser(ctx context.Context, viberID, matrixUserID string) er
 	return nil
 }
 
+// GetViberUserAvatar returns the stored avatar URL, content hash and mxc:// URI for a Viber user.
+// Returns empty strings and nil error if the user does not exist yet.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) GetViberUserAvatar(ctx context.Context, viberID string) (avatarURL, avatarHash, avatarMXC string, err error) {
+	if viberID == "" {
+		return "", "", "", fmt.Errorf("%w: viber_id cannot be empty", ErrInvalidInput)
+	}
+	err = d.db.QueryRowContext(ctx, `
+		SELECT avatar_url, avatar_hash, avatar_mxc
+		FROM viber_users
+		WHERE viber_id = ?
+	`, viberID).Scan(&avatarURL, &avatarHash, &avatarMXC)
+	if err == sql.ErrNoRows {
+		return "", "", "", nil // Not found is not an error - user may not be stored yet
+	}
+	if err != nil {
+		return "", "", "", fmt.Errorf("query avatar for viber user %s: %w", viberID, err)
+	}
+	return avatarURL, avatarHash, avatarMXC, nil
+}
+
+// SetViberUserAvatar stores the avatar URL, content hash and mxc:// URI for a Viber user.
+// The context controls cancellation and timeout for the operation.
+// Invalidates cache if configured.
+func (d *DB) SetViberUserAvatar(ctx context.Context, viberID, avatarURL, avatarHash, avatarMXC string) error {
+	if viberID == "" {
+		return fmt.Errorf("%w: viber_id cannot be empty", ErrInvalidInput)
+	}
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE viber_users
+		SET avatar_url = ?, avatar_hash = ?, avatar_mxc = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE viber_id = ?
+	`, avatarURL, avatarHash, avatarMXC, viberID)
+	if err != nil {
+		return fmt.Errorf("set avatar for viber user %s: %w", viberID, err)
+	}
+
+	// Invalidate cache if configured
+	if d.cache != nil {
+		key := "user:viber:" + viberID
+		_ = d.cache.Delete(ctx, key) // Best-effort cache invalidation
+	}
+
+	return nil
+}
+
 // UnlinkMatrixUser removes the Matrix user link from a Viber user.
 // The context controls cancellation and timeout for the operation.
 func (d *DB) UnlinkMatrixUser(ctx context.Context, matrixUserID string) error {
@@ -481,26 +650,64 @@ type RoomMapping struct {
 	CreatedAt    time.Time
 }
 
+// Message directions recorded in MessageMapping.Direction.
+const (
+	DirectionViberToMatrix = "viber_to_matrix"
+	DirectionMatrixToViber = "matrix_to_viber"
+)
+
+// MessageMapping links a bridged Viber message to its Matrix event.
+type MessageMapping struct {
+	ViberMessageID string    // Viber message_token
+	MatrixEventID  string    // Matrix event ID
+	ViberChatID    string    // Viber conversation (portal key)
+	MatrixRoomID   string    // Matrix portal room
+	Sender         string    // Viber user ID or Matrix user ID of the original author
+	Direction      string    // DirectionViberToMatrix or DirectionMatrixToViber
+	Timestamp      time.Time // Time the original message was sent
+	CreatedAt      time.Time
+}
+
 // StoreMessageMapping stores a mapping between Viber message ID and Matrix event ID.
 // The context controls cancellation and timeout for the operation.
+// Prefer SaveMessageMapping, which also records room, sender and direction.
 func (d *DB) StoreMessageMapping(ctx context.Context, viberMessageID, matrixEventID, viberChatID string) error {
-	if viberMessageID == "" {
+	return d.SaveMessageMapping(ctx, MessageMapping{
+		ViberMessageID: viberMessageID,
+		MatrixEventID:  matrixEventID,
+		ViberChatID:    viberChatID,
+	})
+}
+
+// SaveMessageMapping stores a bridged message in both directions.
+// Saving the same Viber message again replaces the previous mapping.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) SaveMessageMapping(ctx context.Context, m MessageMapping) error {
+	if m.ViberMessageID == "" {
 		return fmt.Errorf("%w: viber_message_id cannot be empty", ErrInvalidInput)
 	}
-	if matrixEventID == "" {
+	if m.MatrixEventID == "" {
 		return fmt.Errorf("%w: matrix_event_id cannot be empty", ErrInvalidInput)
 	}
-	if viberChatID == "" {
+	if m.ViberChatID == "" {
 		return fmt.Errorf("%w: viber_chat_id cannot be empty", ErrInvalidInput)
 	}
+	var timestampMS int64
+	if !m.Timestamp.IsZero() {
+		timestampMS = m.Timestamp.UnixMilli()
+	}
 	_, err := d.db.ExecContext(ctx, `
-		INSERT INTO message_mappings (viber_message_id, matrix_event_id, viber_chat_id)
-		VALUES (?, ?, ?)
+		INSERT INTO message_mappings (viber_message_id, matrix_event_id, viber_chat_id, matrix_room_id, sender, direction, timestamp_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(viber_message_id) DO UPDATE SET
-			matrix_event_id = excluded.matrix_event_id
-	`, viberMessageID, matrixEventID, viberChatID)
+			matrix_event_id = excluded.matrix_event_id,
+			matrix_room_id = excluded.matrix_room_id,
+			sender = excluded.sender,
+			direction = excluded.direction,
+			timestamp_ms = excluded.timestamp_ms
+	`, m.ViberMessageID, m.MatrixEventID, m.ViberChatID, m.MatrixRoomID, m.Sender, m.Direction, timestampMS)
 	if err != nil {
-		return fmt.Errorf("store message mapping %s -> %s: %w", viberMessageID, matrixEventID, err)
+		return fmt.Errorf("store message mapping %s -> %s: %w", m.ViberMessageID, m.MatrixEventID, err)
 	}
 	return nil
 }
@@ -509,22 +716,119 @@ func (d *DB) StoreMessageMapping(ctx context.Context, viberMessageID, matrixEven
 // Returns empty string and nil error if mapping does not exist (not an error condition).
 // The context controls cancellation and timeout for the operation.
 func (d *DB) GetMatrixEventID(ctx context.Context, viberMessageID string) (string, error) {
+	m, err := d.GetMessageMappingByViberID(ctx, viberMessageID)
+	if err != nil || m == nil {
+		return "", err
+	}
+	return m.MatrixEventID, nil
+}
+
+// GetViberMessageID retrieves the Viber message token for a Matrix event.
+// Returns empty string and nil error if mapping does not exist (not an error condition).
+// The context controls cancellation and timeout for the operation.
+func (d *DB) GetViberMessageID(ctx context.Context, matrixEventID string) (string, error) {
+	m, err := d.GetMessageMappingByMatrixID(ctx, matrixEventID)
+	if err != nil || m == nil {
+		return "", err
+	}
+	return m.ViberMessageID, nil
+}
+
+// GetMessageMappingByViberID retrieves the full mapping for a Viber message.
+// Returns nil and nil error if mapping does not exist (not an error condition).
+func (d *DB) GetMessageMappingByViberID(ctx context.Context, viberMessageID string) (*MessageMapping, error) {
 	if viberMessageID == "" {
-		return "", fmt.Errorf("%w: viber_message_id cannot be empty", ErrInvalidInput)
+		return nil, fmt.Errorf("%w: viber_message_id cannot be empty", ErrInvalidInput)
 	}
-	var matrixEventID string
+	m, err := d.queryMessageMapping(ctx, "viber_message_id", viberMessageID)
+	if err != nil {
+		return nil, fmt.Errorf("query message mapping for viber message %s: %w", viberMessageID, err)
+	}
+	return m, nil
+}
+
+// GetMessageMappingByMatrixID retrieves the full mapping for a Matrix event.
+// Returns nil and nil error if mapping does not exist (not an error condition).
+func (d *DB) GetMessageMappingByMatrixID(ctx context.Context, matrixEventID string) (*MessageMapping, error) {
+	if matrixEventID == "" {
+		return nil, fmt.Errorf("%w: matrix_event_id cannot be empty", ErrInvalidInput)
+	}
+	m, err := d.queryMessageMapping(ctx, "matrix_event_id", matrixEventID)
+	if err != nil {
+		return nil, fmt.Errorf("query message mapping for matrix event %s: %w", matrixEventID, err)
+	}
+	return m, nil
+}
+
+// queryMessageMapping loads a single message mapping by a unique column.
+// For rows saved without a room ID, the room is resolved through room_mappings.
+func (d *DB) queryMessageMapping(ctx context.Context, column, value string) (*MessageMapping, error) {
+	var (
+		m           MessageMapping
+		timestampMS int64
+	)
+	// column is always one of the fixed identifiers above, never user input
 	err := d.db.QueryRowContext(ctx, `
-		SELECT matrix_event_id
-		FROM message_mappings
-		WHERE viber_message_id = ?
-	`, viberMessageID).Scan(&matrixEventID)
+		SELECT mm.viber_message_id, mm.matrix_event_id, mm.viber_chat_id,
+			COALESCE(NULLIF(mm.matrix_room_id, ''), rm.matrix_room_id, ''),
+			mm.sender, mm.direction, mm.timestamp_ms, mm.created_at
+		FROM message_mappings mm
+		LEFT JOIN room_mappings rm ON rm.viber_chat_id = mm.viber_chat_id
+		WHERE mm.`+column+` = ?
+	`, value).Scan(&m.ViberMessageID, &m.MatrixEventID, &m.ViberChatID, &m.MatrixRoomID,
+		&m.Sender, &m.Direction, &timestampMS, &m.CreatedAt)
 	if err == sql.ErrNoRows {
-		return "", nil // Not found is not an error - mapping may not exist yet
+		return nil, nil // Not found is not an error - mapping may not exist yet
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timestampMS > 0 {
+		m.Timestamp = time.UnixMilli(timestampMS)
 	}
+	return &m, nil
+}
+
+// MarkWebhookProcessed records a webhook callback and reports whether it is new.
+// Entries older than retention are pruned, so a callback is only treated as a
+// duplicate within the retention window.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) MarkWebhookProcessed(ctx context.Context, messageToken int64, event string, retention time.Duration) (bool, error) {
+	if event == "" {
+		return false, fmt.Errorf("%w: event cannot be empty", ErrInvalidInput)
+	}
+	now := time.Now()
+	if _, err := d.db.ExecContext(ctx, `
+		DELETE FROM processed_webhooks WHERE processed_at < ?
+	`, now.Add(-retention).UnixMilli()); err != nil {
+		return false, fmt.Errorf("prune processed webhooks: %w", err)
+	}
+
+	res, err := d.db.ExecContext(ctx, `
+		INSERT INTO processed_webhooks (message_token, event, processed_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(message_token, event) DO NOTHING
+	`, messageToken, event, now.UnixMilli())
 	if err != nil {
-		return "", fmt.Errorf("query matrix event id for message %s: %w", viberMessageID, err)
+		return false, fmt.Errorf("mark webhook %s/%d processed: %w", event, messageToken, err)
 	}
-	return matrixEventID, nil
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("mark webhook %s/%d processed: %w", event, messageToken, err)
+	}
+	return inserted == 1, nil
+}
+
+// UnmarkWebhookProcessed forgets a webhook callback recorded by MarkWebhookProcessed,
+// so that its next delivery is treated as new.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) UnmarkWebhookProcessed(ctx context.Context, messageToken int64, event string) error {
+	if _, err := d.db.ExecContext(ctx, `
+		DELETE FROM processed_webhooks WHERE message_token = ? AND event = ?
+	`, messageToken, event); err != nil {
+		return fmt.Errorf("unmark webhook %s/%d processed: %w", event, messageToken, err)
+	}
+	return nil
 }
 
 // UpsertGroupMember adds or updates a group member in a Viber chat.
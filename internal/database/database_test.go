@@ -3,8 +3,11 @@ package database
 
 import (
 	"context"
+	"errors"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUpsertViberUser(t *testing.T) {
@@ -128,6 +131,355 @@ func TestMessageMapping(t *testing.T) {
 	if matrixEventID != "$matrix_event_456" {
 		t.Errorf("Expected '$matrix_event_456', got '%s'", matrixEventID)
 	}
+
+	// Legacy mappings resolve their room through room_mappings
+	mapping, err := db.GetMessageMappingByMatrixID(ctx, "$matrix_event_456")
+	if err != nil {
+		t.Fatalf("Failed to get mapping by matrix id: %v", err)
+	}
+	if mapping == nil || mapping.MatrixRoomID != "!room:example.com" {
+		t.Errorf("Expected room '!room:example.com', got %+v", mapping)
+	}
+}
+
+func TestSaveMessageMapping(t *testing.T) {
+	dbPath := "/tmp/test_bridge_message_mappings.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	if err := db.CreateRoomMapping(ctx, "viber_chat_1", "!room:example.com"); err != nil {
+		t.Fatalf("Failed to create room mapping: %v", err)
+	}
+
+	sentAt := time.UnixMilli(1700000000123)
+	err = db.SaveMessageMapping(ctx, MessageMapping{
+		ViberMessageID: "5001",
+		MatrixEventID:  "$outbound",
+		ViberChatID:    "viber_chat_1",
+		MatrixRoomID:   "!room:example.com",
+		Sender:         "@alice:example.com",
+		Direction:      DirectionMatrixToViber,
+		Timestamp:      sentAt,
+	})
+	if err != nil {
+		t.Fatalf("Failed to save message mapping: %v", err)
+	}
+
+	viberID, err := db.GetViberMessageID(ctx, "$outbound")
+	if err != nil || viberID != "5001" {
+		t.Errorf("GetViberMessageID() = %q, %v; want '5001'", viberID, err)
+	}
+
+	mapping, err := db.GetMessageMappingByViberID(ctx, "5001")
+	if err != nil || mapping == nil {
+		t.Fatalf("Failed to get mapping by viber id: %v", err)
+	}
+	if mapping.Sender != "@alice:example.com" || mapping.Direction != DirectionMatrixToViber || !mapping.Timestamp.Equal(sentAt) {
+		t.Errorf("Unexpected mapping %+v", mapping)
+	}
+
+	missing, err := db.GetMessageMappingByMatrixID(ctx, "$missing")
+	if err != nil || missing != nil {
+		t.Errorf("Expected nil mapping for unknown event, got %+v, %v", missing, err)
+	}
+}
+
+func TestMarkWebhookProcessed(t *testing.T) {
+	dbPath := "/tmp/test_bridge_webhooks.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		token     int64
+		event     string
+		retention time.Duration
+		want      bool
+	}{
+		{"first delivery", 42, "message", time.Hour, true},
+		{"retry", 42, "message", time.Hour, false},
+		{"same token other event", 42, "seen", time.Hour, true},
+		{"other token", 43, "message", time.Hour, true},
+		// A negative retention prunes everything, so the token is new again
+		{"expired", 42, "message", -time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.MarkWebhookProcessed(ctx, tt.token, tt.event, tt.retention)
+			if err != nil {
+				t.Fatalf("MarkWebhookProcessed() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("MarkWebhookProcessed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// An unmarked callback is new again
+	if err := db.UnmarkWebhookProcessed(ctx, 43, "message"); err != nil {
+		t.Fatalf("UnmarkWebhookProcessed() error = %v", err)
+	}
+	if first, err := db.MarkWebhookProcessed(ctx, 43, "message", time.Hour); err != nil || !first {
+		t.Errorf("MarkWebhookProcessed() after unmark = %v, %v; want true", first, err)
+	}
+}
+
+func TestQueueJobs(t *testing.T) {
+	dbPath := "/tmp/test_bridge_queue.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	first, err := db.EnqueueJob(ctx, QueueJob{Queue: "messages", Type: "viber_to_matrix", Payload: []byte(`{"event":"message"}`)})
+	if err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+	second, err := db.EnqueueJob(ctx, QueueJob{Queue: "messages", Type: "matrix_to_viber", Payload: []byte("b")})
+	if err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+	if _, err := db.EnqueueJob(ctx, QueueJob{Queue: "messages"}); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("Expected ErrInvalidInput for job without type, got %v", err)
+	}
+	if _, err := db.EnqueueJob(ctx, QueueJob{Type: "viber_to_matrix"}); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("Expected ErrInvalidInput for job without queue, got %v", err)
+	}
+
+	// Queues sharing the database only claim their own jobs
+	other, err := db.EnqueueJob(ctx, QueueJob{Queue: "other", Type: "viber_to_matrix"})
+	if err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+	if job, err := db.ClaimJob(ctx, "other", time.Minute); err != nil || job == nil || job.ID != other || job.Queue != "other" {
+		t.Fatalf("ClaimJob(other) = %+v, %v; want job %d", job, err, other)
+	}
+	if err := db.CompleteJob(ctx, other); err != nil {
+		t.Fatalf("Failed to complete job: %v", err)
+	}
+
+	// Jobs are claimed in order and hidden while leased
+	job, err := db.ClaimJob(ctx, "messages", time.Minute)
+	if err != nil || job == nil || job.ID != first || job.Attempts != 1 {
+		t.Fatalf("ClaimJob() = %+v, %v; want job %d on attempt 1", job, err, first)
+	}
+	job, err = db.ClaimJob(ctx, "messages", time.Minute)
+	if err != nil || job == nil || job.ID != second {
+		t.Fatalf("ClaimJob() = %+v, %v; want job %d", job, err, second)
+	}
+	if job, err := db.ClaimJob(ctx, "messages", time.Minute); err != nil || job != nil {
+		t.Fatalf("Expected no claimable job while leased, got %+v, %v", job, err)
+	}
+
+	// A retried job becomes claimable again at its new time
+	if err := db.RetryJob(ctx, first, time.Now().Add(-time.Second), "homeserver unavailable"); err != nil {
+		t.Fatalf("Failed to retry job: %v", err)
+	}
+	job, err = db.ClaimJob(ctx, "messages", time.Minute)
+	if err != nil || job == nil || job.ID != first || job.Attempts != 2 || job.LastError != "homeserver unavailable" {
+		t.Fatalf("ClaimJob() after retry = %+v, %v", job, err)
+	}
+
+	// An expired lease (crashed worker) makes the job visible again
+	if err := db.CompleteJob(ctx, first); err != nil {
+		t.Fatalf("Failed to complete job: %v", err)
+	}
+	third, err := db.EnqueueJob(ctx, QueueJob{Queue: "messages", Type: "viber_to_matrix", Payload: []byte("c")})
+	if err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+	if job, err := db.ClaimJob(ctx, "messages", -time.Second); err != nil || job == nil || job.ID != third {
+		t.Fatalf("ClaimJob() = %+v, %v; want job %d", job, err, third)
+	}
+	if job, err := db.ClaimJob(ctx, "messages", time.Minute); err != nil || job == nil || job.ID != third || job.Attempts != 2 {
+		t.Fatalf("Expected expired lease to be reclaimed, got %+v, %v", job, err)
+	}
+
+	if err := db.DeadLetterJob(ctx, second, "permanent"); err != nil {
+		t.Fatalf("Failed to dead-letter job: %v", err)
+	}
+	if err := db.DeadLetterJob(ctx, second, "permanent"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for missing job, got %v", err)
+	}
+	if n, err := db.CountJobs(ctx, ""); err != nil || n != 1 {
+		t.Errorf("CountJobs() = %d, %v; want 1", n, err)
+	}
+	if n, err := db.CountDeadLetters(ctx, ""); err != nil || n != 1 {
+		t.Errorf("CountDeadLetters() = %d, %v; want 1", n, err)
+	}
+}
+
+func TestClaimJobConversationOrder(t *testing.T) {
+	dbPath := "/tmp/test_bridge_queue_order.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	enqueue := func(key string) int64 {
+		t.Helper()
+		id, err := db.EnqueueJob(ctx, QueueJob{Queue: "messages", Type: "viber_to_matrix", ConversationKey: key})
+		if err != nil {
+			t.Fatalf("Failed to enqueue job: %v", err)
+		}
+		return id
+	}
+	a1, a2, b1, free := enqueue("viber:a"), enqueue("viber:a"), enqueue("viber:b"), enqueue("")
+
+	claim := func() int64 {
+		t.Helper()
+		job, err := db.ClaimJob(ctx, "messages", time.Minute)
+		if err != nil {
+			t.Fatalf("ClaimJob() error = %v", err)
+		}
+		if job == nil {
+			return 0
+		}
+		return job.ID
+	}
+
+	// a2 is held back while a1 is leased; other conversations and unkeyed jobs are not
+	if got := []int64{claim(), claim(), claim(), claim()}; got[0] != a1 || got[1] != b1 || got[2] != free || got[3] != 0 {
+		t.Fatalf("Claimed %v, want [%d %d %d 0]", got, a1, b1, free)
+	}
+
+	// A retrying head still blocks its conversation
+	if err := db.RetryJob(ctx, a1, time.Now().Add(time.Hour), "temporary"); err != nil {
+		t.Fatalf("Failed to retry job: %v", err)
+	}
+	if id := claim(); id != 0 {
+		t.Fatalf("Claimed %d while the conversation head is waiting to retry", id)
+	}
+
+	if err := db.DeadLetterJob(ctx, a1, "permanent"); err != nil {
+		t.Fatalf("Failed to dead-letter job: %v", err)
+	}
+	if id := claim(); id != a2 {
+		t.Fatalf("Claimed %d after the head was dead-lettered, want %d", id, a2)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	dbPath := "/tmp/test_bridge_dead_letters.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	deadLetter := func(jobType, key, payload string) int64 {
+		t.Helper()
+		id, err := db.EnqueueJob(ctx, QueueJob{Queue: "messages", Type: jobType, ConversationKey: key, Payload: []byte(payload)})
+		if err != nil {
+			t.Fatalf("Failed to enqueue job: %v", err)
+		}
+		if err := db.DeadLetterJob(ctx, id, "failed "+payload); err != nil {
+			t.Fatalf("Failed to dead-letter job: %v", err)
+		}
+		return id
+	}
+	deadLetter("viber_to_matrix", "viber:a", "a1")
+	deadLetter("viber_to_matrix", "viber:b", "b1")
+	m1 := deadLetter("matrix_to_viber", "matrix:!room:example.com", "m1")
+	deadLetter("viber_to_matrix", "viber:a", "a2")
+
+	tests := []struct {
+		name   string
+		filter DeadLetterFilter
+		want   []string // Payloads, most recent failure first
+		total  int
+	}{
+		{"all", DeadLetterFilter{}, []string{"a2", "m1", "b1", "a1"}, 4},
+		{"by type", DeadLetterFilter{Type: "viber_to_matrix"}, []string{"a2", "b1", "a1"}, 3},
+		{"by conversation", DeadLetterFilter{ConversationKeys: []string{"viber:a", "matrix:!room:example.com"}}, []string{"a2", "m1", "a1"}, 3},
+		{"paginated", DeadLetterFilter{Limit: 2, Offset: 1}, []string{"m1", "b1"}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			letters, total, err := db.ListDeadLetters(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("ListDeadLetters() error = %v", err)
+			}
+			var got []string
+			for _, letter := range letters {
+				got = append(got, string(letter.Payload))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") || total != tt.total {
+				t.Errorf("ListDeadLetters() = %v (total %d), want %v (total %d)", got, total, tt.want, tt.total)
+			}
+		})
+	}
+
+	letters, _, _ := db.ListDeadLetters(ctx, DeadLetterFilter{Type: "matrix_to_viber"})
+	letter, err := db.GetDeadLetter(ctx, letters[0].ID)
+	if err != nil || letter == nil || letter.LastError != "failed m1" || letter.Attempts != 0 {
+		t.Fatalf("GetDeadLetter() = %+v, %v", letter, err)
+	}
+	if missing, err := db.GetDeadLetter(ctx, 9999); err != nil || missing != nil {
+		t.Errorf("Expected nil for unknown dead letter, got %+v, %v", missing, err)
+	}
+
+	// A later message of the same conversation arrives while the job is dead-lettered
+	if _, err := db.EnqueueJob(ctx, QueueJob{Queue: "messages", Type: "matrix_to_viber", ConversationKey: "matrix:!room:example.com", Payload: []byte("m2")}); err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+
+	// Retrying moves the job back into the queue with a fresh retry budget, ahead of the later message
+	jobID, err := db.RequeueDeadLetter(ctx, letter.ID)
+	if err != nil {
+		t.Fatalf("RequeueDeadLetter() error = %v", err)
+	}
+	if jobID != m1 {
+		t.Errorf("Requeued job ID = %d, want the original %d", jobID, m1)
+	}
+	job, err := db.ClaimJob(ctx, "messages", time.Minute)
+	if err != nil || job == nil || job.ID != jobID || string(job.Payload) != "m1" || job.Attempts != 1 {
+		t.Fatalf("Expected requeued job to be claimed first, got %+v, %v", job, err)
+	}
+	if _, err := db.RequeueDeadLetter(ctx, letter.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound when retrying twice, got %v", err)
+	}
+
+	if n, err := db.RequeueDeadLetters(ctx, DeadLetterFilter{ConversationKeys: []string{"viber:a"}}); err != nil || n != 2 {
+		t.Errorf("RequeueDeadLetters() = %d, %v; want 2", n, err)
+	}
+	if n, err := db.PurgeDeadLetters(ctx, DeadLetterFilter{}); err != nil || n != 1 {
+		t.Errorf("PurgeDeadLetters() = %d, %v; want 1", n, err)
+	}
+	if err := db.DeleteDeadLetter(ctx, letter.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for deleted dead letter, got %v", err)
+	}
+	if n, err := db.CountJobs(ctx, ""); err != nil || n != 4 {
+		t.Errorf("CountJobs() = %d, %v; want 4", n, err)
+	}
 }
 
 func TestGroupMembers(t *testing.T) {
@@ -224,3 +576,163 @@ func TestLinkViberUser(t *testing.T) {
 		t.Errorf("Expected '@matrix_user:example.com', got '%s'", *user.MatrixUserID)
 	}
 }
+
+func TestViberUserAvatar(t *testing.T) {
+	dbPath := "/tmp/test_bridge_avatar.db"
+	defer func() { _ = os.Remove(dbPath) }()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+
+	if err := db.UpsertViberUser(ctx, "viber_user_1", "Viber User"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	avatarURL, hash, mxc, err := db.GetViberUserAvatar(ctx, "viber_user_1")
+	if err != nil {
+		t.Fatalf("Failed to get avatar: %v", err)
+	}
+	if avatarURL != "" || hash != "" || mxc != "" {
+		t.Errorf("Expected empty avatar for new user, got %q %q %q", avatarURL, hash, mxc)
+	}
+
+	if err := db.SetViberUserAvatar(ctx, "viber_user_1", "https://example.com/a.jpg", "abc123", "mxc://example.com/media"); err != nil {
+		t.Fatalf("Failed to set avatar: %v", err)
+	}
+
+	user, err := db.GetViberUser(ctx, "viber_user_1")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if user.AvatarHash != "abc123" || user.AvatarMXC != "mxc://example.com/media" {
+		t.Errorf("Avatar not persisted: hash=%q mxc=%q", user.AvatarHash, user.AvatarMXC)
+	}
+}
+
+func TestMediaCache(t *testing.T) {
+	dbPath := "/tmp/test_bridge_media_cache.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	if _, err := db.GetMediaCacheEntry(ctx, "", "", 0); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("Expected ErrInvalidInput without url and hash, got %v", err)
+	}
+	if entry, err := db.GetMediaCacheEntry(ctx, "https://viber/a.png", "", 0); err != nil || entry != nil {
+		t.Fatalf("Expected a miss, got %+v, %v", entry, err)
+	}
+
+	entries := []MediaCacheEntry{
+		{SourceURL: "https://viber/a.png", ContentHash: "hash-a", MXC: "mxc://example.com/a", Info: []byte(`{"w":10}`)},
+		{SourceURL: "https://viber/a-forwarded.png", ContentHash: "hash-a", MXC: "mxc://example.com/a2"},
+		{SourceURL: "https://viber/b.png", ContentHash: "hash-b", MXC: "mxc://example.com/b"},
+	}
+	for _, e := range entries {
+		if err := db.SaveMediaCacheEntry(ctx, e); err != nil {
+			t.Fatalf("SaveMediaCacheEntry() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		hash    string
+		wantMXC string
+	}{
+		{"by url", "https://viber/a.png", "", "mxc://example.com/a"},
+		{"url wins over hash", "https://viber/a.png", "hash-b", "mxc://example.com/a"},
+		{"by hash", "https://viber/new.png", "hash-b", "mxc://example.com/b"},
+		{"unknown", "https://viber/new.png", "hash-c", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := db.GetMediaCacheEntry(ctx, tt.url, tt.hash, time.Hour)
+			if err != nil {
+				t.Fatalf("GetMediaCacheEntry() error = %v", err)
+			}
+			if got := ""; entry != nil {
+				got = entry.MXC
+				if got != tt.wantMXC {
+					t.Errorf("Expected %q, got %q", tt.wantMXC, got)
+				}
+			} else if tt.wantMXC != "" {
+				t.Errorf("Expected %q, got a miss", tt.wantMXC)
+			}
+		})
+	}
+	time.Sleep(5 * time.Millisecond) // Usage times have millisecond resolution
+	entry, err := db.GetMediaCacheEntry(ctx, "https://viber/a.png", "", 0)
+	if err != nil || entry == nil || string(entry.Info) != `{"w":10}` {
+		t.Errorf("Expected the stored info, got %+v, %v", entry, err)
+	}
+
+	// a.png was used last, so it survives eviction down to one entry
+	evicted, err := db.PruneMediaCache(ctx, time.Hour, 1)
+	if err != nil || evicted != 2 {
+		t.Fatalf("Expected 2 evicted entries, got %d, %v", evicted, err)
+	}
+	if entry, _ := db.GetMediaCacheEntry(ctx, "", "hash-b", 0); entry != nil {
+		t.Errorf("Expected hash-b to be evicted, got %+v", entry)
+	}
+	if entry, _ := db.GetMediaCacheEntry(ctx, "", "hash-a", 0); entry == nil || entry.MXC != "mxc://example.com/a" {
+		t.Errorf("Expected a.png to survive, got %+v", entry)
+	}
+
+	// Entries unused for longer than the ttl expire
+	time.Sleep(5 * time.Millisecond)
+	if evicted, err := db.PruneMediaCache(ctx, time.Millisecond, 0); err != nil || evicted != 1 {
+		t.Errorf("Expected 1 expired entry, got %d, %v", evicted, err)
+	}
+}
+
+func TestViberStickers(t *testing.T) {
+	dbPath := "/tmp/test_bridge_stickers.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	if s, err := db.GetViberSticker(ctx, 40133); err != nil || s != nil {
+		t.Fatalf("Expected an unknown sticker, got %+v, %v", s, err)
+	}
+	if err := db.SaveViberSticker(ctx, ViberSticker{MXC: "mxc://example.com/s"}); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("Expected ErrInvalidInput without sticker id, got %v", err)
+	}
+
+	want := ViberSticker{StickerID: 40133, MXC: "mxc://example.com/s", MimeType: "image/png", Width: 490, Height: 490, Size: 1234}
+	if err := db.SaveViberSticker(ctx, want); err != nil {
+		t.Fatalf("SaveViberSticker() error = %v", err)
+	}
+	got, err := db.GetViberSticker(ctx, 40133)
+	if err != nil || got == nil {
+		t.Fatalf("GetViberSticker() = %+v, %v", got, err)
+	}
+	got.CreatedAt = time.Time{}
+	if *got != want {
+		t.Errorf("Expected %+v, got %+v", want, *got)
+	}
+
+	byMXC, err := db.GetViberStickerByMXC(ctx, "mxc://example.com/s")
+	if err != nil || byMXC == nil || byMXC.StickerID != 40133 {
+		t.Errorf("Expected sticker 40133 by mxc, got %+v, %v", byMXC, err)
+	}
+	if s, err := db.GetViberStickerByMXC(ctx, "mxc://example.com/other"); err != nil || s != nil {
+		t.Errorf("Expected no sticker for another mxc, got %+v, %v", s, err)
+	}
+}
@@ -0,0 +1,120 @@
+// Package database media_cache remembers media uploaded to the Matrix media repository
+// so identical Viber media is only uploaded once.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MediaCacheEntry maps the source URL and content hash of bridged media to its upload.
+type MediaCacheEntry struct {
+	SourceURL   string
+	ContentHash string // Hex-encoded SHA-256 of the content
+	MXC         string // mxc:// URI of the upload
+	Info        []byte // JSON-encoded Matrix info block of the media (optional)
+	CreatedAt   time.Time
+	LastUsedAt  time.Time
+}
+
+// GetMediaCacheEntry returns the entry for sourceURL or, failing that, the most recently
+// used entry with contentHash; either may be empty. Entries not used within maxAge are
+// ignored (0 means no limit). The returned entry is marked as used.
+// Returns nil, nil when there is no matching entry.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) GetMediaCacheEntry(ctx context.Context, sourceURL, contentHash string, maxAge time.Duration) (*MediaCacheEntry, error) {
+	if sourceURL == "" && contentHash == "" {
+		return nil, fmt.Errorf("%w: source url or content hash required", ErrInvalidInput)
+	}
+	now := time.Now()
+	var notBefore int64
+	if maxAge > 0 {
+		notBefore = now.Add(-maxAge).UnixMilli()
+	}
+
+	var (
+		entry                 MediaCacheEntry
+		createdAt, lastUsedAt int64
+	)
+	err := d.db.QueryRowContext(ctx, `
+		SELECT source_url, content_hash, mxc_uri, info, created_at, last_used_at
+		FROM media_cache
+		WHERE (source_url = ? OR content_hash = ?) AND last_used_at >= ?
+		ORDER BY source_url = ? DESC, last_used_at DESC
+		LIMIT 1
+	`, sourceURL, contentHash, notBefore, sourceURL).Scan(
+		&entry.SourceURL, &entry.ContentHash, &entry.MXC, &entry.Info, &createdAt, &lastUsedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query media cache: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, `
+		UPDATE media_cache SET last_used_at = ? WHERE source_url = ?
+	`, now.UnixMilli(), entry.SourceURL); err != nil {
+		return nil, fmt.Errorf("touch media cache entry: %w", err)
+	}
+	entry.CreatedAt = time.UnixMilli(createdAt)
+	entry.LastUsedAt = now
+	return &entry, nil
+}
+
+// SaveMediaCacheEntry stores an entry, replacing any entry for the same source URL.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) SaveMediaCacheEntry(ctx context.Context, entry MediaCacheEntry) error {
+	if entry.SourceURL == "" || entry.ContentHash == "" || entry.MXC == "" {
+		return fmt.Errorf("%w: source url, content hash and mxc uri are required", ErrInvalidInput)
+	}
+	now := time.Now().UnixMilli()
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO media_cache (source_url, content_hash, mxc_uri, info, created_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(source_url) DO UPDATE SET
+			content_hash = excluded.content_hash,
+			mxc_uri = excluded.mxc_uri,
+			info = excluded.info,
+			created_at = excluded.created_at,
+			last_used_at = excluded.last_used_at
+	`, entry.SourceURL, entry.ContentHash, entry.MXC, entry.Info, now, now)
+	if err != nil {
+		return fmt.Errorf("save media cache entry for %s: %w", entry.SourceURL, err)
+	}
+	return nil
+}
+
+// PruneMediaCache evicts entries not used within ttl and then, if more than maxEntries
+// remain, the least recently used ones. A ttl or maxEntries of 0 disables that limit.
+// Returns the number of evicted entries.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) PruneMediaCache(ctx context.Context, ttl time.Duration, maxEntries int) (int64, error) {
+	var evicted int64
+	if ttl > 0 {
+		res, err := d.db.ExecContext(ctx, `
+			DELETE FROM media_cache WHERE last_used_at < ?
+		`, time.Now().Add(-ttl).UnixMilli())
+		if err != nil {
+			return 0, fmt.Errorf("evict expired media cache entries: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		evicted += n
+	}
+	if maxEntries > 0 {
+		res, err := d.db.ExecContext(ctx, `
+			DELETE FROM media_cache WHERE source_url NOT IN (
+				SELECT source_url FROM media_cache ORDER BY last_used_at DESC LIMIT ?
+			)
+		`, maxEntries)
+		if err != nil {
+			return evicted, fmt.Errorf("evict least recently used media cache entries: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		evicted += n
+	}
+	return evicted, nil
+}
@@ -0,0 +1,388 @@
+// Package database queue persists message queue jobs and dead letters so bridged
+// messages survive restarts.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// QueueJob is a persisted message queue job.
+type QueueJob struct {
+	ID              int64
+	Queue           string // Name of the queue that processes the job
+	Type            string
+	ConversationKey string // Jobs sharing a non-empty key are processed strictly in order
+	Payload         []byte
+	Attempts        int // Number of times the job has been claimed
+	LastError       string
+	AvailableAt     time.Time // Earliest time the job may be claimed
+	CreatedAt       time.Time
+}
+
+// DeadLetter is a job that exhausted its retries.
+type DeadLetter struct {
+	ID              int64
+	JobID           int64
+	Queue           string
+	Type            string
+	ConversationKey string
+	Payload         []byte
+	Attempts        int
+	LastError       string
+	CreatedAt       time.Time
+	FailedAt        time.Time
+}
+
+// EnqueueJob persists a job and returns its ID.
+// A zero AvailableAt makes the job available immediately.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) EnqueueJob(ctx context.Context, job QueueJob) (int64, error) {
+	if job.Queue == "" {
+		return 0, fmt.Errorf("%w: job queue cannot be empty", ErrInvalidInput)
+	}
+	if job.Type == "" {
+		return 0, fmt.Errorf("%w: job type cannot be empty", ErrInvalidInput)
+	}
+	now := time.Now()
+	if job.AvailableAt.IsZero() {
+		job.AvailableAt = now
+	}
+	if job.Payload == nil {
+		job.Payload = []byte{}
+	}
+	res, err := d.db.ExecContext(ctx, `
+		INSERT INTO queue_jobs (queue, type, conversation_key, payload, available_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, job.Queue, job.Type, job.ConversationKey, job.Payload, job.AvailableAt.UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("enqueue %s job: %w", job.Type, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("enqueue %s job: %w", job.Type, err)
+	}
+	return id, nil
+}
+
+// ClaimJob leases the oldest available job of the named queue for the visibility timeout
+// and increments its attempts.
+// A job whose lease expires (e.g. because its worker crashed) becomes claimable again.
+// Only the oldest job of a conversation key can be claimed, so a leased or retrying
+// job holds back later jobs of the same conversation (head-of-line blocking);
+// jobs without a key are never held back.
+// Returns nil, nil when no job is available.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) ClaimJob(ctx context.Context, queue string, visibility time.Duration) (*QueueJob, error) {
+	now := time.Now()
+	var (
+		job                    QueueJob
+		availableAt, createdAt int64
+	)
+	err := d.db.QueryRowContext(ctx, `
+		UPDATE queue_jobs
+		SET locked_until = ?, attempts = attempts + 1
+		WHERE id = (
+			SELECT j.id FROM queue_jobs j
+			WHERE j.queue = ? AND j.available_at <= ? AND j.locked_until <= ?
+			AND (j.conversation_key = '' OR NOT EXISTS (
+				SELECT 1 FROM queue_jobs p
+				WHERE p.queue = j.queue AND p.conversation_key = j.conversation_key AND p.id < j.id
+			))
+			ORDER BY j.id
+			LIMIT 1
+		)
+		RETURNING id, queue, type, conversation_key, payload, attempts, last_error, available_at, created_at
+	`, now.Add(visibility).UnixMilli(), queue, now.UnixMilli(), now.UnixMilli()).Scan(
+		&job.ID, &job.Queue, &job.Type, &job.ConversationKey, &job.Payload, &job.Attempts, &job.LastError, &availableAt, &createdAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim job: %w", err)
+	}
+	job.AvailableAt = time.UnixMilli(availableAt)
+	job.CreatedAt = time.UnixMilli(createdAt)
+	return &job, nil
+}
+
+// CompleteJob removes a successfully processed job.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) CompleteJob(ctx context.Context, id int64) error {
+	if _, err := d.db.ExecContext(ctx, `DELETE FROM queue_jobs WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("complete job %d: %w", id, err)
+	}
+	return nil
+}
+
+// RetryJob releases a job's lease and schedules it again at availableAt.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) RetryJob(ctx context.Context, id int64, availableAt time.Time, lastError string) error {
+	res, err := d.db.ExecContext(ctx, `
+		UPDATE queue_jobs
+		SET available_at = ?, locked_until = 0, last_error = ?
+		WHERE id = ?
+	`, availableAt.UnixMilli(), lastError, id)
+	if err != nil {
+		return fmt.Errorf("retry job %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("retry job %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// DeadLetterJob moves a job to the dead-letter table.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) DeadLetterJob(ctx context.Context, id int64, lastError string) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO dead_letters (job_id, queue, type, conversation_key, payload, attempts, last_error, created_at, failed_at)
+		SELECT id, queue, type, conversation_key, payload, attempts, ?, created_at, ?
+		FROM queue_jobs WHERE id = ?
+	`, lastError, time.Now().UnixMilli(), id)
+	if err != nil {
+		return fmt.Errorf("dead-letter job %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("dead-letter job %d: %w", id, ErrNotFound)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM queue_jobs WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("dead-letter job %d: %w", id, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CountJobs returns the number of jobs in the named queue, including leased ones.
+// An empty name counts the jobs of all queues.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) CountJobs(ctx context.Context, queue string) (int, error) {
+	var n int
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM queue_jobs WHERE ? = '' OR queue = ?`, queue, queue).Scan(&n); err != nil {
+		return 0, fmt.Errorf("count jobs: %w", err)
+	}
+	return n, nil
+}
+
+// CountDeadLetters returns the number of jobs of the named queue that were dead-lettered.
+// An empty name counts the dead letters of all queues.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) CountDeadLetters(ctx context.Context, queue string) (int, error) {
+	var n int
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM dead_letters WHERE ? = '' OR queue = ?`, queue, queue).Scan(&n); err != nil {
+		return 0, fmt.Errorf("count dead letters: %w", err)
+	}
+	return n, nil
+}
+
+// DeadLetterFilter selects dead letters. Zero values match everything.
+type DeadLetterFilter struct {
+	Type             string   // Job type, e.g. "viber_to_matrix"
+	ConversationKeys []string // Any of these conversation keys
+	Limit            int      // Maximum number of results for listing (0 means no limit)
+	Offset           int      // Number of results to skip when listing
+}
+
+// where returns the SQL condition and arguments for the filter.
+func (f DeadLetterFilter) where() (string, []any) {
+	conditions := []string{"1 = 1"}
+	var args []any
+	if f.Type != "" {
+		conditions = append(conditions, "type = ?")
+		args = append(args, f.Type)
+	}
+	if len(f.ConversationKeys) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(f.ConversationKeys)), ", ")
+		conditions = append(conditions, "conversation_key IN ("+placeholders+")")
+		for _, key := range f.ConversationKeys {
+			args = append(args, key)
+		}
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// ListDeadLetters returns matching dead letters, most recent failure first,
+// together with the total number of matches ignoring Limit and Offset.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) ListDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, int, error) {
+	where, args := filter.where()
+
+	var total int
+	if err := d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM dead_letters WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count dead letters: %w", err)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // SQLite: no limit
+	}
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT id, job_id, queue, type, conversation_key, payload, attempts, last_error, created_at, failed_at
+		FROM dead_letters
+		WHERE `+where+`
+		ORDER BY failed_at DESC, id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("list dead letters: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		letters = append(letters, *letter)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("list dead letters: %w", err)
+	}
+	return letters, total, nil
+}
+
+// GetDeadLetter returns a dead letter by ID, or nil if it does not exist.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) GetDeadLetter(ctx context.Context, id int64) (*DeadLetter, error) {
+	row := d.db.QueryRowContext(ctx, `
+		SELECT id, job_id, queue, type, conversation_key, payload, attempts, last_error, created_at, failed_at
+		FROM dead_letters
+		WHERE id = ?
+	`, id)
+	letter, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return letter, err
+}
+
+// scanDeadLetter scans a dead letter from a row.
+func scanDeadLetter(row interface{ Scan(dest ...any) error }) (*DeadLetter, error) {
+	var (
+		letter              DeadLetter
+		createdAt, failedAt int64
+	)
+	err := row.Scan(&letter.ID, &letter.JobID, &letter.Queue, &letter.Type, &letter.ConversationKey, &letter.Payload,
+		&letter.Attempts, &letter.LastError, &createdAt, &failedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scan dead letter: %w", err)
+	}
+	letter.CreatedAt = time.UnixMilli(createdAt)
+	letter.FailedAt = time.UnixMilli(failedAt)
+	return &letter, nil
+}
+
+// RequeueDeadLetter moves a dead letter back into the queue with a fresh retry budget
+// and returns its job ID. The job keeps its original ID, and with it its place in its
+// conversation, so it is processed before any later jobs of that conversation.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) RequeueDeadLetter(ctx context.Context, id int64) (int64, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now().UnixMilli()
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO queue_jobs (id, queue, type, conversation_key, payload, last_error, available_at, created_at)
+		SELECT job_id, queue, type, conversation_key, payload, last_error, ?, created_at
+		FROM dead_letters WHERE id = ?
+	`, now, id)
+	if err != nil {
+		return 0, fmt.Errorf("requeue dead letter %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return 0, fmt.Errorf("requeue dead letter %d: %w", id, ErrNotFound)
+	}
+	jobID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("requeue dead letter %d: %w", id, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = ?`, id); err != nil {
+		return 0, fmt.Errorf("requeue dead letter %d: %w", id, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	return jobID, nil
+}
+
+// RequeueDeadLetters moves all matching dead letters back into the queue under their
+// original job IDs and returns how many were requeued. Limit and Offset are ignored.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) RequeueDeadLetters(ctx context.Context, filter DeadLetterFilter) (int, error) {
+	where, args := filter.where()
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO queue_jobs (id, queue, type, conversation_key, payload, last_error, available_at, created_at)
+		SELECT job_id, queue, type, conversation_key, payload, last_error, ?, created_at
+		FROM dead_letters WHERE `+where+`
+		ORDER BY job_id
+	`, append([]any{time.Now().UnixMilli()}, args...)...)
+	if err != nil {
+		return 0, fmt.Errorf("requeue dead letters: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("requeue dead letters: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM dead_letters WHERE `+where, args...); err != nil {
+		return 0, fmt.Errorf("requeue dead letters: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	return int(n), nil
+}
+
+// DeleteDeadLetter permanently removes a dead letter.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) DeleteDeadLetter(ctx context.Context, id int64) error {
+	res, err := d.db.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete dead letter %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("delete dead letter %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// PurgeDeadLetters permanently removes all matching dead letters and returns how many were removed.
+// Limit and Offset are ignored.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) PurgeDeadLetters(ctx context.Context, filter DeadLetterFilter) (int, error) {
+	where, args := filter.where()
+	res, err := d.db.ExecContext(ctx, `DELETE FROM dead_letters WHERE `+where, args...)
+	if err != nil {
+		return 0, fmt.Errorf("purge dead letters: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("purge dead letters: %w", err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,87 @@
+// Package database stickers catalogs Viber stickers uploaded to Matrix, so each
+// sticker is fetched once and Matrix stickers can be sent back by sticker ID.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ViberSticker is a Viber sticker uploaded to the Matrix media repository.
+type ViberSticker struct {
+	StickerID int64
+	MXC       string // mxc:// URI of the sticker image
+	MimeType  string
+	Width     int
+	Height    int
+	Size      int // Bytes
+	CreatedAt time.Time
+}
+
+// GetViberSticker returns the sticker with the given Viber sticker ID.
+// Returns nil, nil when the sticker has not been uploaded yet.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) GetViberSticker(ctx context.Context, stickerID int64) (*ViberSticker, error) {
+	return d.queryViberSticker(ctx, "sticker_id", stickerID)
+}
+
+// GetViberStickerByMXC returns the sticker uploaded as mxc, e.g. to send a Matrix sticker
+// that originated from Viber back as the same Viber sticker.
+// Returns nil, nil when mxc is not a Viber sticker.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) GetViberStickerByMXC(ctx context.Context, mxc string) (*ViberSticker, error) {
+	if mxc == "" {
+		return nil, fmt.Errorf("%w: mxc uri cannot be empty", ErrInvalidInput)
+	}
+	return d.queryViberSticker(ctx, "mxc_uri", mxc)
+}
+
+// SaveViberSticker stores a sticker, replacing an earlier upload of the same sticker ID.
+// The context controls cancellation and timeout for the operation.
+func (d *DB) SaveViberSticker(ctx context.Context, sticker ViberSticker) error {
+	if sticker.StickerID == 0 {
+		return fmt.Errorf("%w: sticker_id cannot be empty", ErrInvalidInput)
+	}
+	if sticker.MXC == "" {
+		return fmt.Errorf("%w: mxc uri cannot be empty", ErrInvalidInput)
+	}
+	_, err := d.db.ExecContext(ctx, `
+		INSERT INTO viber_stickers (sticker_id, mxc_uri, mime_type, width, height, size, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(sticker_id) DO UPDATE SET
+			mxc_uri = excluded.mxc_uri,
+			mime_type = excluded.mime_type,
+			width = excluded.width,
+			height = excluded.height,
+			size = excluded.size,
+			created_at = excluded.created_at
+	`, sticker.StickerID, sticker.MXC, sticker.MimeType, sticker.Width, sticker.Height, sticker.Size, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("save viber sticker %d: %w", sticker.StickerID, err)
+	}
+	return nil
+}
+
+// queryViberSticker loads the sticker whose column equals value.
+func (d *DB) queryViberSticker(ctx context.Context, column string, value any) (*ViberSticker, error) {
+	var (
+		s         ViberSticker
+		createdAt int64
+	)
+	err := d.db.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT sticker_id, mxc_uri, mime_type, width, height, size, created_at
+		FROM viber_stickers
+		WHERE %s = ?
+	`, column), value).Scan(&s.StickerID, &s.MXC, &s.MimeType, &s.Width, &s.Height, &s.Size, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query viber sticker by %s: %w", column, err)
+	}
+	s.CreatedAt = time.UnixMilli(createdAt)
+	return &s, nil
+}
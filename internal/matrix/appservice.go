@@ -0,0 +1,424 @@
+// Package matrix appservice implements the Matrix Application Service API so the bridge
+// can puppet ghost users and receive events via homeserver transactions instead of /sync.
+package matrix
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mautrix "maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/metrics"
+)
+
+const (
+	// ModeSync runs the bridge as a regular Matrix user driven by /sync (small setups).
+	ModeSync = "sync"
+	// ModeAppService runs the bridge as a Matrix Application Service with ghost puppeting.
+	ModeAppService = "appservice"
+
+	// GhostLocalpartPrefix is the localpart prefix reserved for Viber ghost users.
+	GhostLocalpartPrefix = "viber_"
+	// PortalAliasPrefix is the alias localpart prefix reserved for Viber portal rooms.
+	PortalAliasPrefix = "viber_"
+
+	// appServiceEventBuffer bounds the number of pending transaction events.
+	appServiceEventBuffer = 256
+	// processedTxnRetention is how long handled transaction and event IDs are remembered for deduplication.
+	processedTxnRetention = time.Hour
+)
+
+// RegistrationConfig holds the values used to generate an appservice registration file.
+type RegistrationConfig struct {
+	ID           string // Appservice ID (default: "viber")
+	URL          string // URL the homeserver uses to reach the bridge
+	ServerName   string // Homeserver domain used in ghost user IDs and aliases
+	BotLocalpart string // Localpart of the bridge bot (default: "viberbot")
+}
+
+// GenerateRegistration creates a new registration with random as_token/hs_token values
+// and exclusive user and alias namespaces for Viber ghosts and portals.
+func GenerateRegistration(cfg RegistrationConfig) (*appservice.Registration, error) {
+	if cfg.ServerName == "" {
+		return nil, fmt.Errorf("server name is required to generate registration")
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("appservice url is required to generate registration")
+	}
+	if cfg.ID == "" {
+		cfg.ID = "viber"
+	}
+	if cfg.BotLocalpart == "" {
+		cfg.BotLocalpart = "viberbot"
+	}
+
+	reg := appservice.CreateRegistration()
+	reg.ID = cfg.ID
+	reg.URL = cfg.URL
+	reg.SenderLocalpart = cfg.BotLocalpart
+	rateLimited := false
+	reg.RateLimited = &rateLimited
+	server := regexp.QuoteMeta(cfg.ServerName)
+	reg.Namespaces.UserIDs.Register(regexp.MustCompile(fmt.Sprintf("^@%s.*:%s$", GhostLocalpartPrefix, server)), true)
+	reg.Namespaces.UserIDs.Register(regexp.MustCompile(fmt.Sprintf("^@%s:%s$", regexp.QuoteMeta(cfg.BotLocalpart), server)), true)
+	reg.Namespaces.RoomAliases.Register(regexp.MustCompile(fmt.Sprintf("^#%s.*:%s$", PortalAliasPrefix, server)), true)
+	return reg, nil
+}
+
+// LoadOrGenerateRegistration loads the registration at path, or generates and saves a new one
+// if the file does not exist. The returned bool reports whether a new file was written.
+func LoadOrGenerateRegistration(path string, cfg RegistrationConfig) (*appservice.Registration, bool, error) {
+	reg, err := appservice.LoadRegistration(path)
+	if err == nil {
+		return reg, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, fmt.Errorf("load registration %s: %w", path, err)
+	}
+
+	reg, err = GenerateRegistration(cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := reg.Save(path); err != nil {
+		return nil, false, fmt.Errorf("save registration %s: %w", path, err)
+	}
+	return reg, true, nil
+}
+
+// AppService receives homeserver transactions and answers user/alias queries.
+// Events are handed to persistent listeners before a transaction is acknowledged,
+// and dispatched in order to the other registered listeners by Start.
+type AppService struct {
+	registration *appservice.Registration
+	serverName   string
+	userRegexes  []*regexp.Regexp
+	aliasRegexes []*regexp.Regexp
+
+	mu              sync.Mutex
+	processedTxns   map[string]time.Time
+	processedEvents map[id.EventID]time.Time // Events stored and dispatched, even if their transaction failed later
+	listeners       []func(ctx context.Context, evt *event.Event)
+	persisters      []func(ctx context.Context, evt *event.Event) error
+	userQuery       func(ctx context.Context, userID id.UserID) bool
+	aliasQuery      func(ctx context.Context, alias id.RoomAlias) bool
+
+	events    chan *event.Event
+	startOnce sync.Once
+}
+
+// NewAppService creates an appservice transaction handler for the given registration.
+func NewAppService(reg *appservice.Registration, serverName string) (*AppService, error) {
+	if reg == nil {
+		return nil, fmt.Errorf("registration is required")
+	}
+	as := &AppService{
+		registration:    reg,
+		serverName:      serverName,
+		processedTxns:   make(map[string]time.Time),
+		processedEvents: make(map[id.EventID]time.Time),
+		events:          make(chan *event.Event, appServiceEventBuffer),
+	}
+	for _, ns := range reg.Namespaces.UserIDs {
+		re, err := regexp.Compile(ns.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("compile user namespace %q: %w", ns.Regex, err)
+		}
+		as.userRegexes = append(as.userRegexes, re)
+	}
+	for _, ns := range reg.Namespaces.RoomAliases {
+		re, err := regexp.Compile(ns.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("compile alias namespace %q: %w", ns.Regex, err)
+		}
+		as.aliasRegexes = append(as.aliasRegexes, re)
+	}
+	return as, nil
+}
+
+// BotUserID returns the Matrix user ID of the appservice sender.
+func (as *AppService) BotUserID() id.UserID {
+	return id.NewUserID(as.registration.SenderLocalpart, as.serverName)
+}
+
+// IsNamespacedUser reports whether userID belongs to the appservice user namespace.
+func (as *AppService) IsNamespacedUser(userID id.UserID) bool {
+	for _, re := range as.userRegexes {
+		if re.MatchString(string(userID)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNamespacedAlias reports whether alias belongs to the appservice alias namespace.
+func (as *AppService) isNamespacedAlias(alias id.RoomAlias) bool {
+	for _, re := range as.aliasRegexes {
+		if re.MatchString(string(alias)) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddEventListener registers a callback for every event received in transactions.
+func (as *AppService) AddEventListener(fn func(ctx context.Context, evt *event.Event)) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.listeners = append(as.listeners, fn)
+}
+
+// AddPersistentListener registers a callback that durably stores events, e.g. in a queue.
+// It runs while the transaction is handled, and a failure leaves the transaction
+// unacknowledged so that the homeserver sends it again.
+func (as *AppService) AddPersistentListener(fn func(ctx context.Context, evt *event.Event) error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.persisters = append(as.persisters, fn)
+}
+
+// SetUserQueryHandler sets the callback used to answer /users/{userId} queries.
+// Without a handler, any user in the namespace is reported as existing.
+func (as *AppService) SetUserQueryHandler(fn func(ctx context.Context, userID id.UserID) bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.userQuery = fn
+}
+
+// SetAliasQueryHandler sets the callback used to answer /rooms/{roomAlias} queries.
+// The handler should create the room and alias before returning true.
+func (as *AppService) SetAliasQueryHandler(fn func(ctx context.Context, alias id.RoomAlias) bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.aliasQuery = fn
+}
+
+// RegisterRoutes registers the appservice API endpoints on mux.
+func (as *AppService) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("PUT /_matrix/app/v1/transactions/{txnID}", as.handleTransaction)
+	mux.HandleFunc("GET /_matrix/app/v1/users/{userID}", as.handleUserQuery)
+	mux.HandleFunc("GET /_matrix/app/v1/rooms/{roomAlias}", as.handleAliasQuery)
+	mux.HandleFunc("POST /_matrix/app/v1/ping", as.handlePing)
+}
+
+// Start dispatches queued transaction events to listeners until ctx is cancelled.
+// Calling Start more than once has no effect.
+func (as *AppService) Start(ctx context.Context) {
+	as.startOnce.Do(func() {
+		go as.dispatch(ctx)
+	})
+}
+
+// dispatch delivers events to listeners sequentially to preserve homeserver ordering.
+func (as *AppService) dispatch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt := <-as.events:
+			as.mu.Lock()
+			listeners := append([]func(context.Context, *event.Event){}, as.listeners...)
+			as.mu.Unlock()
+			for _, fn := range listeners {
+				fn(ctx, evt)
+			}
+		}
+	}
+}
+
+// checkToken verifies the hs_token sent by the homeserver.
+// Accepts both the Authorization header and the legacy access_token query parameter.
+func (as *AppService) checkToken(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		mautrix.MMissingToken.WithMessage("Missing access token").Write(w)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(as.registration.ServerToken)) != 1 {
+		metrics.RecordError("appservice_invalid_token", "appservice")
+		mautrix.MForbidden.WithMessage("Invalid access token").Write(w)
+		return false
+	}
+	return true
+}
+
+// handleTransaction handles PUT /_matrix/app/v1/transactions/{txnID}.
+// Events are handed over one at a time, so when a transaction fails halfway the homeserver
+// retries it in full; events already handed over are remembered by ID and skipped.
+func (as *AppService) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	if !as.checkToken(w, r) {
+		return
+	}
+	txnID := r.PathValue("txnID")
+	if as.isProcessed(txnID) {
+		writeEmptyJSON(w)
+		return
+	}
+
+	var txn appservice.Transaction
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		mautrix.MBadJSON.WithMessage("Failed to parse transaction").Write(w)
+		return
+	}
+
+	as.mu.Lock()
+	persisters := append([]func(context.Context, *event.Event) error{}, as.persisters...)
+	as.mu.Unlock()
+
+	for _, evt := range txn.Events {
+		if as.isEventProcessed(evt.ID) {
+			continue
+		}
+		if evt.StateKey != nil {
+			evt.Type.Class = event.StateEventType
+		} else {
+			evt.Type.Class = event.MessageEventType
+		}
+		if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrUnsupportedContentType) {
+			logger.Warn("failed to parse appservice event content",
+				"error", err,
+				"event_id", evt.ID,
+				"event_type", evt.Type.Type,
+			)
+		}
+		for _, persist := range persisters {
+			if err := persist(r.Context(), evt); err != nil {
+				metrics.RecordError("appservice_persist_failure", "appservice")
+				logger.Warn("failed to store appservice event; transaction will be retried",
+					"error", err,
+					"txn_id", txnID,
+					"event_id", evt.ID,
+				)
+				mautrix.MUnknown.WithMessage("Failed to store event").Write(w)
+				return
+			}
+		}
+		select {
+		case as.events <- evt:
+		case <-r.Context().Done():
+			// The homeserver will retry the transaction since we never acknowledged it
+			return
+		}
+		as.markEventProcessed(evt.ID)
+	}
+	metrics.RecordQueueDepth("appservice_events", len(as.events))
+
+	as.markProcessed(txnID)
+	writeEmptyJSON(w)
+}
+
+// handleUserQuery handles GET /_matrix/app/v1/users/{userID}.
+func (as *AppService) handleUserQuery(w http.ResponseWriter, r *http.Request) {
+	if !as.checkToken(w, r) {
+		return
+	}
+	userID := id.UserID(r.PathValue("userID"))
+	as.mu.Lock()
+	query := as.userQuery
+	as.mu.Unlock()
+
+	exists := as.IsNamespacedUser(userID)
+	if exists && query != nil {
+		exists = query(r.Context(), userID)
+	}
+	if !exists {
+		mautrix.MNotFound.WithMessage("User not found").Write(w)
+		return
+	}
+	writeEmptyJSON(w)
+}
+
+// handleAliasQuery handles GET /_matrix/app/v1/rooms/{roomAlias}.
+func (as *AppService) handleAliasQuery(w http.ResponseWriter, r *http.Request) {
+	if !as.checkToken(w, r) {
+		return
+	}
+	alias := id.RoomAlias(r.PathValue("roomAlias"))
+	as.mu.Lock()
+	query := as.aliasQuery
+	as.mu.Unlock()
+
+	if !as.isNamespacedAlias(alias) || query == nil || !query(r.Context(), alias) {
+		mautrix.MNotFound.WithMessage("Alias not found").Write(w)
+		return
+	}
+	writeEmptyJSON(w)
+}
+
+// handlePing handles POST /_matrix/app/v1/ping used by homeservers to check connectivity.
+func (as *AppService) handlePing(w http.ResponseWriter, r *http.Request) {
+	if !as.checkToken(w, r) {
+		return
+	}
+	writeEmptyJSON(w)
+}
+
+// isProcessed reports whether a transaction ID has already been handled.
+func (as *AppService) isProcessed(txnID string) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	_, ok := as.processedTxns[txnID]
+	return ok
+}
+
+// markProcessed records a transaction ID and prunes expired transaction and event entries.
+func (as *AppService) markProcessed(txnID string) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	now := time.Now()
+	for txn, at := range as.processedTxns {
+		if now.Sub(at) > processedTxnRetention {
+			delete(as.processedTxns, txn)
+		}
+	}
+	for evt, at := range as.processedEvents {
+		if now.Sub(at) > processedTxnRetention {
+			delete(as.processedEvents, evt)
+		}
+	}
+	as.processedTxns[txnID] = now
+}
+
+// isEventProcessed reports whether an event has already been stored and dispatched.
+func (as *AppService) isEventProcessed(eventID id.EventID) bool {
+	if eventID == "" {
+		return false
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	_, ok := as.processedEvents[eventID]
+	return ok
+}
+
+// markEventProcessed records an event ID; markProcessed prunes expired entries.
+func (as *AppService) markEventProcessed(eventID id.EventID) {
+	if eventID == "" {
+		return
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.processedEvents[eventID] = time.Now()
+}
+
+// writeEmptyJSON writes an empty JSON object with status 200.
+func writeEmptyJSON(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("{}"))
+}
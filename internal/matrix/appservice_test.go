@@ -0,0 +1,204 @@
+// Package matrix appservice tests - unit tests for the appservice transaction handler.
+package matrix
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestAppService(t *testing.T) (*AppService, *http.ServeMux) {
+	t.Helper()
+	reg, err := GenerateRegistration(RegistrationConfig{URL: "http://localhost:8080", ServerName: "example.com"})
+	if err != nil {
+		t.Fatalf("Failed to generate registration: %v", err)
+	}
+	as, err := NewAppService(reg, "example.com")
+	if err != nil {
+		t.Fatalf("Failed to create appservice: %v", err)
+	}
+	mux := http.NewServeMux()
+	as.RegisterRoutes(mux)
+	return as, mux
+}
+
+func TestGenerateRegistration(t *testing.T) {
+	reg, err := GenerateRegistration(RegistrationConfig{URL: "http://localhost:8080", ServerName: "example.com"})
+	if err != nil {
+		t.Fatalf("GenerateRegistration() error = %v", err)
+	}
+	if reg.AppToken == "" || reg.ServerToken == "" || reg.AppToken == reg.ServerToken {
+		t.Error("Expected distinct non-empty as_token and hs_token")
+	}
+	if reg.SenderLocalpart != "viberbot" {
+		t.Errorf("Expected default sender localpart 'viberbot', got '%s'", reg.SenderLocalpart)
+	}
+	if len(reg.Namespaces.UserIDs) == 0 || len(reg.Namespaces.RoomAliases) == 0 {
+		t.Error("Expected user and alias namespaces to be registered")
+	}
+
+	if _, err := GenerateRegistration(RegistrationConfig{URL: "http://localhost:8080"}); err == nil {
+		t.Error("Expected error when server name is missing")
+	}
+}
+
+func TestAppService_TokenCheck(t *testing.T) {
+	_, mux := newTestAppService(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/1", strings.NewReader(`{"events":[]}`))
+	req.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for invalid hs_token, got %d", w.Code)
+	}
+}
+
+func TestAppService_TransactionDispatch(t *testing.T) {
+	as, mux := newTestAppService(t)
+
+	received := make(chan *event.Event, 2)
+	as.AddEventListener(func(ctx context.Context, evt *event.Event) {
+		received <- evt
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	as.Start(ctx)
+
+	body := `{"events":[{"type":"m.room.message","event_id":"$1","room_id":"!r:example.com","sender":"@alice:example.com","content":{"msgtype":"m.text","body":"hi"}}]}`
+	for i := 0; i < 2; i++ {
+		// The second PUT reuses the transaction ID and must not be dispatched again
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn1", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+as.registration.ServerToken)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	select {
+	case evt := <-received:
+		msg, ok := evt.Content.Parsed.(*event.MessageEventContent)
+		if !ok || msg.Body != "hi" {
+			t.Errorf("Expected parsed message content with body 'hi', got %#v", evt.Content.Parsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Event was not dispatched")
+	}
+
+	select {
+	case <-received:
+		t.Error("Duplicate transaction was dispatched twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAppService_PersistentListener(t *testing.T) {
+	as, mux := newTestAppService(t)
+
+	var stored []id.EventID
+	fail := true
+	as.AddPersistentListener(func(ctx context.Context, evt *event.Event) error {
+		if fail {
+			return errors.New("database is locked")
+		}
+		stored = append(stored, evt.ID)
+		return nil
+	})
+
+	body := `{"events":[{"type":"m.room.message","event_id":"$1","room_id":"!r:example.com","sender":"@alice:example.com","content":{"msgtype":"m.text","body":"hi"}}]}`
+	put := func() int {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn1", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+as.registration.ServerToken)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A transaction is not acknowledged until its events are stored, so the homeserver retries it
+	if code := put(); code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when storing fails, got %d", code)
+	}
+	fail = false
+	if code := put(); code != http.StatusOK {
+		t.Errorf("Expected 200 once stored, got %d", code)
+	}
+	if len(stored) != 1 || stored[0] != "$1" {
+		t.Errorf("Expected $1 to be stored once, got %v", stored)
+	}
+}
+
+func TestAppService_PartialTransaction(t *testing.T) {
+	as, mux := newTestAppService(t)
+
+	var stored []id.EventID
+	failOn := id.EventID("$2")
+	as.AddPersistentListener(func(ctx context.Context, evt *event.Event) error {
+		if evt.ID == failOn {
+			return errors.New("database is locked")
+		}
+		stored = append(stored, evt.ID)
+		return nil
+	})
+
+	body := `{"events":[` +
+		`{"type":"m.room.message","event_id":"$1","room_id":"!r:example.com","sender":"@alice:example.com","content":{"msgtype":"m.text","body":"one"}},` +
+		`{"type":"m.room.message","event_id":"$2","room_id":"!r:example.com","sender":"@alice:example.com","content":{"msgtype":"m.text","body":"two"}}]}`
+	put := func() int {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn1", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+as.registration.ServerToken)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The first event is stored before the second fails; the retry must not store or dispatch it again
+	if code := put(); code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when storing fails, got %d", code)
+	}
+	failOn = ""
+	if code := put(); code != http.StatusOK {
+		t.Errorf("Expected 200 once stored, got %d", code)
+	}
+	if len(stored) != 2 || stored[0] != "$1" || stored[1] != "$2" {
+		t.Errorf("Expected $1 and $2 to be stored once each, got %v", stored)
+	}
+	var dispatched []id.EventID
+	for len(as.events) > 0 {
+		dispatched = append(dispatched, (<-as.events).ID)
+	}
+	if len(dispatched) != 2 || dispatched[0] != "$1" || dispatched[1] != "$2" {
+		t.Errorf("Expected $1 and $2 to be dispatched once each, got %v", dispatched)
+	}
+}
+
+func TestAppService_UserQuery(t *testing.T) {
+	as, mux := newTestAppService(t)
+
+	tests := []struct {
+		userID string
+		want   int
+	}{
+		{"@viber_abc:example.com", http.StatusOK},
+		{"@alice:example.com", http.StatusNotFound},
+		{"@viber_abc:other.com", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/app/v1/users/"+tt.userID, nil)
+		req.Header.Set("Authorization", "Bearer "+as.registration.ServerToken)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("Query %s: expected %d, got %d", tt.userID, tt.want, w.Code)
+		}
+	}
+}
@@ -3,44 +3,126 @@ package matrix
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net/http"
+	"time"
 
-	mautrix "maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 )
 
+// maxAvatarSize bounds avatar downloads to protect against oversized responses.
+const maxAvatarSize = 10 << 20 // 10MB
+
+// AvatarStore persists avatar state so unchanged avatars are not re-uploaded.
+// Implemented by *database.DB.
+type AvatarStore interface {
+	GetViberUserAvatar(ctx context.Context, viberID string) (avatarURL, avatarHash, avatarMXC string, err error)
+	SetViberUserAvatar(ctx context.Context, viberID, avatarURL, avatarHash, avatarMXC string) error
+}
+
 // AvatarManager manages avatar syncing for ghost users.
 type AvatarManager struct {
-	mxClient  *mautrix.Client
-	puppeting *Puppeting
+	client     *Client
+	puppeting  *Puppeting
+	store      AvatarStore // Optional
+	httpClient *http.Client
 }
 
 // NewAvatarManager creates a new avatar manager.
-func NewAvatarManager(mxClient *mautrix.Client, puppeting *Puppeting) *AvatarManager {
+// store may be nil, in which case avatar state is not persisted.
+func NewAvatarManager(client *Client, puppeting *Puppeting, store AvatarStore) *AvatarManager {
 	return &AvatarManager{
-		mxClient:  mxClient,
-		puppeting: puppeting,
+		client:     client,
+		puppeting:  puppeting,
+		store:      store,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
 	}
 }
 
-// SyncAvatar syncs a Viber user's avatar to their Matrix ghost user.
+// SyncAvatar downloads a Viber user's avatar, uploads it to the media repo and sets it on their ghost.
+// The upload is skipped when the content hash matches the last uploaded avatar.
 func (am *AvatarManager) SyncAvatar(ctx context.Context, viberUserID, avatarURL string) error {
-	if am.puppeting == nil {
+	if am.puppeting == nil || am.client == nil {
 		return fmt.Errorf("puppeting not configured")
 	}
-
-	_ = am.puppeting.GetGhostUserID(viberUserID) // For future use
-
 	if avatarURL == "" {
 		return fmt.Errorf("avatar URL is empty")
 	}
 
-	// Parse the URL as a Matrix ContentURI (mxc://server/media)
-	// For now, this is a placeholder - SetAvatarURL doesn't take userID parameter
-	// and requires proper puppeting setup
-	_ = avatarURL
-	_ = ctx
-	return fmt.Errorf("avatar syncing requires appservice puppeting")
+	ghostID := am.puppeting.GetGhostUserID(viberUserID)
+
+	data, mimeType, err := am.download(ctx, avatarURL)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	var storedHash, storedMXC string
+	if am.store != nil {
+		_, storedHash, storedMXC, err = am.store.GetViberUserAvatar(ctx, viberUserID)
+		if err != nil {
+			return fmt.Errorf("load stored avatar: %w", err)
+		}
+	}
+
+	mxc := storedMXC
+	if hash != storedHash || storedMXC == "" {
+		uri, err := am.client.UploadMedia(ctx, data, mimeType)
+		if err != nil {
+			return fmt.Errorf("upload avatar: %w", err)
+		}
+		mxc = uri.String()
+	}
+
+	avatarURI, err := id.ParseContentURI(mxc)
+	if err != nil {
+		return fmt.Errorf("parse avatar uri %s: %w", mxc, err)
+	}
+	if err := am.client.SetGhostAvatar(ctx, ghostID, avatarURI); err != nil {
+		return err
+	}
+
+	if am.store != nil {
+		if err := am.store.SetViberUserAvatar(ctx, viberUserID, avatarURL, hash, mxc); err != nil {
+			return fmt.Errorf("store avatar: %w", err)
+		}
+	}
+	return nil
+}
+
+// download fetches an avatar image and returns its bytes and content type.
+func (am *AvatarManager) download(ctx context.Context, avatarURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, avatarURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("create avatar request: %w", err)
+	}
+	resp, err := am.httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("download avatar: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("download avatar: status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAvatarSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("read avatar data: %w", err)
+	}
+	if len(data) > maxAvatarSize {
+		return nil, "", fmt.Errorf("avatar exceeds %d bytes", maxAvatarSize)
+	}
+
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	return data, mimeType, nil
 }
 
 // SyncAvatarFromViberUser syncs avatar from a Viber UserDetails object.
@@ -60,7 +142,7 @@ func (am *AvatarManager) GetGhostAvatarURL(ctx context.Context, viberUserID stri
 
 	ghostID := am.puppeting.GetGhostUserID(viberUserID)
 
-	profile, err := am.mxClient.GetProfile(ctx, ghostID)
+	profile, err := am.client.mxClient.GetProfile(ctx, ghostID)
 	if err != nil {
 		return "", fmt.Errorf("get profile: %w", err)
 	}
@@ -72,20 +154,18 @@ func (am *AvatarManager) GetGhostAvatarURL(ctx context.Context, viberUserID stri
 	return profile.AvatarURL.String(), nil
 }
 
-// UpdateAvatarIfChanged updates the avatar only if it's different from current.
+// UpdateAvatarIfChanged updates the avatar only if the Viber avatar URL changed since the last sync.
+// Without a store every call performs a full sync.
 func (am *AvatarManager) UpdateAvatarIfChanged(ctx context.Context, viberUserID, newAvatarURL string) error {
 	if newAvatarURL == "" {
 		return nil
 	}
 
-	currentURL, err := am.GetGhostAvatarURL(ctx, viberUserID)
-	if err != nil {
-		// Ghost user may not exist yet, sync anyway
-		return am.SyncAvatar(ctx, viberUserID, newAvatarURL)
-	}
-
-	if currentURL == newAvatarURL {
-		return nil // Already synced
+	if am.store != nil {
+		storedURL, _, storedMXC, err := am.store.GetViberUserAvatar(ctx, viberUserID)
+		if err == nil && storedURL == newAvatarURL && storedMXC != "" {
+			return nil // Already synced
+		}
 	}
 
 	return am.SyncAvatar(ctx, viberUserID, newAvatarURL)
@@ -2,12 +2,18 @@ package matrix
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"mime"
+	"net/http"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	mautrix "maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
@@ -16,129 +22,600 @@ import (
 	"github.com/example/mautrix-viber/internal/metrics"
 )
 
-// Client is a minimal Matrix client wrapper for sending messages into a single room.
+// Client is a Matrix client wrapper used by the bridge.
+// It runs either as a single user driven by /sync (ModeSync) or as an
+// Application Service that can act on behalf of ghost users (ModeAppService).
 // Provides message sending, event listening, and room management functionality.
 type Client struct {
 	homeserverURL string
 	accessToken   string
 	defaultRoomID string
+	mode          string
+	serverName    string
 	mxClient      *mautrix.Client
+	appService    *AppService // nil in sync mode
+
+	intentsMu  sync.Mutex
+	intents    map[id.UserID]*mautrix.Client // Masquerading clients per ghost user
+	registered map[id.UserID]string          // Registered ghosts and their last set display name
+	joined     map[id.RoomID]map[id.UserID]bool
 }
 
 // Config holds Matrix client configuration.
 type Config struct {
 	HomeserverURL string
-	AccessToken   string
+	AccessToken   string // Access token for sync mode; ignored in appservice mode
 	DefaultRoomID string
+	Mode          string                   // ModeSync (default) or ModeAppService
+	UserID        string                   // Bridge user ID in sync mode; resolved via /whoami when empty
+	ServerName    string                   // Homeserver domain (required in appservice mode)
+	Registration  *appservice.Registration // Appservice registration (required in appservice mode)
 }
 
 // NewClient creates a new Matrix client with the given configuration.
 func NewClient(cfg Config) (*Client, error) {
-	// Extract user ID from access token or use a placeholder
-	// In production, parse from token
-	userID := id.UserID("@bridge:local")
-	mx, err := mautrix.NewClient(cfg.HomeserverURL, userID, cfg.AccessToken)
-	if err != nil {
-		return nil, fmt.Errorf("create matrix client: %w", err)
-	}
-
-	// Initialize DefaultSyncer if not already set
-	if mx.Syncer == nil {
-		mx.Syncer = mautrix.NewDefaultSyncer()
+	mode := cfg.Mode
+	if mode == "" {
+		mode = ModeSync
 	}
 
-	return &Client{
+	c := &Client{
 		homeserverURL: cfg.HomeserverURL,
 		accessToken:   cfg.AccessToken,
 		defaultRoomID: cfg.DefaultRoomID,
-		mxClient:      mx,
-	}, nil
+		mode:          mode,
+		serverName:    cfg.ServerName,
+		intents:       make(map[id.UserID]*mautrix.Client),
+		registered:    make(map[id.UserID]string),
+		joined:        make(map[id.RoomID]map[id.UserID]bool),
+	}
+
+	switch mode {
+	case ModeAppService:
+		if cfg.Registration == nil {
+			return nil, fmt.Errorf("appservice mode requires a registration")
+		}
+		if cfg.ServerName == "" {
+			return nil, fmt.Errorf("appservice mode requires a server name")
+		}
+		as, err := NewAppService(cfg.Registration, cfg.ServerName)
+		if err != nil {
+			return nil, fmt.Errorf("create appservice: %w", err)
+		}
+		mx, err := mautrix.NewClient(cfg.HomeserverURL, as.BotUserID(), cfg.Registration.AppToken)
+		if err != nil {
+			return nil, fmt.Errorf("create matrix client: %w", err)
+		}
+		c.accessToken = cfg.Registration.AppToken
+		c.appService = as
+		c.mxClient = mx
+	case ModeSync:
+		mx, err := mautrix.NewClient(cfg.HomeserverURL, id.UserID(cfg.UserID), cfg.AccessToken)
+		if err != nil {
+			return nil, fmt.Errorf("create matrix client: %w", err)
+		}
+		if mx.UserID == "" {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			resp, err := mx.Whoami(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("resolve matrix user id: %w", err)
+			}
+			mx.UserID = resp.UserID
+		}
+		// Initialize DefaultSyncer if not already set
+		if mx.Syncer == nil {
+			mx.Syncer = mautrix.NewDefaultSyncer()
+		}
+		c.mxClient = mx
+	default:
+		return nil, fmt.Errorf("unknown matrix mode %q", mode)
+	}
+
+	return c, nil
+}
+
+// UserID returns the Matrix user ID of the bridge bot.
+func (c *Client) UserID() id.UserID {
+	return c.mxClient.UserID
+}
+
+// IsAppService reports whether the client runs in appservice mode.
+func (c *Client) IsAppService() bool {
+	return c.appService != nil
+}
+
+// AppService returns the appservice transaction handler, or nil in sync mode.
+func (c *Client) AppService() *AppService {
+	return c.appService
+}
+
+// Intent returns a client that acts as userID.
+// In appservice mode requests are masqueraded using the user_id query parameter;
+// in sync mode (or for the bot itself) the bridge's own client is returned.
+func (c *Client) Intent(userID id.UserID) *mautrix.Client {
+	if c.appService == nil || userID == "" || userID == c.mxClient.UserID {
+		return c.mxClient
+	}
+
+	c.intentsMu.Lock()
+	defer c.intentsMu.Unlock()
+	if intent, ok := c.intents[userID]; ok {
+		return intent
+	}
+	intent := &mautrix.Client{
+		HomeserverURL:       c.mxClient.HomeserverURL,
+		UserID:              userID,
+		AccessToken:         c.accessToken,
+		Client:              c.mxClient.Client,
+		Log:                 c.mxClient.Log,
+		Syncer:              c.mxClient.Syncer,
+		Store:               c.mxClient.Store,
+		StateStore:          c.mxClient.StateStore,
+		SetAppServiceUserID: true,
+	}
+	c.intents[userID] = intent
+	return intent
+}
+
+// SendMessageAs sends a message event to roomID as sender and returns the event ID.
+// An empty sender sends as the bridge bot.
+func (c *Client) SendMessageAs(ctx context.Context, roomID id.RoomID, sender id.UserID, content interface{}) (id.EventID, error) {
+	start := time.Now()
+	defer func() {
+		metrics.RecordOperationDuration("matrix_send_event", time.Since(start))
+	}()
+	resp, err := c.Intent(sender).SendMessageEvent(ctx, roomID, event.EventMessage, content)
+	if err != nil {
+		metrics.RecordError("matrix_send_failure", "client")
+		return "", fmt.Errorf("send matrix message as %s: %w", sender, err)
+	}
+	return resp.EventID, nil
+}
+
+// ServerName returns the homeserver domain used for ghost user IDs.
+// Falls back to the bot user's domain when not configured.
+func (c *Client) ServerName() string {
+	if c.serverName != "" {
+		return c.serverName
+	}
+	_, server, err := c.mxClient.UserID.Parse()
+	if err != nil {
+		return ""
+	}
+	return server
 }
 
 // SendText sends a plain/HTML formatted text message to the default room.
-func (c *Client) SendText(ctx context.Context, text string) error {
+// Returns the event ID so the message can be mapped to its Viber counterpart.
+func (c *Client) SendText(ctx context.Context, text string) (id.EventID, error) {
 	if c.defaultRoomID == "" {
-		return fmt.Errorf("default room ID not configured")
+		return "", fmt.Errorf("default room ID not configured")
 	}
+	return c.SendTextAs(ctx, id.RoomID(c.defaultRoomID), "", text)
+}
+
+// SendTextAs sends a markdown-rendered text message to roomID as sender.
+// An empty sender sends as the bridge bot.
+func (c *Client) SendTextAs(ctx context.Context, roomID id.RoomID, sender id.UserID, text string) (id.EventID, error) {
 	start := time.Now()
 	defer func() {
 		metrics.RecordOperationDuration("matrix_send_text", time.Since(start))
 	}()
 	content := format.RenderMarkdown(text, true, true)
-	_, err := c.mxClient.SendMessageEvent(ctx, id.RoomID(c.defaultRoomID), event.EventMessage, content)
+	resp, err := c.Intent(sender).SendMessageEvent(ctx, roomID, event.EventMessage, content)
 	if err != nil {
 		metrics.RecordError("matrix_send_failure", "client")
-		return fmt.Errorf("send matrix message: %w", err)
+		return "", fmt.Errorf("send matrix message: %w", err)
 	}
-	return nil
+	return resp.EventID, nil
 }
 
-// SendImage uploads bytes to the HS and sends an m.image message.
-func (c *Client) SendImage(ctx context.Context, filename string, mimeType string, data []byte, info interface{}) error {
+// SendImage uploads bytes to the HS and sends an m.image message to the default room.
+// Returns the event ID so the message can be mapped to its Viber counterpart.
+func (c *Client) SendImage(ctx context.Context, filename string, mimeType string, data []byte, info *event.FileInfo) (id.EventID, error) {
 	if c.defaultRoomID == "" {
-		return fmt.Errorf("default room ID not configured")
+		return "", fmt.Errorf("default room ID not configured")
+	}
+	return c.SendImageAs(ctx, id.RoomID(c.defaultRoomID), "", filename, mimeType, data, info)
+}
+
+// SendImageAs uploads bytes to the HS and sends an m.image message to roomID as sender.
+// An empty sender sends as the bridge bot.
+func (c *Client) SendImageAs(ctx context.Context, roomID id.RoomID, sender id.UserID, filename string, mimeType string, data []byte, info *event.FileInfo) (id.EventID, error) {
+	if info == nil {
+		info = &event.FileInfo{}
+	}
+	if info.MimeType == "" {
+		info.MimeType = mimeType
 	}
+	return c.SendMedia(ctx, roomID, sender, event.MsgImage, filename, data, info)
+}
+
+// SendMedia uploads bytes to the HS and sends them to roomID as sender in a message of
+// msgType (m.image, m.video, m.audio or m.file). info is sent as the message's info block;
+// its mimetype is guessed from filename and its size taken from data when not set.
+// An empty sender sends as the bridge bot.
+func (c *Client) SendMedia(ctx context.Context, roomID id.RoomID, sender id.UserID, msgType event.MessageType, filename string, data []byte, info *event.FileInfo) (id.EventID, error) {
+	if roomID == "" {
+		return "", fmt.Errorf("no room to send %s to", msgType)
+	}
+	if info == nil {
+		info = &event.FileInfo{}
+	}
+	if info.MimeType == "" {
+		// best-effort guess from extension
+		info.MimeType = mime.TypeByExtension(filepath.Ext(filename))
+		if info.MimeType == "" {
+			info.MimeType = "application/octet-stream"
+		}
+	}
+	if info.Size == 0 {
+		info.Size = len(data)
+	}
+
+	uri, err := c.UploadMediaAs(ctx, sender, data, info.MimeType)
+	if err != nil {
+		return "", err
+	}
+	return c.SendUploadedMedia(ctx, roomID, sender, msgType, filename, uri, info)
+}
+
+// SendUploadedMedia sends already uploaded media to roomID as sender in a message of msgType,
+// with info as the message's info block. An empty sender sends as the bridge bot.
+func (c *Client) SendUploadedMedia(ctx context.Context, roomID id.RoomID, sender id.UserID, msgType event.MessageType, filename string, uri id.ContentURI, info *event.FileInfo) (id.EventID, error) {
+	return c.SendCaptionedMedia(ctx, roomID, sender, msgType, filename, "", uri, info)
+}
+
+// SendCaptionedMedia is SendUploadedMedia with a caption. A non-empty caption becomes the
+// message body and the filename is sent separately (MSC2530); otherwise the body is the filename.
+func (c *Client) SendCaptionedMedia(ctx context.Context, roomID id.RoomID, sender id.UserID, msgType event.MessageType, filename, caption string, uri id.ContentURI, info *event.FileInfo) (id.EventID, error) {
 	start := time.Now()
 	defer func() {
-		metrics.RecordOperationDuration("matrix_send_image", time.Since(start))
+		metrics.RecordOperationDuration("matrix_send_"+strings.TrimPrefix(string(msgType), "m."), time.Since(start))
 	}()
-	if mimeType == "" {
-		// best-effort guess from extension
-		mimeType = mime.TypeByExtension(filepath.Ext(filename))
-		if mimeType == "" {
-			mimeType = "application/octet-stream"
-		}
+	if roomID == "" {
+		return "", fmt.Errorf("no room to send %s to", msgType)
+	}
+	content := &event.MessageEventContent{
+		MsgType: msgType,
+		Body:    filename,
+		URL:     uri.CUString(),
+		Info:    info,
 	}
-	uploadResp, err := c.mxClient.UploadBytes(ctx, data, mimeType)
+	if caption != "" {
+		content.Body = caption
+		content.FileName = filename
+	}
+	resp, err := c.Intent(sender).SendMessageEvent(ctx, roomID, event.EventMessage, content)
 	if err != nil {
-		metrics.RecordError("matrix_upload_failure", "client")
-		return fmt.Errorf("upload image: %w", err)
+		metrics.RecordError("matrix_send_failure", "client")
+		return "", fmt.Errorf("send %s message: %w", msgType, err)
+	}
+	return resp.EventID, nil
+}
+
+// SendVoiceAs sends already uploaded audio to roomID as sender in an m.audio message marked as
+// an MSC3245 voice message, which clients show as a voice bubble rather than an audio file.
+// info.Duration (milliseconds) and waveform (MSC3246 values from 0 to 1024) are repeated in the
+// MSC1767 audio block that clients read them from. An empty sender sends as the bridge bot.
+func (c *Client) SendVoiceAs(ctx context.Context, roomID id.RoomID, sender id.UserID, filename string, uri id.ContentURI, info *event.FileInfo, waveform []int) (id.EventID, error) {
+	start := time.Now()
+	defer func() {
+		metrics.RecordOperationDuration("matrix_send_voice", time.Since(start))
+	}()
+	if roomID == "" {
+		return "", fmt.Errorf("no room to send voice message to")
 	}
-	content := map[string]interface{}{
-		"msgtype": event.MsgImage,
-		"body":    filename,
-		"url":     uploadResp.ContentURI.String(),
+	if info == nil {
+		info = &event.FileInfo{}
 	}
-	if info != nil {
-		content["info"] = info
+	content := &event.MessageEventContent{
+		MsgType:      event.MsgAudio,
+		Body:         filename,
+		URL:          uri.CUString(),
+		Info:         info,
+		MSC1767Audio: &event.MSC1767Audio{Duration: info.Duration, Waveform: waveform},
+		MSC3245Voice: &event.MSC3245Voice{},
 	}
-	_, err = c.mxClient.SendMessageEvent(ctx, id.RoomID(c.defaultRoomID), event.EventMessage, content)
+	resp, err := c.Intent(sender).SendMessageEvent(ctx, roomID, event.EventMessage, content)
 	if err != nil {
 		metrics.RecordError("matrix_send_failure", "client")
-		return fmt.Errorf("send image message: %w", err)
+		return "", fmt.Errorf("send voice message: %w", err)
+	}
+	return resp.EventID, nil
+}
+
+// SendLocationAs sends an m.location message for geoURI to roomID as sender.
+// The location is also described with MSC3488 extensible event content, which clients
+// use to show a pin on a map; body is the fallback for clients without map support.
+// An empty sender sends as the bridge bot.
+func (c *Client) SendLocationAs(ctx context.Context, roomID id.RoomID, sender id.UserID, geoURI, body, description string) (id.EventID, error) {
+	start := time.Now()
+	defer func() {
+		metrics.RecordOperationDuration("matrix_send_location", time.Since(start))
+	}()
+	if roomID == "" {
+		return "", fmt.Errorf("no room to send location to")
+	}
+	location := map[string]interface{}{"uri": geoURI}
+	if description != "" {
+		location["description"] = description
+	}
+	content := &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType: event.MsgLocation,
+			Body:    body,
+			GeoURI:  geoURI,
+		},
+		Raw: map[string]interface{}{
+			"org.matrix.msc3488.location": location,
+			"org.matrix.msc3488.asset":    map[string]interface{}{"type": "m.pin"},
+			"org.matrix.msc3488.ts":       time.Now().UnixMilli(),
+			"org.matrix.msc1767.text":     body,
+		},
 	}
+	resp, err := c.Intent(sender).SendMessageEvent(ctx, roomID, event.EventMessage, content)
+	if err != nil {
+		metrics.RecordError("matrix_send_failure", "client")
+		return "", fmt.Errorf("send location: %w", err)
+	}
+	return resp.EventID, nil
+}
+
+// SendStickerAs sends already uploaded media to roomID as sender in an m.sticker event.
+// info should carry the sticker's dimensions, which clients use to size it.
+// An empty sender sends as the bridge bot.
+func (c *Client) SendStickerAs(ctx context.Context, roomID id.RoomID, sender id.UserID, body string, uri id.ContentURI, info *event.FileInfo) (id.EventID, error) {
+	start := time.Now()
+	defer func() {
+		metrics.RecordOperationDuration("matrix_send_sticker", time.Since(start))
+	}()
+	if roomID == "" {
+		return "", fmt.Errorf("no room to send sticker to")
+	}
+	content := &event.MessageEventContent{
+		Body: body,
+		URL:  uri.CUString(),
+		Info: info,
+	}
+	resp, err := c.Intent(sender).SendMessageEvent(ctx, roomID, event.EventSticker, content)
+	if err != nil {
+		metrics.RecordError("matrix_send_failure", "client")
+		return "", fmt.Errorf("send sticker: %w", err)
+	}
+	return resp.EventID, nil
+}
+
+// UploadMediaAs uploads bytes to the HS as sender, e.g. a thumbnail referenced from a media message's info.
+// An empty sender uploads as the bridge bot.
+func (c *Client) UploadMediaAs(ctx context.Context, sender id.UserID, data []byte, mimeType string) (id.ContentURI, error) {
+	resp, err := c.Intent(sender).UploadBytes(ctx, data, mimeType)
+	if err != nil {
+		metrics.RecordError("matrix_upload_failure", "client")
+		return id.ContentURI{}, fmt.Errorf("upload media: %w", err)
+	}
+	return resp.ContentURI, nil
+}
+
+// DownloadMedia downloads a content URI as the bridge bot, failing when it is larger than maxSize bytes.
+func (c *Client) DownloadMedia(ctx context.Context, uri id.ContentURIString, maxSize int64) ([]byte, error) {
+	parsed, err := uri.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("parse content uri %s: %w", uri, err)
+	}
+	resp, err := c.mxClient.Download(ctx, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %w", uri, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s: unexpected status %d", uri, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", uri, err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("download %s: more than %d bytes", uri, maxSize)
+	}
+	return data, nil
+}
+
+// UploadStreamAs streams content to the HS as sender without buffering it.
+// length is the content length, or -1 when unknown. A stream cannot be replayed,
+// so failed uploads are not retried. An empty sender uploads as the bridge bot.
+func (c *Client) UploadStreamAs(ctx context.Context, sender id.UserID, content io.Reader, length int64, mimeType string) (id.ContentURI, error) {
+	start := time.Now()
+	defer func() {
+		metrics.RecordOperationDuration("matrix_upload_stream", time.Since(start))
+	}()
+	if length <= 0 {
+		length = -1
+	}
+	resp, err := c.Intent(sender).UploadMedia(ctx, mautrix.ReqUploadMedia{
+		Content:       content,
+		ContentLength: length,
+		ContentType:   mimeType,
+	})
+	if err != nil {
+		metrics.RecordError("matrix_upload_failure", "client")
+		return id.ContentURI{}, fmt.Errorf("upload media: %w", err)
+	}
+	return resp.ContentURI, nil
+}
+
+// EnsureRegistered registers a ghost user with the homeserver using the appservice token.
+// Users that already exist are treated as registered. Only available in appservice mode.
+func (c *Client) EnsureRegistered(ctx context.Context, userID id.UserID) error {
+	if c.appService == nil {
+		return fmt.Errorf("ghost registration requires appservice mode")
+	}
+	c.intentsMu.Lock()
+	_, ok := c.registered[userID]
+	c.intentsMu.Unlock()
+	if ok {
+		return nil
+	}
+
+	localpart, _, err := userID.Parse()
+	if err != nil {
+		return fmt.Errorf("parse ghost user id %s: %w", userID, err)
+	}
+	_, _, err = c.mxClient.Register(ctx, &mautrix.ReqRegister{
+		Username:     localpart,
+		Type:         mautrix.AuthTypeAppservice,
+		InhibitLogin: true,
+	})
+	if err != nil && !errors.Is(err, mautrix.MUserInUse) {
+		metrics.RecordError("matrix_register_failure", "client")
+		return fmt.Errorf("register ghost user %s: %w", userID, err)
+	}
+
+	c.intentsMu.Lock()
+	c.registered[userID] = ""
+	c.intentsMu.Unlock()
 	return nil
 }
 
-// EnsureGhostUser attempts to set displayname/avatar for a ghost user.
-// Note: Proper puppeting usually requires an appservice registration. This provides basic profile setting.
+// EnsureGhostUser registers a ghost user and sets its display name.
+// The display name is only updated when it differs from the last value set by this process.
+// Proper puppeting requires appservice mode; in sync mode this returns an error.
 func (c *Client) EnsureGhostUser(ctx context.Context, userID id.UserID, displayName string) error {
-	// Best-effort: set profile if token has privileges
-	// NOTE: SetDisplayName doesn't take userID parameter in mautrix v0.25+
-	// This requires proper appservice puppeting configuration
-	if displayName != "" {
-		_ = displayName // For future implementation
+	if err := c.EnsureRegistered(ctx, userID); err != nil {
+		return err
+	}
+	if displayName == "" {
+		return nil
+	}
+
+	c.intentsMu.Lock()
+	current := c.registered[userID]
+	c.intentsMu.Unlock()
+	if current == displayName {
+		return nil
+	}
+
+	if err := c.Intent(userID).SetDisplayName(ctx, displayName); err != nil {
+		metrics.RecordError("matrix_profile_failure", "client")
+		return fmt.Errorf("set display name for %s: %w", userID, err)
+	}
+
+	c.intentsMu.Lock()
+	c.registered[userID] = displayName
+	c.intentsMu.Unlock()
+	return nil
+}
+
+// SetGhostAvatar sets the avatar of a ghost user to an already uploaded mxc:// URI.
+func (c *Client) SetGhostAvatar(ctx context.Context, userID id.UserID, avatarURI id.ContentURI) error {
+	if err := c.EnsureRegistered(ctx, userID); err != nil {
+		return err
+	}
+	if err := c.Intent(userID).SetAvatarURL(ctx, avatarURI); err != nil {
+		metrics.RecordError("matrix_profile_failure", "client")
+		return fmt.Errorf("set avatar for %s: %w", userID, err)
+	}
+	return nil
+}
+
+// GetMemberProfile returns the display name and avatar of a user as shown in a room.
+// The room member event is preferred, since it carries per-room nicknames;
+// the global profile is used when the member event is missing or has no display name.
+func (c *Client) GetMemberProfile(ctx context.Context, roomID id.RoomID, userID id.UserID) (string, id.ContentURIString, error) {
+	var member event.MemberEventContent
+	if err := c.mxClient.StateEvent(ctx, roomID, event.StateMember, userID.String(), &member); err == nil && member.Displayname != "" {
+		return member.Displayname, member.AvatarURL, nil
+	}
+	profile, err := c.mxClient.GetProfile(ctx, userID)
+	if err != nil {
+		metrics.RecordError("matrix_profile_failure", "client")
+		return "", "", fmt.Errorf("get profile of %s: %w", userID, err)
+	}
+	return profile.DisplayName, profile.AvatarURL.CUString(), nil
+}
+
+// UploadMedia uploads bytes to the homeserver media repository and returns the mxc:// URI.
+func (c *Client) UploadMedia(ctx context.Context, data []byte, mimeType string) (id.ContentURI, error) {
+	resp, err := c.mxClient.UploadBytes(ctx, data, mimeType)
+	if err != nil {
+		metrics.RecordError("matrix_upload_failure", "client")
+		return id.ContentURI{}, fmt.Errorf("upload media: %w", err)
+	}
+	return resp.ContentURI, nil
+}
+
+// EnsureJoined makes sure userID is a member of roomID, inviting it with the bot if needed.
+// Membership is cached in memory so repeated calls are cheap.
+func (c *Client) EnsureJoined(ctx context.Context, roomID id.RoomID, userID id.UserID) error {
+	c.intentsMu.Lock()
+	joined := c.joined[roomID][userID]
+	c.intentsMu.Unlock()
+	if joined {
+		return nil
+	}
+
+	intent := c.Intent(userID)
+	if _, err := intent.JoinRoomByID(ctx, roomID); err != nil {
+		if userID == c.mxClient.UserID || !errors.Is(err, mautrix.MForbidden) {
+			return fmt.Errorf("join room %s as %s: %w", roomID, userID, err)
+		}
+		// Private rooms need an invite from the bot first
+		if _, err := c.mxClient.InviteUser(ctx, roomID, &mautrix.ReqInviteUser{UserID: userID}); err != nil {
+			return fmt.Errorf("invite %s to room %s: %w", userID, roomID, err)
+		}
+		if _, err := intent.JoinRoomByID(ctx, roomID); err != nil {
+			return fmt.Errorf("join room %s as %s after invite: %w", roomID, userID, err)
+		}
+	}
+
+	c.intentsMu.Lock()
+	if c.joined[roomID] == nil {
+		c.joined[roomID] = make(map[id.UserID]bool)
 	}
+	c.joined[roomID][userID] = true
+	c.intentsMu.Unlock()
 	return nil
 }
 
-// StartMessageListener starts a background sync and invokes onMessage for message events.
-// The provided context controls the lifecycle of the sync operation.
-// Each message callback receives a context derived from the parent context for cancellation propagation.
-func (c *Client) StartMessageListener(ctx context.Context, onMessage func(ctx context.Context, evt *event.MessageEventContent, roomID id.RoomID, sender id.UserID)) error {
+// StartMessageListener starts consuming Matrix message and sticker events and invokes onMessage for each.
+// In sync mode this starts a background /sync loop and onMessage errors are logged; in appservice mode
+// it consumes homeserver transactions delivered to the routes registered via AppService().RegisterRoutes,
+// and a transaction is only acknowledged once onMessage succeeded for its events, so onMessage
+// should persist the message (e.g. in a queue) rather than process it.
+// The provided context controls the lifecycle of the listener; an appservice that was already
+// started keeps the context it was started with.
+// Each message callback receives a context derived from the parent context for cancellation propagation,
+// the raw event (for its ID, room, sender and type) and the parsed message content;
+// sticker content has no msgtype.
+func (c *Client) StartMessageListener(ctx context.Context, onMessage func(ctx context.Context, evt *event.Event, msg *event.MessageEventContent) error) error {
+	if c.appService != nil {
+		c.appService.AddPersistentListener(func(handlerCtx context.Context, evt *event.Event) error {
+			if evt == nil || (evt.Type != event.EventMessage && evt.Type != event.EventSticker) || evt.Content.Parsed == nil {
+				return nil
+			}
+			msg, ok := evt.Content.Parsed.(*event.MessageEventContent)
+			if !ok {
+				return nil
+			}
+			return onMessage(handlerCtx, evt, msg)
+		})
+		c.appService.Start(ctx)
+		return nil
+	}
+
 	// Access the client's syncer to register event handlers
 	if c.mxClient.Syncer == nil {
 		return fmt.Errorf("matrix client syncer not configured")
 	}
-
 	// Cast to ExtensibleSyncer to access OnEventType method
 	extSyncer, ok := c.mxClient.Syncer.(mautrix.ExtensibleSyncer)
 	if !ok {
 		return fmt.Errorf("syncer does not implement ExtensibleSyncer interface")
 	}
 
-	// Register message event handler
-	extSyncer.OnEventType(event.EventMessage, func(handlerCtx context.Context, evt *event.Event) {
+	// Register message and sticker event handlers
+	handler := func(handlerCtx context.Context, evt *event.Event) {
 		if evt == nil || evt.Content.Parsed == nil {
 			return
 		}
@@ -148,8 +625,16 @@ func (c *Client) StartMessageListener(ctx context.Context, onMessage func(ctx co
 		}
 		// Use parent context for cancellation propagation (background listener context)
 		// This allows the message handler to respect context cancellation from shutdown
-		onMessage(ctx, msg, evt.RoomID, evt.Sender)
-	})
+		if err := onMessage(ctx, evt, msg); err != nil {
+			logger.Warn("failed to handle matrix message",
+				"error", err,
+				"event_id", evt.ID,
+				"room_id", evt.RoomID,
+			)
+		}
+	}
+	extSyncer.OnEventType(event.EventMessage, handler)
+	extSyncer.OnEventType(event.EventSticker, handler)
 
 	// Start syncing in background goroutine
 	go func() {
@@ -163,6 +648,25 @@ func (c *Client) StartMessageListener(ctx context.Context, onMessage func(ctx co
 	return nil
 }
 
+// MarkReadAs sends a read receipt for eventID in roomID on behalf of userID.
+func (c *Client) MarkReadAs(ctx context.Context, roomID id.RoomID, userID id.UserID, eventID id.EventID) error {
+	if err := c.Intent(userID).MarkRead(ctx, roomID, eventID); err != nil {
+		return fmt.Errorf("mark %s read as %s: %w", eventID, userID, err)
+	}
+	return nil
+}
+
+// SendNoticeToRoom sends an m.notice message to roomID as the bridge bot.
+// Notices are used for bridge status messages that clients should not treat as chat.
+func (c *Client) SendNoticeToRoom(ctx context.Context, roomID id.RoomID, text string) (id.EventID, error) {
+	resp, err := c.mxClient.SendNotice(ctx, roomID, text)
+	if err != nil {
+		metrics.RecordError("matrix_send_failure", "client")
+		return "", fmt.Errorf("send matrix notice: %w", err)
+	}
+	return resp.EventID, nil
+}
+
 // GetDefaultRoomID returns the default Matrix room ID.
 func (c *Client) GetDefaultRoomID() string {
 	return c.defaultRoomID
@@ -181,16 +685,10 @@ func (c *Client) RedactEvent(ctx context.Context, roomID id.RoomID, eventID id.E
 	return err
 }
 
-// SendTextToRoom sends a text message to a specific Matrix room.
-func (c *Client) SendTextToRoom(ctx context.Context, roomID id.RoomID, text string) error {
+// SendTextToRoom sends a text message to a specific Matrix room as the bridge bot.
+func (c *Client) SendTextToRoom(ctx context.Context, roomID id.RoomID, text string) (id.EventID, error) {
 	if c.mxClient == nil {
-		return fmt.Errorf("matrix client not configured")
+		return "", fmt.Errorf("matrix client not configured")
 	}
-
-	content := format.RenderMarkdown(text, true, true)
-	_, err := c.mxClient.SendMessageEvent(ctx, roomID, event.EventMessage, content)
-	if err != nil {
-		return fmt.Errorf("send matrix message: %w", err)
-	}
-	return nil
+	return c.SendTextAs(ctx, roomID, "", text)
 }
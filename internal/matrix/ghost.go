@@ -4,9 +4,11 @@ package matrix
 import (
 	"context"
 	"fmt"
+	"strings"
 
-	mautrix "maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
 )
 
 // GhostUser represents a Matrix ghost user mapped to a Viber contact.
@@ -18,46 +20,85 @@ type GhostUser struct {
 }
 
 // Puppeting manages Matrix ghost users for Viber contacts.
+// Ghost registration and profile updates require appservice mode.
 type Puppeting struct {
-	mxClient *mautrix.Client
-	domain   string // Matrix homeserver domain for ghost user IDs
+	client  *Client
+	domain  string // Matrix homeserver domain for ghost user IDs
+	avatars *AvatarManager
 }
 
 // NewPuppeting creates a new puppeting manager.
-func NewPuppeting(mxClient *mautrix.Client, domain string) *Puppeting {
-	return &Puppeting{
-		mxClient: mxClient,
-		domain:   domain,
+// domain defaults to the client's server name when empty.
+// store may be nil, in which case avatars are re-uploaded whenever their URL changes.
+func NewPuppeting(client *Client, domain string, store AvatarStore) *Puppeting {
+	if domain == "" && client != nil {
+		domain = client.ServerName()
+	}
+	p := &Puppeting{
+		client: client,
+		domain: domain,
 	}
+	p.avatars = NewAvatarManager(client, p, store)
+	return p
+}
+
+// Avatars returns the avatar manager used for ghost users.
+func (p *Puppeting) Avatars() *AvatarManager {
+	return p.avatars
 }
 
 // GetGhostUserID generates a Matrix user ID for a Viber user.
+// Viber IDs are case-sensitive base64 strings, so they are encoded into a valid localpart.
 func (p *Puppeting) GetGhostUserID(viberUserID string) id.UserID {
-	// Format: @viber_<viber_user_id>:<homeserver>
-	return id.UserID(fmt.Sprintf("@viber_%s:%s", viberUserID, p.domain))
+	// Format: @viber_<encoded viber_user_id>:<homeserver>
+	return id.NewUserID(GhostLocalpartPrefix+id.EncodeUserLocalpart(viberUserID), p.domain)
+}
+
+// IsGhostUser reports whether userID is a Viber ghost managed by this bridge.
+func (p *Puppeting) IsGhostUser(userID id.UserID) bool {
+	localpart, server, err := userID.Parse()
+	if err != nil {
+		return false
+	}
+	return server == p.domain && strings.HasPrefix(localpart, GhostLocalpartPrefix)
+}
+
+// ParseGhostUserID returns the Viber user ID encoded in a ghost user ID.
+func (p *Puppeting) ParseGhostUserID(userID id.UserID) (string, bool) {
+	if !p.IsGhostUser(userID) {
+		return "", false
+	}
+	localpart, _, _ := userID.Parse()
+	viberUserID, err := id.DecodeUserLocalpart(strings.TrimPrefix(localpart, GhostLocalpartPrefix))
+	if err != nil {
+		return "", false
+	}
+	return viberUserID, true
 }
 
 // EnsureGhostUser creates or updates a Matrix ghost user for a Viber contact.
+// Registers the ghost, sets its display name and syncs its avatar.
+// Avatar failures are logged and do not fail the call.
 func (p *Puppeting) EnsureGhostUser(ctx context.Context, viberUserID, displayName, avatarURL string) (*GhostUser, error) {
-	if p.mxClient == nil {
+	if p.client == nil {
 		return nil, fmt.Errorf("matrix client not configured")
 	}
+	if viberUserID == "" {
+		return nil, fmt.Errorf("viber user id is empty")
+	}
 
 	ghostID := p.GetGhostUserID(viberUserID)
-
-	// Set display name if provided
-	// NOTE: SetDisplayName doesn't take userID parameter in mautrix v0.25+
-	// This requires proper appservice puppeting configuration
-	if displayName != "" {
-		_ = displayName // For future implementation
+	if err := p.client.EnsureGhostUser(ctx, ghostID, displayName); err != nil {
+		return nil, fmt.Errorf("ensure ghost user %s: %w", ghostID, err)
 	}
 
-	// Set avatar if provided
-	// NOTE: SetAvatarURL doesn't support setting other users' avatars
-	// This requires appservice puppet registration in production
 	if avatarURL != "" {
-		// This will fail without proper puppeting setup - that's expected
-		_ = avatarURL
+		if err := p.avatars.UpdateAvatarIfChanged(ctx, viberUserID, avatarURL); err != nil {
+			logger.WarnWithContext(ctx, "failed to sync ghost avatar",
+				"error", err,
+				"ghost_user_id", ghostID,
+			)
+		}
 	}
 
 	return &GhostUser{
@@ -72,8 +113,7 @@ func (p *Puppeting) EnsureGhostUser(ctx context.Context, viberUserID, displayNam
 func (p *Puppeting) GetGhostUser(ctx context.Context, viberUserID string) (*GhostUser, error) {
 	ghostID := p.GetGhostUserID(viberUserID)
 
-	// Try to get profile (may fail without appservice)
-	profile, err := p.mxClient.GetProfile(ctx, ghostID)
+	profile, err := p.client.mxClient.GetProfile(ctx, ghostID)
 	if err != nil {
 		return &GhostUser{
 			MatrixUserID: ghostID,
@@ -0,0 +1,43 @@
+// Package matrix ghost tests - unit tests for ghost user ID mapping.
+package matrix
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestGhostUserIDRoundTrip(t *testing.T) {
+	p := NewPuppeting(nil, "example.com", nil)
+
+	tests := []string{
+		"01234567890A=",
+		"abc+/XYZ==",
+		"plain",
+	}
+	for _, viberID := range tests {
+		ghostID := p.GetGhostUserID(viberID)
+		localpart, server, err := ghostID.Parse()
+		if err != nil {
+			t.Fatalf("GetGhostUserID(%q) produced unparseable ID %s: %v", viberID, ghostID, err)
+		}
+		if server != "example.com" {
+			t.Errorf("Expected server 'example.com', got '%s'", server)
+		}
+		if _, err := id.DecodeUserLocalpart(localpart[len(GhostLocalpartPrefix):]); err != nil {
+			t.Errorf("Ghost localpart %s is not a valid encoding: %v", localpart, err)
+		}
+
+		parsed, ok := p.ParseGhostUserID(ghostID)
+		if !ok || parsed != viberID {
+			t.Errorf("ParseGhostUserID(%s) = %q, %v; want %q", ghostID, parsed, ok, viberID)
+		}
+	}
+
+	if p.IsGhostUser("@alice:example.com") {
+		t.Error("Regular user detected as ghost")
+	}
+	if p.IsGhostUser("@viber_abc:other.com") {
+		t.Error("Ghost on foreign server detected as ours")
+	}
+}
@@ -0,0 +1,226 @@
+// Package matrix media_proxy serves Matrix media to Viber over expiring, HMAC-signed URLs.
+package matrix
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mautrix "maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/metrics"
+)
+
+// MediaProxyPath is the path prefix under which MediaProxy must be mounted.
+const MediaProxyPath = "/media/"
+
+// DefaultMediaProxyTTL is how long signed media URLs stay valid when not configured.
+const DefaultMediaProxyTTL = 24 * time.Hour
+
+// mediaProxyWriteTimeout replaces the server's write timeout while streaming, which is sized for API calls.
+const mediaProxyWriteTimeout = 10 * time.Minute
+
+// MediaProxy streams Matrix media to clients that cannot authenticate to the homeserver.
+// Viber downloads the media of bot messages from a public URL; the proxy hands out URLs of the form
+//
+//	<base>/media/<server>/<media id>/<file name>?exp=<unix time>&sig=<hmac>
+//
+// and fetches the content with the bridge's Matrix credentials when one is requested.
+// Only URLs signed by this proxy and not yet expired are served.
+type MediaProxy struct {
+	client  *Client
+	baseURL string
+	secret  []byte
+	ttl     time.Duration
+}
+
+// NewMediaProxy creates a media proxy. baseURL is the public URL of the bridge
+// (e.g. "https://bridge.example.com"), secret the HMAC key, and ttl how long URLs
+// stay valid (default: DefaultMediaProxyTTL).
+func NewMediaProxy(client *Client, baseURL string, secret []byte, ttl time.Duration) (*MediaProxy, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("media proxy requires a public base url")
+	}
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("media proxy secret must be at least 16 bytes")
+	}
+	if ttl <= 0 {
+		ttl = DefaultMediaProxyTTL
+	}
+	return &MediaProxy{
+		client:  client,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+		ttl:     ttl,
+	}, nil
+}
+
+// URL returns a signed URL serving uri. filename is only used for the
+// download's name and may be empty.
+func (p *MediaProxy) URL(uri id.ContentURIString, filename string) (string, error) {
+	parsed, err := uri.Parse()
+	if err != nil {
+		return "", fmt.Errorf("parse content uri %s: %w", uri, err)
+	}
+	if filename == "" {
+		filename = parsed.FileID
+	}
+	expires := time.Now().Add(p.ttl).Unix()
+	query := url.Values{
+		"exp": {strconv.FormatInt(expires, 10)},
+		"sig": {p.sign(parsed.Homeserver, parsed.FileID, expires)},
+	}
+	return fmt.Sprintf("%s%s%s/%s/%s?%s", p.baseURL, MediaProxyPath,
+		url.PathEscape(parsed.Homeserver), url.PathEscape(parsed.FileID), url.PathEscape(filename), query.Encode()), nil
+}
+
+// mediaRequest is a request for the media of a proxy URL.
+type mediaRequest struct {
+	server, mediaID, filename string
+	expires                   int64
+	signed                    bool // The signature matches the media and expiry
+}
+
+// parseRequest splits a proxy URL into its parts. It returns false for paths that are not media URLs.
+func (p *MediaProxy) parseRequest(r *http.Request) (mediaRequest, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, MediaProxyPath), "/", 3)
+	if !strings.HasPrefix(r.URL.Path, MediaProxyPath) || len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return mediaRequest{}, false
+	}
+	req := mediaRequest{server: parts[0], mediaID: parts[1], filename: parts[1]}
+	if len(parts) == 3 && parts[2] != "" {
+		req.filename = parts[2]
+	}
+	expires, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	req.expires = expires
+	req.signed = err == nil && hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(p.sign(req.server, req.mediaID, expires)))
+	return req, true
+}
+
+// Authorized reports whether r requests the media of a URL signed by this proxy that has not expired.
+// Such requests come from Viber fetching bridged media, so they may bypass per-IP rate limits.
+func (p *MediaProxy) Authorized(r *http.Request) bool {
+	req, ok := p.parseRequest(r)
+	return ok && req.signed && time.Now().Unix() <= req.expires
+}
+
+// ServeHTTP streams the media of a signed URL from the homeserver.
+// Only images, videos and audio are served inline; anything else is served as an attachment,
+// and a sandboxing Content-Security-Policy keeps documents like HTML from running in the
+// bridge's origin.
+func (p *MediaProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := p.parseRequest(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	server, mediaID, filename, expires := req.server, req.mediaID, req.filename, req.expires
+	if !req.signed {
+		metrics.RecordError("media_proxy_bad_signature", "matrix")
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "link expired", http.StatusGone)
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.RecordOperationDuration("matrix_media_proxy", time.Since(start))
+	}()
+
+	resp, err := p.download(r.Context(), id.ContentURI{Homeserver: server, FileID: mediaID})
+	if err != nil {
+		logger.WarnWithContext(r.Context(), "failed to proxy matrix media",
+			"error", err,
+			"server", server,
+			"media_id", mediaID,
+		)
+		if errors.Is(err, mautrix.MNotFound) {
+			http.Error(w, "media not found", http.StatusNotFound)
+			return
+		}
+		metrics.RecordError("media_proxy_download_failure", "matrix")
+		http.Error(w, "failed to fetch media", http.StatusBadGateway)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	header := w.Header()
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	if resp.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(contentDisposition(contentType), map[string]string{"filename": filename}))
+	header.Set("Content-Security-Policy", "sandbox; default-src 'none'")
+	header.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", max(0, expires-time.Now().Unix())))
+	header.Set("X-Content-Type-Options", "nosniff")
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(mediaProxyWriteTimeout))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logger.DebugWithContext(r.Context(), "media proxy client went away",
+			"error", err,
+			"media_id", mediaID,
+		)
+	}
+}
+
+// contentDisposition returns "inline" for images, videos and audio and "attachment" for
+// anything else, including SVG images, which can carry scripts.
+func contentDisposition(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "image/svg+xml" {
+		return "attachment"
+	}
+	switch kind, _, _ := strings.Cut(mediaType, "/"); kind {
+	case "image", "video", "audio":
+		return "inline"
+	default:
+		return "attachment"
+	}
+}
+
+// download starts an authenticated download of a content URI.
+func (p *MediaProxy) download(ctx context.Context, uri id.ContentURI) (*http.Response, error) {
+	resp, err := p.client.mxClient.Download(ctx, uri)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %w", uri, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("download %s: unexpected status %d", uri, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// sign returns the URL-safe HMAC-SHA256 signature of a media reference and its expiry.
+func (p *MediaProxy) sign(server, mediaID string, expires int64) string {
+	mac := hmac.New(sha256.New, p.secret)
+	_, _ = fmt.Fprintf(mac, "%s/%s\n%d", server, mediaID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,118 @@
+// Package matrix tests - unit tests for the signed media proxy.
+package matrix
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMediaProxy(t *testing.T) {
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v1/media/download/example.com/cat":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte("png bytes"))
+		case "/_matrix/client/v1/media/download/example.com/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte("<script>alert(document.cookie)</script>"))
+		case "/_matrix/client/v1/media/download/example.com/drawing":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			_, _ = w.Write([]byte("<svg><script>alert(1)</script></svg>"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"not found"}`))
+		}
+	}))
+	defer homeserver.Close()
+
+	client, err := NewClient(Config{HomeserverURL: homeserver.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	proxy, err := NewMediaProxy(client, "https://bridge.example.com/", []byte("0123456789abcdef"), time.Hour)
+	if err != nil {
+		t.Fatalf("NewMediaProxy() error = %v", err)
+	}
+
+	signed, err := proxy.URL("mxc://example.com/cat", "cat photo.png")
+	if err != nil {
+		t.Fatalf("URL() error = %v", err)
+	}
+	if !strings.HasPrefix(signed, "https://bridge.example.com/media/example.com/cat/cat%20photo.png?") {
+		t.Fatalf("Unexpected signed URL %s", signed)
+	}
+	missing, _ := proxy.URL("mxc://example.com/missing", "")
+	page, _ := proxy.URL("mxc://example.com/page", "page.html")
+	drawing, _ := proxy.URL("mxc://example.com/drawing", "drawing.svg")
+	expired := resign(t, proxy, signed, time.Now().Add(-time.Minute).Unix())
+
+	tests := []struct {
+		name            string
+		url             string
+		wantStatus      int
+		wantBody        string
+		wantDisposition string
+	}{
+		{"valid", signed, http.StatusOK, "png bytes", `inline; filename="cat photo.png"`},
+		{"html", page, http.StatusOK, "<script>alert(document.cookie)</script>", `attachment; filename=page.html`},
+		{"svg", drawing, http.StatusOK, "<svg><script>alert(1)</script></svg>", `attachment; filename=drawing.svg`},
+		{"tampered media id", strings.Replace(signed, "/cat/", "/dog/", 1), http.StatusForbidden, "", ""},
+		{"tampered expiry", strings.Replace(signed, "exp=", "exp=9", 1), http.StatusForbidden, "", ""},
+		{"missing signature", strings.Split(signed, "?")[0], http.StatusForbidden, "", ""},
+		{"expired", expired, http.StatusGone, "", ""},
+		{"missing media", missing, http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(tt.url)
+			req := httptest.NewRequest(http.MethodGet, u.RequestURI(), nil)
+			if authorized := proxy.Authorized(req); authorized != (tt.wantStatus == http.StatusOK || tt.wantStatus == http.StatusNotFound) {
+				t.Errorf("Authorized() = %v for status %d", authorized, tt.wantStatus)
+			}
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			body, _ := io.ReadAll(rec.Body)
+			if string(body) != tt.wantBody {
+				t.Errorf("Expected body %q, got %q", tt.wantBody, body)
+			}
+			if cd := rec.Header().Get("Content-Disposition"); cd != tt.wantDisposition {
+				t.Errorf("Expected Content-Disposition %s, got %s", tt.wantDisposition, cd)
+			}
+			if csp := rec.Header().Get("Content-Security-Policy"); csp != "sandbox; default-src 'none'" {
+				t.Errorf("Expected a sandboxing Content-Security-Policy, got %q", csp)
+			}
+		})
+	}
+}
+
+// resign returns signedURL with a different expiry, signed with the proxy's key.
+func resign(t *testing.T, proxy *MediaProxy, signedURL string, expires int64) string {
+	t.Helper()
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", signedURL, err)
+	}
+	query := url.Values{
+		"exp": {strconv.FormatInt(expires, 10)},
+		"sig": {proxy.sign("example.com", "cat", expires)},
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
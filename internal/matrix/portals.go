@@ -4,6 +4,7 @@ package matrix
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	mautrix "maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -17,50 +18,127 @@ type PortalRoom struct {
 	Name         string
 	Topic        string
 	AvatarURL    string
+	Created      bool // True if the room was created by this call
+}
+
+// PortalStore persists the mapping between Viber chats and portal rooms.
+// Implemented by *database.DB.
+type PortalStore interface {
+	GetMatrixRoomID(ctx context.Context, viberChatID string) (string, error)
+	CreateRoomMapping(ctx context.Context, viberChatID, matrixRoomID string) error
 }
 
 // Portals manages Matrix portal rooms for Viber chats.
 type Portals struct {
-	mxClient *mautrix.Client
+	client  *Client
+	store   PortalStore
+	invites []id.UserID // Matrix users invited to every new portal
+
+	locksMu sync.Mutex
+	locks   map[string]*sync.Mutex // Per-chat locks so concurrent messages create one room
 }
 
 // NewPortals creates a new portal manager.
-func NewPortals(mxClient *mautrix.Client) *Portals {
+// invites lists Matrix users (e.g. the bridge operator) invited to every new portal room.
+func NewPortals(client *Client, store PortalStore, invites ...id.UserID) *Portals {
 	return &Portals{
-		mxClient: mxClient,
+		client:  client,
+		store:   store,
+		invites: invites,
+		locks:   make(map[string]*sync.Mutex),
+	}
+}
+
+// chatLock returns the lock guarding portal creation for a Viber chat.
+func (p *Portals) chatLock(viberChatID string) *sync.Mutex {
+	p.locksMu.Lock()
+	defer p.locksMu.Unlock()
+	lock, ok := p.locks[viberChatID]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.locks[viberChatID] = lock
+	}
+	return lock
+}
+
+// GetPortalRoomID returns the portal room for a Viber chat, or "" if none exists yet.
+func (p *Portals) GetPortalRoomID(ctx context.Context, viberChatID string) (id.RoomID, error) {
+	if p.store == nil {
+		return "", fmt.Errorf("portal store not configured")
+	}
+	roomID, err := p.store.GetMatrixRoomID(ctx, viberChatID)
+	if err != nil {
+		return "", fmt.Errorf("get portal room for chat %s: %w", viberChatID, err)
 	}
+	return id.RoomID(roomID), nil
 }
 
-// GetOrCreatePortalRoom gets or creates a Matrix room for a Viber chat.
-func (p *Portals) GetOrCreatePortalRoom(ctx context.Context, viberChatID, name string) (*PortalRoom, error) {
-	if p.mxClient == nil {
+// GetOrCreatePortalRoom returns the Matrix room for a Viber chat, creating it if needed.
+// New rooms are private, DM-style rooms; the chat -> room mapping is persisted
+// before returning so later calls reuse the same room.
+// extraInvites are invited in addition to the configured portal invites (e.g. the sender's ghost).
+func (p *Portals) GetOrCreatePortalRoom(ctx context.Context, viberChatID, name string, extraInvites ...id.UserID) (*PortalRoom, error) {
+	if p.client == nil {
 		return nil, fmt.Errorf("matrix client not configured")
 	}
+	if viberChatID == "" {
+		return nil, fmt.Errorf("viber chat id is empty")
+	}
+
+	lock := p.chatLock(viberChatID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	roomID, err := p.GetPortalRoomID(ctx, viberChatID)
+	if err != nil {
+		return nil, err
+	}
+	if roomID != "" {
+		return &PortalRoom{
+			MatrixRoomID: roomID,
+			ViberChatID:  viberChatID,
+			Name:         name,
+		}, nil
+	}
+
+	invites := make([]id.UserID, 0, len(p.invites)+len(extraInvites))
+	for _, userID := range append(append([]id.UserID{}, p.invites...), extraInvites...) {
+		if userID != "" && userID != p.client.UserID() {
+			invites = append(invites, userID)
+		}
+	}
 
-	// Create room with Viber chat name
 	req := &mautrix.ReqCreateRoom{
-		Name:   name,
-		Topic:  fmt.Sprintf("Viber chat: %s", viberChatID),
-		Preset: "public_chat", // Or "private_chat" based on chat type
+		Visibility: "private",
+		Name:       name,
+		Topic:      fmt.Sprintf("Viber chat: %s", viberChatID),
+		Preset:     "trusted_private_chat",
+		IsDirect:   true,
+		Invite:     invites,
 	}
 
-	resp, err := p.mxClient.CreateRoom(ctx, req)
+	resp, err := p.client.mxClient.CreateRoom(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("create room: %w", err)
 	}
 
+	if err := p.store.CreateRoomMapping(ctx, viberChatID, string(resp.RoomID)); err != nil {
+		return nil, fmt.Errorf("store room mapping for chat %s: %w", viberChatID, err)
+	}
+
 	return &PortalRoom{
 		MatrixRoomID: resp.RoomID,
 		ViberChatID:  viberChatID,
 		Name:         name,
 		Topic:        req.Topic,
+		Created:      true,
 	}, nil
 }
 
 // UpdateRoomMetadata updates room name, topic, or avatar.
 func (p *Portals) UpdateRoomMetadata(ctx context.Context, roomID id.RoomID, name, topic, avatarURL string) error {
 	if name != "" {
-		_, err := p.mxClient.SendStateEvent(ctx, roomID, event.StateRoomName, "", map[string]interface{}{
+		_, err := p.client.mxClient.SendStateEvent(ctx, roomID, event.StateRoomName, "", map[string]interface{}{
 			"name": name,
 		})
 		if err != nil {
@@ -69,7 +147,7 @@ func (p *Portals) UpdateRoomMetadata(ctx context.Context, roomID id.RoomID, name
 	}
 
 	if topic != "" {
-		_, err := p.mxClient.SendStateEvent(ctx, roomID, event.StateTopic, "", map[string]interface{}{
+		_, err := p.client.mxClient.SendStateEvent(ctx, roomID, event.StateTopic, "", map[string]interface{}{
 			"topic": topic,
 		})
 		if err != nil {
@@ -80,7 +158,7 @@ func (p *Portals) UpdateRoomMetadata(ctx context.Context, roomID id.RoomID, name
 	if avatarURL != "" {
 		// Parse avatar URL as ContentURI
 		avatarURI := id.MustParseContentURI(avatarURL)
-		_, err := p.mxClient.SendStateEvent(ctx, roomID, event.StateRoomAvatar, "", map[string]interface{}{
+		_, err := p.client.mxClient.SendStateEvent(ctx, roomID, event.StateRoomAvatar, "", map[string]interface{}{
 			"url": avatarURI.String(),
 		})
 		if err != nil {
@@ -93,7 +171,7 @@ func (p *Portals) UpdateRoomMetadata(ctx context.Context, roomID id.RoomID, name
 
 // InviteGhostUser invites a ghost user to a portal room.
 func (p *Portals) InviteGhostUser(ctx context.Context, roomID id.RoomID, ghostUserID id.UserID) error {
-	_, err := p.mxClient.InviteUser(ctx, roomID, &mautrix.ReqInviteUser{
+	_, err := p.client.mxClient.InviteUser(ctx, roomID, &mautrix.ReqInviteUser{
 		UserID: ghostUserID,
 	})
 	if err != nil {
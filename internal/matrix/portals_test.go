@@ -0,0 +1,92 @@
+// Package matrix portals tests - unit tests for portal room creation.
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	mautrix "maunium.net/go/mautrix"
+)
+
+// memoryPortalStore is an in-memory PortalStore for tests.
+type memoryPortalStore struct {
+	mu    sync.Mutex
+	rooms map[string]string
+}
+
+func (s *memoryPortalStore) GetMatrixRoomID(ctx context.Context, viberChatID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rooms[viberChatID], nil
+}
+
+func (s *memoryPortalStore) CreateRoomMapping(ctx context.Context, viberChatID, matrixRoomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms[viberChatID] = matrixRoomID
+	return nil
+}
+
+func TestGetOrCreatePortalRoom_Idempotent(t *testing.T) {
+	var creates int32
+	var lastReq mautrix.ReqCreateRoom
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/createRoom") {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&creates, 1)
+		_ = json.NewDecoder(r.Body).Decode(&lastReq)
+		_, _ = w.Write([]byte(`{"room_id":"!portal:example.com"}`))
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(Config{
+		HomeserverURL: srv.URL,
+		AccessToken:   "token",
+		UserID:        "@bridge:example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	store := &memoryPortalStore{rooms: make(map[string]string)}
+	portals := NewPortals(client, store, "@admin:example.com")
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			room, err := portals.GetOrCreatePortalRoom(ctx, "viber_user_1", "Viber User")
+			if err != nil {
+				t.Errorf("GetOrCreatePortalRoom() error = %v", err)
+				return
+			}
+			if room.MatrixRoomID != "!portal:example.com" {
+				t.Errorf("Expected room '!portal:example.com', got '%s'", room.MatrixRoomID)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if creates != 1 {
+		t.Errorf("Expected exactly 1 room creation, got %d", creates)
+	}
+	if store.rooms["viber_user_1"] != "!portal:example.com" {
+		t.Error("Room mapping was not persisted")
+	}
+	if lastReq.Preset != "trusted_private_chat" || !lastReq.IsDirect || lastReq.Visibility != "private" {
+		t.Errorf("Expected private DM-style room, got preset=%q is_direct=%v visibility=%q", lastReq.Preset, lastReq.IsDirect, lastReq.Visibility)
+	}
+	if len(lastReq.Invite) != 1 || lastReq.Invite[0] != "@admin:example.com" {
+		t.Errorf("Expected configured invite, got %v", lastReq.Invite)
+	}
+}
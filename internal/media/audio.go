@@ -0,0 +1,207 @@
+// Package media audio reads the duration and waveform of voice messages.
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// WaveformLength is the number of values in generated waveforms.
+	WaveformLength = 100
+	// WaveformMax is the largest waveform value, as used by MSC3246 voice messages.
+	WaveformMax = 1024
+)
+
+// oggHeaderSize is the size of an Ogg page header without its segment table.
+const oggHeaderSize = 27
+
+// opusGranuleRate is the rate of Ogg Opus granule positions, whatever the input sample rate.
+const opusGranuleRate = 48000
+
+// ErrUnsupportedAudio indicates audio is not in a format AnalyzeAudio reads.
+var ErrUnsupportedAudio = errors.New("unsupported audio format")
+
+// AudioInfo describes an audio file.
+type AudioInfo struct {
+	MimeType string // e.g. "audio/ogg"
+	Duration time.Duration
+	Waveform []int // Up to WaveformLength values from 0 to WaveformMax, scaled to the loudest part; nil when unknown
+}
+
+// AnalyzeAudio returns the duration of Ogg (Opus or Vorbis) or 16-bit PCM WAV audio, and the
+// waveform of WAV audio. Ogg audio is not decoded, so it has no waveform; decode it to WAV
+// (e.g. with a Transcoder) to measure one.
+func AnalyzeAudio(data []byte) (*AudioInfo, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return analyzeOgg(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return analyzeWAV(data)
+	default:
+		return nil, ErrUnsupportedAudio
+	}
+}
+
+// analyzeOgg reads the duration of the first logical stream of an Ogg file. Truncated files
+// are read up to their last complete page.
+func analyzeOgg(data []byte) (*AudioInfo, error) {
+	var (
+		packets [][]byte
+		partial []byte
+		granule int64
+		serial  uint32
+	)
+	for page := 0; len(data) >= oggHeaderSize && string(data[:4]) == "OggS"; page++ {
+		header := data[:oggHeaderSize]
+		segments := int(header[26])
+		if len(data) < oggHeaderSize+segments {
+			break
+		}
+		table := data[oggHeaderSize : oggHeaderSize+segments]
+		body := data[oggHeaderSize+segments:]
+		var length int
+		for _, s := range table {
+			length += int(s)
+		}
+		if len(body) < length {
+			break
+		}
+		data = body[length:]
+
+		pageSerial := binary.LittleEndian.Uint32(header[14:18])
+		if page == 0 {
+			serial = pageSerial
+		} else if pageSerial != serial {
+			continue // Another multiplexed stream
+		}
+		// -1 marks pages on which no packet ends
+		if g := int64(binary.LittleEndian.Uint64(header[6:14])); g >= 0 {
+			granule = g
+		}
+		// Packets span segments; a segment shorter than 255 bytes ends one
+		var offset int
+		for _, s := range table {
+			partial = append(partial, body[offset:offset+int(s)]...)
+			offset += int(s)
+			if s < 255 {
+				packets = append(packets, partial)
+				partial = nil
+			}
+		}
+	}
+	if len(packets) == 0 {
+		return nil, fmt.Errorf("%w: no ogg packets", ErrUnsupportedAudio)
+	}
+
+	var rate, skip int64
+	switch head := packets[0]; {
+	case bytes.HasPrefix(head, []byte("OpusHead")) && len(head) >= 19:
+		rate = opusGranuleRate
+		skip = int64(binary.LittleEndian.Uint16(head[10:12]))
+	case bytes.HasPrefix(head, []byte("\x01vorbis")) && len(head) >= 16:
+		rate = int64(binary.LittleEndian.Uint32(head[12:16]))
+	default:
+		return nil, fmt.Errorf("%w: unknown ogg codec", ErrUnsupportedAudio)
+	}
+	if rate <= 0 {
+		return nil, fmt.Errorf("%w: invalid sample rate", ErrUnsupportedAudio)
+	}
+
+	info := &AudioInfo{MimeType: "audio/ogg"}
+	if samples := granule - skip; samples > 0 {
+		info.Duration = time.Duration(samples) * time.Second / time.Duration(rate)
+	}
+	return info, nil
+}
+
+// analyzeWAV reads a RIFF WAVE file of 16-bit PCM samples.
+func analyzeWAV(data []byte) (*AudioInfo, error) {
+	var (
+		format, channels, bits uint16
+		rate                   uint32
+		pcm                    []byte
+		haveFormat             bool
+	)
+	for offset := 12; offset+8 <= len(data); {
+		chunk := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		body := data[offset+8:]
+		if size < 0 || size > len(body) {
+			size = len(body) // Truncated or still being written
+		}
+		switch chunk {
+		case "fmt ":
+			if size < 16 {
+				return nil, fmt.Errorf("%w: short wav format chunk", ErrUnsupportedAudio)
+			}
+			format = binary.LittleEndian.Uint16(body[0:2])
+			channels = binary.LittleEndian.Uint16(body[2:4])
+			rate = binary.LittleEndian.Uint32(body[4:8])
+			bits = binary.LittleEndian.Uint16(body[14:16])
+			haveFormat = true
+		case "data":
+			pcm = body[:size]
+		}
+		offset += 8 + size + size&1 // Chunks are padded to an even size
+	}
+	if !haveFormat || pcm == nil {
+		return nil, fmt.Errorf("%w: wav without format or data", ErrUnsupportedAudio)
+	}
+	// 0xFFFE is WAVE_FORMAT_EXTENSIBLE, which wraps PCM in most files using it
+	if (format != 1 && format != 0xFFFE) || bits != 16 || channels == 0 || rate == 0 {
+		return nil, fmt.Errorf("%w: wav format %d with %d-bit samples", ErrUnsupportedAudio, format, bits)
+	}
+
+	frames := len(pcm) / (2 * int(channels))
+	return &AudioInfo{
+		MimeType: "audio/wav",
+		Duration: time.Duration(frames) * time.Second / time.Duration(rate),
+		Waveform: WaveformFromPCM(pcm, int(channels)),
+	}, nil
+}
+
+// WaveformFromPCM returns the waveform of interleaved signed 16-bit little-endian PCM samples:
+// the loudness (RMS) of up to WaveformLength equal parts, scaled so the loudest is WaveformMax.
+func WaveformFromPCM(pcm []byte, channels int) []int {
+	if channels < 1 {
+		channels = 1
+	}
+	frameSize := 2 * channels
+	frames := len(pcm) / frameSize
+	if frames == 0 {
+		return nil
+	}
+	n := min(frames, WaveformLength)
+	levels := make([]float64, n)
+	for i := range levels {
+		start, end := i*frames/n, (i+1)*frames/n
+		var sum float64
+		for j := start * frameSize; j < end*frameSize; j += 2 {
+			v := float64(int16(binary.LittleEndian.Uint16(pcm[j:])))
+			sum += v * v
+		}
+		levels[i] = math.Sqrt(sum / float64((end-start)*channels))
+	}
+	return normalizeWaveform(levels)
+}
+
+// normalizeWaveform scales levels so the loudest is WaveformMax. Silence stays all zeros.
+func normalizeWaveform(levels []float64) []int {
+	var peak float64
+	for _, l := range levels {
+		peak = max(peak, l)
+	}
+	waveform := make([]int, len(levels))
+	if peak == 0 {
+		return waveform
+	}
+	for i, l := range levels {
+		waveform[i] = int(math.Round(l / peak * WaveformMax))
+	}
+	return waveform
+}
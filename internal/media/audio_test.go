@@ -0,0 +1,159 @@
+// Package media tests - unit tests for voice message analysis.
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// TestAnalyzeAudio tests durations of Ogg and WAV audio and waveforms of WAV audio.
+func TestAnalyzeAudio(t *testing.T) {
+	// 2.5 s of Opus in 20 ms packets, with a packet spanning two segments
+	opusHead := append([]byte("OpusHead\x01\x01"), 0x38, 0x01) // Pre-skip 312
+	opusHead = append(opusHead, make([]byte, 7)...)
+	audio := make([][]byte, 125)
+	for i := range audio {
+		audio[i] = make([]byte, 10+i*3) // Up to 382 bytes
+	}
+	opus := append(oggPage(1, 0, opusHead), oggPage(1, 0, []byte("OpusTags"))...)
+	opus = append(opus, oggPage(1, 120000+312, audio...)...)
+
+	vorbisHead := append([]byte("\x01vorbis"), 0, 0, 0, 0, 1, 0x44, 0xAC, 0, 0) // Mono, 44.1 kHz
+	vorbis := append(oggPage(7, 0, vorbisHead), oggPage(7, 0, []byte("\x03vorbis"), []byte("\x05vorbis"))...)
+	vorbis = append(vorbis, oggPage(7, 88200, []byte("ab"), []byte("abcd"))...)
+
+	tests := []struct {
+		name         string
+		data         []byte
+		wantErr      error
+		wantMime     string
+		wantDuration time.Duration
+		wantLength   int
+	}{
+		{"ogg opus", opus, nil, "audio/ogg", 2500 * time.Millisecond, 0},
+		{"ogg vorbis", vorbis, nil, "audio/ogg", 2 * time.Second, 0},
+		{"wav", wav(8000, 3*8000, 1), nil, "audio/wav", 3 * time.Second, WaveformLength},
+		{"short stereo wav", wav(8000, 40, 2), nil, "audio/wav", 5 * time.Millisecond, 40},
+		{"truncated ogg", opus[:len(opus)-10], nil, "audio/ogg", 0, 0},
+		{"mp3", []byte("ID3\x04\x00"), ErrUnsupportedAudio, "", 0, 0},
+		{"ogg flac", oggPage(1, 0, []byte("\x7fFLAC")), ErrUnsupportedAudio, "", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := AnalyzeAudio(tt.data)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("AnalyzeAudio() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AnalyzeAudio() error = %v", err)
+			}
+			if info.MimeType != tt.wantMime || info.Duration != tt.wantDuration {
+				t.Errorf("Expected %s of %v, got %s of %v", tt.wantMime, tt.wantDuration, info.MimeType, info.Duration)
+			}
+			if len(info.Waveform) != tt.wantLength {
+				t.Fatalf("Expected %d waveform values, got %d", tt.wantLength, len(info.Waveform))
+			}
+			if tt.wantLength == 0 {
+				return
+			}
+			// All test WAV audio grows louder towards the end
+			for i := 1; i < len(info.Waveform); i++ {
+				if info.Waveform[i] < info.Waveform[i-1] {
+					t.Fatalf("Expected a rising waveform, got %v", info.Waveform)
+				}
+			}
+			if last := info.Waveform[len(info.Waveform)-1]; last != WaveformMax {
+				t.Errorf("Expected the loudest value to be %d, got %d", WaveformMax, last)
+			}
+		})
+	}
+}
+
+// TestWaveformFromPCM tests waveform levels of PCM samples.
+func TestWaveformFromPCM(t *testing.T) {
+	if got := WaveformFromPCM(nil, 1); got != nil {
+		t.Errorf("Expected no waveform for no samples, got %v", got)
+	}
+	silence := WaveformFromPCM(make([]byte, 2000), 1)
+	for _, v := range silence {
+		if v != 0 {
+			t.Fatalf("Expected silence to be all zeros, got %v", silence)
+		}
+	}
+
+	// A loud half followed by a half at a quarter of the amplitude
+	var pcm bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		amplitude := 20000.0
+		if i >= 500 {
+			amplitude /= 4
+		}
+		sample := int16(amplitude * math.Sin(float64(i)))
+		_ = binary.Write(&pcm, binary.LittleEndian, sample)
+	}
+	waveform := WaveformFromPCM(pcm.Bytes(), 1)
+	if len(waveform) != WaveformLength {
+		t.Fatalf("Expected %d values, got %d", WaveformLength, len(waveform))
+	}
+	loud, quiet := waveform[10], waveform[90]
+	if loud < 900 || quiet < 200 || quiet > 320 {
+		t.Errorf("Expected loud values near %d and quiet ones near a quarter of that, got %d and %d", WaveformMax, loud, quiet)
+	}
+}
+
+// oggPage returns an Ogg page of the stream serial with the given packets.
+// The checksum is not set, as it is not verified.
+func oggPage(serial uint32, granule int64, packets ...[]byte) []byte {
+	var table, body []byte
+	for _, p := range packets {
+		for n := len(p); ; n -= 255 {
+			if n < 255 {
+				table = append(table, byte(n))
+				break
+			}
+			table = append(table, 255)
+		}
+		body = append(body, p...)
+	}
+	header := make([]byte, oggHeaderSize)
+	copy(header, "OggS")
+	binary.LittleEndian.PutUint64(header[6:14], uint64(granule))
+	binary.LittleEndian.PutUint32(header[14:18], serial)
+	header[26] = byte(len(table))
+	return append(append(header, table...), body...)
+}
+
+// wav returns a 16-bit PCM WAV file of a square wave growing linearly louder.
+func wav(rate, frames, channels int) []byte {
+	var pcm bytes.Buffer
+	for i := 0; i < frames; i++ {
+		sample := int16((i + 1) * 30000 / frames)
+		if i%2 == 1 {
+			sample = -sample
+		}
+		for c := 0; c < channels; c++ {
+			_ = binary.Write(&pcm, binary.LittleEndian, sample)
+		}
+	}
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(36+pcm.Len()))
+	b.WriteString("WAVEfmt ")
+	for _, field := range []any{
+		uint32(16), uint16(1), uint16(channels), uint32(rate),
+		uint32(rate * channels * 2), uint16(channels * 2), uint16(16),
+	} {
+		_ = binary.Write(&b, binary.LittleEndian, field)
+	}
+	b.WriteString("data")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(pcm.Len()))
+	b.Write(pcm.Bytes())
+	return b.Bytes()
+}
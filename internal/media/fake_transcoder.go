@@ -0,0 +1,86 @@
+// Package media fake_transcoder is an in-process Transcoder for tests.
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FakeTranscoder is a Transcoder for tests that runs no executables. Transcoding to
+// "audio/wav" returns Output when set and otherwise one second of silence, so the result
+// can be analyzed; other conversions return Output. Err, when set, fails every operation.
+type FakeTranscoder struct {
+	Caps         []Capability
+	Output       []byte        // Result of Transcode
+	ThumbnailJPG []byte        // Result of Thumbnail
+	MediaLength  time.Duration // Result of Duration
+	Err          error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+// Capabilities returns Caps.
+func (f *FakeTranscoder) Capabilities() []Capability {
+	return slices.Clone(f.Caps)
+}
+
+// Calls returns the operations performed so far, e.g. "transcode audio/ogg audio/mp4".
+func (f *FakeTranscoder) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+// Transcode returns Output, or silence for "audio/wav".
+func (f *FakeTranscoder) Transcode(_ context.Context, _ []byte, fromMime, toMime string) ([]byte, error) {
+	if err := f.record(TranscodeTo(toMime), "transcode %s %s", fromMime, toMime); err != nil {
+		return nil, err
+	}
+	if toMime == "audio/wav" && f.Output == nil {
+		return silentWAV(time.Second), nil
+	}
+	return f.Output, nil
+}
+
+// Thumbnail returns ThumbnailJPG.
+func (f *FakeTranscoder) Thumbnail(_ context.Context, _ []byte, mimeType string) ([]byte, error) {
+	if err := f.record(CapabilityThumbnail, "thumbnail %s", mimeType); err != nil {
+		return nil, err
+	}
+	return f.ThumbnailJPG, nil
+}
+
+// Duration returns MediaLength.
+func (f *FakeTranscoder) Duration(_ context.Context, _ []byte, mimeType string) (time.Duration, error) {
+	if err := f.record(CapabilityDuration, "duration %s", mimeType); err != nil {
+		return 0, err
+	}
+	return f.MediaLength, nil
+}
+
+// record notes an operation and returns the error it should fail with.
+func (f *FakeTranscoder) record(capability Capability, format string, args ...any) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+	f.mu.Unlock()
+	if !slices.Contains(f.Caps, capability) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, capability)
+	}
+	return f.Err
+}
+
+// silentWAV returns a mono 16 kHz WAV file of silence, as FFmpeg decodes audio to.
+func silentWAV(length time.Duration) []byte {
+	const rate = 16000
+	samples := int(length.Seconds() * rate)
+	header := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00" +
+		"\x80\x3e\x00\x00\x00\x7d\x00\x00\x02\x00\x10\x00data\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+2*samples))
+	binary.LittleEndian.PutUint32(header[40:], uint32(2*samples))
+	return append(header, make([]byte, 2*samples)...)
+}
@@ -0,0 +1,245 @@
+// Package media ffmpeg implements Transcoder by running the ffmpeg and ffprobe executables.
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// detectTimeout bounds the ffmpeg run that lists its encoders.
+const detectTimeout = 10 * time.Second
+
+// runTimeout bounds each ffmpeg or ffprobe run on media, whatever the caller's deadline.
+const runTimeout = 2 * time.Minute
+
+// thumbnailEncoder is the ffmpeg encoder of video thumbnails.
+const thumbnailEncoder = "mjpeg"
+
+// ffmpegFormat is an audio format ffmpeg converts to.
+type ffmpegFormat struct {
+	encoder string   // Encoder the ffmpeg build needs
+	args    []string // Output options
+}
+
+// ffmpegFormats are the audio formats FFmpeg converts to, by MIME type.
+var ffmpegFormats = map[string]ffmpegFormat{
+	"audio/mp4":  {"aac", []string{"-c:a", "aac", "-b:a", "64k", "-movflags", "+faststart", "-f", "mp4"}},
+	"audio/mpeg": {"libmp3lame", []string{"-c:a", "libmp3lame", "-b:a", "64k", "-f", "mp3"}},
+	"audio/ogg":  {"libopus", []string{"-c:a", "libopus", "-b:a", "32k", "-f", "ogg"}},
+	// Mono 16 kHz is plenty for speech and keeps decoded voice messages small
+	"audio/wav": {"pcm_s16le", []string{"-ac", "1", "-ar", "16000", "-c:a", "pcm_s16le", "-f", "wav"}},
+}
+
+// ffmpegDemuxers are the input formats ffmpeg may read, by MIME type. Inputs are untrusted, so
+// the demuxer is never auto-detected: a playlist or concat script posing as media would
+// otherwise make ffmpeg read local files or fetch URLs and render them into its output.
+var ffmpegDemuxers = map[string]string{
+	"application/ogg":  "ogg",
+	"audio/ogg":        "ogg",
+	"audio/opus":       "ogg",
+	"video/ogg":        "ogg",
+	"audio/mp4":        "mov",
+	"audio/x-m4a":      "mov",
+	"video/mp4":        "mov",
+	"video/quicktime":  "mov",
+	"video/3gpp":       "mov",
+	"audio/webm":       "matroska",
+	"video/webm":       "matroska",
+	"video/x-matroska": "matroska",
+	"audio/wav":        "wav",
+	"audio/wave":       "wav",
+	"audio/x-wav":      "wav",
+	"audio/mpeg":       "mp3",
+	"audio/aac":        "aac",
+}
+
+// FFmpeg is a Transcoder that runs ffmpeg, and ffprobe for durations.
+type FFmpeg struct {
+	ffmpegPath   string
+	ffprobePath  string // Empty when ffprobe is not installed
+	capabilities []Capability
+}
+
+// DetectFFmpeg finds ffmpeg, and ffprobe if installed, on PATH and discovers which
+// conversions the ffmpeg build has encoders for.
+func DetectFFmpeg(ctx context.Context) (*FFmpeg, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("find ffmpeg: %w", err)
+	}
+	f := &FFmpeg{ffmpegPath: ffmpegPath}
+	if ffprobePath, err := exec.LookPath("ffprobe"); err == nil {
+		f.ffprobePath = ffprobePath
+		f.capabilities = append(f.capabilities, CapabilityDuration)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, detectTimeout)
+	defer cancel()
+	out, err := run(ctx, ffmpegPath, "-hide_banner", "-encoders")
+	if err != nil {
+		return nil, fmt.Errorf("list ffmpeg encoders: %w", err)
+	}
+	encoders := parseEncoders(out)
+	if encoders[thumbnailEncoder] {
+		f.capabilities = append(f.capabilities, CapabilityThumbnail)
+	}
+	for mimeType, format := range ffmpegFormats {
+		if encoders[format.encoder] {
+			f.capabilities = append(f.capabilities, TranscodeTo(mimeType))
+		}
+	}
+	slices.Sort(f.capabilities)
+	return f, nil
+}
+
+// parseEncoders returns the encoder names listed by "ffmpeg -encoders", whose lines after
+// the " ------" separator look like " A....D aac    AAC (Advanced Audio Coding)".
+func parseEncoders(out []byte) map[string]bool {
+	encoders := make(map[string]bool)
+	listing := false
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if !listing {
+			listing = len(fields) == 1 && strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders
+}
+
+// Capabilities lists the conversions found by DetectFFmpeg.
+func (f *FFmpeg) Capabilities() []Capability {
+	return slices.Clone(f.capabilities)
+}
+
+// Transcode converts audio to toMime, dropping any video stream.
+func (f *FFmpeg) Transcode(ctx context.Context, data []byte, fromMime, toMime string) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(toMime)
+	format, ok := ffmpegFormats[mediaType]
+	if !ok || !Supports(f, TranscodeTo(mediaType)) {
+		return nil, fmt.Errorf("%w: transcode %s to %s", ErrUnsupported, fromMime, toMime)
+	}
+	return f.convert(ctx, data, fromMime, append([]string{"-vn"}, format.args...))
+}
+
+// Thumbnail returns the first frame of a video as a JPEG.
+func (f *FFmpeg) Thumbnail(ctx context.Context, data []byte, mimeType string) ([]byte, error) {
+	if !Supports(f, CapabilityThumbnail) {
+		return nil, fmt.Errorf("%w: thumbnail of %s", ErrUnsupported, mimeType)
+	}
+	scale := fmt.Sprintf("scale=w='min(%d,iw)':h='min(%d,ih)':force_original_aspect_ratio=decrease",
+		ThumbnailMaxWidth, ThumbnailMaxHeight)
+	return f.convert(ctx, data, mimeType, []string{"-an", "-frames:v", "1", "-vf", scale, "-c:v", thumbnailEncoder, "-f", "mjpeg"})
+}
+
+// Duration returns the duration ffprobe reads from the container.
+func (f *FFmpeg) Duration(ctx context.Context, data []byte, mimeType string) (time.Duration, error) {
+	if f.ffprobePath == "" {
+		return 0, fmt.Errorf("%w: duration of %s", ErrUnsupported, mimeType)
+	}
+	inputArgs, err := demuxerArgs(mimeType)
+	if err != nil {
+		return 0, err
+	}
+	var out []byte
+	err = withTempDir(func(dir string) error {
+		input := filepath.Join(dir, "input")
+		if err := os.WriteFile(input, data, 0o600); err != nil {
+			return fmt.Errorf("write ffprobe input: %w", err)
+		}
+		args := append([]string{"-v", "error"}, inputArgs...)
+		args = append(args, "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", input)
+		var err error
+		out, err = run(ctx, f.ffprobePath, args...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("parse ffprobe duration %q", strings.TrimSpace(string(out)))
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// demuxerArgs returns the input options that pin the demuxer of mimeType and limit ffmpeg
+// to reading the local input file. MIME types without a known demuxer are refused.
+func demuxerArgs(mimeType string) ([]string, error) {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	demuxer, ok := ffmpegDemuxers[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("%w: input of type %q", ErrUnsupported, mimeType)
+	}
+	return []string{"-f", demuxer, "-protocol_whitelist", "file"}, nil
+}
+
+// convert runs ffmpeg on data of type mimeType with the given output options and returns its
+// output. Input and output go through files, since MP4 needs seekable input and output.
+func (f *FFmpeg) convert(ctx context.Context, data []byte, mimeType string, outputArgs []string) ([]byte, error) {
+	inputArgs, err := demuxerArgs(mimeType)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	err = withTempDir(func(dir string) error {
+		input, output := filepath.Join(dir, "input"), filepath.Join(dir, "output")
+		if err := os.WriteFile(input, data, 0o600); err != nil {
+			return fmt.Errorf("write ffmpeg input: %w", err)
+		}
+		args := append([]string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y"}, inputArgs...)
+		args = append(append(args, "-i", input), outputArgs...)
+		if _, err := run(ctx, f.ffmpegPath, append(args, output)...); err != nil {
+			return err
+		}
+		var err error
+		out, err = os.ReadFile(output)
+		if err != nil {
+			return fmt.Errorf("read ffmpeg output: %w", err)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// withTempDir calls fn with a new temporary directory, which is removed afterwards.
+func withTempDir(fn func(dir string) error) error {
+	dir, err := os.MkdirTemp("", "mautrix-viber-media-")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	return fn(dir)
+}
+
+// run runs an executable for at most runTimeout and returns its standard output. Errors carry
+// the last line the executable wrote to standard error, which is where ffmpeg explains failures.
+func run(ctx context.Context, path string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, runTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		name := filepath.Base(path)
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+			return nil, fmt.Errorf("%s: %w: %s", name, err, last)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return out, nil
+}
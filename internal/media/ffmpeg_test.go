@@ -0,0 +1,113 @@
+// Package media tests - unit tests for the ffmpeg transcoder.
+package media
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg stands in for ffmpeg: it lists a few encoders and writes its arguments to the
+// output file, failing on inputs that start with "broken". Like the real ffmpeg, it follows
+// HLS playlists only when the demuxer is auto-detected, and then leaks the files they name.
+const fakeFFmpeg = `#!/bin/sh
+if [ "$2" = "-encoders" ]; then
+	printf 'Encoders:\n V..... = Video\n ------\n V....D mjpeg    MJPEG\n A....D aac      AAC\n A....D pcm_s16le PCM\n'
+	exit 0
+fi
+for arg; do
+	[ "$prev" = "-i" ] && input=$arg
+	[ "$prev" = "-f" ] && [ -z "$input" ] && demuxer=$arg
+	prev=$arg
+	output=$arg
+done
+read -r first < "$input"
+case "$first" in
+broken*)
+	echo "$input: Invalid data found when processing input" >&2
+	exit 1;;
+"#EXTM3U")
+	if [ -n "$demuxer" ]; then
+		echo "$input: Invalid data found when processing input" >&2
+		exit 1
+	fi
+	echo "root:x:0:0:root:/root:/bin/sh" > "$output"
+	exit 0;;
+esac
+echo "$@" > "$output"
+`
+
+// TestFFmpeg tests capability discovery and the ffmpeg and ffprobe invocations.
+func TestFFmpeg(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake executables are shell scripts")
+	}
+	dir := t.TempDir()
+	writeScript(t, dir, "ffmpeg", fakeFFmpeg)
+	writeScript(t, dir, "ffprobe", `#!/bin/sh
+case " $* " in
+*" -f mov -protocol_whitelist file "*) echo 3.500000;;
+*) echo "unpinned input demuxer" >&2; exit 1;;
+esac
+`)
+	t.Setenv("PATH", dir)
+	ctx := context.Background()
+
+	f, err := DetectFFmpeg(ctx)
+	if err != nil {
+		t.Fatalf("DetectFFmpeg() error = %v", err)
+	}
+	wantCaps := []Capability{CapabilityDuration, CapabilityThumbnail, TranscodeTo("audio/mp4"), TranscodeTo("audio/wav")}
+	if caps := f.Capabilities(); !slices.Equal(caps, wantCaps) {
+		t.Errorf("Expected capabilities %v, got %v", wantCaps, caps)
+	}
+
+	out, err := f.Transcode(ctx, []byte("voice"), "audio/ogg; codecs=opus", "audio/mp4")
+	if err != nil || !strings.Contains(string(out), "-f ogg -protocol_whitelist file -i") || !strings.Contains(string(out), "-vn -c:a aac") {
+		t.Errorf("Expected an aac transcode of pinned ogg input, got %q (err %v)", out, err)
+	}
+	if _, err := f.Transcode(ctx, []byte("voice"), "audio/mp4", "audio/ogg"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected ErrUnsupported without libopus, got %v", err)
+	}
+	if _, err := f.Transcode(ctx, []byte("broken voice"), "audio/ogg", "audio/mp4"); err == nil || !strings.Contains(err.Error(), "Invalid data") {
+		t.Errorf("Expected ffmpeg's error message, got %v", err)
+	}
+	out, err = f.Thumbnail(ctx, []byte("video"), "video/mp4")
+	if err != nil || !strings.Contains(string(out), "-frames:v 1") {
+		t.Errorf("Expected a single frame thumbnail, got %q (err %v)", out, err)
+	}
+	if length, err := f.Duration(ctx, []byte("video"), "video/mp4"); err != nil || length != 3500*time.Millisecond {
+		t.Errorf("Expected 3.5s, got %v (err %v)", length, err)
+	}
+
+	// Playlists must never be parsed, whether declared as such or posing as a video
+	playlist := []byte("#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:10.0,\nfile:///etc/passwd\n#EXT-X-ENDLIST\n")
+	if _, err := f.Thumbnail(ctx, playlist, "application/vnd.apple.mpegurl"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected ErrUnsupported for a playlist, got %v", err)
+	}
+	if _, err := f.Duration(ctx, playlist, "application/x-mpegurl"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected ErrUnsupported for a playlist duration, got %v", err)
+	}
+	if out, err := f.Thumbnail(ctx, playlist, "video/mp4"); err == nil {
+		t.Errorf("Expected a playlist posing as mp4 to be rejected, got %q", out)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if _, err := DetectFFmpeg(ctx); err == nil {
+		t.Error("Expected an error without ffmpeg on PATH")
+	}
+}
+
+// writeScript writes an executable script.
+func writeScript(t *testing.T, dir, name, script string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
@@ -0,0 +1,157 @@
+// Package media inspects and converts media bridged between Viber and Matrix.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	// Register decoders for the formats Viber sends
+	_ "image/gif"
+)
+
+const (
+	// ThumbnailMaxWidth and ThumbnailMaxHeight bound generated thumbnails,
+	// matching the largest thumbnail size homeservers generate by default.
+	ThumbnailMaxWidth  = 800
+	ThumbnailMaxHeight = 600
+	// MaxImagePixels is the largest image that is decoded, to guard against decompression bombs.
+	// About 16 megapixels covers what phone cameras save by default, and keeps the decoded image
+	// and its RGBA copy below 100 MiB.
+	MaxImagePixels = 16 << 20
+)
+
+// thumbnailQuality is the JPEG quality of generated thumbnails.
+const thumbnailQuality = 80
+
+// blurhashSize is the size images are reduced to before computing their blurhash.
+const blurhashSize = 32
+
+// Blurhash components of generated hashes, a common choice for landscape and portrait images alike.
+const (
+	blurhashXComponents = 4
+	blurhashYComponents = 3
+)
+
+// ErrImageTooLarge indicates an image has more pixels than MaxImagePixels.
+var ErrImageTooLarge = errors.New("image too large to decode")
+
+// ImageInfo describes an image and carries a thumbnail for it.
+type ImageInfo struct {
+	Width    int
+	Height   int
+	MimeType string // e.g. "image/jpeg"
+
+	Thumbnail         []byte // JPEG, or PNG when the image has transparency
+	ThumbnailMimeType string
+	ThumbnailWidth    int
+	ThumbnailHeight   int
+
+	Blurhash string
+}
+
+// AnalyzeImage decodes a JPEG, PNG or GIF image (the first frame of animations) and returns
+// its dimensions, a thumbnail that fits ThumbnailMaxWidth×ThumbnailMaxHeight and its blurhash.
+func AnalyzeImage(data []byte) (*ImageInfo, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode image config: %w", err)
+	}
+	if cfg.Width*cfg.Height > MaxImagePixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+
+	src := toRGBA(img)
+	info := &ImageInfo{
+		Width:    src.Bounds().Dx(),
+		Height:   src.Bounds().Dy(),
+		MimeType: "image/" + format,
+	}
+
+	thumbWidth, thumbHeight := fit(info.Width, info.Height, ThumbnailMaxWidth, ThumbnailMaxHeight)
+	thumb := Scale(src, thumbWidth, thumbHeight)
+	var buf bytes.Buffer
+	if thumb.Opaque() {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailQuality})
+		info.ThumbnailMimeType = "image/jpeg"
+	} else {
+		err = png.Encode(&buf, thumb)
+		info.ThumbnailMimeType = "image/png"
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encode thumbnail: %w", err)
+	}
+	info.Thumbnail = buf.Bytes()
+	info.ThumbnailWidth, info.ThumbnailHeight = thumbWidth, thumbHeight
+
+	hashWidth, hashHeight := fit(thumbWidth, thumbHeight, blurhashSize, blurhashSize)
+	info.Blurhash, err = Blurhash(Scale(thumb, hashWidth, hashHeight), blurhashXComponents, blurhashYComponents)
+	if err != nil {
+		return nil, fmt.Errorf("compute blurhash: %w", err)
+	}
+	return info, nil
+}
+
+// fit returns the largest size with the aspect ratio of width×height that fits maxWidth×maxHeight.
+// Images are never enlarged, and no side is shrunk below one pixel.
+func fit(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+	if width*maxHeight > height*maxWidth {
+		return maxWidth, max(1, height*maxWidth/width)
+	}
+	return max(1, width*maxHeight/height), maxHeight
+}
+
+// Scale resizes img to width×height by averaging the source pixels covered by each target pixel.
+// This is meant for shrinking; enlarging repeats pixels.
+func Scale(img *image.RGBA, width, height int) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if b.Empty() || width <= 0 || height <= 0 {
+		return dst
+	}
+	for dy := 0; dy < height; dy++ {
+		y0 := b.Min.Y + dy*b.Dy()/height
+		y1 := max(y0+1, b.Min.Y+(dy+1)*b.Dy()/height)
+		for dx := 0; dx < width; dx++ {
+			x0 := b.Min.X + dx*b.Dx()/width
+			x1 := max(x0+1, b.Min.X+(dx+1)*b.Dx()/width)
+
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				row := img.Pix[img.PixOffset(x0, y):img.PixOffset(x1, y)]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					bl += uint64(row[i+2])
+					a += uint64(row[i+3])
+					n++
+				}
+			}
+			dst.SetRGBA(dx, dy, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// toRGBA converts an image to RGBA (alpha-premultiplied) with its origin at 0,0.
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	if rgba, ok := img.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
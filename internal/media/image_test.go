@@ -0,0 +1,194 @@
+// Package media tests - unit tests for image analysis and blurhash.
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// TestAnalyzeImage tests dimensions, thumbnails and blurhashes of decoded images.
+func TestAnalyzeImage(t *testing.T) {
+	opaque := solid(1600, 1200, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+	transparent := solid(300, 600, color.RGBA{})
+
+	tests := []struct {
+		name          string
+		data          []byte
+		wantErr       error
+		wantMime      string
+		wantSize      [2]int
+		wantThumbMime string
+		wantThumbSize [2]int
+	}{
+		{
+			name:          "large jpeg",
+			data:          encode(t, opaque, "jpeg"),
+			wantMime:      "image/jpeg",
+			wantSize:      [2]int{1600, 1200},
+			wantThumbMime: "image/jpeg",
+			wantThumbSize: [2]int{800, 600},
+		},
+		{
+			name:          "small png is not enlarged",
+			data:          encode(t, solid(120, 40, color.RGBA{B: 255, A: 255}), "png"),
+			wantMime:      "image/png",
+			wantSize:      [2]int{120, 40},
+			wantThumbMime: "image/jpeg",
+			wantThumbSize: [2]int{120, 40},
+		},
+		{
+			name:          "transparent png keeps alpha",
+			data:          encode(t, transparent, "png"),
+			wantMime:      "image/png",
+			wantSize:      [2]int{300, 600},
+			wantThumbMime: "image/png",
+			wantThumbSize: [2]int{300, 600},
+		},
+		{
+			name:          "wide gif",
+			data:          encode(t, solid(2000, 100, color.RGBA{G: 255, A: 255}), "gif"),
+			wantMime:      "image/gif",
+			wantSize:      [2]int{2000, 100},
+			wantThumbMime: "image/jpeg",
+			wantThumbSize: [2]int{800, 40},
+		},
+		{name: "not an image", data: []byte("hello"), wantErr: image.ErrFormat},
+		{name: "decompression bomb", data: pngHeader(20000, 20000), wantErr: ErrImageTooLarge},
+		{name: "above pixel limit", data: pngHeader(5000, 4000), wantErr: ErrImageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := AnalyzeImage(tt.data)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AnalyzeImage() error = %v", err)
+			}
+			if info.MimeType != tt.wantMime || [2]int{info.Width, info.Height} != tt.wantSize {
+				t.Errorf("Expected %s %v, got %s %dx%d", tt.wantMime, tt.wantSize, info.MimeType, info.Width, info.Height)
+			}
+			if info.ThumbnailMimeType != tt.wantThumbMime || [2]int{info.ThumbnailWidth, info.ThumbnailHeight} != tt.wantThumbSize {
+				t.Errorf("Expected %s thumbnail %v, got %s %dx%d", tt.wantThumbMime, tt.wantThumbSize,
+					info.ThumbnailMimeType, info.ThumbnailWidth, info.ThumbnailHeight)
+			}
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(info.Thumbnail))
+			if err != nil || "image/"+format != tt.wantThumbMime || cfg.Width != tt.wantThumbSize[0] || cfg.Height != tt.wantThumbSize[1] {
+				t.Errorf("Thumbnail does not match its info: %v %s %+v", err, format, cfg)
+			}
+			if len(info.Blurhash) != 4+2*blurhashXComponents*blurhashYComponents {
+				t.Errorf("Unexpected blurhash %q", info.Blurhash)
+			}
+		})
+	}
+}
+
+// TestBlurhash tests blurhash encoding against properties of the format.
+func TestBlurhash(t *testing.T) {
+	// The DC component of a solid colour is the colour itself, and grey images
+	// have the same AC value in every channel
+	hash, err := Blurhash(solid(8, 8, color.RGBA{R: 255, G: 255, B: 255, A: 255}), 4, 3)
+	if err != nil {
+		t.Fatalf("Blurhash() error = %v", err)
+	}
+	if len(hash) != 4+2*4*3 || hash[0] != base83Chars[3+2*9] || hash[2:6] != "TSUA" {
+		t.Errorf("Unexpected blurhash %s", hash)
+	}
+	for i := 6; i < len(hash); i += 2 {
+		if q := decodeBase83(hash[i : i+2]); q%(19*19+19+1) != 0 {
+			t.Errorf("Expected equal channels in AC component %s of %s", hash[i:i+2], hash)
+		}
+	}
+
+	// A horizontal gradient is dominated by its horizontal component
+	gradient := image.NewRGBA(image.Rect(0, 0, 16, 4))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 4; y++ {
+			gradient.SetRGBA(x, y, color.RGBA{R: uint8(x * 16), G: uint8(x * 16), B: uint8(x * 16), A: 255})
+		}
+	}
+	hash, err = Blurhash(gradient, 2, 2)
+	if err != nil {
+		t.Fatalf("Blurhash() error = %v", err)
+	}
+	if hash[0] != base83Chars[1+1*9] {
+		t.Errorf("Unexpected size flag in %s", hash)
+	}
+	// AC components are (1,0), (0,1) and (1,1); 9 is the quantised zero
+	strength := func(component string) int {
+		q := decodeBase83(component) / (19 * 19)
+		return max(q-9, 9-q)
+	}
+	if horizontal, vertical := strength(hash[6:8]), strength(hash[8:10]); horizontal <= vertical {
+		t.Errorf("Expected the horizontal component to dominate, got %d <= %d in %s", horizontal, vertical, hash)
+	}
+
+	if _, err := Blurhash(gradient, 0, 10); err == nil {
+		t.Error("Expected an error for invalid components")
+	}
+}
+
+// decodeBase83 decodes base83 digits.
+func decodeBase83(s string) int {
+	v := 0
+	for i := 0; i < len(s); i++ {
+		v = v*83 + strings.IndexByte(base83Chars, s[i])
+	}
+	return v
+}
+
+// solid returns a width×height image filled with c.
+func solid(width, height int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+// encode encodes img in format ("jpeg", "png" or "gif").
+func encode(t *testing.T, img image.Image, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// pngHeader returns the start of a PNG file claiming width×height pixels.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 6 // 8-bit RGBA
+
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+	_ = binary.Write(&b, binary.BigEndian, uint32(len(ihdr)-4))
+	b.Write(ihdr)
+	_ = binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return b.Bytes()
+}
@@ -0,0 +1,46 @@
+// Package media transcoder defines the interface of external media converters, such as ffmpeg.
+package media
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// Capability is something a Transcoder can do.
+type Capability string
+
+const (
+	// CapabilityThumbnail is extracting a video frame as a JPEG thumbnail.
+	CapabilityThumbnail Capability = "thumbnail"
+	// CapabilityDuration is reading the duration of audio and video.
+	CapabilityDuration Capability = "duration"
+)
+
+// TranscodeTo returns the capability of converting audio to mimeType, e.g. "audio/mp4".
+func TranscodeTo(mimeType string) Capability {
+	return Capability("transcode:" + mimeType)
+}
+
+// ErrUnsupported indicates a transcoder lacks the capability an operation needs.
+var ErrUnsupported = errors.New("not supported by transcoder")
+
+// Transcoder converts and inspects media that cannot be handled in-process.
+// Callers check Supports before relying on an operation; unsupported operations fail with ErrUnsupported.
+type Transcoder interface {
+	// Capabilities lists what the transcoder can do, as discovered when it was set up.
+	Capabilities() []Capability
+	// Transcode converts audio from one MIME type to another.
+	Transcode(ctx context.Context, data []byte, fromMime, toMime string) ([]byte, error)
+	// Thumbnail returns the first frame of a video as a JPEG that fits
+	// ThumbnailMaxWidth×ThumbnailMaxHeight.
+	Thumbnail(ctx context.Context, data []byte, mimeType string) ([]byte, error)
+	// Duration returns the duration of audio or video.
+	Duration(ctx context.Context, data []byte, mimeType string) (time.Duration, error)
+}
+
+// Supports reports whether t has capability c. A nil transcoder supports nothing.
+func Supports(t Transcoder, c Capability) bool {
+	return t != nil && slices.Contains(t.Capabilities(), c)
+}
@@ -0,0 +1,264 @@
+// Package media vcard writes and reads vCard contact cards (RFC 6350).
+package media
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+)
+
+// VCardMimeType is the MIME type of vCard files.
+const VCardMimeType = "text/vcard"
+
+// vcardLineLength is the longest content line written, in octets, before it is folded.
+const vcardLineLength = 75
+
+// ErrNoVCard indicates data does not contain a vCard.
+var ErrNoVCard = errors.New("no vcard found")
+
+// ErrMultipleVCards indicates data contains more than one vCard.
+var ErrMultipleVCards = errors.New("more than one vcard found")
+
+// Contact is a contact card.
+type Contact struct {
+	Name  string
+	Phone string
+
+	PhotoURL      string // Photo referenced by an http(s) URL
+	Photo         []byte // Photo embedded in the card
+	PhotoMimeType string // MIME type of Photo, when known
+}
+
+// EncodeVCard returns c as a vCard 4.0 file.
+func EncodeVCard(c Contact) []byte {
+	var b bytes.Buffer
+	writeVCardLine(&b, "BEGIN:VCARD")
+	writeVCardLine(&b, "VERSION:4.0")
+	writeVCardLine(&b, "FN:"+escapeVCardText(c.Name))
+	writeVCardLine(&b, "N:"+escapeVCardText(c.Name)+";;;;")
+	if c.Phone != "" {
+		writeVCardLine(&b, "TEL;VALUE=uri;TYPE=cell:tel:"+strings.ReplaceAll(c.Phone, " ", ""))
+	}
+	switch {
+	case c.PhotoURL != "":
+		writeVCardLine(&b, "PHOTO:"+c.PhotoURL)
+	case len(c.Photo) > 0:
+		mimeType := c.PhotoMimeType
+		if mimeType == "" {
+			mimeType = "image/jpeg"
+		}
+		writeVCardLine(&b, "PHOTO:data:"+mimeType+";base64,"+base64.StdEncoding.EncodeToString(c.Photo))
+	}
+	writeVCardLine(&b, "END:VCARD")
+	return b.Bytes()
+}
+
+// writeVCardLine writes a content line, folding it into lines of at most vcardLineLength octets
+// without splitting UTF-8 sequences.
+func writeVCardLine(b *bytes.Buffer, line string) {
+	limit := vcardLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = vcardLineLength - 1 // Continuation lines start with a space
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// escapeVCardText escapes a text value. Line breaks of any style become "\n".
+func escapeVCardText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// unescapeVCardText reverses escapeVCardText.
+func unescapeVCardText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if s[i] == 'n' || s[i] == 'N' {
+			b.WriteByte('\n')
+		} else {
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// ParseVCard returns the contact of a vCard file holding a single card. vCard 2.1, 3.0 and 4.0
+// are accepted, including quoted-printable names and photos embedded as base64 or data: URIs.
+// Files with several cards return ErrMultipleVCards.
+func ParseVCard(data []byte) (*Contact, error) {
+	text := joinSoftLineBreaks(strings.ReplaceAll(string(data), "\r\n", "\n"))
+	// Unfold continuation lines, which start with a space or tab
+	text = strings.NewReplacer("\n ", "", "\n\t", "").Replace(text)
+
+	var (
+		c       Contact
+		inCard  bool
+		found   bool
+		done    bool
+		surname string
+	)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		nameParams, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		params := strings.Split(nameParams, ";")
+		name := strings.ToUpper(params[0])
+		// Properties may be grouped, e.g. "item1.TEL"
+		if _, ungrouped, grouped := strings.Cut(name, "."); grouped {
+			name = ungrouped
+		}
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			if done {
+				return nil, ErrMultipleVCards
+			}
+			inCard, found = true, true
+		case name == "END" && strings.EqualFold(value, "VCARD"):
+			if inCard {
+				if c.Name == "" {
+					c.Name = surname
+				}
+				inCard, done = false, true
+			}
+		case !inCard:
+		case name == "FN":
+			c.Name = unescapeVCardText(decodeVCardValue(params[1:], value))
+		case name == "N":
+			surname = formatStructuredName(decodeVCardValue(params[1:], value))
+		case name == "TEL" && c.Phone == "":
+			c.Phone = strings.TrimPrefix(strings.TrimPrefix(value, "tel:"), "TEL:")
+		case name == "PHOTO" && c.PhotoURL == "" && c.Photo == nil:
+			parsePhoto(&c, params[1:], value)
+		}
+	}
+	if done {
+		return &c, nil
+	}
+	if found {
+		return nil, fmt.Errorf("%w: unterminated vcard", ErrNoVCard)
+	}
+	return nil, ErrNoVCard
+}
+
+// joinSoftLineBreaks joins the lines of vCard 2.1 quoted-printable values, which end
+// with "=" when the value continues on the next line.
+func joinSoftLineBreaks(text string) string {
+	lines := strings.Split(text, "\n")
+	joined := lines[:0]
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if nameParams, _, ok := strings.Cut(line, ":"); ok && strings.Contains(strings.ToUpper(nameParams), "QUOTED-PRINTABLE") {
+			for strings.HasSuffix(line, "=") && i+1 < len(lines) {
+				i++
+				line = line[:len(line)-1] + lines[i]
+			}
+		}
+		joined = append(joined, line)
+	}
+	return strings.Join(joined, "\n")
+}
+
+// decodeVCardValue decodes a vCard 2.1 quoted-printable value ("ENCODING=QUOTED-PRINTABLE",
+// or the bare "QUOTED-PRINTABLE" parameter). Decoded bytes that are not UTF-8 are read as
+// ISO-8859-1, the other charset such cards commonly use. Other values are returned unchanged.
+func decodeVCardValue(params []string, value string) string {
+	quoted := false
+	for _, p := range params {
+		key, val, _ := strings.Cut(p, "=")
+		if strings.EqualFold(key, "QUOTED-PRINTABLE") || (strings.EqualFold(key, "ENCODING") && strings.EqualFold(val, "QUOTED-PRINTABLE")) {
+			quoted = true
+		}
+	}
+	if !quoted {
+		return value
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(value)))
+	if err != nil {
+		return value
+	}
+	if utf8.Valid(decoded) {
+		return string(decoded)
+	}
+	runes := make([]rune, len(decoded))
+	for i, b := range decoded {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// formatStructuredName turns an N value ("Family;Given;Additional;Prefix;Suffix") into a display name.
+func formatStructuredName(value string) string {
+	parts := strings.Split(value, ";")
+	order := []int{3, 1, 2, 0, 4} // Prefix Given Additional Family Suffix
+	var words []string
+	for _, i := range order {
+		if i < len(parts) && parts[i] != "" {
+			words = append(words, unescapeVCardText(parts[i]))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// parsePhoto reads a PHOTO value: an http(s) URL, a data: URI or (vCard 3.0 and older) inline base64.
+func parsePhoto(c *Contact, params []string, value string) {
+	lower := strings.ToLower(value)
+	switch {
+	case strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://"):
+		c.PhotoURL = value
+	case strings.HasPrefix(lower, "data:"):
+		header, payload, ok := strings.Cut(value[len("data:"):], ",")
+		if !ok || !strings.HasSuffix(strings.ToLower(header), ";base64") {
+			return
+		}
+		if photo, err := base64.StdEncoding.DecodeString(payload); err == nil {
+			c.Photo = photo
+			c.PhotoMimeType, _, _ = mime.ParseMediaType(header[:len(header)-len(";base64")])
+		}
+	default:
+		var encoded bool
+		var photoType string
+		for _, p := range params {
+			key, val, _ := strings.Cut(p, "=")
+			switch strings.ToUpper(key) {
+			case "ENCODING":
+				encoded = strings.EqualFold(val, "b") || strings.EqualFold(val, "base64")
+			case "TYPE":
+				photoType = strings.ToLower(val)
+			case "BASE64": // vCard 2.1 bare parameter
+				encoded = true
+			case "JPEG", "PNG", "GIF":
+				photoType = strings.ToLower(key)
+			}
+		}
+		if !encoded {
+			return
+		}
+		if photo, err := base64.StdEncoding.DecodeString(value); err == nil {
+			c.Photo = photo
+			if photoType != "" {
+				c.PhotoMimeType = "image/" + photoType
+			}
+		}
+	}
+}
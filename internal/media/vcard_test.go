@@ -0,0 +1,114 @@
+// Package media tests - unit tests for vCard encoding and parsing.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestEncodeVCard tests that generated vCards are valid 4.0 cards that parse back.
+func TestEncodeVCard(t *testing.T) {
+	contact := Contact{
+		Name:     "Doe, Jane; Sales",
+		Phone:    "+49 30 1234567",
+		PhotoURL: "https://example.com/avatars/" + strings.Repeat("jane", 20) + ".jpg",
+	}
+	data := EncodeVCard(contact)
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\r\n"), "\r\n")
+	if lines[0] != "BEGIN:VCARD" || lines[1] != "VERSION:4.0" || lines[len(lines)-1] != "END:VCARD" {
+		t.Errorf("Unexpected vcard structure:\n%s", data)
+	}
+	for _, line := range lines {
+		if len(line) > vcardLineLength {
+			t.Errorf("Line longer than %d octets: %q", vcardLineLength, line)
+		}
+	}
+	if !bytes.Contains(data, []byte(`FN:Doe\, Jane\; Sales`)) || !bytes.Contains(data, []byte("TEL;VALUE=uri;TYPE=cell:tel:+49301234567")) {
+		t.Errorf("Unexpected vcard properties:\n%s", data)
+	}
+
+	parsed, err := ParseVCard(data)
+	if err != nil {
+		t.Fatalf("ParseVCard() error = %v", err)
+	}
+	if parsed.Name != contact.Name || parsed.Phone != "+49301234567" || parsed.PhotoURL != contact.PhotoURL {
+		t.Errorf("Expected %+v, got %+v", contact, parsed)
+	}
+
+	// Line breaks of any style are escaped, so a lone CR cannot end the content line
+	if data := EncodeVCard(Contact{Name: "Line\rBreak\r\nEnd"}); !bytes.Contains(data, []byte(`FN:Line\nBreak\nEnd`+"\r\n")) {
+		t.Errorf("Expected escaped line breaks, got %q", data)
+	}
+
+	// Embedded photos survive folding
+	photo := bytes.Repeat([]byte{0xff, 0xd8, 0x00}, 100)
+	parsed, err = ParseVCard(EncodeVCard(Contact{Name: "Ünïcødé " + strings.Repeat("ä", 60), Photo: photo, PhotoMimeType: "image/png"}))
+	if err != nil {
+		t.Fatalf("ParseVCard() error = %v", err)
+	}
+	if !bytes.Equal(parsed.Photo, photo) || parsed.PhotoMimeType != "image/png" || parsed.Name != "Ünïcødé "+strings.Repeat("ä", 60) {
+		t.Errorf("Unexpected contact %q %q %d bytes", parsed.Name, parsed.PhotoMimeType, len(parsed.Photo))
+	}
+}
+
+// TestParseVCard tests parsing cards exported by common clients.
+func TestParseVCard(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    Contact
+		wantErr error
+	}{
+		{
+			name: "vcard 3.0 with inline photo",
+			data: "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Smith;John;;Dr.;\r\nFN:John Smith\r\n" +
+				"item1.TEL;type=CELL:+1 555 0100\r\nTEL;TYPE=WORK:+1 555 0199\r\n" +
+				"PHOTO;ENCODING=b;TYPE=JPEG:/9j/\r\n 4AAQ\r\nEND:VCARD\r\n",
+			want: Contact{Name: "John Smith", Phone: "+1 555 0100", Photo: []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10}, PhotoMimeType: "image/jpeg"},
+		},
+		{
+			name: "name from N only",
+			data: "BEGIN:VCARD\nVERSION:2.1\nN:Smith;John;;Dr.;\nTEL;CELL:555\nEND:VCARD\n",
+			want: Contact{Name: "Dr. John Smith", Phone: "555"},
+		},
+		{
+			name: "vcard 2.1 quoted-printable name with soft line break",
+			data: "BEGIN:VCARD\r\nVERSION:2.1\r\nFN;CHARSET=UTF-8;ENCODING=QUOTED-PRINTABLE:=D0=98=D0=B2=D0=B0=D0=BD =\r\n" +
+				"=D0=9F=D0=B5=D1=82=D1=80=D0=BE=D0=B2\r\nTEL;CELL:555\r\nEND:VCARD\r\n",
+			want: Contact{Name: "Иван Петров", Phone: "555"},
+		},
+		{
+			name: "vcard 2.1 quoted-printable latin-1 N",
+			data: "BEGIN:VCARD\nVERSION:2.1\nN;QUOTED-PRINTABLE:M=FCller;J=F6rg;;;\nTEL:555\nEND:VCARD\n",
+			want: Contact{Name: "Jörg Müller", Phone: "555"},
+		},
+		{
+			name:    "several cards",
+			data:    "BEGIN:VCARD\nVERSION:4.0\nFN:First\nEND:VCARD\nBEGIN:VCARD\nVERSION:4.0\nFN:Second\nEND:VCARD\n",
+			wantErr: ErrMultipleVCards,
+		},
+		{name: "not a vcard", data: "hello", wantErr: ErrNoVCard},
+		{name: "unterminated", data: "BEGIN:VCARD\nFN:Jane\n", wantErr: ErrNoVCard},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseVCard([]byte(tt.data))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVCard() error = %v", err)
+			}
+			if got.Name != tt.want.Name || got.Phone != tt.want.Phone || got.PhotoURL != tt.want.PhotoURL ||
+				!bytes.Equal(got.Photo, tt.want.Photo) || got.PhotoMimeType != tt.want.PhotoMimeType {
+				t.Errorf("Expected %+v, got %+v", tt.want, *got)
+			}
+		})
+	}
+}
@@ -54,6 +54,15 @@ var (
 		},
 		[]string{"connection_type"}, // connection_type: matrix_sync, viber_webhook
 	)
+
+	// MediaCacheLookups tracks lookups in the media deduplication cache.
+	MediaCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "viber_media_cache_lookups_total",
+			Help: "Total number of media cache lookups by result",
+		},
+		[]string{"result"}, // result: hit, miss
+	)
 )
 
 func init() {
@@ -62,6 +71,7 @@ func init() {
 	prometheus.MustRegister(ErrorRate)
 	prometheus.MustRegister(OperationDuration)
 	prometheus.MustRegister(ActiveConnections)
+	prometheus.MustRegister(MediaCacheLookups)
 }
 
 // RecordMessageLatency records message processing latency.
@@ -88,3 +98,12 @@ func RecordOperationDuration(operation string, duration time.Duration) {
 func RecordActiveConnections(connectionType string, count int) {
 	ActiveConnections.WithLabelValues(connectionType).Set(float64(count))
 }
+
+// RecordMediaCacheLookup records a media cache hit or miss.
+func RecordMediaCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	MediaCacheLookups.WithLabelValues(result).Inc()
+}
@@ -91,3 +91,8 @@ func (rw *bodyResponseWriter) Write(b []byte) (int, error) {
 func (rw *bodyResponseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *bodyResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -1,84 +1,325 @@
-// Package queue provides message queue for reliable message delivery with retry logic.
+// Package queue provides a durable message queue for reliable message delivery with retry logic.
+// Jobs are persisted through a Store (the bridge database), leased to workers for a
+// visibility timeout, retried with exponential backoff and dead-lettered after MaxRetries.
+// Jobs are partitioned by conversation key: jobs of one conversation are processed
+// strictly in order, while different conversations are processed in parallel.
 package queue
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
+
+	"github.com/example/mautrix-viber/internal/database"
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/metrics"
+	"github.com/example/mautrix-viber/internal/retry"
 )
 
+// ErrPermanent marks a handler error that cannot succeed on retry.
+// Jobs failing with an error wrapping ErrPermanent are dead-lettered immediately.
+var ErrPermanent = errors.New("queue: permanent failure")
+
+// Store persists queue jobs. Implemented by *database.DB.
+type Store interface {
+	EnqueueJob(ctx context.Context, job database.QueueJob) (int64, error)
+	ClaimJob(ctx context.Context, queue string, visibility time.Duration) (*database.QueueJob, error)
+	CompleteJob(ctx context.Context, id int64) error
+	RetryJob(ctx context.Context, id int64, availableAt time.Time, lastError string) error
+	DeadLetterJob(ctx context.Context, id int64, lastError string) error
+	CountJobs(ctx context.Context, queue string) (int, error)
+	CountDeadLetters(ctx context.Context, queue string) (int, error)
+}
+
 // MessageJob represents a message delivery job.
 type MessageJob struct {
-	ID         string
+	ID         int64
 	Type       string // "viber_to_matrix", "matrix_to_viber"
-	Payload    interface{}
-	Retries    int
+	Key        string // Conversation key; see ViberKey and MatrixKey
+	Payload    []byte
+	Retries    int // Failed attempts before this one
 	MaxRetries int
 	CreatedAt  time.Time
 }
 
-// Queue represents a message queue.
+// Handler processes a job. The context is cancelled when the job's visibility
+// timeout expires or the queue is stopped. A failed job is retried after its backoff,
+// or later if the error has a RetryAfter() time.Duration method asking for more.
+type Handler func(ctx context.Context, job MessageJob) error
+
+// ViberKey returns the conversation key of a Viber chat or user.
+func ViberKey(chatID string) string {
+	if chatID == "" {
+		return ""
+	}
+	return "viber:" + chatID
+}
+
+// MatrixKey returns the conversation key of a Matrix room.
+func MatrixKey(roomID string) string {
+	if roomID == "" {
+		return ""
+	}
+	return "matrix:" + roomID
+}
+
+// Config configures a Queue.
+type Config struct {
+	Name              string        // Queue name, stored with its jobs and used in metrics (default: "messages")
+	Workers           int           // Concurrent workers (default: 4)
+	MaxRetries        int           // Retries before a job is dead-lettered (default: 5)
+	VisibilityTimeout time.Duration // How long a claimed job is hidden from other workers (default: 5m)
+	PollInterval      time.Duration // How often idle workers check for new jobs (default: 1s)
+	Backoff           retry.Config  // Delay between retries; MaxAttempts is ignored
+}
+
+// DefaultConfig returns a default queue configuration.
+func DefaultConfig() Config {
+	return Config{
+		Name:              "messages",
+		Workers:           4,
+		MaxRetries:        5,
+		VisibilityTimeout: 5 * time.Minute,
+		PollInterval:      time.Second,
+		Backoff: retry.Config{
+			InitialDelay: time.Second,
+			MaxDelay:     5 * time.Minute,
+			Multiplier:   2.0,
+			Jitter:       true,
+		},
+	}
+}
+
+// Queue represents a durable message queue.
 type Queue struct {
+	store   Store
+	cfg     Config
+	handler Handler
+
+	wake    chan struct{} // Signals idle workers that a job was enqueued
+	stop    chan struct{} // Closed by Stop; workers finish their current job and exit
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	started bool
 	mu      sync.Mutex
-	jobs    []MessageJob
-	workers int
-	handler func(ctx context.Context, job MessageJob) error
 }
 
-// NewQueue creates a new message queue.
-func NewQueue(workers int, handler func(ctx context.Context, job MessageJob) error) *Queue {
-	q := &Queue{
-		workers: workers,
+// New creates a queue. Zero config values are replaced with DefaultConfig values.
+// Call Start to begin processing.
+func New(store Store, cfg Config, handler Handler) *Queue {
+	defaults := DefaultConfig()
+	if cfg.Name == "" {
+		cfg.Name = defaults.Name
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaults.Workers
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = defaults.MaxRetries
+	}
+	if cfg.VisibilityTimeout <= 0 {
+		cfg.VisibilityTimeout = defaults.VisibilityTimeout
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaults.PollInterval
+	}
+	if cfg.Backoff.InitialDelay <= 0 {
+		cfg.Backoff = defaults.Backoff
+	}
+	return &Queue{
+		store:   store,
+		cfg:     cfg,
 		handler: handler,
-		jobs:    make([]MessageJob, 0),
+		wake:    make(chan struct{}, cfg.Workers),
+		stop:    make(chan struct{}),
 	}
+}
 
-	// Start workers
-	for i := 0; i < workers; i++ {
-		go q.worker(i)
+// Start launches the workers. Jobs left in the store by a previous run,
+// including ones leased by a worker that crashed, are picked up automatically.
+// Cancelling ctx aborts in-flight jobs; use Stop for a graceful shutdown.
+func (q *Queue) Start(ctx context.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started {
+		return
 	}
+	q.started = true
 
-	return q
+	ctx, q.cancel = context.WithCancel(ctx)
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker(ctx)
+	}
+	q.reportDepth(ctx)
 }
 
-// Enqueue adds a job to the queue.
-func (q *Queue) Enqueue(job MessageJob) {
+// Stop stops claiming new jobs and waits for in-flight jobs to finish.
+// If ctx expires first, in-flight jobs are cancelled and ctx.Err() is returned;
+// their leases expire and they are retried on the next start.
+func (q *Queue) Stop(ctx context.Context) error {
 	q.mu.Lock()
-	defer q.mu.Unlock()
-	q.jobs = append(q.jobs, job)
+	if !q.started {
+		q.mu.Unlock()
+		return nil
+	}
+	select {
+	case <-q.stop:
+	default:
+		close(q.stop)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
 }
 
-// worker processes jobs from the queue.
-func (q *Queue) worker(id int) {
+// Enqueue persists a job and wakes an idle worker.
+// Jobs with the same non-empty key are processed one at a time in enqueue order;
+// a failing job is retried before any later job of its key (head-of-line blocking)
+// until it succeeds or is dead-lettered. Jobs with an empty key are unordered.
+func (q *Queue) Enqueue(ctx context.Context, jobType, key string, payload []byte) (int64, error) {
+	id, err := q.store.EnqueueJob(ctx, database.QueueJob{Queue: q.cfg.Name, Type: jobType, ConversationKey: key, Payload: payload})
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	q.reportDepth(ctx)
+	return id, nil
+}
+
+// Length returns the current number of queued jobs.
+func (q *Queue) Length(ctx context.Context) (int, error) {
+	return q.store.CountJobs(ctx, q.cfg.Name)
+}
+
+// worker claims and processes jobs until the queue is stopped.
+func (q *Queue) worker(ctx context.Context) {
+	defer q.wg.Done()
 	for {
-		q.mu.Lock()
-		if len(q.jobs) == 0 {
-			q.mu.Unlock()
-			time.Sleep(100 * time.Millisecond)
+		select {
+		case <-q.stop:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		job, err := q.store.ClaimJob(ctx, q.cfg.Name, q.cfg.VisibilityTimeout)
+		if err != nil {
+			logger.WarnWithContext(ctx, "failed to claim queue job",
+				"error", err,
+				"queue", q.cfg.Name,
+			)
+		}
+		if job == nil {
+			select {
+			case <-q.stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+			case <-time.After(q.cfg.PollInterval):
+			}
 			continue
 		}
+		q.process(ctx, job)
+	}
+}
 
-		job := q.jobs[0]
-		q.jobs = q.jobs[1:]
-		q.mu.Unlock()
+// process runs the handler for a claimed job and records the outcome.
+func (q *Queue) process(ctx context.Context, stored *database.QueueJob) {
+	job := MessageJob{
+		ID:         stored.ID,
+		Type:       stored.Type,
+		Key:        stored.ConversationKey,
+		Payload:    stored.Payload,
+		Retries:    stored.Attempts - 1,
+		MaxRetries: q.cfg.MaxRetries,
+		CreatedAt:  stored.CreatedAt,
+	}
+
+	// The handler must finish within the lease, otherwise another worker may claim the job
+	jobCtx, cancel := context.WithTimeout(ctx, q.cfg.VisibilityTimeout)
+	start := time.Now()
+	err := q.handler(jobCtx, job)
+	cancel()
+	metrics.RecordOperationDuration("queue_job_"+job.Type, time.Since(start))
 
-		// Process job
-		ctx := context.Background()
-		err := q.handler(ctx, job)
+	// Bookkeeping uses a fresh context so results are recorded even while shutting down
+	storeCtx, storeCancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer storeCancel()
 
-		if err != nil && job.Retries < job.MaxRetries {
-			// Retry with exponential backoff
-			job.Retries++
-			delay := time.Duration(job.Retries) * 100 * time.Millisecond
-			time.Sleep(delay)
-			q.Enqueue(job)
+	switch {
+	case err == nil:
+		if err := q.store.CompleteJob(storeCtx, job.ID); err != nil {
+			logger.WarnWithContext(ctx, "failed to complete queue job",
+				"error", err,
+				"queue", q.cfg.Name,
+				"job_id", job.ID,
+			)
+		}
+	case errors.Is(err, ErrPermanent) || job.Retries >= job.MaxRetries:
+		metrics.RecordError("queue_dead_letter", q.cfg.Name)
+		logger.WarnWithContext(ctx, "moving queue job to dead letters",
+			"error", err,
+			"queue", q.cfg.Name,
+			"job_id", job.ID,
+			"type", job.Type,
+			"attempts", job.Retries+1,
+		)
+		if err := q.store.DeadLetterJob(storeCtx, job.ID, err.Error()); err != nil {
+			logger.WarnWithContext(ctx, "failed to dead-letter queue job",
+				"error", err,
+				"queue", q.cfg.Name,
+				"job_id", job.ID,
+			)
+		}
+	default:
+		// An error with a Retry-After (see retry.RetryAfter) delays the retry at least that long
+		delay := max(q.cfg.Backoff.Delay(job.Retries+1), retry.RetryAfter(err))
+		logger.DebugWithContext(ctx, "retrying queue job",
+			"error", err,
+			"queue", q.cfg.Name,
+			"job_id", job.ID,
+			"type", job.Type,
+			"attempt", job.Retries+1,
+			"delay", delay,
+		)
+		if err := q.store.RetryJob(storeCtx, job.ID, time.Now().Add(delay), err.Error()); err != nil {
+			logger.WarnWithContext(ctx, "failed to reschedule queue job",
+				"error", err,
+				"queue", q.cfg.Name,
+				"job_id", job.ID,
+			)
 		}
 	}
+	q.reportDepth(storeCtx)
 }
 
-// Length returns the current queue length.
-func (q *Queue) Length() int {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	return len(q.jobs)
+// reportDepth publishes the number of queued and dead-lettered jobs (best-effort).
+func (q *Queue) reportDepth(ctx context.Context) {
+	if n, err := q.store.CountJobs(ctx, q.cfg.Name); err == nil {
+		metrics.RecordQueueDepth(q.cfg.Name, n)
+	}
+	if n, err := q.store.CountDeadLetters(ctx, q.cfg.Name); err == nil {
+		metrics.RecordQueueDepth(fmt.Sprintf("%s_dead_letters", q.cfg.Name), n)
+	}
 }
@@ -4,89 +4,282 @@ package queue
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/example/mautrix-viber/internal/database"
+	"github.com/example/mautrix-viber/internal/retry"
 )
 
-func TestQueue_Enqueue(t *testing.T) {
-	q := NewQueue(1, func(ctx context.Context, job MessageJob) error {
-		return nil
+// openTestDB opens a fresh database removed when the test ends.
+func openTestDB(t *testing.T, name string) *database.DB {
+	t.Helper()
+	dbPath := "/tmp/" + name
+	_ = os.Remove(dbPath)
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+		_ = os.Remove(dbPath)
 	})
+	return db
+}
+
+// testConfig returns a fast-polling configuration for tests.
+func testConfig() Config {
+	return Config{
+		Workers:      1,
+		MaxRetries:   3,
+		PollInterval: 10 * time.Millisecond,
+		Backoff:      retry.Config{InitialDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond, Multiplier: 2},
+	}
+}
 
-	job := MessageJob{
-		ID:         "test-job-1",
-		Type:       "test",
-		MaxRetries: 3,
-		CreatedAt:  time.Now(),
+// waitFor polls cond until it holds or the deadline passes.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+}
 
-	q.Enqueue(job)
+func TestQueue_Enqueue(t *testing.T) {
+	db := openTestDB(t, "test_queue_enqueue.db")
+	ctx := context.Background()
 
-	// Give worker time to process
-	time.Sleep(50 * time.Millisecond)
+	var mu sync.Mutex
+	var got []string
+	q := New(db, testConfig(), func(ctx context.Context, job MessageJob) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, string(job.Payload))
+		return nil
+	})
+	q.Start(ctx)
+	defer func() { _ = q.Stop(ctx) }()
 
-	// Queue should be empty or processing
-	length := q.Length()
-	if length > 1 {
-		t.Errorf("Expected queue length <= 1, got %d", length)
+	if _, err := q.Enqueue(ctx, "test", "", []byte("hello")); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	waitFor(t, func() bool {
+		n, _ := q.Length(ctx)
+		return n == 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0] != "hello" {
+		t.Errorf("Expected job 'hello' to be processed once, got %v", got)
 	}
 }
 
 func TestQueue_Retry(t *testing.T) {
-	attempts := 0
-	q := NewQueue(1, func(ctx context.Context, job MessageJob) error {
-		attempts++
-		if attempts < 2 {
+	db := openTestDB(t, "test_queue_retry.db")
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var retries []int
+	q := New(db, testConfig(), func(ctx context.Context, job MessageJob) error {
+		mu.Lock()
+		defer mu.Unlock()
+		retries = append(retries, job.Retries)
+		if job.Retries < 1 {
 			return errors.New("temporary error")
 		}
 		return nil
 	})
+	q.Start(ctx)
+	defer func() { _ = q.Stop(ctx) }()
 
-	job := MessageJob{
-		ID:         "test-job-2",
-		Type:       "test",
-		MaxRetries: 3,
-		CreatedAt:  time.Now(),
+	if _, err := q.Enqueue(ctx, "test", "", nil); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
 	}
 
-	q.Enqueue(job)
+	waitFor(t, func() bool {
+		n, _ := q.Length(ctx)
+		return n == 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(retries) != "[0 1]" {
+		t.Errorf("Expected attempts with retries [0 1], got %v", retries)
+	}
+	if n, _ := db.CountDeadLetters(ctx, ""); n != 0 {
+		t.Errorf("Expected no dead letters, got %d", n)
+	}
+}
+
+func TestQueue_DeadLetter(t *testing.T) {
+	db := openTestDB(t, "test_queue_dead_letter.db")
+	ctx := context.Background()
 
-	// Wait for processing and retry
-	time.Sleep(200 * time.Millisecond)
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{"exhausted retries", errors.New("homeserver unavailable"), 4},
+		{"permanent failure", fmt.Errorf("%w: bad payload", ErrPermanent), 1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			q := New(db, testConfig(), func(ctx context.Context, job MessageJob) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				return tt.err
+			})
+			q.Start(ctx)
+			defer func() { _ = q.Stop(ctx) }()
 
-	if attempts < 2 {
-		t.Errorf("Expected at least 2 attempts, got %d", attempts)
+			if _, err := q.Enqueue(ctx, "test", "", nil); err != nil {
+				t.Fatalf("Enqueue() error = %v", err)
+			}
+			waitFor(t, func() bool {
+				n, _ := db.CountDeadLetters(ctx, "")
+				return n == i+1
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != tt.attempts {
+				t.Errorf("Expected %d attempts, got %d", tt.attempts, attempts)
+			}
+		})
 	}
 }
 
-func TestQueue_Length(t *testing.T) {
-	q := NewQueue(1, func(ctx context.Context, job MessageJob) error {
-		time.Sleep(10 * time.Millisecond)
+func TestQueue_Persistence(t *testing.T) {
+	db := openTestDB(t, "test_queue_persistence.db")
+	ctx := context.Background()
+
+	// Jobs enqueued before the queue starts (e.g. before a restart) are processed
+	first := New(db, testConfig(), func(ctx context.Context, job MessageJob) error { return nil })
+	for i := 0; i < 3; i++ {
+		if _, err := first.Enqueue(ctx, "test", "", []byte{byte(i)}); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	if n, err := first.Length(ctx); err != nil || n != 3 {
+		t.Fatalf("Length() = %d, %v; want 3", n, err)
+	}
+
+	var mu sync.Mutex
+	processed := 0
+	second := New(db, testConfig(), func(ctx context.Context, job MessageJob) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed++
 		return nil
 	})
+	second.Start(ctx)
+	defer func() { _ = second.Stop(ctx) }()
 
-	// Enqueue multiple jobs
-	for i := 0; i < 5; i++ {
-		q.Enqueue(MessageJob{
-			ID:         "job-" + string(rune(i)),
-			Type:       "test",
-			MaxRetries: 1,
-			CreatedAt:  time.Now(),
-		})
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return processed == 3
+	})
+}
+
+func TestQueue_Stop(t *testing.T) {
+	db := openTestDB(t, "test_queue_stop.db")
+	ctx := context.Background()
+
+	started := make(chan struct{})
+	q := New(db, testConfig(), func(ctx context.Context, job MessageJob) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	q.Start(ctx)
+	if _, err := q.Enqueue(ctx, "test", "", nil); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
 	}
+	<-started
 
-	// Check initial length
-	length := q.Length()
-	if length != 5 {
-		t.Errorf("Expected queue length 5, got %d", length)
+	// The handler never finishes on its own, so Stop cancels it when ctx expires
+	stopCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := q.Stop(stopCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stop() error = %v, want deadline exceeded", err)
 	}
 
-	// Wait for processing
-	time.Sleep(100 * time.Millisecond)
+	// The interrupted job is kept for the next run
+	if n, err := q.Length(ctx); err != nil || n != 1 {
+		t.Errorf("Length() = %d, %v; want 1", n, err)
+	}
+}
+
+func TestQueue_Ordering(t *testing.T) {
+	db := openTestDB(t, "test_queue_ordering.db")
+	ctx := context.Background()
+
+	cfg := testConfig()
+	cfg.Workers = 4
+	cfg.MaxRetries = 5
 
-	// Should be processing
-	finalLength := q.Length()
-	if finalLength > 5 {
-		t.Errorf("Queue length should decrease, got %d", finalLength)
+	var mu sync.Mutex
+	seen := map[string][]string{}
+	bDone := make(chan struct{})
+	q := New(db, cfg, func(ctx context.Context, job MessageJob) error {
+		payload := string(job.Payload)
+		if payload == "a1" && job.Retries == 0 {
+			// Conversation b must progress while a's head is still in flight
+			select {
+			case <-bDone:
+			case <-time.After(5 * time.Second):
+				t.Error("conversation b was blocked by conversation a")
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		seen[job.Key] = append(seen[job.Key], payload)
+		if payload == "b2" {
+			close(bDone)
+		}
+		if payload == "a1" && job.Retries < 2 {
+			return errors.New("temporary error")
+		}
+		return nil
+	})
+
+	for _, job := range []struct{ key, payload string }{
+		{ViberKey("a"), "a1"},
+		{ViberKey("a"), "a2"},
+		{ViberKey("b"), "b1"},
+		{ViberKey("a"), "a3"},
+		{ViberKey("b"), "b2"},
+	} {
+		if _, err := q.Enqueue(ctx, "test", job.key, []byte(job.payload)); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	q.Start(ctx)
+	defer func() { _ = q.Stop(ctx) }()
+
+	waitFor(t, func() bool {
+		n, _ := q.Length(ctx)
+		return n == 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	// a1 is retried before a2 and a3 are attempted (head-of-line retry)
+	if got := fmt.Sprint(seen[ViberKey("a")]); got != "[a1 a1 a1 a2 a3]" {
+		t.Errorf("Conversation a processed as %s", got)
+	}
+	if got := fmt.Sprint(seen[ViberKey("b")]); got != "[b1 b2]" {
+		t.Errorf("Conversation b processed as %s", got)
 	}
 }
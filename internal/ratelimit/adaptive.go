@@ -0,0 +1,187 @@
+// Package ratelimit provides token-bucket rate limiters that adapt to upstream throttling.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrLimited indicates a token could not be obtained within the allowed wait.
+// Wait returns it as a *LimitedError; use errors.Is to detect it.
+var ErrLimited = errors.New("rate limit exceeded")
+
+// LimitedError is the ErrLimited returned by Wait, with the wait that was refused.
+type LimitedError struct {
+	Wait time.Duration // How long the caller would have had to wait for a token
+}
+
+// Error implements error.
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("%s (token available in %v)", ErrLimited, e.Wait.Round(time.Millisecond))
+}
+
+// Is reports whether target is ErrLimited.
+func (e *LimitedError) Is(target error) bool {
+	return target == ErrLimited
+}
+
+// RetryAfter returns how long until a token is available.
+// Used by retry.RetryAfter to schedule the next attempt.
+func (e *LimitedError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// AdaptiveLimiter is a token bucket with adaptive rate adjustment.
+// The rate drops while upstream keeps throttling (see RecordError and Pause)
+// and recovers towards the configured rate once calls succeed again.
+type AdaptiveLimiter struct {
+	mu          sync.Mutex
+	tokens      float64
+	rate        float64
+	baseRate    float64
+	burst       float64
+	lastRefill  time.Time
+	pausedUntil time.Time
+	requests    int
+	errors      int
+}
+
+// NewAdaptiveLimiter creates a new adaptive limiter allowing rate tokens per second
+// with bursts of up to burst tokens. The bucket starts full.
+func NewAdaptiveLimiter(rate, burst float64) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		tokens:     burst,
+		rate:       rate,
+		baseRate:   rate,
+		burst:      burst,
+		lastRefill: time.Now(),
+	}
+}
+
+// Allow reports whether a token is available now, consuming it if so.
+func (al *AdaptiveLimiter) Allow() bool {
+	_, ok := al.reserve(time.Now(), 0)
+	return ok
+}
+
+// Wait blocks until a token is available. If the token cannot be obtained before
+// ctx's deadline it returns a *LimitedError immediately instead of waiting in vain.
+func (al *AdaptiveLimiter) Wait(ctx context.Context) error {
+	maxWait := time.Duration(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = time.Until(deadline)
+	}
+	delay, ok := al.reserve(time.Now(), maxWait)
+	if !ok {
+		return &LimitedError{Wait: delay}
+	}
+	if err := sleep(ctx, delay); err != nil {
+		al.cancel()
+		return err
+	}
+	return nil
+}
+
+// RecordError records an upstream throttling error for adaptive rate adjustment.
+func (al *AdaptiveLimiter) RecordError() {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.errors++
+}
+
+// Pause grants no tokens for d, e.g. while a Retry-After from upstream runs out.
+// Tokens are refilled from zero once the pause ends.
+func (al *AdaptiveLimiter) Pause(d time.Duration) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	until := time.Now().Add(d)
+	if until.Before(al.pausedUntil) {
+		return
+	}
+	al.pausedUntil = until
+	al.tokens = min(al.tokens, 0)
+	al.lastRefill = until
+}
+
+// Rate returns the current, possibly reduced, rate in tokens per second.
+func (al *AdaptiveLimiter) Rate() float64 {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.rate
+}
+
+// reserve takes a token, returning how long the caller must wait before using it.
+// If that is longer than maxWait the token is not taken, ok is false and delay is the
+// wait that was refused.
+func (al *AdaptiveLimiter) reserve(now time.Time, maxWait time.Duration) (delay time.Duration, ok bool) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	// Refill tokens; lastRefill is in the future while paused
+	if elapsed := now.Sub(al.lastRefill).Seconds(); elapsed > 0 {
+		al.tokens = min(al.burst, al.tokens+elapsed*al.rate)
+		al.lastRefill = now
+	}
+	al.adapt()
+
+	// A negative balance is a queue of callers waiting for the refill
+	tokens := al.tokens - 1
+	if pause := al.pausedUntil.Sub(now); pause > 0 {
+		delay = pause
+	}
+	if tokens < 0 {
+		delay += time.Duration(-tokens / al.rate * float64(time.Second))
+	}
+	if delay > maxWait {
+		return delay, false
+	}
+	al.tokens = tokens
+	al.requests++
+	return delay, true
+}
+
+// cancel returns a reserved token that was not used.
+func (al *AdaptiveLimiter) cancel() {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.tokens = min(al.burst, al.tokens+1)
+	if al.requests > 0 {
+		al.requests--
+	}
+}
+
+// adapt adjusts the rate based on the error rate of the last window of requests.
+func (al *AdaptiveLimiter) adapt() {
+	if al.requests <= 10 {
+		return
+	}
+	errorRate := float64(al.errors) / float64(al.requests)
+	if errorRate > 0.1 {
+		// High error rate - reduce rate by 20%, down to a tenth of the configured rate
+		al.rate = max(al.baseRate/10, al.rate*0.8)
+	} else if errorRate < 0.01 {
+		// Low error rate - increase rate by 10%, up to the configured rate
+		al.rate = min(al.baseRate, al.rate*1.1)
+	}
+	al.requests = 0
+	al.errors = 0
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,144 @@
+// Package ratelimit limiter combines a global bucket with one bucket per key.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// keyIdleTimeout is how long an unused per-key bucket is kept before it is dropped.
+const keyIdleTimeout = 10 * time.Minute
+
+// Config configures a Limiter. A zero rate disables the corresponding limit.
+type Config struct {
+	Rate     float64       // Global tokens per second (0 disables)
+	Burst    int           // Global bucket size (default: rate rounded up, at least 1)
+	KeyRate  float64       // Tokens per second for each key (0 disables)
+	KeyBurst int           // Per-key bucket size (default: key rate rounded up, at least 1)
+	MaxWait  time.Duration // How long Wait queues for a token before failing; 0 fails fast
+}
+
+// Limiter enforces a global rate and a per-key rate, e.g. per Viber receiver.
+// A call must obtain a token from both buckets.
+type Limiter struct {
+	cfg    Config
+	global *AdaptiveLimiter
+
+	mu        sync.Mutex
+	keys      map[string]*keyLimiter
+	lastPrune time.Time
+}
+
+// keyLimiter is a per-key bucket and when it was last used.
+type keyLimiter struct {
+	limiter  *AdaptiveLimiter
+	lastUsed time.Time
+}
+
+// New creates a limiter. It returns nil when both limits are disabled;
+// a nil *Limiter allows everything.
+func New(cfg Config) *Limiter {
+	if cfg.Rate <= 0 && cfg.KeyRate <= 0 {
+		return nil
+	}
+	l := &Limiter{cfg: cfg, keys: make(map[string]*keyLimiter), lastPrune: time.Now()}
+	if cfg.Rate > 0 {
+		l.global = NewAdaptiveLimiter(cfg.Rate, burstOrDefault(cfg.Burst, cfg.Rate))
+	}
+	return l
+}
+
+// Wait blocks until both the global and the key's bucket grant a token.
+// It waits at most MaxWait (or until ctx's deadline, whichever is sooner)
+// and returns a *LimitedError straight away if the tokens will not be available by then.
+func (l *Limiter) Wait(ctx context.Context, key string) error {
+	if l == nil {
+		return nil
+	}
+	maxWait := l.cfg.MaxWait
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = min(maxWait, time.Until(deadline))
+	}
+
+	now := time.Now()
+	var reserved []*AdaptiveLimiter
+	var delay time.Duration
+	for _, al := range []*AdaptiveLimiter{l.global, l.keyLimiter(key, now)} {
+		if al == nil {
+			continue
+		}
+		d, ok := al.reserve(now, maxWait)
+		if !ok {
+			for _, r := range reserved {
+				r.cancel()
+			}
+			return &LimitedError{Wait: max(delay, d)}
+		}
+		reserved = append(reserved, al)
+		delay = max(delay, d)
+	}
+
+	if err := sleep(ctx, delay); err != nil {
+		for _, r := range reserved {
+			r.cancel()
+		}
+		return err
+	}
+	return nil
+}
+
+// Throttled feeds an upstream "too many requests" response into the global bucket:
+// it counts towards lowering the rate and, if retryAfter is set, pauses the bucket.
+func (l *Limiter) Throttled(retryAfter time.Duration) {
+	if l == nil || l.global == nil {
+		return
+	}
+	l.global.RecordError()
+	if retryAfter > 0 {
+		l.global.Pause(retryAfter)
+	}
+}
+
+// Rate returns the current global rate, or +Inf when there is no global limit.
+func (l *Limiter) Rate() float64 {
+	if l == nil || l.global == nil {
+		return math.Inf(1)
+	}
+	return l.global.Rate()
+}
+
+// keyLimiter returns the bucket of a key, or nil when per-key limits are disabled.
+func (l *Limiter) keyLimiter(key string, now time.Time) *AdaptiveLimiter {
+	if l.cfg.KeyRate <= 0 || key == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > keyIdleTimeout {
+		for k, kl := range l.keys {
+			if now.Sub(kl.lastUsed) > keyIdleTimeout {
+				delete(l.keys, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	kl, ok := l.keys[key]
+	if !ok {
+		kl = &keyLimiter{limiter: NewAdaptiveLimiter(l.cfg.KeyRate, burstOrDefault(l.cfg.KeyBurst, l.cfg.KeyRate))}
+		l.keys[key] = kl
+	}
+	kl.lastUsed = now
+	return kl.limiter
+}
+
+// burstOrDefault returns burst, or the rate rounded up (at least 1) when burst is not set.
+func burstOrDefault(burst int, rate float64) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return max(1, math.Ceil(rate))
+}
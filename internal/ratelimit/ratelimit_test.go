@@ -0,0 +1,132 @@
+// Package ratelimit tests - unit tests for token-bucket limiters.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiter_Allow(t *testing.T) {
+	al := NewAdaptiveLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if !al.Allow() {
+			t.Fatalf("Expected request %d within burst to be allowed", i+1)
+		}
+	}
+	if al.Allow() {
+		t.Error("Expected request beyond burst to be denied")
+	}
+}
+
+func TestAdaptiveLimiter_Wait(t *testing.T) {
+	al := NewAdaptiveLimiter(50, 1)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := al.Wait(ctx); err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+	}
+	// The first token is in the bucket, the next two take 20ms each
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("Expected Wait to pace requests, took %v", elapsed)
+	}
+
+	// A deadline that cannot be met fails without waiting
+	short, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := al.Wait(short); !errors.Is(err, ErrLimited) {
+		t.Errorf("Wait() error = %v, want ErrLimited", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("Expected Wait to fail fast, took %v", elapsed)
+	}
+}
+
+func TestAdaptiveLimiter_Pause(t *testing.T) {
+	al := NewAdaptiveLimiter(1000, 10)
+	al.Pause(50 * time.Millisecond)
+
+	if al.Allow() {
+		t.Error("Expected no tokens while paused")
+	}
+	start := time.Now()
+	if err := al.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Errorf("Expected Wait to last until the pause ends, took %v", elapsed)
+	}
+}
+
+func TestAdaptiveLimiter_Adapt(t *testing.T) {
+	al := NewAdaptiveLimiter(100, 100)
+
+	// A window with a high error rate lowers the rate
+	for i := 0; i < 11; i++ {
+		al.Allow()
+		al.RecordError()
+	}
+	al.Allow()
+	if rate := al.Rate(); rate != 80 {
+		t.Fatalf("Expected rate to drop to 80, got %v", rate)
+	}
+
+	// Error-free windows recover it, but never beyond the configured rate
+	for window := 0; window < 5; window++ {
+		for i := 0; i < 11; i++ {
+			al.Allow()
+		}
+	}
+	al.Allow()
+	if rate := al.Rate(); rate != 100 {
+		t.Errorf("Expected rate to recover to 100, got %v", rate)
+	}
+}
+
+func TestLimiter_Wait(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		keys    []string
+		wantErr []bool
+	}{
+		{"disabled", Config{}, []string{"a", "a", "a"}, []bool{false, false, false}},
+		{"per key", Config{KeyRate: 1, KeyBurst: 2}, []string{"a", "a", "b", "a"}, []bool{false, false, false, true}},
+		{"global", Config{Rate: 1, Burst: 2, KeyRate: 1, KeyBurst: 2}, []string{"a", "b", "c"}, []bool{false, false, true}},
+		{"queue within max wait", Config{KeyRate: 50, KeyBurst: 1, MaxWait: time.Second}, []string{"a", "a"}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.cfg)
+			for i, key := range tt.keys {
+				err := l.Wait(ctx, key)
+				if gotErr := errors.Is(err, ErrLimited); gotErr != tt.wantErr[i] || (err != nil && !gotErr) {
+					t.Errorf("Wait(%q) #%d error = %v, want limited %v", key, i+1, err, tt.wantErr[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLimiter_Throttled(t *testing.T) {
+	l := New(Config{Rate: 1000, Burst: 10})
+	l.Throttled(time.Minute)
+
+	err := l.Wait(context.Background(), "a")
+	if !errors.Is(err, ErrLimited) {
+		t.Fatalf("Wait() error = %v, want ErrLimited while throttled", err)
+	}
+	// The error says when the pause ends, so callers can try again then
+	var limited *LimitedError
+	if !errors.As(err, &limited) || limited.RetryAfter() < 59*time.Second || limited.RetryAfter() > 61*time.Second {
+		t.Errorf("Expected a retry after about a minute, got %v", err)
+	}
+}
@@ -4,8 +4,11 @@ package retry
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
 	"time"
 )
 
@@ -35,21 +38,10 @@ func Do(ctx context.Context, cfg Config, fn func() error) error {
 
 	for attempt := 0; attempt < cfg.MaxAttempts; attempt++ {
 		if attempt > 0 {
-			// Calculate delay with exponential backoff
-			delay := time.Duration(float64(cfg.InitialDelay) * pow(cfg.Multiplier, float64(attempt-1)))
-			if delay > cfg.MaxDelay {
-				delay = cfg.MaxDelay
-			}
-			if cfg.Jitter {
-				// Add ±25% jitter
-				jitter := time.Duration(float64(delay) * 0.25 * (rand.Float64()*2 - 1))
-				delay += jitter
-			}
-
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case <-time.After(delay):
+			case <-time.After(cfg.Delay(attempt)):
 			}
 		}
 
@@ -64,6 +56,24 @@ func Do(ctx context.Context, cfg Config, fn func() error) error {
 	return fmt.Errorf("max attempts (%d) exceeded: %w", cfg.MaxAttempts, lastErr)
 }
 
+// Delay returns the backoff before the given retry (1 for the first retry),
+// growing exponentially from InitialDelay up to MaxDelay with optional jitter.
+func (cfg Config) Delay(retry int) time.Duration {
+	if retry < 1 {
+		return 0
+	}
+	delay := time.Duration(float64(cfg.InitialDelay) * pow(cfg.Multiplier, float64(retry-1)))
+	if delay > cfg.MaxDelay {
+		delay = cfg.MaxDelay
+	}
+	if cfg.Jitter {
+		// Add ±25% jitter
+		jitter := time.Duration(float64(delay) * 0.25 * (rand.Float64()*2 - 1))
+		delay += jitter
+	}
+	return delay
+}
+
 func pow(base, exp float64) float64 {
 	result := 1.0
 	for i := 0; i < int(exp); i++ {
@@ -72,16 +82,68 @@ func pow(base, exp float64) float64 {
 	return result
 }
 
-// IsRetryable determines if an error is worth retrying.
-// Common retryable errors: network timeouts, 5xx errors, rate limits.
-// Currently returns true for all errors; can be enhanced to check specific error types.
+// DoRetryable executes fn like Do, but only retries errors for which IsRetryable
+// reports true; any other error is returned immediately. When an error carries a
+// Retry-After delay (see RetryAfter) the next attempt waits at least that long.
+// A Retry-After longer than MaxDelay is not waited out: the error is returned so
+// that the caller can reschedule the work instead of blocking.
+func DoRetryable(ctx context.Context, cfg Config, fn func() error) error {
+	var lastErr error
+
+	for attempt := 0; attempt < cfg.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := cfg.Delay(attempt)
+			if after := RetryAfter(lastErr); after > 0 {
+				if after > cfg.MaxDelay {
+					return lastErr
+				}
+				delay = max(delay, after)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+		lastErr = err
+	}
+
+	return fmt.Errorf("max attempts (%d) exceeded: %w", cfg.MaxAttempts, lastErr)
+}
+
+// IsRetryable determines if an error is a transient failure worth retrying.
+// Errors implementing Retryable() bool (anywhere in the chain) decide for themselves;
+// otherwise network errors, timeouts and truncated responses are retryable.
+// Cancellation and all other errors are not.
 func IsRetryable(err error) bool {
-	if err == nil {
+	if err == nil || errors.Is(err, context.Canceled) {
 		return false
 	}
-	// Could check for specific error types:
-	// - Network timeouts: errors.Is(err, context.DeadlineExceeded)
-	// - HTTP 5xx: check if err contains status code >= 500
-	// - Rate limits: check if err contains 429 status code
-	return true
+	var r interface{ Retryable() bool }
+	if errors.As(err, &r) {
+		return r.Retryable()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// RetryAfter returns the delay requested by the server for an error implementing
+// RetryAfter() time.Duration (e.g. from an HTTP Retry-After header), or 0.
+func RetryAfter(err error) time.Duration {
+	var r interface{ RetryAfter() time.Duration }
+	if errors.As(err, &r) {
+		return r.RetryAfter()
+	}
+	return 0
 }
@@ -4,6 +4,9 @@ package retry
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"testing"
 	"time"
 )
@@ -86,3 +89,92 @@ func TestDo_ContextCancel(t *testing.T) {
 		t.Errorf("Expected context.Canceled, got %v", err)
 	}
 }
+
+func TestConfig_Delay(t *testing.T) {
+	cfg := Config{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 2}
+
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{0, 0},
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second}, // Capped at MaxDelay
+	}
+	for _, tt := range tests {
+		if got := cfg.Delay(tt.retry); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.retry, got, tt.want)
+		}
+	}
+}
+
+// testError is a transient or permanent failure with an optional Retry-After delay.
+type testError struct {
+	retryable  bool
+	retryAfter time.Duration
+}
+
+func (e testError) Error() string             { return "test error" }
+func (e testError) Retryable() bool           { return e.retryable }
+func (e testError) RetryAfter() time.Duration { return e.retryAfter }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("bad request"), false},
+		{"canceled", context.Canceled, false},
+		{"deadline exceeded", fmt.Errorf("call: %w", context.DeadlineExceeded), true},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"unexpected EOF", fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{"transient error", fmt.Errorf("send: %w", testError{retryable: true}), true},
+		{"permanent error", testError{retryable: false}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoRetryable(t *testing.T) {
+	cfg := Config{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: 100 * time.Millisecond, Multiplier: 2}
+
+	tests := []struct {
+		name         string
+		err          error
+		wantAttempts int
+		minElapsed   time.Duration
+	}{
+		{"permanent error is not retried", testError{retryable: false}, 1, 0},
+		{"transient error is retried", testError{retryable: true}, 3, 0},
+		{"retry-after is honoured", testError{retryable: true, retryAfter: 30 * time.Millisecond}, 3, 60 * time.Millisecond},
+		{"retry-after beyond max delay is returned", testError{retryable: true, retryAfter: time.Minute}, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			start := time.Now()
+			err := DoRetryable(context.Background(), cfg, func() error {
+				attempts++
+				return tt.err
+			})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("Expected %d attempts, got %d", tt.wantAttempts, attempts)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minElapsed {
+				t.Errorf("Expected to wait at least %v, waited %v", tt.minElapsed, elapsed)
+			}
+		})
+	}
+}
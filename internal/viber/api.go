@@ -0,0 +1,172 @@
+// Package viber api implements the transport shared by all Viber REST API calls:
+// typed errors, retries of transient failures and a circuit breaker per endpoint.
+package viber
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/mautrix-viber/internal/circuitbreaker"
+	"github.com/example/mautrix-viber/internal/metrics"
+	"github.com/example/mautrix-viber/internal/retry"
+)
+
+// Viber REST API endpoints, relative to /pa/.
+const (
+	endpointSetWebhook     = "set_webhook"
+	endpointSendMessage    = "send_message"
+	endpointGetUserDetails = "get_user_details"
+)
+
+// Circuit breaker settings applied to each endpoint: the circuit opens after
+// breakerMaxFailures consecutive transient failures and lets a trial call
+// through after breakerTimeout.
+const (
+	breakerMaxFailures  = 5
+	breakerMaxSuccesses = 1
+	breakerTimeout      = 30 * time.Second
+)
+
+// maxAPIResponseSize bounds how much of an API response is read.
+const maxAPIResponseSize = 1 << 20
+
+// DefaultAPIRetry returns the retry policy for Viber API calls when Config.APIRetry is not set.
+func DefaultAPIRetry() retry.Config {
+	return retry.Config{
+		MaxAttempts:  3,
+		InitialDelay: 500 * time.Millisecond,
+		MaxDelay:     10 * time.Second,
+		Multiplier:   2.0,
+		Jitter:       true,
+	}
+}
+
+// apiBaseURL returns the configured Viber API base URL.
+func (c *Client) apiBaseURL() string {
+	if c.config.ViberAPIBaseURL != "" {
+		return c.config.ViberAPIBaseURL
+	}
+	return "https://chatapi.viber.com"
+}
+
+// breaker returns the circuit breaker guarding an endpoint, creating it on first use.
+func (c *Client) breaker(endpoint string) *circuitbreaker.CircuitBreaker {
+	c.breakersMu.Lock()
+	defer c.breakersMu.Unlock()
+	if c.breakers == nil {
+		c.breakers = make(map[string]*circuitbreaker.CircuitBreaker)
+	}
+	cb, ok := c.breakers[endpoint]
+	if !ok {
+		cb = circuitbreaker.NewCircuitBreaker(breakerMaxFailures, breakerMaxSuccesses, breakerTimeout)
+		c.breakers[endpoint] = cb
+	}
+	return cb
+}
+
+// callAPI POSTs body as JSON to a Viber API endpoint and decodes the response into out (if non-nil).
+// Transient failures are retried with backoff, honouring Retry-After. Every attempt goes through
+// the endpoint's circuit breaker; only transient failures count against it, so a rejected
+// receiver does not take the endpoint down. A non-OK Viber status is returned as *APIError,
+// and an open circuit as circuitbreaker.ErrCircuitOpen.
+func (c *Client) callAPI(ctx context.Context, endpoint string, body, out any) error {
+	if c.config.APIToken == "" {
+		return fmt.Errorf("api token not configured")
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		metrics.RecordError("viber_marshal_failure", endpoint)
+		return fmt.Errorf("marshal %s request: %w", endpoint, err)
+	}
+
+	cfg := c.config.APIRetry
+	if cfg.MaxAttempts <= 0 {
+		cfg = DefaultAPIRetry()
+	}
+	cb := c.breaker(endpoint)
+	err = retry.DoRetryable(ctx, cfg, func() error {
+		var callErr error
+		err := cb.Execute(func() error {
+			callErr = c.doAPIRequest(ctx, endpoint, data, out)
+			if retry.IsRetryable(callErr) {
+				return callErr
+			}
+			return nil
+		})
+		metricAPICircuitState.WithLabelValues(endpoint).Set(float64(cb.GetState()))
+		if errors.Is(callErr, ErrTooManyRequests) {
+			// Viber throttles the bot account as a whole, so slow down all sends
+			c.limiter.Throttled(retry.RetryAfter(callErr))
+		}
+		if errors.Is(err, circuitbreaker.ErrCircuitOpen) {
+			return fmt.Errorf("viber %s: %w", endpoint, err)
+		}
+		if err != nil {
+			return err
+		}
+		return callErr
+	})
+	if err != nil {
+		metrics.RecordError("viber_api_error", endpoint)
+	}
+	return err
+}
+
+// doAPIRequest performs a single API call.
+func (c *Client) doAPIRequest(ctx context.Context, endpoint string, data []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiBaseURL()+"/pa/"+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("create %s request: %w", endpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Viber-Auth-Token", c.config.APIToken)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", endpoint, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIResponseSize))
+	if err != nil {
+		return fmt.Errorf("read %s response: %w", endpoint, err)
+	}
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+
+	if resp.StatusCode != http.StatusOK {
+		return &APIError{
+			Endpoint:      endpoint,
+			HTTPStatus:    resp.StatusCode,
+			StatusMessage: strings.TrimSpace(string(respBody)),
+			retryAfter:    retryAfter,
+		}
+	}
+
+	var status WebhookResponse
+	if err := json.Unmarshal(respBody, &status); err != nil {
+		return fmt.Errorf("decode %s response: %w", endpoint, err)
+	}
+	if status.Status != StatusOK {
+		return &APIError{
+			Endpoint:      endpoint,
+			HTTPStatus:    resp.StatusCode,
+			Status:        status.Status,
+			StatusMessage: status.StatusMessage,
+			retryAfter:    retryAfter,
+		}
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("decode %s response: %w", endpoint, err)
+		}
+	}
+	return nil
+}
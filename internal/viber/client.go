@@ -1,104 +1,151 @@
 package viber
 
 import (
-	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"text/template"
 	"time"
 
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/circuitbreaker"
 	"github.com/example/mautrix-viber/internal/database"
 	"github.com/example/mautrix-viber/internal/logger"
 	mx "github.com/example/mautrix-viber/internal/matrix"
+	"github.com/example/mautrix-viber/internal/media"
 	"github.com/example/mautrix-viber/internal/metrics"
+	"github.com/example/mautrix-viber/internal/ratelimit"
+	"github.com/example/mautrix-viber/internal/retry"
 )
 
 // Config holds Viber API configuration.
 type Config struct {
-	APIToken        string        // Viber Bot API token for authentication
-	WebhookURL      string        // Public HTTPS URL where Viber will send webhooks
-	ViberAPIBaseURL string        // Viber API base URL (default: "https://chatapi.viber.com")
-	ListenAddress   string        // HTTP server listen address (optional)
-	HTTPTimeout     time.Duration // HTTP client timeout (default: 15s)
+	APIToken        string           // Viber Bot API token for authentication
+	WebhookURL      string           // Public HTTPS URL where Viber will send webhooks
+	ViberAPIBaseURL string           // Viber API base URL (default: "https://chatapi.viber.com")
+	ListenAddress   string           // HTTP server listen address (optional)
+	HTTPTimeout     time.Duration    // HTTP client timeout (default: 15s)
+	PortalInvites   []id.UserID      // Matrix users invited to every new portal room (optional)
+	DedupRetention  time.Duration    // How long processed callbacks are remembered (default: 24h)
+	InboxWorkers    int              // Workers processing queued webhooks (default: 4)
+	InboxMaxRetries int              // Processing retries before a queued webhook is dead-lettered (default: 5)
+	APIRetry        retry.Config     // Retry policy for transient API failures (default: DefaultAPIRetry)
+	SendLimit       ratelimit.Config // Outbound pacing; Key* limits apply per receiver (zero value disables)
+	MaxMediaSize    int64            // Largest media bridged to Matrix, in bytes (default: DefaultMaxMediaSize)
+
+	MediaCacheTTL        time.Duration // How long unused media cache entries are kept (default: DefaultMediaCacheTTL)
+	MediaCacheMaxEntries int           // Media cache entries kept before the least recently used are evicted (default: DefaultMediaCacheMaxEntries)
+
+	SenderNameTemplate    string // text/template for Matrix sender names in Viber (default: DefaultSenderNameTemplate)
+	DisableSenderOverride bool   // Send Matrix messages under the bot's own name and avatar
+	MapURLTemplate        string // text/template for map links in bridged locations (default: DefaultMapURLTemplate)
 }
 
 // Client manages Viber API interactions and webhook handling.
 // It forwards messages to Matrix and stores state in the database.
 type Client struct {
-	config     Config       // Viber API configuration
-	httpClient *http.Client // HTTP client for API requests (15s timeout)
-	matrix     *mx.Client   // Matrix client for forwarding messages (may be nil)
-	db         *database.DB // Database for persistence (may be nil)
+	config      Config             // Viber API configuration
+	httpClient  *http.Client       // HTTP client for API requests (15s timeout)
+	mediaClient *http.Client       // HTTP client for media downloads (no overall timeout; bounded by ctx)
+	matrix      *mx.Client         // Matrix client for forwarding messages (may be nil)
+	db          *database.DB       // Database for persistence (may be nil)
+	puppets     *mx.Puppeting      // Ghost user management (nil without Matrix)
+	portals     *mx.Portals        // Per-conversation portal rooms (nil without Matrix or database)
+	router      *router            // Event and message type handlers
+	dedup       DedupStore         // Duplicate callback detection (nil disables)
+	inbox       *inbox             // Asynchronous webhook processing (nil until StartInbox)
+	outbox      *outbox            // Asynchronous Matrix message forwarding (nil until StartOutbox)
+	limiter     *ratelimit.Limiter // Outbound send pacing (nil disables)
+	media       MediaLinker        // Public links to Matrix media (nil sends media as text)
+	mediaCache  MediaCache         // Deduplicates media uploads (nil disables)
+	transcoder  media.Transcoder   // Converts voice messages and inspects videos (nil disables)
+
+	senderTemplate *template.Template // Renders Matrix sender names
+	mapTemplate    *template.Template // Renders map links of Viber locations
+	senders        senderCache        // Recently resolved Matrix senders
+
+	breakersMu sync.Mutex                                // Guards breakers
+	breakers   map[string]*circuitbreaker.CircuitBreaker // Circuit breaker per API endpoint
 }
 
 // NewClient creates a new Viber client with the given configuration.
 // matrixClient and db may be nil if those features are not configured.
+// When db is set it is also used to deduplicate webhook callbacks and media uploads;
+// see SetDedupStore and SetMediaCache.
 func NewClient(cfg Config, matrixClient *mx.Client, db *database.DB) *Client {
 	timeout := cfg.HTTPTimeout
 	if timeout == 0 {
 		timeout = 15 * time.Second // Default timeout
 	}
-	return &Client{
-		config:     cfg,
-		httpClient: &http.Client{Timeout: timeout},
-		matrix:     matrixClient,
-		db:         db,
+	// Media downloads may take much longer than API calls; only waiting for headers is bounded
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+	c := &Client{
+		config:      cfg,
+		httpClient:  &http.Client{Timeout: timeout},
+		mediaClient: &http.Client{Transport: transport},
+		matrix:      matrixClient,
+		db:          db,
+		router:      newRouter(),
+		limiter:     ratelimit.New(cfg.SendLimit),
+	}
+	c.registerDefaultHandlers()
+	tmpl, err := ParseSenderNameTemplate(cfg.SenderNameTemplate)
+	if err != nil {
+		logger.Warn("invalid sender name template, using default", "error", err)
+		tmpl, _ = ParseSenderNameTemplate("")
+	}
+	c.senderTemplate = tmpl
+	mapTmpl, err := ParseMapURLTemplate(cfg.MapURLTemplate)
+	if err != nil {
+		logger.Warn("invalid map url template, using default", "error", err)
+		mapTmpl, _ = ParseMapURLTemplate("")
+	}
+	c.mapTemplate = mapTmpl
+	if db != nil {
+		c.dedup = db
+		c.mediaCache = db
+	}
+	if matrixClient != nil {
+		var store mx.AvatarStore
+		if db != nil {
+			store = db
+		}
+		c.puppets = mx.NewPuppeting(matrixClient, "", store)
+		if db != nil {
+			c.portals = mx.NewPortals(matrixClient, db, cfg.PortalInvites...)
+		}
 	}
+	return c
 }
 
 // EnsureWebhook registers the webhook URL with Viber's API.
 // This should be called on startup to ensure Viber knows where to send events.
-// Returns an error if registration fails.
+// Returns an error (an *APIError when Viber rejects the URL) if registration fails.
 func (c *Client) EnsureWebhook(ctx context.Context) error {
 	if c.config.WebhookURL == "" || c.config.APIToken == "" {
 		return fmt.Errorf("webhook url or api token not configured")
 	}
-	apiBaseURL := c.config.ViberAPIBaseURL
-	if apiBaseURL == "" {
-		apiBaseURL = "https://chatapi.viber.com"
-	}
-	// Build payload for set_webhook
 	body := map[string]any{
 		"url":         c.config.WebhookURL,
-		"event_types": []string{"message", "subscribed", "unsubscribed", "conversation_started"},
-	}
-	data, err := json.Marshal(body)
-	if err != nil {
-		return fmt.Errorf("marshal webhook payload: %w", err)
-	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiBaseURL+"/pa/set_webhook", bytes.NewReader(data))
-	if err != nil {
-		return fmt.Errorf("create set_webhook request: %w", err)
+		"event_types": []Event{EventDelivered, EventSeen, EventFailed, EventSubscribed, EventUnsubscribed, EventConversation, EventMessage},
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Viber-Auth-Token", c.config.APIToken)
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("set_webhook request failed: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("set_webhook unexpected status: %s", resp.Status)
-	}
-	var wr WebhookResponse
-	if err := json.NewDecoder(resp.Body).Decode(&wr); err != nil {
-		return fmt.Errorf("decode set_webhook response: %w", err)
-	}
-	if wr.Status != 0 {
-		return fmt.Errorf("set_webhook failed: %d %s", wr.Status, wr.StatusMessage)
+	if err := c.callAPI(ctx, endpointSetWebhook, body, nil); err != nil {
+		return fmt.Errorf("set webhook: %w", err)
 	}
 	return nil
 }
 
 // WebhookHandler processes incoming Viber webhook callbacks.
-// It verifies the HMAC-SHA256 signature, parses the payload, and forwards
-// messages to Matrix when configured. Also stores sender information in the database.
+// It verifies the HMAC-SHA256 signature, parses the payload, stores sender
+// information in the database and dispatches the event to the registered handlers.
 //
 // Security: All requests are verified using HMAC-SHA256 signature from the
 // X-Viber-Content-Signature header before processing.
@@ -128,96 +175,118 @@ func (c *Client) WebhookHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse webhook payload
-	var payload WebhookRequest
-	if err := json.NewDecoder(bytes.NewReader(raw)).Decode(&payload); err != nil {
+	payload, err := DecodeWebhookRequest(raw)
+	if err != nil {
+		logger.WarnWithContext(r.Context(), "rejected malformed Viber webhook",
+			"error", err,
+		)
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 	metricWebhookRequests.WithLabelValues(string(payload.Event)).Inc()
 
-	// Forward text messages to Matrix when configured
-	// This is the basic bridging functionality - more advanced features
-	// (media, formatting, etc.) are handled in other modules
-	if payload.Event == EventMessage && payload.Message.Type == "text" && c.matrix != nil {
-		start := time.Now()
-		text := fmt.Sprintf("[Viber] %s: %s", payload.Sender.Name, payload.Message.Text)
-		if err := c.matrix.SendText(r.Context(), text); err != nil {
-			// Log error but don't fail the webhook - this is best-effort forwarding
-			logger.WarnWithContext(r.Context(), "failed to forward text message to Matrix",
-				"error", err,
-				"sender", payload.Sender.Name,
-				"event", payload.Event,
-			)
-			metrics.RecordError("message_forward_failure", "webhook")
-		} else {
-			// Record message processing latency for successful forwards
-			metrics.RecordMessageLatency("viber_to_matrix", "text", time.Since(start))
+	// Viber retries callbacks it considers undelivered; acknowledge duplicates without re-bridging
+	duplicate, err := c.isDuplicate(r.Context(), payload)
+	if err != nil {
+		logger.WarnWithContext(r.Context(), "failed to check webhook deduplication",
+			"error", err,
+			"message_token", payload.MessageToken,
+		)
+		metrics.RecordError("webhook_dedup_failure", "webhook")
+	}
+	if duplicate {
+		metricDuplicateWebhooks.WithLabelValues(string(payload.Event)).Inc()
+		logger.DebugWithContext(r.Context(), "ignoring duplicate Viber webhook",
+			"event", payload.Event,
+			"message_token", payload.MessageToken,
+		)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	// Persist the payload and acknowledge immediately so slow Matrix calls never
+	// make Viber time out; without an inbox the callback is processed inline.
+	// The callback was recorded as processed above so concurrent deliveries are bridged
+	// once; if it can be neither persisted nor bridged, the record is released again.
+	if c.inbox != nil {
+		err := c.inbox.enqueue(r.Context(), payload, raw)
+		if err == nil {
+			w.WriteHeader(http.StatusOK)
+			return
 		}
-		metricForwardedMessages.WithLabelValues("text").Inc()
+		logger.WarnWithContext(r.Context(), "failed to persist webhook to inbox; processing inline",
+			"error", err,
+			"message_token", payload.MessageToken,
+		)
+	}
+	if err := c.processWebhook(r.Context(), payload); err != nil {
+		logger.WarnWithContext(r.Context(), "failed to handle Viber event",
+			"error", err,
+			"event", payload.Event,
+			"message_token", payload.MessageToken,
+		)
+		// Ask Viber to deliver the callback again when that may succeed;
+		// otherwise acknowledge it, as a retry would only fail the same way
+		if isTransient(err) {
+			c.releaseDuplicate(r.Context(), payload)
+			http.Error(w, "temporarily unable to process callback", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// processWebhook records the sender and routes a decoded callback to its handlers.
+func (c *Client) processWebhook(ctx context.Context, payload WebhookRequest) error {
+	if unknown := payload.UnknownFieldNames(); len(unknown) > 0 {
+		// Viber adds fields over time; keep them visible without failing the webhook
+		logger.DebugWithContext(ctx, "Viber webhook contains unknown fields",
+			"event", payload.Event,
+			"fields", unknown,
+		)
 	}
 
 	// Store sender information in database for user mapping and group membership tracking
-	// This enables features like ghost user puppeting and group chat management
+	// This enables features like ghost user puppeting and group chat management.
+	// Runs before forwarding so ghost avatar state can be attached to the stored user.
 	if c.db != nil && payload.Sender.ID != "" && payload.Sender.Name != "" {
-		if err := c.db.UpsertViberUser(r.Context(), payload.Sender.ID, payload.Sender.Name); err != nil {
+		if err := c.db.UpsertViberUser(ctx, payload.Sender.ID, payload.Sender.Name); err != nil {
 			// Log error but don't fail webhook - best-effort persistence
-			logger.WarnWithContext(r.Context(), "failed to upsert Viber user",
+			logger.WarnWithContext(ctx, "failed to upsert Viber user",
 				"error", err,
 				"viber_user_id", payload.Sender.ID,
 				"viber_user_name", payload.Sender.Name,
 			)
 		}
-		if payload.Message.ChatID != "" {
-			if err := c.db.UpsertGroupMember(r.Context(), payload.Message.ChatID, payload.Sender.ID); err != nil {
-				// Log error but don't fail webhook - best-effort persistence
-				logger.WarnWithContext(r.Context(), "failed to upsert group member",
-					"error", err,
-					"chat_id", payload.Message.ChatID,
-					"user_id", payload.Sender.ID,
-				)
-			}
-		}
 	}
 
-	// Picture message -> download media and forward as image
-	if payload.Event == EventMessage && (payload.Message.Type == "picture" || strings.HasSuffix(strings.ToLower(payload.Message.Media), ".jpg") || strings.HasSuffix(strings.ToLower(payload.Message.Media), ".png")) && c.matrix != nil {
-		if payload.Message.Media != "" {
-			// Download media using request context for cancellation support
-			req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, payload.Message.Media, nil)
-			if err == nil {
-				resp, err := c.httpClient.Do(req)
-				if err == nil && resp.StatusCode == http.StatusOK {
-					defer func() { _ = resp.Body.Close() }()
-					data, err := io.ReadAll(resp.Body)
-					if err != nil {
-						// Log error but don't fail webhook - best-effort image forwarding
-						logger.WarnWithContext(r.Context(), "failed to read image data from media URL",
-							"error", err,
-							"media_url", payload.Message.Media,
-							"event", payload.Event,
-						)
-					} else {
-						filename := payload.Message.FileName
-						if filename == "" {
-							filename = "viber-image"
-						}
-						// best-effort content-type
-						mimeType := resp.Header.Get("Content-Type")
-						if err := c.matrix.SendImage(r.Context(), filename, mimeType, data, nil); err != nil {
-							// Log error but don't fail webhook - best-effort forwarding
-							logger.WarnWithContext(r.Context(), "failed to forward image to Matrix",
-								"error", err,
-								"filename", filename,
-								"sender", payload.Sender.Name,
-							)
-						} else {
-							metricForwardedMessages.WithLabelValues("image").Inc()
-						}
-					}
-				}
-			}
-		}
-	}
+	// Route the event to its handlers (portal routing, message types, receipts, ...)
+	return c.dispatch(ctx, payload)
+}
 
-	w.WriteHeader(http.StatusOK)
+// storeInboundMapping records the Matrix event created for a Viber message (best-effort).
+func (c *Client) storeInboundMapping(ctx context.Context, payload WebhookRequest, roomID id.RoomID, eventID id.EventID) {
+	if c.db == nil || payload.MessageToken == 0 || eventID == "" {
+		return
+	}
+	timestamp := time.Now()
+	if payload.Timestamp > 0 {
+		timestamp = time.UnixMilli(payload.Timestamp)
+	}
+	if err := c.db.SaveMessageMapping(ctx, database.MessageMapping{
+		ViberMessageID: strconv.FormatInt(payload.MessageToken, 10),
+		MatrixEventID:  string(eventID),
+		ViberChatID:    conversationID(payload),
+		MatrixRoomID:   string(roomID),
+		Sender:         payload.Sender.ID,
+		Direction:      database.DirectionViberToMatrix,
+		Timestamp:      timestamp,
+	}); err != nil {
+		// Log error but don't fail webhook - best-effort persistence
+		logger.WarnWithContext(ctx, "failed to store message mapping",
+			"error", err,
+			"message_token", payload.MessageToken,
+			"event_id", eventID,
+		)
+	}
 }
@@ -6,13 +6,34 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/circuitbreaker"
 	"github.com/example/mautrix-viber/internal/database"
+	mx "github.com/example/mautrix-viber/internal/matrix"
+	"github.com/example/mautrix-viber/internal/media"
+	"github.com/example/mautrix-viber/internal/queue"
+	"github.com/example/mautrix-viber/internal/ratelimit"
+	"github.com/example/mautrix-viber/internal/retry"
 )
 
 // TestWebhookSignatureVerification tests signature verification.
@@ -167,3 +188,1842 @@ func TestWebhookHandler_EventTypes(t *testing.T) {
 		})
 	}
 }
+
+// TestParseGeoURI tests parsing of Matrix geo URIs.
+func TestParseGeoURI(t *testing.T) {
+	tests := []struct {
+		uri      string
+		lat, lon float64
+		wantErr  bool
+	}{
+		{"geo:51.5008,0.1247", 51.5008, 0.1247, false},
+		{"geo:-33.8688,151.2093,58;u=35", -33.8688, 151.2093, false},
+		{"geo:51.5008", 0, 0, true},
+		{"51.5008,0.1247", 0, 0, true},
+		{"geo:abc,0.1", 0, 0, true},
+		{"geo:-90,180", -90, 180, false},
+		{"geo:90,-180", 90, -180, false},
+		{"geo:90.5,0", 0, 0, true},
+		{"geo:0,-180.1", 0, 0, true},
+		{"geo:NaN,0", 0, 0, true},
+		{"geo:0,nan", 0, 0, true},
+		{"geo:Inf,0", 0, 0, true},
+		{"geo:0,-Infinity", 0, 0, true},
+	}
+	for _, tt := range tests {
+		lat, lon, err := parseGeoURI(tt.uri)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGeoURI(%q) error = %v, wantErr %v", tt.uri, err, tt.wantErr)
+			continue
+		}
+		if lat != tt.lat || lon != tt.lon {
+			t.Errorf("parseGeoURI(%q) = %v, %v; want %v, %v", tt.uri, lat, lon, tt.lat, tt.lon)
+		}
+	}
+}
+
+// TestHandleLocation tests that Viber locations become m.location events with a configurable map link.
+func TestHandleLocation(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test", MapURLTemplate: "https://maps.example.com/?q={{.Lat}},{{.Lon}}"}, mxClient, nil)
+	target := Target{RoomID: "!room:example.com", Ghost: "@viber_abc:example.com"}
+
+	if _, err := client.HandleLocation(context.Background(), target, 52.520008, 13.404954, "Berlin"); err != nil {
+		t.Fatalf("HandleLocation() error = %v", err)
+	}
+	if len(hs.messages) != 1 {
+		t.Fatalf("Expected 1 matrix message, got %d", len(hs.messages))
+	}
+	content := hs.messages[0]
+	if content["msgtype"] != "m.location" || content["geo_uri"] != "geo:52.520008,13.404954" {
+		t.Errorf("Unexpected location content %v", content)
+	}
+	if content["body"] != "📍 Berlin: https://maps.example.com/?q=52.520008,13.404954" {
+		t.Errorf("Unexpected fallback body %q", content["body"])
+	}
+	location, _ := content["org.matrix.msc3488.location"].(map[string]interface{})
+	if location["uri"] != "geo:52.520008,13.404954" || location["description"] != "Berlin" {
+		t.Errorf("Unexpected MSC3488 location %v", location)
+	}
+}
+
+// TestHandleContact tests that Viber contacts become vCard files with a text fallback.
+func TestHandleContact(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, nil)
+	target := Target{RoomID: "!room:example.com", Ghost: "@viber_abc:example.com"}
+
+	if _, err := client.HandleContact(context.Background(), target, "Jane Doe", "+49 30 1234567", ""); err != nil {
+		t.Fatalf("HandleContact() error = %v", err)
+	}
+	if len(hs.messages) != 1 {
+		t.Fatalf("Expected 1 matrix message, got %d", len(hs.messages))
+	}
+	content := hs.messages[0]
+	if content["msgtype"] != "m.file" || content["filename"] != "Jane Doe.vcf" || content["url"] != "mxc://example.com/text-vcard" {
+		t.Errorf("Unexpected contact content %v", content)
+	}
+	if body, _ := content["body"].(string); !strings.Contains(body, "Jane Doe") || !strings.Contains(body, "+49 30 1234567") {
+		t.Errorf("Expected a text fallback in the body, got %q", body)
+	}
+}
+
+// TestLocationGeoURI tests reading the location of Matrix events from geo_uri or MSC3488 content.
+func TestLocationGeoURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"geo_uri", `{"msgtype":"m.location","body":"Here","geo_uri":"geo:1,2"}`, "geo:1,2"},
+		{"msc3488 only", `{"msgtype":"m.location","body":"Here","org.matrix.msc3488.location":{"uri":"geo:3,4"}}`, "geo:3,4"},
+		{"neither", `{"msgtype":"m.location","body":"Here"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evt := &event.Event{Type: event.EventMessage}
+			if err := json.Unmarshal([]byte(tt.content), &evt.Content); err != nil {
+				t.Fatalf("Failed to decode content: %v", err)
+			}
+			if err := evt.Content.ParseRaw(evt.Type); err != nil {
+				t.Fatalf("Failed to parse content: %v", err)
+			}
+			if got := locationGeoURI(evt, evt.Content.AsMessage()); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestHandleMatrixMessage_Routing tests that Matrix messages are routed by portal room.
+func TestHandleMatrixMessage_Routing(t *testing.T) {
+	var sent []SendMessageRequest
+	viberAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req SendMessageRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		sent = append(sent, req)
+		_ = json.NewEncoder(w).Encode(SendMessageResponse{MessageToken: int64(1000 + len(sent))})
+	}))
+	defer viberAPI.Close()
+
+	dbPath := "/tmp/test_outbound_routing.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	hs := newFakeHomeserver(t)
+	mxClient, err := mx.NewClient(mx.Config{
+		HomeserverURL: hs.URL,
+		AccessToken:   "token",
+		UserID:        "@bridge:example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := db.CreateRoomMapping(ctx, "viber_user_1", "!portal:example.com"); err != nil {
+		t.Fatalf("Failed to create room mapping: %v", err)
+	}
+
+	if err := db.SaveViberSticker(ctx, database.ViberSticker{StickerID: 40133, MXC: "mxc://example.com/sticker"}); err != nil {
+		t.Fatalf("Failed to save sticker: %v", err)
+	}
+
+	client := NewClient(Config{APIToken: "test", ViberAPIBaseURL: viberAPI.URL, SenderNameTemplate: "{{.DisplayName}} (Matrix)"}, mxClient, db)
+	client.SetMediaLinker(fakeLinker{})
+
+	text := &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}
+	image := &event.MessageEventContent{MsgType: event.MsgImage, Body: "cat.png", URL: "mxc://example.com/abc"}
+	viberSticker := &event.MessageEventContent{Body: "Sticker", URL: "mxc://example.com/sticker"}
+	hs.files["jane"] = []byte("BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Jane Doe\r\nTEL;TYPE=CELL:+49 30 1234567\r\nEND:VCARD\r\n")
+	vcard := &event.MessageEventContent{MsgType: event.MsgFile, Body: "jane.vcf", URL: "mxc://example.com/jane"}
+	brokenVCard := &event.MessageEventContent{MsgType: event.MsgFile, Body: "missing.vcf", URL: "mxc://example.com/missing"}
+	hs.files["team"] = append(append([]byte{}, hs.files["jane"]...), "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:John Doe\r\nTEL:+49 30 7654321\r\nEND:VCARD\r\n"...)
+	teamVCard := &event.MessageEventContent{MsgType: event.MsgFile, Body: "team.vcf", URL: "mxc://example.com/team"}
+	matrixSticker := &event.MessageEventContent{Body: "Wave", URL: "mxc://example.com/abc"}
+	voice := &event.MessageEventContent{
+		MsgType:      event.MsgAudio,
+		Body:         "Voice message",
+		URL:          "mxc://example.com/voice",
+		Info:         &event.FileInfo{MimeType: "audio/ogg", Size: 4096, Duration: 3000},
+		MSC3245Voice: &event.MSC3245Voice{},
+	}
+
+	tests := []struct {
+		name     string
+		evtType  event.Type
+		msg      *event.MessageEventContent
+		roomID   id.RoomID
+		sender   id.UserID
+		wantType string // Empty when nothing should be sent
+	}{
+		{"text in portal", event.EventMessage, text, "!portal:example.com", "@alice:example.com", "text"},
+		{"image in portal", event.EventMessage, image, "!portal:example.com", "@alice:example.com", "picture"},
+		{"viber sticker", event.EventSticker, viberSticker, "!portal:example.com", "@alice:example.com", "sticker"},
+		{"matrix sticker", event.EventSticker, matrixSticker, "!portal:example.com", "@alice:example.com", "picture"},
+		{"vcard", event.EventMessage, vcard, "!portal:example.com", "@alice:example.com", "contact"},
+		{"unreadable vcard", event.EventMessage, brokenVCard, "!portal:example.com", "@alice:example.com", "file"},
+		{"vcard with several contacts", event.EventMessage, teamVCard, "!portal:example.com", "@alice:example.com", "file"},
+		{"voice message", event.EventMessage, voice, "!portal:example.com", "@alice:example.com", "file"},
+		{"unbridged room", event.EventMessage, text, "!other:example.com", "@alice:example.com", ""},
+		{"bridge bot echo", event.EventMessage, text, "!portal:example.com", "@bridge:example.com", ""},
+		{"ghost echo", event.EventMessage, text, "!portal:example.com", "@viber_abc:example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = nil
+			evt := &event.Event{ID: id.EventID("$" + tt.name), Type: tt.evtType, RoomID: tt.roomID, Sender: tt.sender}
+			if err := client.HandleMatrixMessage(ctx, evt, tt.msg); err != nil {
+				t.Fatalf("HandleMatrixMessage() error = %v", err)
+			}
+			if tt.wantType == "" {
+				if len(sent) != 0 {
+					t.Errorf("Expected no message, got %+v", sent)
+				}
+				return
+			}
+			if len(sent) != 1 {
+				t.Fatalf("Expected 1 message, got %d", len(sent))
+			}
+			if sent[0].Receiver != "viber_user_1" || sent[0].Type != tt.wantType {
+				t.Errorf("Expected %s to viber_user_1, got %s to %s", tt.wantType, sent[0].Type, sent[0].Receiver)
+			}
+			mapping, err := db.GetMessageMappingByMatrixID(ctx, string(evt.ID))
+			if err != nil || mapping == nil {
+				t.Fatalf("Expected message mapping for %s, got %v (err %v)", evt.ID, mapping, err)
+			}
+			if mapping.ViberMessageID != "1001" || mapping.Direction != database.DirectionMatrixToViber || mapping.MatrixRoomID != string(tt.roomID) {
+				t.Errorf("Unexpected mapping %+v", mapping)
+			}
+			if tt.wantType == "picture" && sent[0].Media != testMediaBase+"example.com/abc" {
+				t.Errorf("Unexpected media URL %s", sent[0].Media)
+			}
+			if tt.msg == voice && (sent[0].FileName != "viber-voice.ogg" || sent[0].Media != testMediaBase+"example.com/voice") {
+				t.Errorf("Expected viber-voice.ogg from the media link, got %s from %s", sent[0].FileName, sent[0].Media)
+			}
+			if tt.wantType == "sticker" && sent[0].StickerID != 40133 {
+				t.Errorf("Expected sticker 40133, got %d", sent[0].StickerID)
+			}
+			wantContact := Contact{Name: "Jane Doe", PhoneNumber: "+49 30 1234567"}
+			if tt.wantType == "contact" && (sent[0].Contact == nil || *sent[0].Contact != wantContact) {
+				t.Errorf("Expected contact %+v, got %+v", wantContact, sent[0].Contact)
+			}
+			wantSender := MessageSender{Name: "Alice (Matrix)", Avatar: testMediaBase + "example.com/alice"}
+			if sent[0].Sender == nil || *sent[0].Sender != wantSender {
+				t.Errorf("Expected sender %+v, got %+v", wantSender, sent[0].Sender)
+			}
+		})
+	}
+
+	// Without a media linker, media is never linked and arrives as its body
+	sent = nil
+	unlinked := NewClient(Config{APIToken: "test", ViberAPIBaseURL: viberAPI.URL}, mxClient, db)
+	evt := &event.Event{ID: "$unlinked image", Type: event.EventMessage, RoomID: "!portal:example.com", Sender: "@alice:example.com"}
+	if err := unlinked.HandleMatrixMessage(ctx, evt, image); err != nil {
+		t.Fatalf("HandleMatrixMessage() error = %v", err)
+	}
+	if len(sent) != 1 || sent[0].Type != "text" || sent[0].Text != "cat.png" || sent[0].Media != "" {
+		t.Errorf("Expected the image body as text, got %+v", sent)
+	} else if sent[0].Sender == nil || sent[0].Sender.Avatar != "" {
+		t.Errorf("Expected a sender without avatar, got %+v", sent[0].Sender)
+	}
+}
+
+// TestQueueMatrixMessage tests forwarding through the outbox, resuming persisted messages and skipping retries.
+func TestQueueMatrixMessage(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		sent []string
+	)
+	viberAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req SendMessageRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		sent = append(sent, req.Text)
+		n := len(sent)
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(SendMessageResponse{MessageToken: int64(1000 + n)})
+	}))
+	defer viberAPI.Close()
+
+	dbPath := "/tmp/test_outbox.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	hs := newFakeHomeserver(t)
+	mxClient, err := mx.NewClient(mx.Config{
+		HomeserverURL: hs.URL,
+		AccessToken:   "token",
+		UserID:        "@bridge:example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	ctx := context.Background()
+	if err := db.CreateRoomMapping(ctx, "viber_user_1", "!portal:example.com"); err != nil {
+		t.Fatalf("Failed to create room mapping: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test", ViberAPIBaseURL: viberAPI.URL}, mxClient, db)
+
+	message := func(eventID, body string) *event.Event {
+		return &event.Event{
+			ID: id.EventID(eventID), Type: event.EventMessage, RoomID: "!portal:example.com", Sender: "@alice:example.com",
+			Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+		}
+	}
+
+	// A message accepted before a crash is still waiting in the outbox
+	leftover, _ := json.Marshal(message("$1", "before restart"))
+	if _, err := db.EnqueueJob(ctx, database.QueueJob{Queue: outboxQueueName, Type: outboxJobType, ConversationKey: "matrix:!portal:example.com", Payload: leftover}); err != nil {
+		t.Fatalf("Failed to enqueue message: %v", err)
+	}
+	if err := client.StartOutbox(ctx); err != nil {
+		t.Fatalf("StartOutbox() error = %v", err)
+	}
+	defer func() { _ = client.StopOutbox(ctx) }()
+
+	for _, evt := range []*event.Event{message("$2", "after restart"), message("$2", "after restart"), message("$3", "again")} {
+		if err := client.QueueMatrixMessage(ctx, evt, evt.Content.AsMessage()); err != nil {
+			t.Fatalf("QueueMatrixMessage() error = %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := db.CountJobs(ctx, outboxQueueName)
+		if err != nil {
+			t.Fatalf("CountJobs() error = %v", err)
+		}
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected an empty outbox, got %d pending", pending)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"before restart", "after restart", "again"}; strings.Join(sent, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %q to be sent once each in order, got %q", want, sent)
+	}
+}
+
+// retryRecorder is a queue store that reports how the queue settled a failed job.
+type retryRecorder struct {
+	*database.DB
+	retried      chan time.Time // When a job was scheduled again
+	deadLettered chan string    // The error a job was dead-lettered with
+}
+
+func (r *retryRecorder) RetryJob(ctx context.Context, id int64, availableAt time.Time, lastError string) error {
+	r.retried <- availableAt
+	return r.DB.RetryJob(ctx, id, availableAt, lastError)
+}
+
+func (r *retryRecorder) DeadLetterJob(ctx context.Context, id int64, lastError string) error {
+	r.deadLettered <- lastError
+	return r.DB.DeadLetterJob(ctx, id, lastError)
+}
+
+// newOutboxTestClient returns a client sending to viberURL whose database bridges
+// !portal:example.com to viber_user_1.
+func newOutboxTestClient(t *testing.T, dbPath string, cfg Config) (*Client, *database.DB) {
+	t.Helper()
+	_ = os.Remove(dbPath)
+	t.Cleanup(func() { _ = os.Remove(dbPath) })
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := db.CreateRoomMapping(context.Background(), "viber_user_1", "!portal:example.com"); err != nil {
+		t.Fatalf("Failed to create room mapping: %v", err)
+	}
+
+	hs := newFakeHomeserver(t)
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	return NewClient(cfg, mxClient, db), db
+}
+
+// forwardOnce queues a Matrix text message on an outbox with the default backoff and waits
+// for its first attempt. It returns when the job was scheduled again, or the error it was
+// dead-lettered with.
+func forwardOnce(t *testing.T, client *Client, db *database.DB, body string) (retryAt time.Time, deadLetter string) {
+	t.Helper()
+	ctx := context.Background()
+	store := &retryRecorder{DB: db, retried: make(chan time.Time, 1), deadLettered: make(chan string, 1)}
+	ob := &outbox{client: client}
+	ob.queue = queue.New(store, queue.Config{Name: outboxQueueName, Workers: 1, PollInterval: 10 * time.Millisecond}, ob.process)
+	ob.queue.Start(ctx)
+	defer func() { _ = ob.queue.Stop(ctx) }()
+
+	raw, _ := json.Marshal(&event.Event{
+		ID: "$1", Type: event.EventMessage, RoomID: "!portal:example.com", Sender: "@alice:example.com",
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+	})
+	if _, err := ob.queue.Enqueue(ctx, outboxJobType, queue.MatrixKey("!portal:example.com"), raw); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	select {
+	case retryAt = <-store.retried:
+	case deadLetter = <-store.deadLettered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Outbox job was not processed")
+	}
+	return retryAt, deadLetter
+}
+
+// TestOutbox_CircuitOpen tests that messages sent while the Viber API circuit is open are retried later.
+func TestOutbox_CircuitOpen(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	apiRetry := testAPIRetry()
+	apiRetry.MaxAttempts = 1
+	client, db := newOutboxTestClient(t, "/tmp/test_outbox_circuit_open.db", Config{APIToken: "test", ViberAPIBaseURL: server.URL, APIRetry: apiRetry})
+	for i := 0; i < breakerMaxFailures; i++ {
+		_, _ = client.SendText(context.Background(), "viber_user_1", "failing")
+	}
+	if got := client.breaker(endpointSendMessage).GetState(); got != circuitbreaker.StateOpen {
+		t.Fatalf("Expected send_message circuit open, got %s", got)
+	}
+
+	start := time.Now()
+	retryAt, deadLetter := forwardOnce(t, client, db, "during outage")
+	if deadLetter != "" {
+		t.Fatalf("Expected the message to be retried, got dead-lettered: %s", deadLetter)
+	}
+	if !retryAt.After(start) {
+		t.Errorf("Expected the retry to be delayed by backoff, got %v", retryAt.Sub(start))
+	}
+	if n, err := db.CountDeadLetters(context.Background(), outboxQueueName); err != nil || n != 0 {
+		t.Errorf("CountDeadLetters() = %d, %v; want 0", n, err)
+	}
+}
+
+// TestOutbox_RateLimited tests that messages held back by send pacing are retried once a token is available.
+func TestOutbox_RateLimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		viberStatus(StatusOK)(w)
+	}))
+	defer server.Close()
+
+	client, db := newOutboxTestClient(t, "/tmp/test_outbox_rate_limited.db", Config{
+		APIToken:        "test",
+		ViberAPIBaseURL: server.URL,
+		SendLimit:       ratelimit.Config{KeyRate: 0.1, KeyBurst: 1}, // A token every 10s
+	})
+	if _, err := client.SendText(context.Background(), "viber_user_1", "first"); err != nil {
+		t.Fatalf("SendText() error = %v", err)
+	}
+
+	start := time.Now()
+	retryAt, deadLetter := forwardOnce(t, client, db, "second")
+	if deadLetter != "" {
+		t.Fatalf("Expected the message to be retried, got dead-lettered: %s", deadLetter)
+	}
+	// The retry waits for the receiver's next token rather than the shorter backoff
+	if wait := retryAt.Sub(start); wait < 9*time.Second || wait > 11*time.Second {
+		t.Errorf("Expected the retry once the next token is available in 10s, got %v", wait)
+	}
+	if n, err := db.CountDeadLetters(context.Background(), outboxQueueName); err != nil || n != 0 {
+		t.Errorf("CountDeadLetters() = %d, %v; want 0", n, err)
+	}
+}
+
+// testMediaBase is where fakeLinker links Matrix media.
+const testMediaBase = "https://bridge.example.com/media/"
+
+// fakeLinker links Matrix media as testMediaBase followed by the server name and media ID.
+type fakeLinker struct{}
+
+func (fakeLinker) URL(uri id.ContentURIString, _ string) (string, error) {
+	parsed, err := uri.Parse()
+	if err != nil {
+		return "", err
+	}
+	return testMediaBase + parsed.Homeserver + "/" + parsed.FileID, nil
+}
+
+// fakeHomeserver records Matrix messages sent by the bridge and hands out portal rooms.
+type fakeHomeserver struct {
+	*httptest.Server
+	mu         sync.Mutex
+	messages   []map[string]interface{}
+	eventTypes []string // Event type of each message
+	uploads    int
+	files      map[string][]byte // Downloadable media by media ID
+
+	failCreateRoom bool // Fail room creation with a server error
+}
+
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	t.Helper()
+	hs := &fakeHomeserver{files: make(map[string][]byte)}
+	hs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/createRoom"):
+			hs.mu.Lock()
+			fail := hs.failCreateRoom
+			hs.mu.Unlock()
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"database unavailable"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"room_id":"!portal:example.com"}`))
+		case strings.Contains(r.URL.Path, "/state/m.room.member/"):
+			_, _ = w.Write([]byte(`{"membership":"join","displayname":"Alice","avatar_url":"mxc://example.com/alice"}`))
+		case strings.HasSuffix(r.URL.Path, "/media/v3/upload"):
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			hs.mu.Lock()
+			hs.uploads++
+			hs.mu.Unlock()
+			_, _ = fmt.Fprintf(w, `{"content_uri":"mxc://example.com/%s"}`, strings.ReplaceAll(r.Header.Get("Content-Type"), "/", "-"))
+		case strings.Contains(r.URL.Path, "/media/download/example.com/"):
+			hs.mu.Lock()
+			data, ok := hs.files[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+			hs.mu.Unlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(data)
+		case strings.Contains(r.URL.Path, "/send/"):
+			var content map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&content)
+			eventType, _, _ := strings.Cut(r.URL.Path[strings.Index(r.URL.Path, "/send/")+len("/send/"):], "/")
+			hs.mu.Lock()
+			hs.messages = append(hs.messages, content)
+			hs.eventTypes = append(hs.eventTypes, eventType)
+			n := len(hs.messages)
+			hs.mu.Unlock()
+			_, _ = fmt.Fprintf(w, `{"event_id":"$event%d"}`, n)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+// TestForwardMedia tests that Viber media is bridged with the matching msgtype and info block.
+func TestForwardMedia(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 1000, 500))); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/video.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+		case "/thumb.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+		case "/report.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+		case "/song.mp3":
+			w.Header().Set("Content-Type", "audio/mpeg")
+		case "/cat.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(picture.Bytes())
+			return
+		case "/broken.png":
+			w.Header().Set("Content-Type", "image/png")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("media"))
+	}))
+	defer media.Close()
+
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, nil)
+	target := Target{RoomID: "!room:example.com", Sender: Sender{ID: "viber_user_1"}}
+
+	tests := []struct {
+		name         string
+		message      Message
+		wantType     string
+		wantBody     string
+		wantInfo     map[string]interface{}
+		wantThumbURL string
+	}{
+		{
+			name:         "video",
+			message:      Message{Type: "video", Media: media.URL + "/video.mp4", Thumbnail: media.URL + "/thumb.jpg", Duration: 12},
+			wantType:     "m.video",
+			wantBody:     "viber-video.mp4",
+			wantInfo:     map[string]interface{}{"mimetype": "video/mp4", "size": float64(5), "duration": float64(12000)},
+			wantThumbURL: "mxc://example.com/image-jpeg",
+		},
+		{
+			name:     "video without thumbnail",
+			message:  Message{Type: "video", Media: media.URL + "/video.mp4", Thumbnail: media.URL + "/missing.jpg"},
+			wantType: "m.video",
+			wantBody: "viber-video.mp4",
+			wantInfo: map[string]interface{}{"mimetype": "video/mp4", "size": float64(5)},
+		},
+		{
+			name:     "file",
+			message:  Message{Type: "file", Media: media.URL + "/report.pdf", FileName: "report.pdf"},
+			wantType: "m.file",
+			wantBody: "report.pdf",
+			wantInfo: map[string]interface{}{"mimetype": "application/pdf", "size": float64(5)},
+		},
+		{
+			name:     "audio",
+			message:  Message{Type: "audio", Media: media.URL + "/song.mp3", FileName: "song.mp3"},
+			wantType: "m.audio",
+			wantBody: "song.mp3",
+			wantInfo: map[string]interface{}{"mimetype": "audio/mpeg", "size": float64(5)},
+		},
+		{
+			name:     "picture",
+			message:  Message{Type: "picture", Media: media.URL + "/cat.png"},
+			wantType: "m.image",
+			wantBody: "viber-image",
+			wantInfo: map[string]interface{}{
+				"mimetype": "image/png", "size": float64(picture.Len()), "w": float64(1000), "h": float64(500),
+			},
+			wantThumbURL: "mxc://example.com/image-png",
+		},
+		{
+			name:     "undecodable picture",
+			message:  Message{Type: "picture", Media: media.URL + "/broken.png"},
+			wantType: "m.image",
+			wantBody: "viber-image",
+			wantInfo: map[string]interface{}{"mimetype": "image/png", "size": float64(5)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs.mu.Lock()
+			hs.messages = nil
+			hs.mu.Unlock()
+
+			if _, err := client.ForwardMedia(context.Background(), target, tt.message); err != nil {
+				t.Fatalf("ForwardMedia() error = %v", err)
+			}
+			if len(hs.messages) != 1 {
+				t.Fatalf("Expected 1 matrix message, got %d", len(hs.messages))
+			}
+			content := hs.messages[0]
+			if content["msgtype"] != tt.wantType || content["body"] != tt.wantBody {
+				t.Errorf("Expected %s %q, got %v %q", tt.wantType, tt.wantBody, content["msgtype"], content["body"])
+			}
+			info, _ := content["info"].(map[string]interface{})
+			for key, want := range tt.wantInfo {
+				if info[key] != want {
+					t.Errorf("Expected info.%s = %v, got %v", key, want, info[key])
+				}
+			}
+			if thumb, _ := info["thumbnail_url"].(string); thumb != tt.wantThumbURL {
+				t.Errorf("Expected thumbnail_url %q, got %q", tt.wantThumbURL, thumb)
+			}
+			if tt.wantType == "m.image" && tt.wantThumbURL != "" {
+				thumbInfo, _ := info["thumbnail_info"].(map[string]interface{})
+				if thumbInfo["w"] != float64(800) || thumbInfo["h"] != float64(400) {
+					t.Errorf("Expected an 800x400 thumbnail, got %v", thumbInfo)
+				}
+				if hash, _ := info["xyz.amorgan.blurhash"].(string); hash == "" {
+					t.Error("Expected a blurhash")
+				}
+			}
+		})
+	}
+}
+
+// TestHandleVoiceMessage tests that Viber voice messages become MSC3245 voice messages.
+func TestHandleVoiceMessage(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	// Two seconds of 8 kHz mono PCM, silent in the first half
+	pcm := make([]byte, 2*16000)
+	for i := 8000; i < 16000; i++ {
+		pcm[2*i+1] = byte(0x40 * (i % 2))
+	}
+	var wav bytes.Buffer
+	wav.WriteString("RIFF")
+	_ = binary.Write(&wav, binary.LittleEndian, uint32(36+len(pcm)))
+	wav.WriteString("WAVEfmt ")
+	_ = binary.Write(&wav, binary.LittleEndian, [8]uint16{16, 0, 1, 1, 8000, 0, 16000, 0})
+	_ = binary.Write(&wav, binary.LittleEndian, [2]uint16{2, 16})
+	wav.WriteString("data")
+	_ = binary.Write(&wav, binary.LittleEndian, uint32(len(pcm)))
+	wav.Write(pcm)
+
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/voice.wav":
+			w.Header().Set("Content-Type", "audio/wav")
+			_, _ = w.Write(wav.Bytes())
+		case "/voice.m4a":
+			w.Header().Set("Content-Type", "audio/mp4")
+			_, _ = w.Write([]byte("not decodable"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer files.Close()
+
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	target := Target{RoomID: "!room:example.com", Ghost: "@viber_abc:example.com"}
+	decoder := &media.FakeTranscoder{Caps: []media.Capability{media.TranscodeTo("audio/wav")}}
+
+	tests := []struct {
+		name         string
+		message      Message
+		transcoder   media.Transcoder
+		wantBody     string
+		wantMime     string
+		wantDuration float64
+		wantWaveform int  // Number of waveform values
+		wantLoudEnd  bool // Whether the waveform ends at its loudest
+	}{
+		{"decodable", Message{Type: "voice", Media: files.URL + "/voice.wav", Duration: 5}, nil, "viber-voice.wav", "audio/wav", 2000, 100, true},
+		{"undecodable", Message{Type: "voice", Media: files.URL + "/voice.m4a", Duration: 5}, nil, "viber-voice.m4a", "audio/mp4", 5000, 0, false},
+		{"decoded by transcoder", Message{Type: "voice", Media: files.URL + "/voice.m4a", Duration: 5}, decoder, "viber-voice.m4a", "audio/mp4", 1000, 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs.mu.Lock()
+			hs.messages = nil
+			hs.mu.Unlock()
+
+			client := NewClient(Config{APIToken: "test"}, mxClient, nil)
+			client.SetTranscoder(tt.transcoder)
+			if _, err := client.ForwardMedia(context.Background(), target, tt.message); err != nil {
+				t.Fatalf("ForwardMedia() error = %v", err)
+			}
+			if len(hs.messages) != 1 {
+				t.Fatalf("Expected 1 matrix message, got %d", len(hs.messages))
+			}
+			content := hs.messages[0]
+			if content["msgtype"] != "m.audio" || content["body"] != tt.wantBody {
+				t.Errorf("Expected m.audio %q, got %v %q", tt.wantBody, content["msgtype"], content["body"])
+			}
+			if _, ok := content["org.matrix.msc3245.voice"]; !ok {
+				t.Error("Expected the message to be marked as a voice message")
+			}
+			info, _ := content["info"].(map[string]interface{})
+			if info["mimetype"] != tt.wantMime || info["duration"] != tt.wantDuration {
+				t.Errorf("Expected %s of %v ms, got info %v", tt.wantMime, tt.wantDuration, info)
+			}
+			audio, _ := content["org.matrix.msc1767.audio"].(map[string]interface{})
+			waveform, _ := audio["waveform"].([]interface{})
+			if audio["duration"] != tt.wantDuration || len(waveform) != tt.wantWaveform {
+				t.Fatalf("Expected %v ms and %d waveform values, got %v", tt.wantDuration, tt.wantWaveform, audio)
+			}
+			if tt.wantLoudEnd && (waveform[0] != float64(0) || waveform[len(waveform)-1] != float64(1024)) {
+				t.Errorf("Expected a silent start and a loud end, got %v", waveform)
+			}
+		})
+	}
+}
+
+// TestHandleMatrixMessage_Transcoding tests converting Matrix voice messages and completing
+// video details for Viber, and the fallback to files when transcoding fails.
+func TestHandleMatrixMessage_Transcoding(t *testing.T) {
+	var sent []SendMessageRequest
+	viberAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req SendMessageRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		sent = append(sent, req)
+		_ = json.NewEncoder(w).Encode(SendMessageResponse{MessageToken: int64(1000 + len(sent))})
+	}))
+	defer viberAPI.Close()
+
+	dbPath := "/tmp/test_outbound_transcoding.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	ctx := context.Background()
+	if err := db.CreateRoomMapping(ctx, "viber_user_1", "!portal:example.com"); err != nil {
+		t.Fatalf("Failed to create room mapping: %v", err)
+	}
+
+	hs := newFakeHomeserver(t)
+	hs.files["voice"] = []byte("ogg opus")
+	hs.files["clip"] = []byte("mp4 video")
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+
+	allCaps := []media.Capability{media.TranscodeTo("audio/mp4"), media.CapabilityThumbnail, media.CapabilityDuration}
+	working := &media.FakeTranscoder{Caps: allCaps, Output: []byte("m4a"), ThumbnailJPG: []byte("jpeg"), MediaLength: 7 * time.Second}
+	failing := &media.FakeTranscoder{Caps: allCaps, Err: errors.New("invalid data")}
+
+	voice := &event.MessageEventContent{
+		MsgType:      event.MsgAudio,
+		Body:         "Voice message",
+		URL:          "mxc://example.com/voice",
+		Info:         &event.FileInfo{MimeType: "audio/ogg", Size: 8, Duration: 3200},
+		MSC3245Voice: &event.MSC3245Voice{},
+	}
+	video := &event.MessageEventContent{MsgType: event.MsgVideo, Body: "clip.mp4", URL: "mxc://example.com/clip"}
+	download := testMediaBase + "example.com/"
+
+	tests := []struct {
+		name       string
+		transcoder media.Transcoder
+		msg        *event.MessageEventContent
+		want       SendMessageRequest // Type, Media, Thumbnail, Duration, Size and FileName are compared
+	}{
+		{"voice", working, voice, SendMessageRequest{Type: "video", Media: download + "audio-mp4", Duration: 3, Size: 3}},
+		{"voice without transcoder", nil, voice, SendMessageRequest{Type: "file", Media: download + "voice", Size: 8, FileName: "viber-voice.ogg"}},
+		{"failed voice transcoding", failing, voice, SendMessageRequest{Type: "file", Media: download + "voice", Size: 8, FileName: "viber-voice.ogg"}},
+		{"video", working, video, SendMessageRequest{Type: "video", Media: download + "clip", Thumbnail: download + "image-jpeg", Duration: 7, Size: 9}},
+		{"failed video inspection", failing, video, SendMessageRequest{Type: "video", Media: download + "clip", Size: 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = nil
+			client := NewClient(Config{APIToken: "test", ViberAPIBaseURL: viberAPI.URL}, mxClient, db)
+			client.SetMediaLinker(fakeLinker{})
+			client.SetTranscoder(tt.transcoder)
+			evt := &event.Event{ID: id.EventID("$" + tt.name), Type: event.EventMessage, RoomID: "!portal:example.com", Sender: "@alice:example.com"}
+			if err := client.HandleMatrixMessage(ctx, evt, tt.msg); err != nil {
+				t.Fatalf("HandleMatrixMessage() error = %v", err)
+			}
+			if len(sent) != 1 {
+				t.Fatalf("Expected 1 message, got %d", len(sent))
+			}
+			got := SendMessageRequest{
+				Type: sent[0].Type, Media: sent[0].Media, Thumbnail: sent[0].Thumbnail,
+				Duration: sent[0].Duration, Size: sent[0].Size, FileName: sent[0].FileName,
+			}
+			if got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestForwardMedia_Cache tests that identical media is uploaded to Matrix only once.
+func TestForwardMedia_Cache(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	var downloads int
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		if strings.HasSuffix(r.URL.Path, ".mp4") {
+			w.Header().Set("Content-Type", "video/mp4")
+			_, _ = w.Write([]byte("video"))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(picture.Bytes())
+	}))
+	defer media.Close()
+
+	dbPath := "/tmp/test_viber_media_cache.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, db)
+	target := Target{RoomID: "!room:example.com", Sender: Sender{ID: "viber_user_1"}}
+
+	steps := []struct {
+		name          string
+		message       Message
+		wantDownloads int
+		wantUploads   int // Image and thumbnail
+	}{
+		{"new image", Message{Type: "picture", Media: media.URL + "/sticker.png"}, 1, 2},
+		{"same url", Message{Type: "picture", Media: media.URL + "/sticker.png"}, 1, 2},
+		{"forwarded copy", Message{Type: "picture", Media: media.URL + "/forwarded.png"}, 2, 2},
+		{"new video", Message{Type: "video", Media: media.URL + "/clip.mp4"}, 3, 3},
+		{"same video", Message{Type: "video", Media: media.URL + "/clip.mp4"}, 3, 3},
+	}
+	for _, step := range steps {
+		if _, err := client.ForwardMedia(context.Background(), target, step.message); err != nil {
+			t.Fatalf("%s: ForwardMedia() error = %v", step.name, err)
+		}
+		hs.mu.Lock()
+		uploads, last := hs.uploads, hs.messages[len(hs.messages)-1]
+		hs.mu.Unlock()
+		if downloads != step.wantDownloads || uploads != step.wantUploads {
+			t.Errorf("%s: expected %d downloads and %d uploads, got %d and %d",
+				step.name, step.wantDownloads, step.wantUploads, downloads, uploads)
+		}
+		info, _ := last["info"].(map[string]interface{})
+		if info["mimetype"] == nil || info["size"] == nil {
+			t.Errorf("%s: expected mimetype and size in %v", step.name, info)
+		}
+		if step.message.Type == "picture" && info["thumbnail_url"] == nil {
+			t.Errorf("%s: expected the cached thumbnail in %v", step.name, info)
+		}
+	}
+}
+
+// pruneCountingCache is a MediaCache that counts prunes.
+type pruneCountingCache struct {
+	MediaCache
+	prunes chan time.Duration
+}
+
+func (c *pruneCountingCache) PruneMediaCache(_ context.Context, ttl time.Duration, _ int) (int64, error) {
+	c.prunes <- ttl
+	return 0, nil
+}
+
+// TestStartMediaCachePruning tests that the media cache is pruned by the background loop rather than on upload.
+func TestStartMediaCachePruning(t *testing.T) {
+	dbPath := "/tmp/test_viber_media_prune.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	client := NewClient(Config{APIToken: "test", MediaCacheTTL: time.Hour}, nil, db)
+	cache := &pruneCountingCache{MediaCache: db, prunes: make(chan time.Duration, 10)}
+	client.SetMediaCache(cache)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.storeMedia(ctx, "https://viber.example/a.png", "hash", id.ContentURI{Homeserver: "example.com", FileID: "a"}, &event.FileInfo{MimeType: "image/png"})
+	if len(cache.prunes) != 0 {
+		t.Fatalf("Expected no prune on upload, got %d", len(cache.prunes))
+	}
+
+	client.StartMediaCachePruning(ctx)
+	select {
+	case ttl := <-cache.prunes:
+		if ttl != time.Hour {
+			t.Errorf("Expected the configured TTL, got %v", ttl)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the cache to be pruned on start")
+	}
+}
+
+// TestForwardSticker tests that Viber stickers become m.sticker events and are fetched once per sticker ID.
+func TestForwardSticker(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	var sticker bytes.Buffer
+	if err := png.Encode(&sticker, image.NewRGBA(image.Rect(0, 0, 490, 490))); err != nil {
+		t.Fatalf("Failed to encode test sticker: %v", err)
+	}
+	var downloads int
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(sticker.Bytes())
+	}))
+	defer media.Close()
+
+	dbPath := "/tmp/test_viber_stickers.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, db)
+	client.SetMediaCache(nil) // Only the sticker catalog avoids downloads
+	target := Target{RoomID: "!room:example.com", Sender: Sender{ID: "viber_user_1"}}
+
+	// Viber sends a new, expiring media URL with every sticker message
+	for i := 0; i < 2; i++ {
+		m := Message{Type: "sticker", StickerID: 40133, Media: fmt.Sprintf("%s/sticker-%d.png", media.URL, i)}
+		if _, err := client.ForwardMedia(context.Background(), target, m); err != nil {
+			t.Fatalf("ForwardMedia() error = %v", err)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("Expected the sticker to be downloaded once, got %d downloads", downloads)
+	}
+	if len(hs.messages) != 2 {
+		t.Fatalf("Expected 2 matrix events, got %d", len(hs.messages))
+	}
+	for i, content := range hs.messages {
+		if hs.eventTypes[i] != "m.sticker" {
+			t.Errorf("Expected m.sticker, got %s", hs.eventTypes[i])
+		}
+		info, _ := content["info"].(map[string]interface{})
+		if content["url"] != hs.messages[0]["url"] || info["w"] != float64(490) || info["h"] != float64(490) {
+			t.Errorf("Unexpected sticker content %v", content)
+		}
+	}
+
+	stored, err := db.GetViberSticker(context.Background(), 40133)
+	if err != nil || stored == nil || stored.MXC != hs.messages[0]["url"] || stored.Width != 490 {
+		t.Errorf("Expected the sticker to be catalogued, got %+v, %v", stored, err)
+	}
+}
+
+// TestStreamMedia tests the size limit, MIME detection, progress and cancellation of media transfers.
+func TestStreamMedia(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 100)...)
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.bin":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(png)
+		case "/declared-large":
+			w.Header().Set("Content-Length", "2048")
+			_, _ = w.Write(make([]byte, 2048))
+		case "/undeclared-large":
+			// Flushing forces a chunked response without Content-Length
+			for i := 0; i < 4; i++ {
+				_, _ = w.Write(make([]byte, 512))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer media.Close()
+
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test", MaxMediaSize: 1024}, mxClient, nil)
+	target := Target{RoomID: "!room:example.com"}
+
+	tests := []struct {
+		name     string
+		url      string
+		cancel   bool
+		wantErr  error
+		wantMime string
+	}{
+		{name: "sniffs generic content type", url: media.URL + "/image.bin", wantMime: "image/png"},
+		{name: "declared length over limit", url: media.URL + "/declared-large", wantErr: ErrMediaTooLarge},
+		{name: "streamed length over limit", url: media.URL + "/undeclared-large", wantErr: ErrMediaTooLarge},
+		{name: "cancelled", url: media.URL + "/image.bin", cancel: true, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs.mu.Lock()
+			hs.messages = nil
+			hs.mu.Unlock()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			_, err := client.streamMediaTo(ctx, target, event.MsgFile, tt.url, "file", &event.FileInfo{MimeType: "video/mp4"}, nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expected %v, got %v", tt.wantErr, err)
+				}
+				if len(hs.messages) != 0 {
+					t.Errorf("Expected nothing to be sent, got %v", hs.messages)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("streamMediaTo() error = %v", err)
+			}
+			info, _ := hs.messages[0]["info"].(map[string]interface{})
+			if info["mimetype"] != tt.wantMime || info["size"] != float64(len(png)) {
+				t.Errorf("Unexpected info %v", info)
+			}
+		})
+	}
+}
+
+// TestUploadFile_Progress tests that UploadFile reports byte-level progress.
+func TestUploadFile_Progress(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	const size = 3*progressInterval + 100
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		_, _ = w.Write(make([]byte, size))
+	}))
+	defer media.Close()
+
+	mxClient, err := mx.NewClient(mx.Config{HomeserverURL: hs.URL, AccessToken: "token", UserID: "@bridge:example.com", DefaultRoomID: "!room:example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, nil)
+
+	progress := make(chan FileUploadProgress, 100)
+	if err := client.UploadFile(context.Background(), media.URL+"/report.pdf", "report.pdf", "", progress); err != nil {
+		t.Fatalf("UploadFile() error = %v", err)
+	}
+	var updates []FileUploadProgress
+	for p := range progress {
+		updates = append(updates, p)
+	}
+
+	if len(updates) < 5 || updates[0].Status != "downloading" {
+		t.Fatalf("Expected downloading, several uploading and a complete update, got %+v", updates)
+	}
+	var last int64
+	for _, p := range updates[1 : len(updates)-1] {
+		if p.Status != "uploading" || p.BytesUploaded <= last || p.TotalBytes != size {
+			t.Errorf("Unexpected progress update %+v after %d bytes", p, last)
+		}
+		last = p.BytesUploaded
+	}
+	if done := updates[len(updates)-1]; done.Status != "complete" || done.BytesUploaded != size || done.PercentComplete != 100 {
+		t.Errorf("Unexpected final update %+v", done)
+	}
+	if len(hs.messages) != 1 || hs.messages[0]["msgtype"] != "m.file" {
+		t.Errorf("Expected one m.file message, got %v", hs.messages)
+	}
+}
+
+// TestWebhookHandler_Router tests dispatching to built-in and registered handlers.
+func TestWebhookHandler_Router(t *testing.T) {
+	hs := newFakeHomeserver(t)
+
+	dbPath := "/tmp/test_webhook_router.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	mxClient, err := mx.NewClient(mx.Config{
+		HomeserverURL: hs.URL,
+		AccessToken:   "token",
+		UserID:        "@bridge:example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, db)
+
+	var seen []WebhookRequest
+	client.RegisterEventHandler(EventSeen, func(ctx context.Context, payload WebhookRequest) error {
+		seen = append(seen, payload)
+		return nil
+	})
+	var stickerTarget Target
+	client.RegisterMessageHandler(MessageTypeSticker, func(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+		stickerTarget = msg.Target
+		return "$sticker", nil
+	})
+
+	post := func(payload WebhookRequest) {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		w := httptest.NewRecorder()
+		client.WebhookHandler(w, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	}
+	sender := Sender{ID: "viber_user_1", Name: "Alice"}
+
+	post(WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 1,
+		Message: Message{Type: MessageTypeLocation, Location: &Location{Lat: 1.5, Lon: 2.5}}})
+	if len(hs.messages) != 1 || hs.messages[0]["msgtype"] != "m.location" || hs.messages[0]["geo_uri"] != "geo:1.500000,2.500000" {
+		t.Errorf("Expected location to be bridged, got %v", hs.messages)
+	}
+
+	post(WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 2,
+		Message: Message{Type: MessageTypeSticker, StickerID: 40100, Media: "https://example.com/sticker.png"}})
+	if stickerTarget.RoomID != "!portal:example.com" || stickerTarget.Sender.ID != sender.ID {
+		t.Errorf("Registered sticker handler got target %+v", stickerTarget)
+	}
+	if eventID, _ := db.GetMatrixEventID(context.Background(), "2"); eventID != "$sticker" {
+		t.Errorf("Expected sticker mapping to '$sticker', got %q", eventID)
+	}
+
+	post(WebhookRequest{Event: EventSeen, UserID: sender.ID, MessageToken: 99})
+	if len(seen) != 1 || seen[0].MessageToken != 99 {
+		t.Errorf("Expected registered seen handler to run once, got %v", seen)
+	}
+}
+
+// TestWebhookHandler_Duplicates tests that retried callbacks are acknowledged but not bridged twice.
+func TestWebhookHandler_Duplicates(t *testing.T) {
+	hs := newFakeHomeserver(t)
+
+	dbPath := "/tmp/test_webhook_dedup.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	mxClient, err := mx.NewClient(mx.Config{
+		HomeserverURL: hs.URL,
+		AccessToken:   "token",
+		UserID:        "@bridge:example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, db)
+
+	var seen int
+	client.RegisterEventHandler(EventSeen, func(ctx context.Context, payload WebhookRequest) error {
+		seen++
+		return nil
+	})
+
+	sender := Sender{ID: "viber_user_1", Name: "Alice"}
+	payloads := []WebhookRequest{
+		{Event: EventMessage, Sender: sender, MessageToken: 7, Message: Message{Type: MessageTypeText, Text: "hello"}},
+		{Event: EventMessage, Sender: sender, MessageToken: 7, Message: Message{Type: MessageTypeText, Text: "hello"}},
+		// Same token with a different event is a distinct callback
+		{Event: EventSeen, UserID: sender.ID, MessageToken: 7},
+		{Event: EventSeen, UserID: sender.ID, MessageToken: 7},
+	}
+	for i, payload := range payloads {
+		body, _ := json.Marshal(payload)
+		w := httptest.NewRecorder()
+		client.WebhookHandler(w, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("payload %d: expected 200, got %d", i, w.Code)
+		}
+	}
+
+	if len(hs.messages) != 1 {
+		t.Errorf("Expected message to be bridged once, got %d", len(hs.messages))
+	}
+	if seen != 1 {
+		t.Errorf("Expected seen handler to run once, got %d", seen)
+	}
+}
+
+// TestWebhookHandler_InlineFailure tests that a callback bridged inline is redelivered after a transient failure.
+func TestWebhookHandler_InlineFailure(t *testing.T) {
+	hs := newFakeHomeserver(t)
+
+	dbPath := "/tmp/test_webhook_inline_failure.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	mxClient, err := mx.NewClient(mx.Config{
+		HomeserverURL: hs.URL,
+		AccessToken:   "token",
+		UserID:        "@bridge:example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, db)
+
+	var calls int
+	client.RegisterMessageHandler(MessageTypeSticker, func(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+		calls++
+		if calls == 1 {
+			return "", mautrix.HTTPError{Response: &http.Response{StatusCode: http.StatusBadGateway}}
+		}
+		return "$sticker", nil
+	})
+	client.RegisterMessageHandler(MessageTypeContact, func(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+		calls++
+		return "", errors.New("contact message without contact")
+	})
+
+	sender := Sender{ID: "viber_user_1", Name: "Alice"}
+	post := func(payload WebhookRequest) int {
+		body, _ := json.Marshal(payload)
+		w := httptest.NewRecorder()
+		client.WebhookHandler(w, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	// A transient failure asks Viber to retry, and the retry is not ignored as a duplicate
+	sticker := WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 1, Message: Message{Type: MessageTypeSticker}}
+	if code := post(sticker); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after a transient failure, got %d", code)
+	}
+	if code := post(sticker); code != http.StatusOK || calls != 2 {
+		t.Errorf("Expected the redelivery to be bridged, got %d after %d calls", code, calls)
+	}
+
+	// A permanent failure is acknowledged, and its redelivery is a duplicate
+	contact := WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 2, Message: Message{Type: MessageTypeContact}}
+	for i := 0; i < 2; i++ {
+		if code := post(contact); code != http.StatusOK {
+			t.Errorf("Expected 200 for a permanent failure, got %d", code)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("Expected the contact to be attempted once, got %d calls in total", calls)
+	}
+}
+
+// TestWebhookHandler_Inbox tests asynchronous processing and resuming of persisted callbacks.
+func TestWebhookHandler_Inbox(t *testing.T) {
+	hs := newFakeHomeserver(t)
+
+	dbPath := "/tmp/test_webhook_inbox.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	mxClient, err := mx.NewClient(mx.Config{
+		HomeserverURL: hs.URL,
+		AccessToken:   "token",
+		UserID:        "@bridge:example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test", InboxWorkers: 1}, mxClient, db)
+
+	// A callback accepted before a crash is still waiting in the inbox
+	sender := Sender{ID: "viber_user_1", Name: "Alice"}
+	leftover, _ := json.Marshal(WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 1,
+		Message: Message{Type: MessageTypeText, Text: "before restart"}})
+	if _, err := db.EnqueueJob(context.Background(), database.QueueJob{Queue: inboxQueueName, Type: inboxJobType, Payload: leftover}); err != nil {
+		t.Fatalf("Failed to enqueue webhook: %v", err)
+	}
+
+	if err := client.StartInbox(context.Background()); err != nil {
+		t.Fatalf("StartInbox() error = %v", err)
+	}
+	defer func() { _ = client.StopInbox(context.Background()) }()
+
+	body, _ := json.Marshal(WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 2,
+		Message: Message{Type: MessageTypeText, Text: "after restart"}})
+	w := httptest.NewRecorder()
+	client.WebhookHandler(w, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hs.mu.Lock()
+		n := len(hs.messages)
+		hs.mu.Unlock()
+		pending, err := db.CountJobs(context.Background(), "")
+		if err != nil {
+			t.Fatalf("CountJobs() error = %v", err)
+		}
+		if n == 2 && pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 bridged messages and an empty inbox, got %d messages and %d pending", n, pending)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestInbox_Process tests how failed callbacks are classified and that retries do not bridge twice.
+func TestInbox_Process(t *testing.T) {
+	hs := newFakeHomeserver(t)
+
+	dbPath := "/tmp/test_webhook_inbox_process.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	mxClient, err := mx.NewClient(mx.Config{
+		HomeserverURL: hs.URL,
+		AccessToken:   "token",
+		UserID:        "@bridge:example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, db)
+	homeserverStatus := http.StatusBadGateway
+	client.RegisterMessageHandler(MessageTypeSticker, func(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+		return "", mautrix.HTTPError{Response: &http.Response{StatusCode: homeserverStatus}}
+	})
+	ib := &inbox{client: client}
+
+	sender := Sender{ID: "viber_user_1", Name: "Alice"}
+	process := func(ctx context.Context, payload WebhookRequest) error {
+		t.Helper()
+		raw, _ := json.Marshal(payload)
+		return ib.process(ctx, queue.MessageJob{Type: inboxJobType, Payload: raw})
+	}
+
+	tests := []struct {
+		name          string
+		payload       WebhookRequest
+		wantPermanent bool
+	}{
+		{name: "unsupported type", wantPermanent: true,
+			payload: WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 1, Message: Message{Type: "hologram"}}},
+		{name: "location without coordinates", wantPermanent: true,
+			payload: WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 2, Message: Message{Type: MessageTypeLocation}}},
+		{name: "contact without contact", wantPermanent: true,
+			payload: WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 3, Message: Message{Type: MessageTypeContact}}},
+		{name: "homeserver unavailable", wantPermanent: false,
+			payload: WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 4, Message: Message{Type: MessageTypeSticker}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := process(context.Background(), tt.payload)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if permanent := errors.Is(err, queue.ErrPermanent); permanent != tt.wantPermanent {
+				t.Errorf("Expected permanent = %v, got %v (%v)", tt.wantPermanent, permanent, err)
+			}
+		})
+	}
+
+	homeserverStatus = http.StatusForbidden
+	sticker := WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 5, Message: Message{Type: MessageTypeSticker}}
+	if err := process(context.Background(), sticker); !errors.Is(err, queue.ErrPermanent) {
+		t.Errorf("Expected a rejected send to be permanent, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := process(ctx, sticker); err == nil || errors.Is(err, queue.ErrPermanent) {
+		t.Errorf("Expected a cancelled callback to be retried, got %v", err)
+	}
+
+	// A retried callback whose message was bridged is not sent again
+	text := WebhookRequest{Event: EventMessage, Sender: sender, MessageToken: 6, Message: Message{Type: MessageTypeText, Text: "hello"}}
+	for i := 0; i < 2; i++ {
+		if err := process(context.Background(), text); err != nil {
+			t.Fatalf("process() attempt %d error = %v", i+1, err)
+		}
+	}
+	if len(hs.messages) != 1 {
+		t.Errorf("Expected message to be bridged once, got %d", len(hs.messages))
+	}
+}
+
+// TestInbox_PortalFailure tests that a message whose portal cannot be created is retried, not sent to the default room.
+func TestInbox_PortalFailure(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	hs.failCreateRoom = true
+
+	dbPath := "/tmp/test_webhook_portal_failure.db"
+	_ = os.Remove(dbPath)
+	defer func() { _ = os.Remove(dbPath) }()
+	db, err := database.Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	mxClient, err := mx.NewClient(mx.Config{
+		HomeserverURL: hs.URL,
+		AccessToken:   "token",
+		UserID:        "@bridge:example.com",
+		DefaultRoomID: "!default:example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create matrix client: %v", err)
+	}
+	client := NewClient(Config{APIToken: "test"}, mxClient, db)
+	ib := &inbox{client: client}
+
+	raw, _ := json.Marshal(WebhookRequest{Event: EventMessage, Sender: Sender{ID: "viber_user_1", Name: "Alice"}, MessageToken: 1,
+		Message: Message{Type: MessageTypeText, Text: "private"}})
+	err = ib.process(context.Background(), queue.MessageJob{Type: inboxJobType, Payload: raw})
+	if err == nil || errors.Is(err, queue.ErrPermanent) {
+		t.Errorf("Expected a retryable error, got %v", err)
+	}
+	if len(hs.messages) != 0 {
+		t.Errorf("Expected nothing to be sent to the default room, got %v", hs.messages)
+	}
+}
+
+// TestOrderingKey tests that only messages share their conversation's ordering key.
+func TestOrderingKey(t *testing.T) {
+	sender := Sender{ID: "viber_user_1"}
+	tests := []struct {
+		name    string
+		payload WebhookRequest
+		want    string
+	}{
+		{name: "direct message", payload: WebhookRequest{Event: EventMessage, Sender: sender}, want: "viber_user_1"},
+		{name: "group message", payload: WebhookRequest{Event: EventMessage, Sender: sender, Message: Message{ChatID: "group_1"}}, want: "group_1"},
+		{name: "seen", payload: WebhookRequest{Event: EventSeen, UserID: "viber_user_1"}, want: "seen:viber_user_1"},
+		{name: "delivered", payload: WebhookRequest{Event: EventDelivered, UserID: "viber_user_1"}, want: "delivered:viber_user_1"},
+		{name: "subscribed", payload: WebhookRequest{Event: EventSubscribed, User: Sender{ID: "viber_user_1"}}, want: "subscribed:viber_user_1"},
+		{name: "webhook", payload: WebhookRequest{Event: EventWebhook}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderingKey(tt.payload); got != tt.want {
+				t.Errorf("orderingKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDecodeWebhookRequest tests strict decoding of Viber callbacks.
+func TestDecodeWebhookRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+		check   func(t *testing.T, r WebhookRequest)
+	}{
+		{
+			name: "location message",
+			body: `{"event":"message","timestamp":1457764197627,"message_token":4912661846655238145,
+				"sender":{"id":"01234567890A=","name":"John McClane","api_version":1},
+				"message":{"type":"location","location":{"lat":50.76891,"lon":6.11499},"tracking_data":"tracking"}}`,
+			check: func(t *testing.T, r WebhookRequest) {
+				if r.Message.Location == nil || r.Message.Location.Lat != 50.76891 {
+					t.Errorf("Location not decoded: %+v", r.Message.Location)
+				}
+				if r.Timestamp != 1457764197627 || r.MessageToken != 4912661846655238145 || r.Message.TrackingData != "tracking" {
+					t.Errorf("Metadata not decoded: %+v", r)
+				}
+				if len(r.UnknownFieldNames()) != 0 {
+					t.Errorf("Expected no unknown fields, got %v", r.UnknownFieldNames())
+				}
+			},
+		},
+		{
+			name: "video message",
+			body: `{"event":"message","message":{"type":"video","media":"https://example.com/v.mp4","size":10000,"duration":12}}`,
+			check: func(t *testing.T, r WebhookRequest) {
+				if r.Message.Size != 10000 || r.Message.Duration != 12 {
+					t.Errorf("Media metadata not decoded: %+v", r.Message)
+				}
+			},
+		},
+		{
+			name: "conversation started",
+			body: `{"event":"conversation_started","type":"open","context":"ref","subscribed":true,"user":{"id":"u1","name":"Jane"}}`,
+			check: func(t *testing.T, r WebhookRequest) {
+				if r.User.ID != "u1" || r.Context != "ref" || !r.Subscribed || r.Type != "open" {
+					t.Errorf("Conversation fields not decoded: %+v", r)
+				}
+			},
+		},
+		{
+			name: "failed with desc",
+			body: `{"event":"failed","user_id":"u1","message_token":1,"desc":"failure description"}`,
+			check: func(t *testing.T, r WebhookRequest) {
+				if r.UserID != "u1" || r.Desc != "failure description" {
+					t.Errorf("Failure fields not decoded: %+v", r)
+				}
+			},
+		},
+		{
+			name: "unknown fields kept",
+			body: `{"event":"message","silent":true,"message":{"type":"text","text":"hi","reply_to":5}}`,
+			check: func(t *testing.T, r WebhookRequest) {
+				if string(r.Unknown["silent"]) != "true" || string(r.Message.Unknown["reply_to"]) != "5" {
+					t.Errorf("Unknown fields not kept: %v / %v", r.Unknown, r.Message.Unknown)
+				}
+			},
+		},
+		{name: "type mismatch", body: `{"event":"message","message_token":"abc"}`, wantErr: true},
+		{name: "missing event", body: `{"message":{"type":"text"}}`, wantErr: true},
+		{name: "not json", body: `nope`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := DecodeWebhookRequest([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeWebhookRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, r)
+			}
+		})
+	}
+}
+
+// TestCallAPI_Errors tests mapping of Viber API failures to typed errors and retries.
+func TestCallAPI_Errors(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    []func(w http.ResponseWriter) // Replayed in order, the last one repeating
+		wantErr      error                         // nil when the call should succeed
+		wantAttempts int
+	}{
+		{
+			name:         "receiver not subscribed",
+			responses:    []func(w http.ResponseWriter){viberStatus(StatusReceiverNotSubscribed)},
+			wantErr:      ErrReceiverNotSubscribed,
+			wantAttempts: 1,
+		},
+		{
+			name:         "bad auth token",
+			responses:    []func(w http.ResponseWriter){viberStatus(StatusInvalidAuthToken)},
+			wantErr:      ErrInvalidAuthToken,
+			wantAttempts: 1,
+		},
+		{
+			name: "server error is retried",
+			responses: []func(w http.ResponseWriter){
+				httpStatus(http.StatusServiceUnavailable, ""),
+				httpStatus(http.StatusBadGateway, ""),
+				viberStatus(StatusOK),
+			},
+			wantAttempts: 3,
+		},
+		{
+			name:         "rate limit is retried",
+			responses:    []func(w http.ResponseWriter){viberStatus(StatusTooManyRequests), viberStatus(StatusOK)},
+			wantAttempts: 2,
+		},
+		{
+			name:         "retry-after beyond max delay is not waited out",
+			responses:    []func(w http.ResponseWriter){httpStatus(http.StatusTooManyRequests, "60")},
+			wantErr:      ErrTooManyRequests,
+			wantAttempts: 1,
+		},
+		{
+			name:         "persistent server error",
+			responses:    []func(w http.ResponseWriter){httpStatus(http.StatusInternalServerError, "")},
+			wantErr:      ErrServiceUnavailable,
+			wantAttempts: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.URL.Path != "/pa/send_message" || r.Header.Get("X-Viber-Auth-Token") != "test-token" {
+					t.Errorf("Unexpected request %s", r.URL.Path)
+				}
+				tt.responses[min(attempts, len(tt.responses)-1)](w)
+				attempts++
+			}))
+			defer server.Close()
+
+			client := NewClient(Config{APIToken: "test-token", ViberAPIBaseURL: server.URL, APIRetry: testAPIRetry()}, nil, nil)
+			resp, err := client.SendText(context.Background(), "user1", "hello")
+
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("SendText() error = %v", err)
+			}
+			if tt.wantErr != nil {
+				var apiErr *APIError
+				if !errors.Is(err, tt.wantErr) || !errors.As(err, &apiErr) || apiErr.Endpoint != "send_message" {
+					t.Fatalf("SendText() error = %v, want %v", err, tt.wantErr)
+				}
+			}
+			if tt.wantErr == nil && resp.MessageToken != 1001 {
+				t.Errorf("Expected message token 1001, got %d", resp.MessageToken)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("Expected %d attempts, got %d", tt.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+// TestCallAPI_CircuitBreaker tests that an endpoint failing persistently is short-circuited.
+func TestCallAPI_CircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/pa/send_message" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": StatusOK, "user": map[string]string{"id": "user1", "name": "Alice"}})
+	}))
+	defer server.Close()
+
+	cfg := testAPIRetry()
+	cfg.MaxAttempts = 1
+	client := NewClient(Config{APIToken: "test-token", ViberAPIBaseURL: server.URL, APIRetry: cfg}, nil, nil)
+	ctx := context.Background()
+
+	for i := 0; i < breakerMaxFailures; i++ {
+		if _, err := client.SendText(ctx, "user1", "hello"); !errors.Is(err, ErrServiceUnavailable) {
+			t.Fatalf("SendText() error = %v, want service unavailable", err)
+		}
+	}
+	if _, err := client.SendText(ctx, "user1", "hello"); !errors.Is(err, circuitbreaker.ErrCircuitOpen) {
+		t.Fatalf("SendText() error = %v, want open circuit", err)
+	}
+	if calls["/pa/send_message"] != breakerMaxFailures {
+		t.Errorf("Expected %d send_message calls, got %d", breakerMaxFailures, calls["/pa/send_message"])
+	}
+	if got := client.breaker(endpointSendMessage).GetState(); got != circuitbreaker.StateOpen {
+		t.Errorf("Expected send_message circuit open, got %s", got)
+	}
+
+	// Other endpoints have their own breaker
+	user, err := client.GetUserDetails(ctx, "user1")
+	if err != nil || user.Name != "Alice" {
+		t.Errorf("GetUserDetails() = %+v, %v", user, err)
+	}
+}
+
+// testAPIRetry returns a fast retry policy for API tests.
+func testAPIRetry() retry.Config {
+	return retry.Config{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond, Multiplier: 2}
+}
+
+// viberStatus responds with HTTP 200 and the given Viber status.
+func viberStatus(status int) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "status_message": "status", "message_token": 1001})
+	}
+}
+
+// httpStatus responds with an HTTP error status and optional Retry-After header.
+func httpStatus(code int, retryAfter string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(code)
+	}
+}
+
+// TestSendMessage_RateLimit tests client-side send pacing and its reaction to Viber throttling.
+func TestSendMessage_RateLimit(t *testing.T) {
+	var mu sync.Mutex
+	throttle := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if throttle {
+			httpStatus(http.StatusTooManyRequests, "60")(w)
+			return
+		}
+		viberStatus(StatusOK)(w)
+	}))
+	defer server.Close()
+
+	client := NewClient(Config{
+		APIToken:        "test-token",
+		ViberAPIBaseURL: server.URL,
+		APIRetry:        testAPIRetry(),
+		SendLimit:       ratelimit.Config{Rate: 1000, Burst: 100, KeyRate: 1, KeyBurst: 1},
+	}, nil, nil)
+	ctx := context.Background()
+
+	if _, err := client.SendText(ctx, "user1", "first"); err != nil {
+		t.Fatalf("SendText() error = %v", err)
+	}
+	// The receiver's bucket is empty and sends fail fast without a maximum wait
+	if _, err := client.SendText(ctx, "user1", "second"); !errors.Is(err, ratelimit.ErrLimited) {
+		t.Fatalf("SendText() error = %v, want rate limited", err)
+	}
+	if _, err := client.SendText(ctx, "user2", "other receiver"); err != nil {
+		t.Fatalf("SendText() error = %v", err)
+	}
+
+	// A Retry-After from Viber pauses sends to every receiver
+	mu.Lock()
+	throttle = true
+	mu.Unlock()
+	if _, err := client.SendText(ctx, "user3", "throttled"); !errors.Is(err, ErrTooManyRequests) {
+		t.Fatalf("SendText() error = %v, want too many requests", err)
+	}
+	if _, err := client.SendText(ctx, "user4", "paused"); !errors.Is(err, ratelimit.ErrLimited) {
+		t.Errorf("SendText() error = %v, want rate limited while paused", err)
+	}
+}
+
+// TestSenderName tests rendering and truncation of Matrix sender names.
+func TestSenderName(t *testing.T) {
+	tests := []struct {
+		name        string
+		template    string
+		userID      id.UserID
+		displayName string
+		want        string
+	}{
+		{"default template", "", "@alice:example.com", "Alice", "Alice"},
+		{"custom template", "{{.DisplayName}} ({{.Server}})", "@alice:example.com", "Alice", "Alice (example.com)"},
+		{"missing display name", "", "@alice:example.com", "  ", "alice"},
+		{"user id", "{{.UserID}}", "@alice:example.com", "Alice", "@alice:example.com"},
+		{"truncated", "", "@alice:example.com", "Alice Wonderland of the Looking Glass", "Alice Wonderland of the Loo…"},
+		{"truncated by characters", "", "@yuki:example.com", "雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪", "雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪雪…"},
+		{"invalid template falls back", "{{.DisplayName", "@alice:example.com", "Alice", "Alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(Config{SenderNameTemplate: tt.template}, nil, nil)
+			got := client.senderName(tt.userID, tt.displayName)
+			if got != tt.want {
+				t.Errorf("senderName() = %q, want %q", got, tt.want)
+			}
+			if n := len([]rune(got)); n > MaxSenderNameLength {
+				t.Errorf("senderName() is %d characters, limit is %d", n, MaxSenderNameLength)
+			}
+		})
+	}
+}
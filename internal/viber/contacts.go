@@ -1,35 +1,61 @@
-// Package viber contacts handles contact card sharing (vCard) messages.
+// Package viber contacts bridges contact cards as vCard files in both directions.
 package viber
 
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/media"
 )
 
-// HandleContact handles a Viber contact card message and forwards it to Matrix.
-func (c *Client) HandleContact(ctx context.Context, contactName, phoneNumber, avatarURL string) error {
+// maxVCardSize bounds vCards downloaded from Matrix; cards with embedded photos stay well below it.
+const maxVCardSize = 1 << 20
+
+// unsafeFilenameChars matches characters replaced in vCard filenames.
+var unsafeFilenameChars = regexp.MustCompile(`[^\p{L}\p{N} ._-]+`)
+
+// HandleContact forwards a Viber contact card to the target Matrix room as a vCard file.
+// The message body keeps a text version of the card for clients that do not open vCards.
+func (c *Client) HandleContact(ctx context.Context, t Target, contactName, phoneNumber, avatarURL string) (id.EventID, error) {
 	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
+		return "", fmt.Errorf("matrix client not configured")
+	}
+	if t.RoomID == "" {
+		return "", fmt.Errorf("no matrix room for viber sender %s", t.Sender.ID)
 	}
 
-	// Format contact card as text
 	contactText := fmt.Sprintf("📇 Contact Card\nName: %s\nPhone: %s", contactName, phoneNumber)
-	if avatarURL != "" {
-		contactText += fmt.Sprintf("\nAvatar: %s", avatarURL)
+	if t.Ghost == "" && t.Sender.Name != "" {
+		contactText = fmt.Sprintf("[Viber] %s: %s", t.Sender.Name, contactText)
 	}
 
-	return c.matrix.SendText(ctx, contactText)
+	vcard := media.EncodeVCard(media.Contact{Name: contactName, Phone: phoneNumber, PhotoURL: avatarURL})
+	uri, err := c.matrix.UploadMediaAs(ctx, t.Ghost, vcard, media.VCardMimeType)
+	if err != nil {
+		// Losing the attachment is better than losing the contact
+		logger.WarnWithContext(ctx, "failed to upload vcard, sending contact as text",
+			"error", err,
+		)
+		return c.sendTextTo(ctx, t, contactText)
+	}
+	info := &event.FileInfo{MimeType: media.VCardMimeType, Size: len(vcard)}
+	return c.matrix.SendCaptionedMedia(ctx, t.RoomID, t.Ghost, event.MsgFile, vcardFilename(contactName), contactText, uri, info)
 }
 
-// ForwardContact forwards a contact from Viber contact message.
-func (c *Client) ForwardContact(ctx context.Context, contactData string) error {
-	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
+// vcardFilename returns a .vcf filename for a contact.
+func vcardFilename(name string) string {
+	name = strings.TrimSpace(unsafeFilenameChars.ReplaceAllString(name, "_"))
+	if name == "" {
+		name = "contact"
 	}
-
-	// Parse vCard data if needed
-	text := fmt.Sprintf("[Contact Card] %s", contactData)
-	return c.matrix.SendText(ctx, text)
+	return name + ".vcf"
 }
 
 // SendContactToViber sends a contact card message to Viber from Matrix.
@@ -42,3 +68,79 @@ func (c *Client) SendContactToViber(ctx context.Context, receiver string, contac
 	_, err := c.SendContact(ctx, receiver, contact)
 	return err
 }
+
+// isVCard reports whether a Matrix file message is a vCard.
+func isVCard(msg *event.MessageEventContent) bool {
+	if msg.Info != nil {
+		switch strings.ToLower(msg.Info.MimeType) {
+		case "text/vcard", "text/x-vcard", "text/directory":
+			return true
+		}
+	}
+	filename := msg.FileName
+	if filename == "" {
+		filename = msg.Body
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".vcf" || ext == ".vcard"
+}
+
+// sendMatrixVCard sends a Matrix vCard file as a Viber contact with the card's name, phone
+// number and photo. Embedded photos are uploaded to Matrix, since Viber needs a link.
+// A Viber contact holds a single card, so files with several cards fail with
+// media.ErrMultipleVCards and are left for the caller to send as files.
+func (c *Client) sendMatrixVCard(ctx context.Context, receiver string, msg *event.MessageEventContent, opts ...SendOption) (*SendMessageResponse, error) {
+	data, err := c.matrix.DownloadMedia(ctx, msg.URL, maxVCardSize)
+	if err != nil {
+		return nil, err
+	}
+	card, err := media.ParseVCard(data)
+	if err != nil {
+		return nil, err
+	}
+	if card.Phone == "" {
+		return nil, fmt.Errorf("vcard of %q has no phone number", card.Name)
+	}
+
+	contact := Contact{Name: card.Name, PhoneNumber: card.Phone, Avatar: card.PhotoURL}
+	if contact.Name == "" {
+		contact.Name = card.Phone
+	}
+	if contact.Avatar == "" && len(card.Photo) > 0 {
+		contact.Avatar, err = c.uploadContactPhoto(ctx, card)
+		if err != nil {
+			logger.WarnWithContext(ctx, "failed to attach vcard photo",
+				"error", err,
+			)
+		}
+	}
+	return c.SendContact(ctx, receiver, contact, opts...)
+}
+
+// uploadContactPhoto uploads the photo embedded in a vCard and returns a URL Viber can fetch it from.
+func (c *Client) uploadContactPhoto(ctx context.Context, card *media.Contact) (string, error) {
+	if c.media == nil {
+		return "", errNoMediaLinker
+	}
+	mimeType := card.PhotoMimeType
+	if mimeType == "" {
+		mimeType = "image/jpeg"
+	}
+	uri, err := c.matrix.UploadMediaAs(ctx, "", card.Photo, mimeType)
+	if err != nil {
+		return "", err
+	}
+	return c.mediaURL(uri.CUString(), "avatar"+extensionFor(mimeType))
+}
+
+// extensionFor returns the usual file extension of an image MIME type.
+func extensionFor(mimeType string) string {
+	switch mimeType {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	default:
+		return ".jpg"
+	}
+}
@@ -0,0 +1,63 @@
+// Package viber dedup keeps Viber webhook retries from being bridged twice.
+package viber
+
+import (
+	"context"
+	"time"
+
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/metrics"
+)
+
+// DefaultDedupRetention is how long processed callbacks are remembered when not configured.
+const DefaultDedupRetention = 24 * time.Hour
+
+// DedupStore remembers processed webhook callbacks keyed by message token and event type.
+// Implemented by *database.DB for single instances and *cache.Cache (Redis) for
+// multi-replica deployments.
+type DedupStore interface {
+	// MarkWebhookProcessed records the callback and reports whether it was seen for the first time.
+	MarkWebhookProcessed(ctx context.Context, messageToken int64, event string, retention time.Duration) (bool, error)
+	// UnmarkWebhookProcessed forgets a recorded callback, so that its next delivery is processed.
+	UnmarkWebhookProcessed(ctx context.Context, messageToken int64, event string) error
+}
+
+// SetDedupStore replaces the store used to detect duplicate webhook callbacks.
+// A nil store disables deduplication.
+func (c *Client) SetDedupStore(store DedupStore) {
+	c.dedup = store
+}
+
+// isDuplicate reports whether a callback was already processed.
+// Callbacks without a message token are never considered duplicates. Callers treat
+// store errors as new callbacks, preferring a rare duplicate over a dropped message.
+func (c *Client) isDuplicate(ctx context.Context, payload WebhookRequest) (bool, error) {
+	if c.dedup == nil || payload.MessageToken == 0 {
+		return false, nil
+	}
+	retention := c.config.DedupRetention
+	if retention <= 0 {
+		retention = DefaultDedupRetention
+	}
+	first, err := c.dedup.MarkWebhookProcessed(ctx, payload.MessageToken, string(payload.Event), retention)
+	if err != nil {
+		return false, err
+	}
+	return !first, nil
+}
+
+// releaseDuplicate forgets a callback recorded by isDuplicate that could not be bridged,
+// so that Viber's next delivery of it is not ignored.
+func (c *Client) releaseDuplicate(ctx context.Context, payload WebhookRequest) {
+	if c.dedup == nil || payload.MessageToken == 0 {
+		return
+	}
+	if err := c.dedup.UnmarkWebhookProcessed(ctx, payload.MessageToken, string(payload.Event)); err != nil {
+		logger.WarnWithContext(ctx, "failed to release webhook deduplication",
+			"error", err,
+			"event", payload.Event,
+			"message_token", payload.MessageToken,
+		)
+		metrics.RecordError("webhook_dedup_failure", "webhook")
+	}
+}
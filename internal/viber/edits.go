@@ -6,37 +6,19 @@ import (
 	"fmt"
 
 	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/database"
 )
 
 // HandleDeletion handles a Viber message deletion and redacts the corresponding Matrix event.
 func (c *Client) HandleDeletion(ctx context.Context, viberMsgID string) error {
-	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
-	}
-
-	if c.db == nil {
-		return fmt.Errorf("database not configured")
-	}
-
-	// Get Matrix event ID from database
-	matrixEventID, err := c.db.GetMatrixEventID(ctx, viberMsgID)
+	mapping, err := c.lookupMessage(ctx, viberMsgID)
 	if err != nil {
-		return fmt.Errorf("get matrix event id: %w", err)
+		return err
 	}
 
-	if matrixEventID == "" {
-		return fmt.Errorf("matrix event id not found for viber message %s", viberMsgID)
-	}
-
-	// Get room ID from database (we track this in message_mappings)
-	// For now, use default room if available
-	roomID := c.matrix.GetDefaultRoomID()
-	if roomID == "" {
-		return fmt.Errorf("room id not available")
-	}
-
-	// Redact the Matrix event
-	if err := c.matrix.RedactEvent(ctx, id.RoomID(roomID), id.EventID(matrixEventID)); err != nil {
+	// Redact the Matrix event in the room it was bridged to
+	if err := c.matrix.RedactEvent(ctx, id.RoomID(mapping.MatrixRoomID), id.EventID(mapping.MatrixEventID)); err != nil {
 		return fmt.Errorf("redact matrix event: %w", err)
 	}
 
@@ -45,18 +27,48 @@ func (c *Client) HandleDeletion(ctx context.Context, viberMsgID string) error {
 
 // HandleEdit handles a Viber message edit and updates the corresponding Matrix event.
 func (c *Client) HandleEdit(ctx context.Context, viberMsgID, newText string) error {
-	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
+	mapping, err := c.lookupMessage(ctx, viberMsgID)
+	if err != nil {
+		return err
 	}
 
 	// Matrix message editing works by redacting the old message and sending a new one
 	// with m.new_content indicating it's an edit. For now, we redact and send a new message.
-	if err := c.HandleDeletion(ctx, viberMsgID); err != nil {
+	if err := c.matrix.RedactEvent(ctx, id.RoomID(mapping.MatrixRoomID), id.EventID(mapping.MatrixEventID)); err != nil {
 		return fmt.Errorf("delete old message: %w", err)
 	}
 
 	// Send new message with "(edited)" indicator
-	// Proper Matrix editing would use m.new_content but requires event ID tracking
 	editedText := fmt.Sprintf("%s (edited)", newText)
-	return c.matrix.SendText(ctx, editedText)
+	eventID, err := c.matrix.SendTextToRoom(ctx, id.RoomID(mapping.MatrixRoomID), editedText)
+	if err != nil {
+		return err
+	}
+
+	// Point the Viber message at the replacement event
+	mapping.MatrixEventID = string(eventID)
+	return c.db.SaveMessageMapping(ctx, *mapping)
+}
+
+// lookupMessage returns the message mapping for a bridged Viber message.
+func (c *Client) lookupMessage(ctx context.Context, viberMsgID string) (*database.MessageMapping, error) {
+	if c.matrix == nil {
+		return nil, fmt.Errorf("matrix client not configured")
+	}
+
+	if c.db == nil {
+		return nil, fmt.Errorf("database not configured")
+	}
+
+	mapping, err := c.db.GetMessageMappingByViberID(ctx, viberMsgID)
+	if err != nil {
+		return nil, fmt.Errorf("get message mapping: %w", err)
+	}
+	if mapping == nil {
+		return nil, fmt.Errorf("matrix event id not found for viber message %s", viberMsgID)
+	}
+	if mapping.MatrixRoomID == "" {
+		return nil, fmt.Errorf("matrix room not found for viber message %s", viberMsgID)
+	}
+	return mapping, nil
 }
@@ -0,0 +1,150 @@
+// Package viber errors maps Viber REST API failures to typed errors.
+package viber
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Viber REST API status codes returned in the "status" field of responses.
+const (
+	StatusOK                         = 0
+	StatusInvalidURL                 = 1
+	StatusInvalidAuthToken           = 2
+	StatusBadData                    = 3
+	StatusMissingData                = 4
+	StatusReceiverNotRegistered      = 5
+	StatusReceiverNotSubscribed      = 6
+	StatusPublicAccountBlocked       = 7
+	StatusPublicAccountNotFound      = 8
+	StatusPublicAccountSuspended     = 9
+	StatusWebhookNotSet              = 10
+	StatusReceiverNoSuitableDevice   = 11
+	StatusTooManyRequests            = 12
+	StatusAPIVersionNotSupported     = 13
+	StatusIncompatibleWithVersion    = 14
+	StatusPublicAccountNotAuthorized = 15
+)
+
+// Sentinel errors matched by *APIError through errors.Is.
+var (
+	// ErrInvalidRequest indicates the request was malformed (invalid URL, bad or missing data).
+	ErrInvalidRequest = errors.New("viber: invalid request")
+	// ErrInvalidAuthToken indicates the API token was rejected.
+	ErrInvalidAuthToken = errors.New("viber: invalid auth token")
+	// ErrReceiverNotRegistered indicates the receiver is not a Viber user.
+	ErrReceiverNotRegistered = errors.New("viber: receiver not registered")
+	// ErrReceiverNotSubscribed indicates the receiver has not subscribed to the bot.
+	ErrReceiverNotSubscribed = errors.New("viber: receiver not subscribed")
+	// ErrAccountUnavailable indicates the bot account is blocked, suspended, missing or not authorized.
+	ErrAccountUnavailable = errors.New("viber: account unavailable")
+	// ErrWebhookNotSet indicates the bot has no webhook registered.
+	ErrWebhookNotSet = errors.New("viber: webhook not set")
+	// ErrNoSuitableDevice indicates the receiver has no device able to show the message.
+	ErrNoSuitableDevice = errors.New("viber: receiver has no suitable device")
+	// ErrTooManyRequests indicates the bot is being rate limited.
+	ErrTooManyRequests = errors.New("viber: too many requests")
+	// ErrServiceUnavailable indicates a server-side failure of the Viber API.
+	ErrServiceUnavailable = errors.New("viber: service unavailable")
+)
+
+// APIError is a failed Viber API call: either a non-200 HTTP response
+// or a response whose Viber status is not StatusOK.
+type APIError struct {
+	Endpoint      string // API endpoint, e.g. "send_message"
+	HTTPStatus    int    // HTTP status code of the response
+	Status        int    // Viber status code (StatusOK for HTTP-level failures)
+	StatusMessage string // Viber status message, or the response body for HTTP-level failures
+
+	retryAfter time.Duration // Delay requested by a Retry-After header
+}
+
+// Error implements error.
+func (e *APIError) Error() string {
+	if e.Status != StatusOK {
+		return fmt.Sprintf("viber %s: status %d: %s", e.Endpoint, e.Status, e.StatusMessage)
+	}
+	return fmt.Sprintf("viber %s: http %d: %s", e.Endpoint, e.HTTPStatus, e.StatusMessage)
+}
+
+// Is reports whether the error matches one of the package sentinel errors.
+func (e *APIError) Is(target error) bool {
+	sentinel := e.sentinel()
+	return sentinel != nil && sentinel == target
+}
+
+// Retryable reports whether the call may succeed when repeated: rate limiting and server errors.
+// Used by retry.IsRetryable.
+func (e *APIError) Retryable() bool {
+	switch e.sentinel() {
+	case ErrTooManyRequests, ErrServiceUnavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryAfter returns the delay requested by the server's Retry-After header, or 0.
+// Used by retry.DoRetryable.
+func (e *APIError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// sentinel returns the sentinel error the failure maps to, or nil for unclassified failures.
+func (e *APIError) sentinel() error {
+	switch e.Status {
+	case StatusOK:
+		// HTTP-level failure
+	case StatusInvalidURL, StatusBadData, StatusMissingData, StatusAPIVersionNotSupported, StatusIncompatibleWithVersion:
+		return ErrInvalidRequest
+	case StatusInvalidAuthToken:
+		return ErrInvalidAuthToken
+	case StatusReceiverNotRegistered:
+		return ErrReceiverNotRegistered
+	case StatusReceiverNotSubscribed:
+		return ErrReceiverNotSubscribed
+	case StatusPublicAccountBlocked, StatusPublicAccountNotFound, StatusPublicAccountSuspended, StatusPublicAccountNotAuthorized:
+		return ErrAccountUnavailable
+	case StatusWebhookNotSet:
+		return ErrWebhookNotSet
+	case StatusReceiverNoSuitableDevice:
+		return ErrNoSuitableDevice
+	case StatusTooManyRequests:
+		return ErrTooManyRequests
+	default:
+		return nil
+	}
+
+	switch {
+	case e.HTTPStatus == http.StatusTooManyRequests:
+		return ErrTooManyRequests
+	case e.HTTPStatus == http.StatusUnauthorized || e.HTTPStatus == http.StatusForbidden:
+		return ErrInvalidAuthToken
+	case e.HTTPStatus >= 500:
+		return ErrServiceUnavailable
+	case e.HTTPStatus >= 400:
+		return ErrInvalidRequest
+	default:
+		return nil
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
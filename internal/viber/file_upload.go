@@ -3,95 +3,81 @@ package viber
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 // FileUploadProgress represents upload progress information.
 type FileUploadProgress struct {
 	BytesUploaded   int64
-	TotalBytes      int64
-	PercentComplete float64
-	Status          string // "downloading", "uploading", "complete", "error"
+	TotalBytes      int64   // -1 when Viber does not announce the size
+	PercentComplete float64 // 0 while the total size is unknown
+	Status          string  // "downloading", "uploading", "complete", "error"
 }
 
-// UploadFile downloads a file from Viber and uploads it to Matrix with progress tracking.
+// UploadFile streams a file from Viber to the default Matrix room, reporting progress on
+// progressChan (which may be nil and is closed on return). Data is passed on to Matrix as it
+// is downloaded, so BytesUploaded counts bytes that went through both legs. mimeType is used
+// when the type cannot be detected from the download.
 func (c *Client) UploadFile(ctx context.Context, fileURL, filename, mimeType string, progressChan chan<- FileUploadProgress) error {
-	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
-	}
-
-	defer close(progressChan)
-
-	// Step 1: Download from Viber
 	if progressChan != nil {
-		progressChan <- FileUploadProgress{Status: "downloading"}
+		defer close(progressChan)
 	}
-
-	resp, err := c.httpClient.Get(fileURL)
-	if err != nil {
-		if progressChan != nil {
-			progressChan <- FileUploadProgress{Status: "error"}
+	report := func(p FileUploadProgress) {
+		if progressChan == nil {
+			return
 		}
-		return fmt.Errorf("download file: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		if progressChan != nil {
-			progressChan <- FileUploadProgress{Status: "error"}
+		select {
+		case progressChan <- p:
+		case <-ctx.Done():
 		}
-		return fmt.Errorf("download failed: status %d", resp.StatusCode)
 	}
 
-	totalBytes := resp.ContentLength
-	if mimeType == "" {
-		mimeType = resp.Header.Get("Content-Type")
-		if mimeType == "" {
-			mimeType = "application/octet-stream"
-		}
+	if c.matrix == nil {
+		return fmt.Errorf("matrix client not configured")
 	}
-
-	// Read file data
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		if progressChan != nil {
-			progressChan <- FileUploadProgress{Status: "error"}
-		}
-		return fmt.Errorf("read file data: %w", err)
+	t := Target{RoomID: id.RoomID(c.matrix.GetDefaultRoomID())}
+	if t.RoomID == "" {
+		return fmt.Errorf("default room ID not configured")
 	}
 
-	if progressChan != nil {
-		progressChan <- FileUploadProgress{
-			BytesUploaded:   int64(len(data)),
-			TotalBytes:      totalBytes,
-			PercentComplete: 50.0,
+	report(FileUploadProgress{TotalBytes: -1, Status: "downloading"})
+	var done, total int64 = 0, -1
+	progress := func(n, size int64) {
+		done, total = n, size
+		report(FileUploadProgress{
+			BytesUploaded:   n,
+			TotalBytes:      size,
+			PercentComplete: percentOf(n, size),
 			Status:          "uploading",
-		}
+		})
 	}
-
-	// Step 2: Upload to Matrix
-	if err := c.matrix.SendImage(ctx, filename, mimeType, data, nil); err != nil {
-		if progressChan != nil {
-			progressChan <- FileUploadProgress{Status: "error"}
-		}
+	if _, err := c.streamMediaTo(ctx, t, event.MsgFile, fileURL, filename, &event.FileInfo{MimeType: mimeType}, progress); err != nil {
+		report(FileUploadProgress{BytesUploaded: done, TotalBytes: total, Status: "error"})
 		return fmt.Errorf("upload to matrix: %w", err)
 	}
 
-	if progressChan != nil {
-		progressChan <- FileUploadProgress{
-			BytesUploaded:   int64(len(data)),
-			TotalBytes:      totalBytes,
-			PercentComplete: 100.0,
-			Status:          "complete",
-		}
-	}
-
+	report(FileUploadProgress{
+		BytesUploaded:   done,
+		TotalBytes:      total,
+		PercentComplete: 100.0,
+		Status:          "complete",
+	})
 	return nil
 }
 
+// percentOf returns done as a percentage of total, or 0 when total is unknown.
+func percentOf(done, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(done) / float64(total) * 100
+}
+
 // UploadFileWithRetry uploads a file with retry logic.
 func (c *Client) UploadFileWithRetry(ctx context.Context, fileURL, filename, mimeType string, maxRetries int) error {
 	var lastErr error
@@ -107,6 +93,9 @@ func (c *Client) UploadFileWithRetry(ctx context.Context, fileURL, filename, mim
 		}
 
 		if err := c.UploadFile(ctx, fileURL, filename, mimeType, nil); err != nil {
+			if errors.Is(err, ErrMediaTooLarge) {
+				return err // Retrying will not make it smaller
+			}
 			lastErr = err
 			continue
 		}
@@ -0,0 +1,69 @@
+// Package viber ghosts maps Viber senders to Matrix ghost users in appservice mode.
+package viber
+
+import (
+	"context"
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
+)
+
+// ensureGhost registers a ghost user for sender and syncs its profile.
+// Returns an empty user ID, meaning "send as the bridge bot", in sync mode
+// or when puppeting fails.
+func (c *Client) ensureGhost(ctx context.Context, sender Sender) id.UserID {
+	if c.puppets == nil || !c.matrix.IsAppService() || sender.ID == "" {
+		return ""
+	}
+
+	ghost, err := c.puppets.EnsureGhostUser(ctx, sender.ID, sender.Name, sender.Avatar)
+	if err != nil {
+		logger.WarnWithContext(ctx, "failed to ensure ghost user, sending as bridge bot",
+			"error", err,
+			"viber_user_id", sender.ID,
+		)
+		return ""
+	}
+	return ghost.MatrixUserID
+}
+
+// joinGhost makes sure ghost is joined to roomID.
+// Returns an empty user ID when ghost is empty or cannot join.
+func (c *Client) joinGhost(ctx context.Context, roomID id.RoomID, ghost id.UserID) id.UserID {
+	if ghost == "" || roomID == "" {
+		return ""
+	}
+	if err := c.matrix.EnsureJoined(ctx, roomID, ghost); err != nil {
+		logger.WarnWithContext(ctx, "failed to join ghost user to room, sending as bridge bot",
+			"error", err,
+			"ghost_user_id", ghost,
+			"room_id", roomID,
+		)
+		return ""
+	}
+	return ghost
+}
+
+// sendTextTo sends text from a Viber sender to the target room.
+// The message is sent as the target's ghost when set, otherwise as the bridge bot
+// with a "[Viber] Name:" prefix.
+func (c *Client) sendTextTo(ctx context.Context, t Target, text string) (id.EventID, error) {
+	if t.RoomID == "" {
+		return "", fmt.Errorf("no matrix room for viber sender %s", t.Sender.ID)
+	}
+	if t.Ghost == "" && t.Sender.Name != "" {
+		text = fmt.Sprintf("[Viber] %s: %s", t.Sender.Name, text)
+	}
+	return c.matrix.SendTextAs(ctx, t.RoomID, t.Ghost, text)
+}
+
+// sendUploadedTo sends already uploaded media to the target room as a message of msgType.
+func (c *Client) sendUploadedTo(ctx context.Context, t Target, msgType event.MessageType, filename string, uri id.ContentURI, info *event.FileInfo) (id.EventID, error) {
+	if t.RoomID == "" {
+		return "", fmt.Errorf("no matrix room for viber sender %s", t.Sender.ID)
+	}
+	return c.matrix.SendUploadedMedia(ctx, t.RoomID, t.Ghost, msgType, filename, uri, info)
+}
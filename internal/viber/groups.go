@@ -39,30 +39,15 @@ func (gm *GroupChatManager) HandleGroupMessage(ctx context.Context, chatID strin
 		return fmt.Errorf("database not configured")
 	}
 
-	// Get or create Matrix room for this Viber group
-	matrixRoomID, err := gm.db.GetMatrixRoomID(ctx, chatID)
-	if err != nil {
-		return fmt.Errorf("get matrix room id: %w", err)
+	// Get or create Matrix room for this Viber group; the mapping is persisted by the portal manager
+	if gm.portals == nil {
+		return fmt.Errorf("portals not configured")
 	}
-
-	if matrixRoomID == "" {
-		// Create new portal room for this group
-		if gm.portals == nil {
-			return fmt.Errorf("portals not configured")
-		}
-
-		room, err := gm.portals.GetOrCreatePortalRoom(ctx, chatID, fmt.Sprintf("Viber Group: %s", chatID))
-		if err != nil {
-			return fmt.Errorf("create portal room: %w", err)
-		}
-
-		matrixRoomID = string(room.MatrixRoomID)
-
-		// Store room mapping
-		if err := gm.db.CreateRoomMapping(ctx, chatID, matrixRoomID); err != nil {
-			return fmt.Errorf("create room mapping: %w", err)
-		}
+	room, err := gm.portals.GetOrCreatePortalRoom(ctx, chatID, fmt.Sprintf("Viber Group: %s", chatID))
+	if err != nil {
+		return fmt.Errorf("get or create portal room: %w", err)
 	}
+	matrixRoomID := string(room.MatrixRoomID)
 
 	// Ensure sender is in group members
 	if err := gm.db.UpsertGroupMember(ctx, chatID, senderID); err != nil {
@@ -71,7 +56,7 @@ func (gm *GroupChatManager) HandleGroupMessage(ctx context.Context, chatID strin
 
 	// Forward message to Matrix room
 	text := fmt.Sprintf("[Viber] %s: %s", senderName, messageText)
-	if err := gm.matrixClient.SendTextToRoom(ctx, id.RoomID(matrixRoomID), text); err != nil {
+	if _, err := gm.matrixClient.SendTextToRoom(ctx, id.RoomID(matrixRoomID), text); err != nil {
 		return fmt.Errorf("send message to matrix: %w", err)
 	}
 
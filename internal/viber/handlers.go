@@ -0,0 +1,196 @@
+// Package viber handlers contains the built-in handlers for Viber webhook events and message types.
+package viber
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/metrics"
+)
+
+// handleTextMessage bridges a text message.
+func (c *Client) handleTextMessage(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+	return c.sendTextTo(ctx, msg.Target, msg.Payload.Message.Text)
+}
+
+// handlePictureMessage downloads a picture and bridges it as an image.
+func (c *Client) handlePictureMessage(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+	m := msg.Payload.Message
+	eventID, err := c.forwardImage(ctx, msg.Target, m.Media, m.FileName)
+	if err != nil {
+		return "", err
+	}
+	// Pictures may carry a caption in the text field
+	if m.Text != "" {
+		if _, err := c.sendTextTo(ctx, msg.Target, m.Text); err != nil {
+			logger.WarnWithContext(ctx, "failed to forward picture caption",
+				"error", err,
+				"room_id", msg.RoomID,
+			)
+		}
+	}
+	return eventID, nil
+}
+
+// handleMediaMessage bridges video, voice and file messages.
+func (c *Client) handleMediaMessage(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+	return c.ForwardMedia(ctx, msg.Target, msg.Payload.Message)
+}
+
+// handleStickerMessage bridges a sticker.
+func (c *Client) handleStickerMessage(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+	m := msg.Payload.Message
+	return c.HandleSticker(ctx, msg.Target, m.StickerID, m.Media, m.Thumbnail)
+}
+
+// handleLocationMessage bridges a location.
+func (c *Client) handleLocationMessage(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+	loc := msg.Payload.Message.Location
+	if loc == nil {
+		return "", fmt.Errorf("location message without coordinates")
+	}
+	return c.HandleLocation(ctx, msg.Target, loc.Lat, loc.Lon, msg.Payload.Message.Text)
+}
+
+// handleContactMessage bridges a contact card.
+func (c *Client) handleContactMessage(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+	contact := msg.Payload.Message.Contact
+	if contact == nil {
+		return "", fmt.Errorf("contact message without contact")
+	}
+	return c.HandleContact(ctx, msg.Target, contact.Name, contact.PhoneNumber, contact.Avatar)
+}
+
+// handleURLMessage bridges a URL message; the URL is carried in the media field.
+func (c *Client) handleURLMessage(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+	link := msg.Payload.Message.Media
+	if link == "" {
+		link = msg.Payload.Message.Text
+	}
+	return c.sendTextTo(ctx, msg.Target, link)
+}
+
+// handleRichMediaMessage bridges a rich media message as its text alternative.
+func (c *Client) handleRichMediaMessage(ctx context.Context, msg *InboundMessage) (id.EventID, error) {
+	text := msg.Payload.Message.Text
+	if text == "" {
+		text = "[Rich media message - open Viber to view]"
+	}
+	return c.sendTextTo(ctx, msg.Target, text)
+}
+
+// handleSubscribed stores the subscribing user and prepares their ghost.
+func (c *Client) handleSubscribed(ctx context.Context, payload WebhookRequest) error {
+	logger.InfoWithContext(ctx, "Viber user subscribed",
+		"viber_user_id", payload.User.ID,
+	)
+	return c.upsertUser(ctx, payload.User)
+}
+
+// handleConversationStarted stores the user opening a conversation with the bot.
+// The user may not be subscribed yet, so no portal is created until they send a message.
+func (c *Client) handleConversationStarted(ctx context.Context, payload WebhookRequest) error {
+	logger.InfoWithContext(ctx, "Viber conversation started",
+		"viber_user_id", payload.User.ID,
+		"type", payload.Type,
+		"context", payload.Context,
+		"subscribed", payload.Subscribed,
+	)
+	return c.upsertUser(ctx, payload.User)
+}
+
+// handleUnsubscribed records that a user unsubscribed; the bot can no longer message them.
+func (c *Client) handleUnsubscribed(ctx context.Context, payload WebhookRequest) error {
+	logger.InfoWithContext(ctx, "Viber user unsubscribed",
+		"viber_user_id", payload.UserID,
+	)
+	if c.matrix == nil || c.db == nil || payload.UserID == "" {
+		return nil
+	}
+	roomID, err := c.db.GetMatrixRoomID(ctx, payload.UserID)
+	if err != nil || roomID == "" {
+		return err
+	}
+	_, err = c.matrix.SendNoticeToRoom(ctx, id.RoomID(roomID), "The Viber user unsubscribed from the bot. Messages can no longer be delivered.")
+	return err
+}
+
+// handleDelivered records that a bridged message reached the Viber user's device.
+func (c *Client) handleDelivered(ctx context.Context, payload WebhookRequest) error {
+	metricReceipts.WithLabelValues(string(EventDelivered)).Inc()
+	logger.DebugWithContext(ctx, "Viber message delivered",
+		"message_token", payload.MessageToken,
+		"viber_user_id", payload.UserID,
+	)
+	return nil
+}
+
+// handleSeen mirrors a Viber read receipt onto the bridged Matrix event as the user's ghost.
+func (c *Client) handleSeen(ctx context.Context, payload WebhookRequest) error {
+	metricReceipts.WithLabelValues(string(EventSeen)).Inc()
+	if c.matrix == nil || c.db == nil || c.puppets == nil || !c.matrix.IsAppService() || payload.MessageToken == 0 {
+		return nil
+	}
+	mapping, err := c.db.GetMessageMappingByViberID(ctx, strconv.FormatInt(payload.MessageToken, 10))
+	if err != nil || mapping == nil || mapping.MatrixRoomID == "" {
+		return err
+	}
+	ghost := c.puppets.GetGhostUserID(payload.UserID)
+	return c.matrix.MarkReadAs(ctx, id.RoomID(mapping.MatrixRoomID), ghost, id.EventID(mapping.MatrixEventID))
+}
+
+// handleFailed reports a failed delivery in the portal room of the original message.
+func (c *Client) handleFailed(ctx context.Context, payload WebhookRequest) error {
+	metricReceipts.WithLabelValues(string(EventFailed)).Inc()
+	metrics.RecordError("viber_delivery_failed", "webhook")
+	logger.WarnWithContext(ctx, "Viber message delivery failed",
+		"message_token", payload.MessageToken,
+		"viber_user_id", payload.UserID,
+		"desc", payload.Desc,
+	)
+	if c.matrix == nil || c.db == nil || payload.MessageToken == 0 {
+		return nil
+	}
+	mapping, err := c.db.GetMessageMappingByViberID(ctx, strconv.FormatInt(payload.MessageToken, 10))
+	if err != nil || mapping == nil || mapping.MatrixRoomID == "" {
+		return err
+	}
+	notice := "⚠️ A message could not be delivered to Viber."
+	if payload.Desc != "" {
+		notice = fmt.Sprintf("⚠️ A message could not be delivered to Viber: %s", payload.Desc)
+	}
+	_, err = c.matrix.SendNoticeToRoom(ctx, id.RoomID(mapping.MatrixRoomID), notice)
+	return err
+}
+
+// handleWebhookVerification acknowledges the callback Viber sends when the webhook is set.
+func (c *Client) handleWebhookVerification(ctx context.Context, payload WebhookRequest) error {
+	logger.InfoWithContext(ctx, "Viber webhook verified")
+	return nil
+}
+
+// handleClientStatus logs client status changes; they have no Matrix equivalent.
+func (c *Client) handleClientStatus(ctx context.Context, payload WebhookRequest) error {
+	logger.DebugWithContext(ctx, "Viber client status changed",
+		"viber_user_id", payload.UserID,
+	)
+	return nil
+}
+
+// upsertUser stores a Viber user and syncs their ghost profile.
+func (c *Client) upsertUser(ctx context.Context, user Sender) error {
+	if user.ID == "" {
+		return nil
+	}
+	if c.db != nil && user.Name != "" {
+		if err := c.db.UpsertViberUser(ctx, user.ID, user.Name); err != nil {
+			return fmt.Errorf("upsert viber user %s: %w", user.ID, err)
+		}
+	}
+	c.ensureGhost(ctx, user)
+	return nil
+}
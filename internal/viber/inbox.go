@@ -0,0 +1,128 @@
+// Package viber inbox processes persisted webhook callbacks asynchronously.
+package viber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/example/mautrix-viber/internal/circuitbreaker"
+	"github.com/example/mautrix-viber/internal/queue"
+	"github.com/example/mautrix-viber/internal/ratelimit"
+	"github.com/example/mautrix-viber/internal/retry"
+)
+
+const (
+	// DefaultInboxWorkers is the number of inbox workers when not configured.
+	DefaultInboxWorkers = 4
+	// DefaultInboxMaxRetries is the number of processing retries when not configured.
+	DefaultInboxMaxRetries = 5
+)
+
+const (
+	// inboxQueueName is the name of the webhook inbox queue.
+	inboxQueueName = "viber_webhooks"
+	// inboxJobType identifies webhook inbox jobs in the message queue.
+	inboxJobType = "viber_to_matrix"
+)
+
+// inbox persists raw webhook payloads in the durable queue and processes them on its workers.
+type inbox struct {
+	client *Client
+	queue  *queue.Queue
+}
+
+// StartInbox switches webhook handling to asynchronous processing.
+// Callbacks are written to the database queue and acknowledged immediately;
+// workers then bridge them with retries, dead-lettering callbacks that keep failing.
+// Callbacks of one conversation are bridged in the order they were received.
+// Jobs left unprocessed by a previous run are resumed. Requires a database.
+func (c *Client) StartInbox(ctx context.Context) error {
+	if c.db == nil {
+		return fmt.Errorf("webhook inbox requires a database")
+	}
+	cfg := queue.DefaultConfig()
+	cfg.Name = inboxQueueName
+	cfg.Workers = c.config.InboxWorkers
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultInboxWorkers
+	}
+	cfg.MaxRetries = c.config.InboxMaxRetries
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = DefaultInboxMaxRetries
+	}
+
+	ib := &inbox{client: c}
+	ib.queue = queue.New(c.db, cfg, ib.process)
+	ib.queue.Start(ctx)
+	c.inbox = ib
+	return nil
+}
+
+// StopInbox stops the inbox workers, waiting for in-flight callbacks until ctx expires.
+// Callbacks still queued are resumed by the next StartInbox.
+func (c *Client) StopInbox(ctx context.Context) error {
+	if c.inbox == nil {
+		return nil
+	}
+	return c.inbox.queue.Stop(ctx)
+}
+
+// enqueue persists a raw payload and schedules it for processing
+// in order with the other callbacks of its conversation.
+func (ib *inbox) enqueue(ctx context.Context, payload WebhookRequest, raw []byte) error {
+	_, err := ib.queue.Enqueue(ctx, inboxJobType, queue.ViberKey(orderingKey(payload)), raw)
+	return err
+}
+
+// orderingKey returns the key of the callbacks that must be processed in order: messages by
+// conversation, and other events (receipts, subscriptions, ...) by the user they carry outside
+// of Sender, so that a failing receipt never holds up the messages of its conversation.
+func orderingKey(payload WebhookRequest) string {
+	if payload.Event == EventMessage {
+		return conversationID(payload)
+	}
+	user := payload.UserID
+	if user == "" {
+		user = payload.User.ID
+	}
+	if user == "" {
+		return ""
+	}
+	return string(payload.Event) + ":" + user
+}
+
+// process bridges one queued callback.
+// Transient failures make the queue retry the job with backoff; any other failure
+// cannot succeed on retry and dead-letters the job without blocking its conversation.
+func (ib *inbox) process(ctx context.Context, job queue.MessageJob) error {
+	payload, err := DecodeWebhookRequest(job.Payload)
+	if err != nil {
+		// The payload was validated before it was stored, so this cannot succeed on retry
+		return fmt.Errorf("%w: %v", queue.ErrPermanent, err)
+	}
+	err = ib.client.processWebhook(ctx, payload)
+	if err != nil && ctx.Err() == nil && !isTransient(err) {
+		return fmt.Errorf("%w: %w", queue.ErrPermanent, err)
+	}
+	return err
+}
+
+// isTransient reports whether a failed message may be bridged on retry: network failures,
+// timeouts, retryable Viber API errors, an open Viber API circuit, sends held back by the
+// send rate limit, and homeserver rate limiting or server errors. Deterministic failures, like unsupported messages, oversized
+// media or a request the homeserver rejected, are not.
+func isTransient(err error) bool {
+	if retry.IsRetryable(err) || errors.Is(err, circuitbreaker.ErrCircuitOpen) || errors.Is(err, ratelimit.ErrLimited) {
+		return true
+	}
+	var httpErr mautrix.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Response != nil {
+		status := httpErr.Response.StatusCode
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	return false
+}
@@ -1,48 +1,98 @@
-// Package viber location handles location sharing with map preview in Matrix.
+// Package viber location bridges locations as native Matrix m.location events with a map link fallback.
 package viber
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
-// HandleLocation handles a Viber location message and forwards it to Matrix with map preview.
-func (c *Client) HandleLocation(ctx context.Context, lat, lon float64, label string) error {
-	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
-	}
+// DefaultMapURLTemplate links bridged locations to OpenStreetMap.
+const DefaultMapURLTemplate = "https://www.openstreetmap.org/?mlat={{.Lat}}&mlon={{.Lon}}#map=15/{{.Lat}}/{{.Lon}}"
 
-	// Format location message
-	locationText := fmt.Sprintf("📍 Location: %s\nLatitude: %.6f\nLongitude: %.6f", label, lat, lon)
-	if label == "" {
-		locationText = fmt.Sprintf("📍 Location\nLatitude: %.6f\nLongitude: %.6f", lat, lon)
-	}
+// MapURLData is the data available to the map URL template.
+type MapURLData struct {
+	Lat string // Latitude in decimal degrees, e.g. "52.520008"
+	Lon string // Longitude in decimal degrees, e.g. "13.404954"
+}
 
-	// Generate map preview URL (OpenStreetMap)
-	// Note: This could be made configurable via config if needed for different map providers
-	const osmBaseURL = "https://www.openstreetmap.org"
-	mapURL := fmt.Sprintf("%s/?mlat=%.6f&mlon=%.6f&zoom=15", osmBaseURL, lat, lon)
+// ParseMapURLTemplate parses a map URL template; an empty string selects the default.
+func ParseMapURLTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultMapURLTemplate
+	}
+	tmpl, err := template.New("map_url").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse map url template: %w", err)
+	}
+	return tmpl, nil
+}
 
-	// Send as text with map URL
-	text := fmt.Sprintf("%s\n\nMap: %s", locationText, mapURL)
+// formatCoordinate formats a coordinate without exponent, to about 10 cm precision.
+func formatCoordinate(v float64) string {
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
 
-	return c.matrix.SendText(ctx, text)
+// mapURL renders the map link of a location.
+func (c *Client) mapURL(lat, lon float64) (string, error) {
+	var b strings.Builder
+	if err := c.mapTemplate.Execute(&b, MapURLData{Lat: formatCoordinate(lat), Lon: formatCoordinate(lon)}); err != nil {
+		return "", fmt.Errorf("render map url: %w", err)
+	}
+	return b.String(), nil
 }
 
-// ForwardLocation forwards a location from Viber location message.
-func (c *Client) ForwardLocation(ctx context.Context, locationURL string) error {
+// HandleLocation forwards a Viber location to the target Matrix room as an m.location event.
+// label, if set, describes the location; the body is a map link for clients without map support.
+func (c *Client) HandleLocation(ctx context.Context, t Target, lat, lon float64, label string) (id.EventID, error) {
 	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
+		return "", fmt.Errorf("matrix client not configured")
+	}
+	if t.RoomID == "" {
+		return "", fmt.Errorf("no matrix room for viber sender %s", t.Sender.ID)
+	}
+	mapURL, err := c.mapURL(lat, lon)
+	if err != nil {
+		return "", err
 	}
 
-	// Location forwarding from Viber URL format
-	// Viber location messages contain lat/lon in the message payload
-	// This method receives the location URL for display
-	text := fmt.Sprintf("📍 Location: %s", locationURL)
-	return c.matrix.SendText(ctx, text)
+	body := "📍 Location: " + mapURL
+	if label != "" {
+		body = fmt.Sprintf("📍 %s: %s", label, mapURL)
+	}
+	if t.Ghost == "" && t.Sender.Name != "" {
+		body = fmt.Sprintf("[Viber] %s: %s", t.Sender.Name, body)
+	}
+	geoURI := fmt.Sprintf("geo:%s,%s", formatCoordinate(lat), formatCoordinate(lon))
+	return c.matrix.SendLocationAs(ctx, t.RoomID, t.Ghost, geoURI, body, label)
 }
 
 // SendLocationToViber sends a location message to Viber from Matrix.
 func (c *Client) SendLocationToViber(ctx context.Context, receiver string, lat, lon float64) (*SendMessageResponse, error) {
 	return c.SendLocation(ctx, receiver, lat, lon)
 }
+
+// locationGeoURI returns the geo URI of a Matrix location event: the m.location geo_uri,
+// or the MSC3488 location URI sent by clients that only fill in extensible event content.
+func locationGeoURI(evt *event.Event, msg *event.MessageEventContent) string {
+	if msg.GeoURI != "" || evt == nil {
+		return msg.GeoURI
+	}
+	var extensible struct {
+		Location struct {
+			URI string `json:"uri"`
+		} `json:"org.matrix.msc3488.location"`
+	}
+	if len(evt.Content.VeryRaw) > 0 {
+		_ = json.Unmarshal(evt.Content.VeryRaw, &extensible)
+	} else if location, ok := evt.Content.Raw["org.matrix.msc3488.location"].(map[string]interface{}); ok {
+		extensible.Location.URI, _ = location["uri"].(string)
+	}
+	return extensible.Location.URI
+}
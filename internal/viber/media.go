@@ -4,143 +4,197 @@ package viber
 import (
 	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/database"
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/media"
 )
 
-// ForwardMedia forwards various media types from Viber to Matrix.
-func (c *Client) ForwardMedia(ctx context.Context, msgType, mediaURL, filename, thumbnail string) error {
+// stickerBody is the fallback text of bridged stickers.
+const stickerBody = "Sticker"
+
+// ForwardMedia forwards a Viber media message to the target Matrix room
+// as a Matrix message of the matching msgtype.
+func (c *Client) ForwardMedia(ctx context.Context, t Target, m Message) (id.EventID, error) {
 	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
+		return "", fmt.Errorf("matrix client not configured")
 	}
 
-	switch strings.ToLower(msgType) {
+	switch strings.ToLower(m.Type) {
 	case "video":
-		return c.forwardVideo(ctx, mediaURL, filename)
-	case "audio", "file":
-		return c.forwardFile(ctx, mediaURL, filename)
+		return c.forwardVideo(ctx, t, m.Media, m.FileName, m.Thumbnail, m.Duration)
+	case "voice":
+		return c.HandleVoiceMessage(ctx, t, m.Media, m.Duration)
+	case "audio":
+		return c.forwardFile(ctx, t, event.MsgAudio, m.Media, m.FileName)
+	case "file":
+		return c.forwardFile(ctx, t, event.MsgFile, m.Media, m.FileName)
 	case "sticker":
-		return c.forwardSticker(ctx, mediaURL, thumbnail)
-	case "location":
-		return c.forwardLocation(ctx, mediaURL)
-	case "contact":
-		return c.forwardContact(ctx, mediaURL)
+		return c.forwardSticker(ctx, t, m.StickerID, m.Media, m.Thumbnail)
+	case "picture", "image":
+		return c.forwardImage(ctx, t, m.Media, m.FileName)
 	default:
-		return fmt.Errorf("unsupported media type: %s", msgType)
+		return "", fmt.Errorf("unsupported media type: %s", m.Type)
 	}
 }
 
-// forwardVideo downloads and forwards a video to Matrix.
-func (c *Client) forwardVideo(ctx context.Context, mediaURL, filename string) error {
-	resp, err := c.httpClient.Get(mediaURL)
-	if err != nil {
-		return fmt.Errorf("download video: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed: status %d", resp.StatusCode)
+// forwardVideo streams a video to Matrix as m.video.
+// duration is in seconds; the Viber thumbnail is attached when it can be fetched.
+func (c *Client) forwardVideo(ctx context.Context, t Target, mediaURL, filename, thumbnailURL string, duration int) (id.EventID, error) {
+	if filename == "" {
+		filename = "viber-video.mp4"
 	}
-
-	data, err := io.ReadAll(resp.Body)
+	info := &event.FileInfo{MimeType: "video/mp4", Duration: duration * 1000}
+	c.attachThumbnail(ctx, t.Ghost, info, thumbnailURL)
+	eventID, err := c.streamMediaTo(ctx, t, event.MsgVideo, mediaURL, filename, info, nil)
 	if err != nil {
-		return fmt.Errorf("read video data: %w", err)
-	}
-
-	mimeType := resp.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = "video/mp4"
+		return "", fmt.Errorf("forward video: %w", err)
 	}
-
-	// Video forwarding requires Matrix client SendVideo method
-	// Currently forwards as image as fallback until SendVideo is implemented
-	return c.matrix.SendImage(ctx, filename, mimeType, data, nil)
+	return eventID, nil
 }
 
-// forwardFile downloads and forwards a file to Matrix.
-func (c *Client) forwardFile(ctx context.Context, mediaURL, filename string) error {
-	resp, err := c.httpClient.Get(mediaURL)
-	if err != nil {
-		return fmt.Errorf("download file: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed: status %d", resp.StatusCode)
+// forwardFile streams a file to Matrix as msgType (m.file or m.audio).
+func (c *Client) forwardFile(ctx context.Context, t Target, msgType event.MessageType, mediaURL, filename string) (id.EventID, error) {
+	if filename == "" {
+		filename = "viber-file"
 	}
-
-	data, err := io.ReadAll(resp.Body)
+	eventID, err := c.streamMediaTo(ctx, t, msgType, mediaURL, filename, nil, nil)
 	if err != nil {
-		return fmt.Errorf("read file data: %w", err)
-	}
-
-	mimeType := resp.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+		return "", fmt.Errorf("forward file: %w", err)
 	}
+	return eventID, nil
+}
 
-	// File forwarding requires Matrix client SendFile method
-	// Currently forwards as image as fallback until SendFile is implemented
-	return c.matrix.SendImage(ctx, filename, mimeType, data, nil)
+// attachThumbnail uploads the thumbnail at thumbnailURL as sender and references it from info.
+// Thumbnails are optional, so failures are logged and the media is sent without one.
+func (c *Client) attachThumbnail(ctx context.Context, sender id.UserID, info *event.FileInfo, thumbnailURL string) {
+	if thumbnailURL == "" {
+		return
+	}
+	uri, thumbInfo, err := c.uploadMedia(ctx, sender, thumbnailURL, "image/jpeg", nil)
+	if err == nil {
+		info.ThumbnailURL = uri.CUString()
+		info.ThumbnailInfo = thumbInfo
+		return
+	}
+	logger.WarnWithContext(ctx, "failed to attach viber thumbnail",
+		"error", err,
+		"thumbnail_url", thumbnailURL,
+	)
 }
 
-// forwardSticker forwards a sticker (as image for now, could be enhanced to Matrix stickers).
-func (c *Client) forwardSticker(ctx context.Context, mediaURL, thumbnail string) error {
-	// Use thumbnail if available, otherwise media URL
-	url := thumbnail
+// forwardSticker forwards a Viber sticker as an m.sticker event. Stickers are catalogued by
+// sticker ID, so each one is fetched and uploaded once; stickers without an ID (or without a
+// database) are uploaded through the media cache instead.
+func (c *Client) forwardSticker(ctx context.Context, t Target, stickerID int, mediaURL, thumbnail string) (id.EventID, error) {
+	if t.RoomID == "" {
+		return "", fmt.Errorf("no matrix room for viber sender %s", t.Sender.ID)
+	}
+	if stickerID != 0 && c.db != nil {
+		sticker, err := c.db.GetViberSticker(ctx, int64(stickerID))
+		if err != nil {
+			logger.WarnWithContext(ctx, "failed to look up viber sticker",
+				"error", err,
+				"sticker_id", stickerID,
+			)
+		} else if sticker != nil {
+			if uri, err := id.ParseContentURI(sticker.MXC); err == nil {
+				info := &event.FileInfo{MimeType: sticker.MimeType, Width: sticker.Width, Height: sticker.Height, Size: sticker.Size}
+				return c.matrix.SendStickerAs(ctx, t.RoomID, t.Ghost, stickerBody, uri, info)
+			}
+		}
+	}
+
+	// The media URL is the full sticker; the thumbnail is a fallback
+	url := mediaURL
 	if url == "" {
-		url = mediaURL
+		url = thumbnail
 	}
 	if url == "" {
-		return fmt.Errorf("no sticker URL available")
+		return "", fmt.Errorf("no sticker URL available")
 	}
-
-	// Forward as image (Matrix sticker support would require additional implementation)
-	return c.forwardImage(ctx, url, "sticker.png")
-}
-
-// HandleSticker handles a Viber sticker and forwards it to Matrix.
-func (c *Client) HandleSticker(ctx context.Context, stickerURL, thumbnailURL string) error {
-	return c.forwardSticker(ctx, stickerURL, thumbnailURL)
-}
-
-// forwardImage downloads and forwards an image.
-func (c *Client) forwardImage(ctx context.Context, mediaURL, filename string) error {
-	resp, err := c.httpClient.Get(mediaURL)
+	uri, info, err := c.uploadMedia(ctx, t.Ghost, url, "image/png", func(data []byte, mimeType string) *event.FileInfo {
+		return c.imageInfo(ctx, t.Ghost, data, mimeType)
+	})
 	if err != nil {
-		return fmt.Errorf("download image: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
+		return "", fmt.Errorf("upload sticker: %w", err)
+	}
+
+	if stickerID != 0 && c.db != nil {
+		if err := c.db.SaveViberSticker(ctx, database.ViberSticker{
+			StickerID: int64(stickerID),
+			MXC:       uri.String(),
+			MimeType:  info.MimeType,
+			Width:     info.Width,
+			Height:    info.Height,
+			Size:      info.Size,
+		}); err != nil {
+			logger.WarnWithContext(ctx, "failed to store viber sticker",
+				"error", err,
+				"sticker_id", stickerID,
+			)
+		}
+	}
+	return c.matrix.SendStickerAs(ctx, t.RoomID, t.Ghost, stickerBody, uri, info)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed: status %d", resp.StatusCode)
+// HandleSticker handles a Viber sticker and forwards it to the target Matrix room.
+func (c *Client) HandleSticker(ctx context.Context, t Target, stickerID int, stickerURL, thumbnailURL string) (id.EventID, error) {
+	if c.matrix == nil {
+		return "", fmt.Errorf("matrix client not configured")
 	}
+	return c.forwardSticker(ctx, t, stickerID, stickerURL, thumbnailURL)
+}
 
-	data, err := io.ReadAll(resp.Body)
+// forwardImage forwards an image with its dimensions, thumbnail and blurhash.
+// Images uploaded before, e.g. forwarded ones, are not uploaded again.
+func (c *Client) forwardImage(ctx context.Context, t Target, mediaURL, filename string) (id.EventID, error) {
+	uri, info, err := c.uploadMedia(ctx, t.Ghost, mediaURL, "image/png", func(data []byte, mimeType string) *event.FileInfo {
+		return c.imageInfo(ctx, t.Ghost, data, mimeType)
+	})
 	if err != nil {
-		return fmt.Errorf("read image data: %w", err)
+		return "", fmt.Errorf("upload image: %w", err)
 	}
-
-	mimeType := resp.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = "image/png"
+	if filename == "" {
+		filename = "viber-image"
 	}
-
-	return c.matrix.SendImage(ctx, filename, mimeType, data, nil)
+	return c.sendUploadedTo(ctx, t, event.MsgImage, filename, uri, info)
 }
 
-// forwardLocation forwards a location message (text representation).
-func (c *Client) forwardLocation(ctx context.Context, locationData string) error {
-	// Parse location data and send as text message
-	// Format: "Location: lat,lon" or URL
-	text := fmt.Sprintf("[Location] %s", locationData)
-	return c.matrix.SendText(ctx, text)
-}
-
-// forwardContact forwards a contact card (vCard representation).
-func (c *Client) forwardContact(ctx context.Context, contactData string) error {
-	// Parse contact data and send as text message
-	text := fmt.Sprintf("[Contact] %s", contactData)
-	return c.matrix.SendText(ctx, text)
+// imageInfo returns the info block of an image: its size, dimensions and blurhash, and a
+// thumbnail uploaded as sender. Images that cannot be decoded only get their MIME type and size.
+func (c *Client) imageInfo(ctx context.Context, sender id.UserID, data []byte, mimeType string) *event.FileInfo {
+	info := &event.FileInfo{MimeType: mimeType, Size: len(data)}
+	analysis, err := media.AnalyzeImage(data)
+	if err != nil {
+		logger.WarnWithContext(ctx, "failed to analyze viber image",
+			"error", err,
+			"mime_type", mimeType,
+		)
+		return info
+	}
+	info.MimeType = analysis.MimeType
+	info.Width, info.Height = analysis.Width, analysis.Height
+	info.Blurhash = analysis.Blurhash
+	info.AnoaBlurhash = analysis.Blurhash
+
+	uri, err := c.matrix.UploadMediaAs(ctx, sender, analysis.Thumbnail, analysis.ThumbnailMimeType)
+	if err != nil {
+		logger.WarnWithContext(ctx, "failed to upload image thumbnail",
+			"error", err,
+		)
+		return info
+	}
+	info.ThumbnailURL = uri.CUString()
+	info.ThumbnailInfo = &event.FileInfo{
+		MimeType: analysis.ThumbnailMimeType,
+		Width:    analysis.ThumbnailWidth,
+		Height:   analysis.ThumbnailHeight,
+		Size:     len(analysis.Thumbnail),
+	}
+	return info
 }
@@ -0,0 +1,187 @@
+// Package viber media_cache reuses earlier Matrix uploads of identical Viber media,
+// so stickers and forwarded images are not uploaded again and again.
+package viber
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/database"
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/metrics"
+)
+
+// Defaults for the media cache when not configured.
+const (
+	DefaultMediaCacheTTL        = 30 * 24 * time.Hour
+	DefaultMediaCacheMaxEntries = 10000
+)
+
+// mediaCachePruneInterval is how often StartMediaCachePruning evicts stale cache entries.
+const mediaCachePruneInterval = time.Hour
+
+// MediaCache maps the source URL and content hash of bridged media to its mxc:// URI.
+// Implemented by *database.DB.
+type MediaCache interface {
+	GetMediaCacheEntry(ctx context.Context, sourceURL, contentHash string, maxAge time.Duration) (*database.MediaCacheEntry, error)
+	SaveMediaCacheEntry(ctx context.Context, entry database.MediaCacheEntry) error
+	PruneMediaCache(ctx context.Context, ttl time.Duration, maxEntries int) (int64, error)
+}
+
+// SetMediaCache replaces the cache used to deduplicate media uploads.
+// A nil cache disables deduplication.
+func (c *Client) SetMediaCache(cache MediaCache) {
+	c.mediaCache = cache
+}
+
+// mediaCacheTTL returns how long unused cache entries are kept.
+func (c *Client) mediaCacheTTL() time.Duration {
+	if c.config.MediaCacheTTL > 0 {
+		return c.config.MediaCacheTTL
+	}
+	return DefaultMediaCacheTTL
+}
+
+// mediaCacheMaxEntries returns how many cache entries are kept.
+func (c *Client) mediaCacheMaxEntries() int {
+	if c.config.MediaCacheMaxEntries > 0 {
+		return c.config.MediaCacheMaxEntries
+	}
+	return DefaultMediaCacheMaxEntries
+}
+
+// StartMediaCachePruning evicts media cache entries unused for longer than the cache TTL,
+// and the least recently used entries beyond the entry limit, now and then every
+// mediaCachePruneInterval until ctx is cancelled. It does nothing without a media cache.
+func (c *Client) StartMediaCachePruning(ctx context.Context) {
+	if c.mediaCache == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(mediaCachePruneInterval)
+		defer ticker.Stop()
+		for {
+			c.pruneMediaCache(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// pruneMediaCache evicts stale media cache entries. Failures are logged and retried on the next run.
+func (c *Client) pruneMediaCache(ctx context.Context) {
+	if _, err := c.mediaCache.PruneMediaCache(ctx, c.mediaCacheTTL(), c.mediaCacheMaxEntries()); err != nil && ctx.Err() == nil {
+		logger.WarnWithContext(ctx, "failed to prune media cache",
+			"error", err,
+		)
+	}
+}
+
+// cachedUpload is media found in the cache.
+type cachedUpload struct {
+	URI  id.ContentURI
+	Info *event.FileInfo // Info block of the media; MimeType and Size are always set
+}
+
+// lookupMedia returns the cached upload for sourceURL or, failing that, for contentHash.
+// Cache failures are logged and treated as misses.
+func (c *Client) lookupMedia(ctx context.Context, sourceURL, contentHash string) *cachedUpload {
+	if c.mediaCache == nil {
+		return nil
+	}
+	entry, err := c.mediaCache.GetMediaCacheEntry(ctx, sourceURL, contentHash, c.mediaCacheTTL())
+	if err == nil && entry == nil {
+		metrics.RecordMediaCacheLookup(false)
+		return nil
+	}
+	var upload cachedUpload
+	if err == nil {
+		if upload.URI, err = id.ParseContentURI(entry.MXC); err == nil {
+			upload.Info = &event.FileInfo{}
+			if len(entry.Info) > 0 {
+				err = json.Unmarshal(entry.Info, upload.Info)
+			}
+		}
+	}
+	if err != nil {
+		logger.WarnWithContext(ctx, "failed to look up cached media",
+			"error", err,
+			"source_url", sourceURL,
+		)
+		return nil
+	}
+	metrics.RecordMediaCacheLookup(true)
+	return &upload
+}
+
+// storeMedia records an upload of the content at sourceURL.
+// Cache failures are logged, since the media was bridged regardless.
+func (c *Client) storeMedia(ctx context.Context, sourceURL, contentHash string, uri id.ContentURI, info *event.FileInfo) {
+	if c.mediaCache == nil || sourceURL == "" {
+		return
+	}
+	err := func() error {
+		infoJSON, err := json.Marshal(info)
+		if err != nil {
+			return fmt.Errorf("encode media info: %w", err)
+		}
+		return c.mediaCache.SaveMediaCacheEntry(ctx, database.MediaCacheEntry{
+			SourceURL:   sourceURL,
+			ContentHash: contentHash,
+			MXC:         uri.String(),
+			Info:        infoJSON,
+		})
+	}()
+	if err != nil {
+		logger.WarnWithContext(ctx, "failed to cache uploaded media",
+			"error", err,
+			"source_url", sourceURL,
+		)
+	}
+}
+
+// uploadMedia downloads a Viber media URL and uploads it as sender, reusing an earlier upload
+// of the same URL or content. describe, if set, builds the info block of new uploads; the
+// stored info block is returned for reused ones. MimeType and Size of the info are always set.
+func (c *Client) uploadMedia(ctx context.Context, sender id.UserID, mediaURL, fallbackMime string, describe func(data []byte, mimeType string) *event.FileInfo) (id.ContentURI, *event.FileInfo, error) {
+	if cached := c.lookupMedia(ctx, mediaURL, ""); cached != nil {
+		return cached.URI, cached.Info, nil
+	}
+	data, mimeType, err := c.downloadMedia(ctx, mediaURL, fallbackMime)
+	if err != nil {
+		return id.ContentURI{}, nil, err
+	}
+	hash := contentHash(data)
+	if cached := c.lookupMedia(ctx, "", hash); cached != nil {
+		c.storeMedia(ctx, mediaURL, hash, cached.URI, cached.Info)
+		return cached.URI, cached.Info, nil
+	}
+
+	info := &event.FileInfo{MimeType: mimeType}
+	if describe != nil {
+		info = describe(data, mimeType)
+	}
+	info.Size = len(data)
+	uri, err := c.matrix.UploadMediaAs(ctx, sender, data, info.MimeType)
+	if err != nil {
+		return id.ContentURI{}, nil, err
+	}
+	c.storeMedia(ctx, mediaURL, hash, uri, info)
+	return uri, info, nil
+}
+
+// contentHash returns the hex-encoded SHA-256 of data.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,215 @@
+// Package viber media_transfer streams Viber media into the Matrix media repository
+// with a size limit, MIME type detection and byte-level progress.
+package viber
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/metrics"
+)
+
+// DefaultMaxMediaSize is the largest Viber media bridged to Matrix when Config.MaxMediaSize
+// is not set. It matches Synapse's default max_upload_size.
+const DefaultMaxMediaSize = 50 << 20
+
+// sniffLen is how many leading bytes are inspected to detect a MIME type (see http.DetectContentType).
+const sniffLen = 512
+
+// progressInterval is how many bytes pass between two progress reports.
+const progressInterval = 256 << 10
+
+// ErrMediaTooLarge indicates media exceeds the configured maximum size.
+var ErrMediaTooLarge = errors.New("media too large")
+
+// downloadStatusError is a media download answered with an HTTP status other than 200.
+type downloadStatusError struct {
+	status int
+}
+
+// Error implements error.
+func (e *downloadStatusError) Error() string {
+	return fmt.Sprintf("download failed: status %d", e.status)
+}
+
+// Retryable reports whether the download may succeed later: rate limiting and server errors.
+// Used by retry.IsRetryable.
+func (e *downloadStatusError) Retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= http.StatusInternalServerError
+}
+
+// mediaDownload is an open download of Viber media. Reads fail with ErrMediaTooLarge
+// once more than the size limit has been read.
+type mediaDownload struct {
+	body     io.Closer
+	reader   io.Reader
+	MimeType string // Detected MIME type
+	Length   int64  // Declared length, or -1 when unknown
+
+	read     int64
+	limit    int64
+	reported int64
+	progress func(done, total int64)
+	err      error // Set when the limit was exceeded
+}
+
+// Read reads from the download, enforcing the size limit and reporting progress.
+func (d *mediaDownload) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.reader.Read(p)
+	d.read += int64(n)
+	if d.read > d.limit {
+		d.err = fmt.Errorf("%w: more than %d bytes", ErrMediaTooLarge, d.limit)
+		return n, d.err
+	}
+	// The HTTP client stops reading at the declared length, so that counts as the end too
+	end := errors.Is(err, io.EOF) || (d.Length > 0 && d.read >= d.Length)
+	if d.progress != nil && (d.read-d.reported >= progressInterval || (end && d.read > d.reported)) {
+		d.reported = d.read
+		d.progress(d.read, d.Length)
+	}
+	return n, err
+}
+
+// Close closes the underlying response body.
+func (d *mediaDownload) Close() error {
+	return d.body.Close()
+}
+
+// maxMediaSize returns the configured media size limit.
+func (c *Client) maxMediaSize() int64 {
+	if c.config.MaxMediaSize > 0 {
+		return c.config.MaxMediaSize
+	}
+	return DefaultMaxMediaSize
+}
+
+// openMedia starts downloading a Viber media URL. Media whose declared length exceeds the
+// size limit is rejected before any of it is read. fallbackMime is used when the type can
+// neither be taken from the response nor sniffed from the content.
+func (c *Client) openMedia(ctx context.Context, mediaURL, fallbackMime string) (*mediaDownload, error) {
+	if mediaURL == "" {
+		return nil, fmt.Errorf("media url is empty")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create media request: %w", err)
+	}
+	resp, err := c.mediaClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download media: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, &downloadStatusError{status: resp.StatusCode}
+	}
+	limit := c.maxMediaSize()
+	if resp.ContentLength > limit {
+		_ = resp.Body.Close()
+		metrics.RecordError("media_too_large", "viber")
+		return nil, fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrMediaTooLarge, resp.ContentLength, limit)
+	}
+
+	br := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, _ := br.Peek(sniffLen) // Short or failed reads surface when the body is read
+	return &mediaDownload{
+		body:     resp.Body,
+		reader:   br,
+		MimeType: detectMimeType(resp.Header.Get("Content-Type"), head, fallbackMime),
+		Length:   resp.ContentLength,
+		limit:    limit,
+	}, nil
+}
+
+// detectMimeType returns the Content-Type header unless it is missing or generic,
+// then the type sniffed from the first bytes, then fallback.
+func detectMimeType(header string, head []byte, fallback string) string {
+	if mediaType, _, err := mime.ParseMediaType(header); err == nil &&
+		mediaType != "application/octet-stream" && mediaType != "binary/octet-stream" {
+		return header
+	}
+	if len(head) > 0 {
+		if sniffed := http.DetectContentType(head); !strings.HasPrefix(sniffed, "application/octet-stream") {
+			return sniffed
+		}
+	}
+	if fallback == "" {
+		return "application/octet-stream"
+	}
+	return fallback
+}
+
+// downloadMedia fetches a Viber media URL into memory, within the size limit, and returns
+// its bytes and content type. It is meant for media that must be decoded, like images;
+// streamMediaTo bridges media without buffering it.
+func (c *Client) downloadMedia(ctx context.Context, mediaURL, fallbackMime string) ([]byte, string, error) {
+	d, err := c.openMedia(ctx, mediaURL, fallbackMime)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = d.Close() }()
+
+	data, err := io.ReadAll(d)
+	if err != nil {
+		if errors.Is(err, ErrMediaTooLarge) {
+			metrics.RecordError("media_too_large", "viber")
+		}
+		return nil, "", fmt.Errorf("read media data: %w", err)
+	}
+	return data, d.MimeType, nil
+}
+
+// streamMediaTo streams a Viber media URL into the Matrix media repository as the target's
+// sender and sends it to the target room as a message of msgType. info.MimeType, if set, is
+// the fallback type; the detected type and the actual size are filled in. progress, if set,
+// is called with the bytes transferred so far and the total (-1 when unknown).
+// Media streamed before from the same URL is not transferred again. Streamed media is
+// deduplicated by URL only: its content hash is known only once it has been uploaded.
+// Deduplication by content hash applies to images and stickers, which uploadMedia
+// downloads before uploading.
+func (c *Client) streamMediaTo(ctx context.Context, t Target, msgType event.MessageType, mediaURL, filename string, info *event.FileInfo, progress func(done, total int64)) (id.EventID, error) {
+	if t.RoomID == "" {
+		return "", fmt.Errorf("no matrix room for viber sender %s", t.Sender.ID)
+	}
+	if info == nil {
+		info = &event.FileInfo{}
+	}
+	if cached := c.lookupMedia(ctx, mediaURL, ""); cached != nil {
+		info.MimeType, info.Size = cached.Info.MimeType, cached.Info.Size
+		return c.matrix.SendUploadedMedia(ctx, t.RoomID, t.Ghost, msgType, filename, cached.URI, info)
+	}
+	d, err := c.openMedia(ctx, mediaURL, info.MimeType)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = d.Close() }()
+	d.progress = progress
+
+	hash := sha256.New()
+	uri, err := c.matrix.UploadStreamAs(ctx, t.Ghost, io.TeeReader(d, hash), d.Length, d.MimeType)
+	if d.err != nil {
+		// The upload error wraps whatever the HTTP client made of the failed read
+		metrics.RecordError("media_too_large", "viber")
+		return "", d.err
+	}
+	if err != nil {
+		return "", err
+	}
+	info.MimeType = d.MimeType
+	info.Size = int(d.read)
+	c.storeMedia(ctx, mediaURL, hex.EncodeToString(hash.Sum(nil)), uri, &event.FileInfo{MimeType: info.MimeType, Size: info.Size})
+	return c.matrix.SendUploadedMedia(ctx, t.RoomID, t.Ghost, msgType, filename, uri, info)
+}
@@ -11,6 +11,29 @@ var (
 		prometheus.CounterOpts{Name: "viber_messages_forwarded_total", Help: "Messages forwarded to Matrix"},
 		[]string{"type"},
 	)
+	metricOutboundMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "viber_messages_sent_total", Help: "Matrix messages sent to Viber"},
+		[]string{"type"},
+	)
+	metricReceipts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "viber_receipts_total", Help: "Delivery, seen and failed callbacks received"},
+		[]string{"event"},
+	)
+	metricUnsupported = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "viber_unsupported_total", Help: "Webhook events and message types without a handler"},
+		[]string{"kind", "type"},
+	)
+	metricDuplicateWebhooks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "viber_webhook_duplicates_total", Help: "Duplicate webhook callbacks acknowledged without processing"},
+		[]string{"event"},
+	)
+	metricAPICircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "viber_api_circuit_breaker_state", Help: "Viber API circuit breaker state (0=closed, 1=open, 2=half-open)"},
+		[]string{"endpoint"},
+	)
+	metricSendRateLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "viber_send_rate_limited_total", Help: "Outbound messages rejected by client-side send pacing"},
+	)
 	metricSignatureFailures = prometheus.NewCounter(
 		prometheus.CounterOpts{Name: "viber_signature_failures_total", Help: "Signature verification failures"},
 	)
@@ -19,5 +42,11 @@ var (
 func init() {
 	prometheus.MustRegister(metricWebhookRequests)
 	prometheus.MustRegister(metricForwardedMessages)
+	prometheus.MustRegister(metricOutboundMessages)
+	prometheus.MustRegister(metricReceipts)
+	prometheus.MustRegister(metricUnsupported)
+	prometheus.MustRegister(metricDuplicateWebhooks)
+	prometheus.MustRegister(metricAPICircuitState)
+	prometheus.MustRegister(metricSendRateLimited)
 	prometheus.MustRegister(metricSignatureFailures)
 }
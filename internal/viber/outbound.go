@@ -0,0 +1,295 @@
+// Package viber outbound routes Matrix messages to the Viber conversation bridged to their room.
+package viber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/database"
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/media"
+)
+
+// HandleMatrixMessage forwards a Matrix message to the Viber conversation bridged to its room
+// and records the resulting message mapping.
+// Messages in unbridged rooms and messages sent by the bridge bot or Viber ghosts
+// are ignored so bridged messages are never echoed back to Viber, and messages
+// that already have a mapping are not sent again.
+func (c *Client) HandleMatrixMessage(ctx context.Context, evt *event.Event, msg *event.MessageEventContent) error {
+	if evt == nil || msg == nil || c.matrix == nil || c.db == nil {
+		return nil
+	}
+	roomID, sender := evt.RoomID, evt.Sender
+	if c.isBridgeUser(sender) {
+		return nil
+	}
+	if evt.ID != "" {
+		// A retried message that already reached Viber has a mapping and is not sent again
+		mapping, err := c.db.GetMessageMappingByMatrixID(ctx, string(evt.ID))
+		if err != nil {
+			return fmt.Errorf("look up message mapping for %s: %w", evt.ID, err)
+		}
+		if mapping != nil {
+			return nil
+		}
+	}
+
+	receiver, err := c.db.GetViberChatID(ctx, string(roomID))
+	if err != nil {
+		return fmt.Errorf("resolve viber chat for room %s: %w", roomID, err)
+	}
+	if receiver == "" {
+		logger.DebugWithContext(ctx, "ignoring message in unbridged room",
+			"room_id", roomID,
+			"sender", sender,
+		)
+		return nil
+	}
+
+	if msg.MsgType == event.MsgLocation && msg.GeoURI == "" {
+		location := *msg
+		location.GeoURI = locationGeoURI(evt, msg)
+		msg = &location
+	}
+	opts := []SendOption{WithSender(c.matrixSender(ctx, roomID, sender))}
+	var (
+		msgType string
+		resp    *SendMessageResponse
+	)
+	if evt.Type == event.EventSticker {
+		msgType, resp, err = c.sendMatrixSticker(ctx, receiver, msg, opts...)
+	} else {
+		msgType, resp, err = c.sendMatrixContent(ctx, receiver, msg, opts...)
+	}
+	if err != nil {
+		kind := string(msg.MsgType)
+		if evt.Type == event.EventSticker {
+			kind = evt.Type.Type
+		}
+		return fmt.Errorf("send %s to viber %s: %w", kind, receiver, err)
+	}
+	metricOutboundMessages.WithLabelValues(msgType).Inc()
+
+	if resp != nil && resp.MessageToken != 0 && evt.ID != "" {
+		timestamp := time.UnixMilli(evt.Timestamp)
+		if evt.Timestamp == 0 {
+			timestamp = time.Now()
+		}
+		if err := c.db.SaveMessageMapping(ctx, database.MessageMapping{
+			ViberMessageID: strconv.FormatInt(resp.MessageToken, 10),
+			MatrixEventID:  string(evt.ID),
+			ViberChatID:    receiver,
+			MatrixRoomID:   string(roomID),
+			Sender:         string(sender),
+			Direction:      database.DirectionMatrixToViber,
+			Timestamp:      timestamp,
+		}); err != nil {
+			// Log error but don't fail - the message was delivered
+			logger.WarnWithContext(ctx, "failed to store message mapping",
+				"error", err,
+				"event_id", evt.ID,
+				"message_token", resp.MessageToken,
+			)
+		}
+	}
+	return nil
+}
+
+// isBridgeUser reports whether sender is the bridge bot or one of its Viber ghosts.
+func (c *Client) isBridgeUser(sender id.UserID) bool {
+	if sender == c.matrix.UserID() {
+		return true
+	}
+	if c.puppets != nil && c.puppets.IsGhostUser(sender) {
+		return true
+	}
+	if as := c.matrix.AppService(); as != nil && as.IsNamespacedUser(sender) {
+		return true
+	}
+	return false
+}
+
+// sendMatrixContent converts msg to the matching Viber message type and sends it.
+// Returns the Viber message type that was sent and the API response.
+func (c *Client) sendMatrixContent(ctx context.Context, receiver string, msg *event.MessageEventContent, opts ...SendOption) (string, *SendMessageResponse, error) {
+	switch msg.MsgType {
+	case event.MsgText, event.MsgNotice:
+		resp, err := c.SendText(ctx, receiver, msg.Body, opts...)
+		return "text", resp, err
+	case event.MsgEmote:
+		resp, err := c.SendText(ctx, receiver, "* "+msg.Body, opts...)
+		return "text", resp, err
+	case event.MsgLocation:
+		lat, lon, err := parseGeoURI(msg.GeoURI)
+		if err != nil {
+			// Fall back to the textual description so the message is not lost
+			resp, err := c.SendText(ctx, receiver, msg.Body, opts...)
+			return "text", resp, err
+		}
+		resp, err := c.SendLocation(ctx, receiver, lat, lon, opts...)
+		return "location", resp, err
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		return c.sendMatrixMedia(ctx, receiver, msg, opts...)
+	default:
+		if msg.Body == "" {
+			return "", nil, fmt.Errorf("unsupported message type %s", msg.MsgType)
+		}
+		resp, err := c.SendText(ctx, receiver, msg.Body, opts...)
+		return "text", resp, err
+	}
+}
+
+// sendMatrixSticker sends a Matrix sticker. Stickers that originated from Viber are sent back
+// as the same Viber sticker; Viber bots cannot send other stickers, so those become pictures.
+func (c *Client) sendMatrixSticker(ctx context.Context, receiver string, msg *event.MessageEventContent, opts ...SendOption) (string, *SendMessageResponse, error) {
+	if msg.URL != "" {
+		sticker, err := c.db.GetViberStickerByMXC(ctx, string(msg.URL))
+		if err != nil {
+			logger.WarnWithContext(ctx, "failed to look up viber sticker",
+				"error", err,
+				"mxc", msg.URL,
+			)
+		} else if sticker != nil {
+			resp, err := c.SendSticker(ctx, receiver, int(sticker.StickerID), opts...)
+			return "sticker", resp, err
+		}
+	}
+	image := *msg
+	image.MsgType = event.MsgImage
+	return c.sendMatrixMedia(ctx, receiver, &image, opts...)
+}
+
+// MediaLinker turns Matrix content URIs into URLs that Viber can download without credentials.
+// *matrix.MediaProxy implements it.
+type MediaLinker interface {
+	URL(uri id.ContentURIString, filename string) (string, error)
+}
+
+// errNoMediaLinker is returned when Matrix media must be linked but no MediaLinker is set.
+var errNoMediaLinker = errors.New("no media linker configured")
+
+// SetMediaLinker sets how Matrix media is linked in messages sent to Viber.
+// Without one, Matrix media is not linked at all: media messages are sent as their
+// text body and Matrix senders appear without avatars.
+func (c *Client) SetMediaLinker(linker MediaLinker) {
+	c.media = linker
+}
+
+// mediaURL returns a URL Viber can download a Matrix content URI from.
+func (c *Client) mediaURL(uri id.ContentURIString, filename string) (string, error) {
+	if c.media == nil {
+		return "", errNoMediaLinker
+	}
+	return c.media.URL(uri, filename)
+}
+
+// sendMatrixMedia sends Matrix media as a Viber picture, video or file message,
+// and vCard files as Viber contacts. Voice messages are converted to audio Viber plays
+// as a video when a transcoder is set, and sent as files otherwise.
+// Encrypted media cannot be linked publicly, and no media can without a MediaLinker;
+// such media is sent as its text body instead.
+func (c *Client) sendMatrixMedia(ctx context.Context, receiver string, msg *event.MessageEventContent, opts ...SendOption) (string, *SendMessageResponse, error) {
+	if msg.URL == "" || c.media == nil {
+		resp, err := c.SendText(ctx, receiver, msg.Body, opts...)
+		return "text", resp, err
+	}
+	filename := msg.FileName
+	if filename == "" {
+		filename = msg.Body
+	}
+	if msg.MSC3245Voice != nil && filepath.Ext(filename) == "" {
+		// Voice messages are often named "Voice message"; Viber needs an extension to accept a file
+		filename = voiceFilename + ".ogg" // What Matrix clients record
+		if msg.Info != nil && audioExtension(msg.Info.MimeType) != "" {
+			filename = voiceFilename + audioExtension(msg.Info.MimeType)
+		}
+	}
+	mediaURL, err := c.mediaURL(msg.URL, filename)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var size int64
+	var duration int
+	var thumbnailURL string
+	if msg.Info != nil {
+		size = int64(msg.Info.Size)
+		duration = msg.Info.Duration / 1000 // Matrix uses milliseconds, Viber seconds
+		if msg.Info.ThumbnailURL != "" {
+			thumbnailURL, _ = c.mediaURL(msg.Info.ThumbnailURL, "thumbnail")
+		}
+	}
+
+	switch msg.MsgType {
+	case event.MsgImage:
+		resp, err := c.SendImage(ctx, receiver, mediaURL, thumbnailURL, opts...)
+		return "picture", resp, err
+	case event.MsgVideo:
+		c.completeVideo(ctx, msg, &thumbnailURL, &duration, &size)
+		resp, err := c.SendVideo(ctx, receiver, mediaURL, size, duration, append(opts, WithThumbnail(thumbnailURL))...)
+		return "video", resp, err
+	default:
+		if msg.MSC3245Voice != nil && media.Supports(c.transcoder, media.TranscodeTo(viberVoiceMime)) {
+			voiceURL, voiceSize, voiceDuration, err := c.transcodeVoice(ctx, msg)
+			if err == nil {
+				resp, err := c.SendVideo(ctx, receiver, voiceURL, voiceSize, voiceDuration, opts...)
+				return "video", resp, err
+			}
+			// The original recording still arrives as a file
+			logger.WarnWithContext(ctx, "failed to convert voice message for viber",
+				"error", err,
+				"mxc", msg.URL,
+			)
+		}
+		if msg.MsgType == event.MsgFile && isVCard(msg) {
+			resp, err := c.sendMatrixVCard(ctx, receiver, msg, opts...)
+			if err == nil {
+				return "contact", resp, nil
+			}
+			// Cards that cannot be sent as contacts still arrive as files
+			logger.WarnWithContext(ctx, "failed to send vcard as viber contact",
+				"error", err,
+				"filename", filename,
+			)
+		}
+		// Viber has no audio message type for bots; audio, voice messages included, is sent as a file
+		resp, err := c.SendFile(ctx, receiver, mediaURL, size, filename, opts...)
+		return "file", resp, err
+	}
+}
+
+// parseGeoURI parses an RFC 5870 geo URI ("geo:lat,lon[,alt][;params]").
+// Coordinates outside the WGS 84 range, NaN and infinities are rejected.
+func parseGeoURI(uri string) (lat, lon float64, err error) {
+	coords, ok := strings.CutPrefix(uri, "geo:")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid geo uri %q", uri)
+	}
+	coords, _, _ = strings.Cut(coords, ";")
+	parts := strings.Split(coords, ",")
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("invalid geo uri %q", uri)
+	}
+	if lat, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid latitude in %q: %w", uri, err)
+	}
+	if lon, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid longitude in %q: %w", uri, err)
+	}
+	// Negated so that NaN, which fails every comparison, is rejected too
+	if !(lat >= -90 && lat <= 90) {
+		return 0, 0, fmt.Errorf("latitude out of range in %q", uri)
+	}
+	if !(lon >= -180 && lon <= 180) {
+		return 0, 0, fmt.Errorf("longitude out of range in %q", uri)
+	}
+	return lat, lon, nil
+}
@@ -0,0 +1,94 @@
+// Package viber outbox forwards persisted Matrix messages to Viber asynchronously.
+package viber
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+
+	"github.com/example/mautrix-viber/internal/queue"
+)
+
+const (
+	// outboxQueueName is the name of the Matrix message outbox queue.
+	outboxQueueName = "matrix_outbox"
+	// outboxJobType identifies outbox jobs in the message queue.
+	outboxJobType = "matrix_to_viber"
+)
+
+// outbox persists Matrix message events in the durable queue and forwards them on its workers.
+type outbox struct {
+	client *Client
+	queue  *queue.Queue
+}
+
+// StartOutbox switches forwarding of Matrix messages to asynchronous processing.
+// Messages passed to QueueMatrixMessage are written to the database queue and
+// forwarded by workers with retries, dead-lettering messages that keep failing.
+// Messages of one room are forwarded in the order they were received.
+// Jobs left unprocessed by a previous run are resumed. Requires a database.
+func (c *Client) StartOutbox(ctx context.Context) error {
+	if c.db == nil {
+		return fmt.Errorf("matrix outbox requires a database")
+	}
+	cfg := queue.DefaultConfig()
+	cfg.Name = outboxQueueName
+
+	ob := &outbox{client: c}
+	ob.queue = queue.New(c.db, cfg, ob.process)
+	ob.queue.Start(ctx)
+	c.outbox = ob
+	return nil
+}
+
+// StopOutbox stops the outbox workers, waiting for in-flight messages until ctx expires.
+// Messages still queued are resumed by the next StartOutbox.
+func (c *Client) StopOutbox(ctx context.Context) error {
+	if c.outbox == nil {
+		return nil
+	}
+	return c.outbox.queue.Stop(ctx)
+}
+
+// QueueMatrixMessage persists a Matrix message for forwarding to Viber, in order with the
+// other messages of its room. Without an outbox the message is forwarded inline.
+// It matches the callback of matrix.Client.StartMessageListener.
+func (c *Client) QueueMatrixMessage(ctx context.Context, evt *event.Event, msg *event.MessageEventContent) error {
+	if c.outbox == nil {
+		return c.HandleMatrixMessage(ctx, evt, msg)
+	}
+	if evt == nil || c.isBridgeUser(evt.Sender) {
+		return nil
+	}
+	raw, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("encode matrix event %s: %w", evt.ID, err)
+	}
+	_, err = c.outbox.queue.Enqueue(ctx, outboxJobType, queue.MatrixKey(string(evt.RoomID)), raw)
+	return err
+}
+
+// process forwards one queued Matrix message.
+// Transient failures make the queue retry the job with backoff; any other failure
+// cannot succeed on retry and dead-letters the job without blocking its room.
+func (ob *outbox) process(ctx context.Context, job queue.MessageJob) error {
+	var evt event.Event
+	if err := json.Unmarshal(job.Payload, &evt); err != nil {
+		return fmt.Errorf("%w: decode matrix event: %v", queue.ErrPermanent, err)
+	}
+	evt.Type.Class = event.MessageEventType
+	if err := evt.Content.ParseRaw(evt.Type); err != nil {
+		return fmt.Errorf("%w: parse matrix event %s: %v", queue.ErrPermanent, evt.ID, err)
+	}
+	msg, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return fmt.Errorf("%w: matrix event %s of type %s is not a message", queue.ErrPermanent, evt.ID, evt.Type.Type)
+	}
+	err := ob.client.HandleMatrixMessage(ctx, &evt, msg)
+	if err != nil && ctx.Err() == nil && !isTransient(err) {
+		return fmt.Errorf("%w: %w", queue.ErrPermanent, err)
+	}
+	return err
+}
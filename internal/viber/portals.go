@@ -0,0 +1,64 @@
+// Package viber portals routes each Viber conversation to its own Matrix portal room.
+package viber
+
+import (
+	"context"
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/metrics"
+)
+
+// conversationID returns the Viber conversation a webhook belongs to.
+// Group messages carry a chat ID; one-to-one conversations are keyed by the sender.
+func conversationID(payload WebhookRequest) string {
+	if payload.Message.ChatID != "" {
+		return payload.Message.ChatID
+	}
+	return payload.Sender.ID
+}
+
+// portalName returns the Matrix room name for a Viber conversation.
+func portalName(payload WebhookRequest) string {
+	if payload.Message.ChatID != "" {
+		return fmt.Sprintf("Viber Group: %s", payload.Message.ChatID)
+	}
+	if payload.Sender.Name != "" {
+		return payload.Sender.Name
+	}
+	return fmt.Sprintf("Viber: %s", payload.Sender.ID)
+}
+
+// resolvePortal returns the portal room for a webhook and the ghost to send as.
+// The portal is created on demand with the sender's ghost invited.
+// Falls back to MATRIX_DEFAULT_ROOM_ID (sent as the bridge bot) only when the bridge
+// has no portals, e.g. without a database; failing to get or create a portal is an
+// error, so that a conversation is never leaked into the shared default room.
+func (c *Client) resolvePortal(ctx context.Context, payload WebhookRequest) (Target, error) {
+	ghost := c.ensureGhost(ctx, payload.Sender)
+	target := Target{Sender: payload.Sender}
+
+	chatID := conversationID(payload)
+	if c.portals != nil && chatID != "" {
+		room, err := c.portals.GetOrCreatePortalRoom(ctx, chatID, portalName(payload), ghost)
+		if err != nil {
+			metrics.RecordError("portal_resolve_failure", "webhook")
+			return Target{}, fmt.Errorf("get portal room for %s: %w", chatID, err)
+		}
+		if room.Created {
+			logger.InfoWithContext(ctx, "created portal room for Viber conversation",
+				"chat_id", chatID,
+				"room_id", room.MatrixRoomID,
+			)
+		}
+		target.RoomID = room.MatrixRoomID
+		target.Ghost = c.joinGhost(ctx, room.MatrixRoomID, ghost)
+		return target, nil
+	}
+
+	target.RoomID = id.RoomID(c.matrix.GetDefaultRoomID())
+	target.Ghost = c.joinGhost(ctx, target.RoomID, ghost)
+	return target, nil
+}
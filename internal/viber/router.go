@@ -0,0 +1,201 @@
+// Package viber router dispatches Viber webhook events and message types to typed handlers.
+package viber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/metrics"
+)
+
+// Target identifies the Matrix destination of a bridged Viber message.
+type Target struct {
+	RoomID id.RoomID // Portal room of the conversation
+	Ghost  id.UserID // Ghost to send as; empty sends as the bridge bot
+	Sender Sender    // Original Viber sender, used for attribution when sending as the bot
+}
+
+// InboundMessage is a Viber message event routed to its portal room.
+type InboundMessage struct {
+	Payload WebhookRequest
+	Target
+}
+
+// EventHandler handles a decoded Viber webhook event.
+type EventHandler func(ctx context.Context, payload WebhookRequest) error
+
+// MessageHandler bridges one Viber message type to Matrix.
+// It returns the Matrix event ID so the message mapping can be recorded.
+type MessageHandler func(ctx context.Context, msg *InboundMessage) (id.EventID, error)
+
+// router holds the handlers registered for each event and message type.
+type router struct {
+	mu       sync.RWMutex
+	events   map[Event][]EventHandler
+	messages map[string]MessageHandler
+}
+
+func newRouter() *router {
+	return &router{
+		events:   make(map[Event][]EventHandler),
+		messages: make(map[string]MessageHandler),
+	}
+}
+
+// RegisterEventHandler adds a handler for a webhook event type.
+// Handlers run in registration order after the built-in handler for the event.
+func (c *Client) RegisterEventHandler(evt Event, handler EventHandler) {
+	c.router.mu.Lock()
+	defer c.router.mu.Unlock()
+	c.router.events[evt] = append(c.router.events[evt], handler)
+}
+
+// RegisterMessageHandler sets the handler for a Viber message type (e.g. MessageTypeSticker),
+// replacing the built-in handler.
+func (c *Client) RegisterMessageHandler(msgType string, handler MessageHandler) {
+	c.router.mu.Lock()
+	defer c.router.mu.Unlock()
+	c.router.messages[msgType] = handler
+}
+
+// registerDefaultHandlers installs the built-in handlers for all known events and message types.
+func (c *Client) registerDefaultHandlers() {
+	c.RegisterEventHandler(EventMessage, c.handleMessageEvent)
+	c.RegisterEventHandler(EventSubscribed, c.handleSubscribed)
+	c.RegisterEventHandler(EventConversation, c.handleConversationStarted)
+	c.RegisterEventHandler(EventUnsubscribed, c.handleUnsubscribed)
+	c.RegisterEventHandler(EventDelivered, c.handleDelivered)
+	c.RegisterEventHandler(EventSeen, c.handleSeen)
+	c.RegisterEventHandler(EventFailed, c.handleFailed)
+	c.RegisterEventHandler(EventWebhook, c.handleWebhookVerification)
+	c.RegisterEventHandler(EventClientStatus, c.handleClientStatus)
+
+	c.RegisterMessageHandler(MessageTypeText, c.handleTextMessage)
+	c.RegisterMessageHandler(MessageTypePicture, c.handlePictureMessage)
+	c.RegisterMessageHandler(MessageTypeVideo, c.handleMediaMessage)
+	c.RegisterMessageHandler(MessageTypeVoice, c.handleMediaMessage)
+	c.RegisterMessageHandler(MessageTypeFile, c.handleMediaMessage)
+	c.RegisterMessageHandler(MessageTypeSticker, c.handleStickerMessage)
+	c.RegisterMessageHandler(MessageTypeLocation, c.handleLocationMessage)
+	c.RegisterMessageHandler(MessageTypeContact, c.handleContactMessage)
+	c.RegisterMessageHandler(MessageTypeURL, c.handleURLMessage)
+	c.RegisterMessageHandler(MessageTypeRichMedia, c.handleRichMediaMessage)
+}
+
+// dispatch runs all handlers registered for the payload's event type.
+// All handlers run even if one fails; their errors are joined into the returned error.
+// A failed callback is retried with every handler, so handlers must be idempotent:
+// the built-in message handler skips messages that already have a message mapping.
+func (c *Client) dispatch(ctx context.Context, payload WebhookRequest) error {
+	c.router.mu.RLock()
+	handlers := append([]EventHandler(nil), c.router.events[payload.Event]...)
+	c.router.mu.RUnlock()
+
+	if len(handlers) == 0 {
+		metricUnsupported.WithLabelValues("event", string(payload.Event)).Inc()
+		logger.DebugWithContext(ctx, "ignoring unknown Viber event",
+			"event", payload.Event,
+		)
+		return nil
+	}
+	var errs []error
+	for _, handler := range handlers {
+		if err := handler(ctx, payload); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("handle %s event: %w", payload.Event, errors.Join(errs...))
+	}
+	return nil
+}
+
+// messageHandler returns the handler registered for a message type.
+func (c *Client) messageHandler(msgType string) (MessageHandler, bool) {
+	c.router.mu.RLock()
+	defer c.router.mu.RUnlock()
+	handler, ok := c.router.messages[msgType]
+	return handler, ok
+}
+
+// handleMessageEvent routes a message event to its portal room and message type handler,
+// then records the message mapping. Messages that already have a mapping are skipped,
+// so retrying a callback does not send its message to Matrix twice.
+func (c *Client) handleMessageEvent(ctx context.Context, payload WebhookRequest) error {
+	if c.matrix == nil {
+		return nil
+	}
+	msgType := payload.Message.Type
+	handler, ok := c.messageHandler(msgType)
+	if !ok {
+		metricUnsupported.WithLabelValues("message", msgType).Inc()
+		if payload.Message.Text == "" {
+			return fmt.Errorf("unsupported message type %q", msgType)
+		}
+		// Unknown types that carry text are still worth bridging
+		handler = c.handleTextMessage
+	}
+
+	if c.alreadyBridged(ctx, payload) {
+		// A retry of a callback whose message reached Matrix before a later step failed
+		return nil
+	}
+
+	start := time.Now()
+	target, err := c.resolvePortal(ctx, payload)
+	if err != nil {
+		return fmt.Errorf("route %s message: %w", msgType, err)
+	}
+	msg := &InboundMessage{Payload: payload, Target: target}
+
+	// Group membership references the portal mapping, so it is tracked once the portal exists
+	if c.db != nil && payload.Message.ChatID != "" && payload.Sender.ID != "" {
+		if err := c.db.UpsertGroupMember(ctx, payload.Message.ChatID, payload.Sender.ID, payload.Sender.Name); err != nil {
+			// Log error but don't fail - best-effort persistence
+			logger.WarnWithContext(ctx, "failed to upsert group member",
+				"error", err,
+				"chat_id", payload.Message.ChatID,
+				"user_id", payload.Sender.ID,
+			)
+		}
+	}
+	eventID, err := handler(ctx, msg)
+	if err != nil {
+		metrics.RecordError("message_forward_failure", "webhook")
+		return fmt.Errorf("forward %s message to matrix: %w", msgType, err)
+	}
+	// Record message processing latency for successful forwards
+	metrics.RecordMessageLatency("viber_to_matrix", msgType, time.Since(start))
+	metricForwardedMessages.WithLabelValues(msgType).Inc()
+	c.storeInboundMapping(ctx, payload, msg.RoomID, eventID)
+	return nil
+}
+
+// alreadyBridged reports whether a message mapping exists for the payload's message token.
+func (c *Client) alreadyBridged(ctx context.Context, payload WebhookRequest) bool {
+	if c.db == nil || payload.MessageToken == 0 {
+		return false
+	}
+	mapping, err := c.db.GetMessageMappingByViberID(ctx, strconv.FormatInt(payload.MessageToken, 10))
+	if err != nil {
+		logger.WarnWithContext(ctx, "failed to look up message mapping",
+			"error", err,
+			"message_token", payload.MessageToken,
+		)
+		return false
+	}
+	if mapping != nil {
+		logger.DebugWithContext(ctx, "skipping already bridged Viber message",
+			"message_token", payload.MessageToken,
+			"matrix_event_id", mapping.MatrixEventID,
+		)
+	}
+	return mapping != nil
+}
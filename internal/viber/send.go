@@ -1,15 +1,10 @@
 // Package viber send implements Viber API message sending functions.
-// Supports text, image, video, file, location, contact, and URL messages.
+// Supports text, image, video, file, sticker, location, contact, and URL messages.
 package viber
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/example/mautrix-viber/internal/metrics"
@@ -17,20 +12,49 @@ import (
 
 // SendMessageRequest represents a Viber send message API request.
 type SendMessageRequest struct {
-	Receiver      string     `json:"receiver"`
-	Type          string     `json:"type"`
-	Text          string     `json:"text,omitempty"`
-	Media         string     `json:"media,omitempty"`
-	Thumbnail     string     `json:"thumbnail,omitempty"`
-	Duration      int        `json:"duration,omitempty"`
-	Size          int64      `json:"size,omitempty"`
-	FileName      string     `json:"file_name,omitempty"`
-	Location      *Location  `json:"location,omitempty"`
-	Contact       *Contact   `json:"contact,omitempty"`
-	TrackingData  string     `json:"tracking_data,omitempty"`
-	Keyboard      *Keyboard  `json:"keyboard,omitempty"`
-	RichMedia     *RichMedia `json:"rich_media,omitempty"`
-	MinAPIVersion int        `json:"min_api_version,omitempty"`
+	Receiver      string         `json:"receiver"`
+	Sender        *MessageSender `json:"sender,omitempty"`
+	Type          string         `json:"type"`
+	Text          string         `json:"text,omitempty"`
+	Media         string         `json:"media,omitempty"`
+	Thumbnail     string         `json:"thumbnail,omitempty"`
+	Duration      int            `json:"duration,omitempty"`
+	Size          int64          `json:"size,omitempty"`
+	FileName      string         `json:"file_name,omitempty"`
+	StickerID     int            `json:"sticker_id,omitempty"`
+	Location      *Location      `json:"location,omitempty"`
+	Contact       *Contact       `json:"contact,omitempty"`
+	TrackingData  string         `json:"tracking_data,omitempty"`
+	Keyboard      *Keyboard      `json:"keyboard,omitempty"`
+	RichMedia     *RichMedia     `json:"rich_media,omitempty"`
+	MinAPIVersion int            `json:"min_api_version,omitempty"`
+}
+
+// MessageSender overrides the name and avatar a message is shown with instead of the bot's.
+// Viber allows names of up to MaxSenderNameLength characters.
+type MessageSender struct {
+	Name   string `json:"name"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+// SendOption customizes a message built by the Send* helpers.
+type SendOption func(*SendMessageRequest)
+
+// WithSender shows the message as sent by sender. A nil sender keeps the bot's identity.
+func WithSender(sender *MessageSender) SendOption {
+	return func(req *SendMessageRequest) {
+		req.Sender = sender
+	}
+}
+
+// WithThumbnail sets the thumbnail shown for a picture or video message.
+// An empty URL leaves the request unchanged.
+func WithThumbnail(thumbnailURL string) SendOption {
+	return func(req *SendMessageRequest) {
+		if thumbnailURL != "" {
+			req.Thumbnail = thumbnailURL
+		}
+	}
 }
 
 // Location represents a location for Viber location messages.
@@ -74,172 +98,122 @@ type SendMessageResponse struct {
 }
 
 // SendText sends a text message to a Viber user.
-func (c *Client) SendText(ctx context.Context, receiver, text string) (*SendMessageResponse, error) {
-	return c.SendMessage(ctx, SendMessageRequest{
+func (c *Client) SendText(ctx context.Context, receiver, text string, opts ...SendOption) (*SendMessageResponse, error) {
+	return c.SendMessage(ctx, buildRequest(SendMessageRequest{
 		Receiver: receiver,
 		Type:     "text",
 		Text:     text,
-	})
+	}, opts))
 }
 
 // SendImage sends an image message to a Viber user.
 // mediaURL should be a publicly accessible image URL.
-func (c *Client) SendImage(ctx context.Context, receiver, mediaURL, thumbnailURL string) (*SendMessageResponse, error) {
-	return c.SendMessage(ctx, SendMessageRequest{
+func (c *Client) SendImage(ctx context.Context, receiver, mediaURL, thumbnailURL string, opts ...SendOption) (*SendMessageResponse, error) {
+	return c.SendMessage(ctx, buildRequest(SendMessageRequest{
 		Receiver:  receiver,
 		Type:      "picture",
 		Media:     mediaURL,
 		Thumbnail: thumbnailURL,
-	})
+	}, opts))
 }
 
 // SendVideo sends a video message to a Viber user.
-func (c *Client) SendVideo(ctx context.Context, receiver, mediaURL string, size int64, duration int) (*SendMessageResponse, error) {
-	return c.SendMessage(ctx, SendMessageRequest{
+func (c *Client) SendVideo(ctx context.Context, receiver, mediaURL string, size int64, duration int, opts ...SendOption) (*SendMessageResponse, error) {
+	return c.SendMessage(ctx, buildRequest(SendMessageRequest{
 		Receiver: receiver,
 		Type:     "video",
 		Media:    mediaURL,
 		Size:     size,
 		Duration: duration,
-	})
+	}, opts))
 }
 
 // SendFile sends a file message to a Viber user.
-func (c *Client) SendFile(ctx context.Context, receiver, mediaURL string, size int64, filename string) (*SendMessageResponse, error) {
-	return c.SendMessage(ctx, SendMessageRequest{
+func (c *Client) SendFile(ctx context.Context, receiver, mediaURL string, size int64, filename string, opts ...SendOption) (*SendMessageResponse, error) {
+	return c.SendMessage(ctx, buildRequest(SendMessageRequest{
 		Receiver: receiver,
 		Type:     "file",
 		Media:    mediaURL,
 		Size:     size,
 		FileName: filename,
-	})
+	}, opts))
+}
+
+// SendSticker sends a Viber sticker by its sticker ID to a Viber user.
+func (c *Client) SendSticker(ctx context.Context, receiver string, stickerID int, opts ...SendOption) (*SendMessageResponse, error) {
+	return c.SendMessage(ctx, buildRequest(SendMessageRequest{
+		Receiver:  receiver,
+		Type:      "sticker",
+		StickerID: stickerID,
+	}, opts))
 }
 
 // SendLocation sends a location message to a Viber user.
-func (c *Client) SendLocation(ctx context.Context, receiver string, lat, lon float64) (*SendMessageResponse, error) {
-	return c.SendMessage(ctx, SendMessageRequest{
+func (c *Client) SendLocation(ctx context.Context, receiver string, lat, lon float64, opts ...SendOption) (*SendMessageResponse, error) {
+	return c.SendMessage(ctx, buildRequest(SendMessageRequest{
 		Receiver: receiver,
 		Type:     "location",
 		Location: &Location{Lat: lat, Lon: lon},
-	})
+	}, opts))
 }
 
 // SendContact sends a contact card message to a Viber user.
-func (c *Client) SendContact(ctx context.Context, receiver string, contact Contact) (*SendMessageResponse, error) {
-	return c.SendMessage(ctx, SendMessageRequest{
+func (c *Client) SendContact(ctx context.Context, receiver string, contact Contact, opts ...SendOption) (*SendMessageResponse, error) {
+	return c.SendMessage(ctx, buildRequest(SendMessageRequest{
 		Receiver: receiver,
 		Type:     "contact",
 		Contact:  &contact,
-	})
+	}, opts))
 }
 
 // SendURL sends a URL message to a Viber user.
-func (c *Client) SendURL(ctx context.Context, receiver, urlStr string) (*SendMessageResponse, error) {
-	return c.SendMessage(ctx, SendMessageRequest{
+func (c *Client) SendURL(ctx context.Context, receiver, urlStr string, opts ...SendOption) (*SendMessageResponse, error) {
+	return c.SendMessage(ctx, buildRequest(SendMessageRequest{
 		Receiver: receiver,
 		Type:     "url",
 		Media:    urlStr,
-	})
+	}, opts))
 }
 
-// SendMessage sends a generic message to a Viber user using the send_message API.
-func (c *Client) SendMessage(ctx context.Context, req SendMessageRequest) (*SendMessageResponse, error) {
-	if c.config.APIToken == "" {
-		return nil, fmt.Errorf("api token not configured")
+// buildRequest applies send options to a request.
+func buildRequest(req SendMessageRequest, opts []SendOption) SendMessageRequest {
+	for _, opt := range opts {
+		opt(&req)
 	}
+	return req
+}
 
+// SendMessage sends a generic message to a Viber user using the send_message API.
+// Viber rejections are returned as *APIError; use errors.Is with the package
+// sentinels (e.g. ErrReceiverNotSubscribed) to tell them apart.
+// Sends are paced by Config.SendLimit; a send that cannot go out within its
+// maximum wait fails with ratelimit.ErrLimited, whose RetryAfter says when it could.
+func (c *Client) SendMessage(ctx context.Context, req SendMessageRequest) (*SendMessageResponse, error) {
 	start := time.Now()
 	defer func() {
 		metrics.RecordOperationDuration("viber_send_message", time.Since(start))
 	}()
 
-	apiBaseURL := c.config.ViberAPIBaseURL
-	if apiBaseURL == "" {
-		apiBaseURL = "https://chatapi.viber.com"
-	}
-	apiURL := apiBaseURL + "/pa/send_message"
-	body, err := json.Marshal(req)
-	if err != nil {
-		metrics.RecordError("viber_marshal_failure", "send")
-		return nil, fmt.Errorf("marshal request: %w", err)
-	}
-
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewReader(body))
-	if err != nil {
-		metrics.RecordError("viber_request_failure", "send")
-		return nil, fmt.Errorf("create request: %w", err)
-	}
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("X-Viber-Auth-Token", c.config.APIToken)
-
-	resp, err := c.httpClient.Do(httpReq)
-	if err != nil {
-		metrics.RecordError("viber_send_failure", "send")
-		return nil, fmt.Errorf("send request: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		metrics.RecordError("viber_read_failure", "send")
-		return nil, fmt.Errorf("read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		metrics.RecordError("viber_api_error", "send")
-		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(respBody))
+	if err := c.limiter.Wait(ctx, req.Receiver); err != nil {
+		metricSendRateLimited.Inc()
+		return nil, fmt.Errorf("viber send_message to %s: %w", req.Receiver, err)
 	}
 
 	var sendResp SendMessageResponse
-	if err := json.Unmarshal(respBody, &sendResp); err != nil {
-		metrics.RecordError("viber_decode_failure", "send")
-		return nil, fmt.Errorf("unmarshal response: %w", err)
-	}
-
-	if sendResp.Status != 0 {
-		metrics.RecordError("viber_api_error", "send")
-		return nil, fmt.Errorf("viber api error %d: %s", sendResp.Status, sendResp.StatusMessage)
+	if err := c.callAPI(ctx, endpointSendMessage, req, &sendResp); err != nil {
+		return nil, err
 	}
-
 	return &sendResp, nil
 }
 
 // GetUserDetails retrieves user information from Viber API.
 func (c *Client) GetUserDetails(ctx context.Context, userID string) (*UserDetails, error) {
-	if c.config.APIToken == "" {
-		return nil, fmt.Errorf("api token not configured")
-	}
-
-	apiBaseURL := c.config.ViberAPIBaseURL
-	if apiBaseURL == "" {
-		apiBaseURL = "https://chatapi.viber.com"
-	}
-	apiURL := fmt.Sprintf("%s/pa/get_user_details?id=%s", apiBaseURL, url.QueryEscape(userID))
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
-	}
-	httpReq.Header.Set("X-Viber-Auth-Token", c.config.APIToken)
-
-	resp, err := c.httpClient.Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
 	var userResp struct {
-		Status int         `json:"status"`
-		User   UserDetails `json:"user"`
+		User UserDetails `json:"user"`
 	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&userResp); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+	if err := c.callAPI(ctx, endpointGetUserDetails, map[string]string{"id": userID}, &userResp); err != nil {
+		return nil, err
 	}
-
-	if userResp.Status != 0 {
-		return nil, fmt.Errorf("viber api error %d", userResp.Status)
-	}
-
 	return &userResp.User, nil
 }
 
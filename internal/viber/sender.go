@@ -0,0 +1,149 @@
+// Package viber sender shows Matrix users by name and avatar on messages sent to Viber.
+package viber
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
+)
+
+const (
+	// DefaultSenderNameTemplate renders the Matrix display name unchanged.
+	DefaultSenderNameTemplate = "{{.DisplayName}}"
+	// MaxSenderNameLength is the longest sender name Viber accepts, in characters.
+	MaxSenderNameLength = 28
+)
+
+// senderCacheTTL is how long a resolved Matrix sender is reused before its profile is fetched again.
+const senderCacheTTL = 5 * time.Minute
+
+// SenderNameData is the data available to the sender name template.
+type SenderNameData struct {
+	DisplayName string // Room display name, or the localpart when the user has none
+	UserID      string // Full Matrix user ID, e.g. "@alice:example.com"
+	Localpart   string // Localpart of the user ID, e.g. "alice"
+	Server      string // Homeserver of the user ID, e.g. "example.com"
+}
+
+// ParseSenderNameTemplate parses a sender name template; an empty string selects the default.
+func ParseSenderNameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultSenderNameTemplate
+	}
+	tmpl, err := template.New("sender_name").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse sender name template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// senderCache remembers resolved senders per room and user.
+type senderCache struct {
+	mu      sync.Mutex
+	entries map[string]senderCacheEntry
+}
+
+// senderCacheEntry is a cached sender and when it expires.
+type senderCacheEntry struct {
+	sender  *MessageSender
+	expires time.Time
+}
+
+// get returns a cached sender that has not expired.
+func (sc *senderCache) get(key string, now time.Time) (*MessageSender, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	entry, ok := sc.entries[key]
+	if !ok || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.sender, true
+}
+
+// put caches a sender, dropping expired entries while at it.
+func (sc *senderCache) put(key string, sender *MessageSender, now time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.entries == nil {
+		sc.entries = make(map[string]senderCacheEntry)
+	}
+	for k, entry := range sc.entries {
+		if now.After(entry.expires) {
+			delete(sc.entries, k)
+		}
+	}
+	sc.entries[key] = senderCacheEntry{sender: sender, expires: now.Add(senderCacheTTL)}
+}
+
+// matrixSender returns the Viber sender for a Matrix user's message in a portal room,
+// or nil when sender override is disabled. Profile lookup failures fall back to the
+// user's localpart so the message is still attributed.
+func (c *Client) matrixSender(ctx context.Context, roomID id.RoomID, userID id.UserID) *MessageSender {
+	if c.config.DisableSenderOverride || c.matrix == nil {
+		return nil
+	}
+	key := roomID.String() + "|" + userID.String()
+	now := time.Now()
+	if sender, ok := c.senders.get(key, now); ok {
+		return sender
+	}
+
+	displayName, avatar, err := c.matrix.GetMemberProfile(ctx, roomID, userID)
+	if err != nil {
+		logger.WarnWithContext(ctx, "failed to get matrix sender profile",
+			"error", err,
+			"room_id", roomID,
+			"sender", userID,
+		)
+	}
+	sender := &MessageSender{Name: c.senderName(userID, displayName)}
+	if avatar != "" {
+		if avatarURL, err := c.mediaURL(avatar, "avatar"); err == nil {
+			sender.Avatar = avatarURL
+		}
+	}
+	if err == nil {
+		c.senders.put(key, sender, now)
+	}
+	return sender
+}
+
+// senderName renders the sender name template for a Matrix user and truncates it to Viber's limit.
+func (c *Client) senderName(userID id.UserID, displayName string) string {
+	localpart, server, _ := userID.Parse()
+	if localpart == "" {
+		localpart = strings.TrimPrefix(userID.String(), "@")
+	}
+	data := SenderNameData{
+		DisplayName: strings.TrimSpace(displayName),
+		UserID:      userID.String(),
+		Localpart:   localpart,
+		Server:      server,
+	}
+	if data.DisplayName == "" {
+		data.DisplayName = localpart
+	}
+
+	name := data.DisplayName
+	var b strings.Builder
+	if err := c.senderTemplate.Execute(&b, data); err == nil && strings.TrimSpace(b.String()) != "" {
+		name = strings.TrimSpace(b.String())
+	}
+	return truncateName(name, MaxSenderNameLength)
+}
+
+// truncateName shortens name to at most n characters, marking the cut with an ellipsis.
+func truncateName(name string, n int) string {
+	runes := []rune(name)
+	if len(runes) <= n {
+		return name
+	}
+	return strings.TrimSpace(string(runes[:n-1])) + "…"
+}
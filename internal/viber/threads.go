@@ -44,13 +44,15 @@ func (tm *ThreadManager) HandleReply(ctx context.Context, roomID id.RoomID, repl
 	if originalEventID == "" {
 		// Original message not found, send as regular message
 		text := fmt.Sprintf("[Viber] %s: %s", senderName, replyText)
-		return tm.matrixClient.SendTextToRoom(ctx, roomID, text)
+		_, err = tm.matrixClient.SendTextToRoom(ctx, roomID, text)
+		return err
 	}
 
 	// Send as reply (thread support requires matrix client enhancements)
 	// For now, prefix with "Re: " to indicate reply
 	text := fmt.Sprintf("Re: %s\n\n[Viber] %s: %s", originalEventID, senderName, replyText)
-	return tm.matrixClient.SendTextToRoom(ctx, roomID, text)
+	_, err = tm.matrixClient.SendTextToRoom(ctx, roomID, text)
+	return err
 }
 
 // GetThreadRoot gets the root event ID for a thread.
@@ -1,6 +1,13 @@
 package viber
 
-// Incoming webhook payload minimal structures
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Incoming webhook payload structures (Viber REST API callbacks)
 
 // Event represents a Viber webhook event type.
 type Event string
@@ -9,41 +16,175 @@ const (
 	// EventMessage is a message event.
 	EventMessage Event = "message"
 	// EventSubscribed is a subscription event.
-	EventSubscribed = "subscribed"
+	EventSubscribed Event = "subscribed"
 	// EventUnsubscribed is an unsubscription event.
-	EventUnsubscribed = "unsubscribed"
+	EventUnsubscribed Event = "unsubscribed"
 	// EventConversation is a conversation start event.
-	EventConversation = "conversation_started"
+	EventConversation Event = "conversation_started"
+	// EventDelivered reports that a message sent by the bot reached the user's device.
+	EventDelivered Event = "delivered"
+	// EventSeen reports that a message sent by the bot was read.
+	EventSeen Event = "seen"
+	// EventFailed reports that a message sent by the bot could not be delivered.
+	EventFailed Event = "failed"
+	// EventWebhook is the verification callback sent when the webhook is set.
+	EventWebhook Event = "webhook"
+	// EventClientStatus reports a change in the user's client status.
+	EventClientStatus Event = "client_status"
+)
+
+// Message types carried in Message.Type.
+const (
+	MessageTypeText      = "text"
+	MessageTypePicture   = "picture"
+	MessageTypeVideo     = "video"
+	MessageTypeVoice     = "voice"
+	MessageTypeFile      = "file"
+	MessageTypeSticker   = "sticker"
+	MessageTypeLocation  = "location"
+	MessageTypeContact   = "contact"
+	MessageTypeURL       = "url"
+	MessageTypeRichMedia = "rich_media"
 )
 
 // Sender represents a message sender.
 type Sender struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	Avatar   string `json:"avatar,omitempty"`
-	Language string `json:"language,omitempty"`
-	Country  string `json:"country,omitempty"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Avatar     string `json:"avatar,omitempty"`
+	Language   string `json:"language,omitempty"`
+	Country    string `json:"country,omitempty"`
+	APIVersion int    `json:"api_version,omitempty"`
+
+	// Unknown holds fields not described by this struct, kept for diagnostics
+	Unknown map[string]json.RawMessage `json:"-"`
 }
 
 // Message represents a Viber message.
 type Message struct {
-	Type      string `json:"type"`
-	Text      string `json:"text,omitempty"`
-	Media     string `json:"media,omitempty"`
-	FileName  string `json:"file_name,omitempty"`
-	Thumbnail string `json:"thumbnail,omitempty"`
+	Type         string `json:"type"`
+	Text         string `json:"text,omitempty"`
+	Media        string `json:"media,omitempty"`     // Media URL; the link itself for url messages
+	FileName     string `json:"file_name,omitempty"` // File messages
+	Size         int64  `json:"size,omitempty"`      // Media size in bytes (file and video messages)
+	Duration     int    `json:"duration,omitempty"`  // Video and voice message duration in seconds
+	Thumbnail    string `json:"thumbnail,omitempty"`
+	StickerID    int    `json:"sticker_id,omitempty"`
+	TrackingData string `json:"tracking_data,omitempty"` // Opaque data echoed from the bot's last message
+	// Structured payloads for location and contact messages
+	Location *Location `json:"location,omitempty"`
+	Contact  *Contact  `json:"contact,omitempty"`
 	// Group or chat identifiers (may vary by Viber API version)
 	ChatID string `json:"chat_id,omitempty"`
+
+	// Unknown holds fields not described by this struct, kept for diagnostics
+	Unknown map[string]json.RawMessage `json:"-"`
 }
 
 // WebhookRequest represents an incoming Viber webhook request.
 type WebhookRequest struct {
-	Event   Event   `json:"event"`
-	Sender  Sender  `json:"sender"`
-	Message Message `json:"message"`
-	// Token/hostname fields commonly present in Viber webhooks
-	MessageToken int64  `json:"message_token,omitempty"`
-	ChatHostname string `json:"chat_hostname,omitempty"`
+	Event        Event   `json:"event"`
+	Timestamp    int64   `json:"timestamp,omitempty"` // Unix epoch milliseconds
+	MessageToken int64   `json:"message_token,omitempty"`
+	ChatHostname string  `json:"chat_hostname,omitempty"`
+	Sender       Sender  `json:"sender"`
+	Message      Message `json:"message"`
+	// User is set on subscribed and conversation_started events instead of Sender
+	User Sender `json:"user"`
+	// UserID is set on delivered, seen, failed, unsubscribed and client_status events
+	UserID string `json:"user_id,omitempty"`
+	// Type is the conversation_started trigger (e.g. "open")
+	Type string `json:"type,omitempty"`
+	// Context is the deep link context of a conversation_started event
+	Context string `json:"context,omitempty"`
+	// Subscribed reports whether a conversation_started user is already subscribed
+	Subscribed bool `json:"subscribed,omitempty"`
+	// Desc describes the failure of a failed event
+	Desc string `json:"desc,omitempty"`
+
+	// Unknown holds fields not described by this struct, kept for diagnostics
+	Unknown map[string]json.RawMessage `json:"-"`
+}
+
+// DecodeWebhookRequest strictly decodes a Viber callback body.
+// Type mismatches and payloads without an event are rejected; fields the model
+// does not know are kept in the Unknown maps instead of being silently dropped.
+func DecodeWebhookRequest(raw []byte) (WebhookRequest, error) {
+	var payload WebhookRequest
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return WebhookRequest{}, fmt.Errorf("decode webhook payload: %w", err)
+	}
+	if payload.Event == "" {
+		return WebhookRequest{}, fmt.Errorf("decode webhook payload: missing event")
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return WebhookRequest{}, fmt.Errorf("decode webhook payload: %w", err)
+	}
+	payload.Unknown = unknownFields(fields, payload)
+	var err error
+	if payload.Message.Unknown, err = nestedUnknownFields(fields["message"], payload.Message); err != nil {
+		return WebhookRequest{}, fmt.Errorf("decode webhook message: %w", err)
+	}
+	if payload.Sender.Unknown, err = nestedUnknownFields(fields["sender"], payload.Sender); err != nil {
+		return WebhookRequest{}, fmt.Errorf("decode webhook sender: %w", err)
+	}
+	if payload.User.Unknown, err = nestedUnknownFields(fields["user"], payload.User); err != nil {
+		return WebhookRequest{}, fmt.Errorf("decode webhook user: %w", err)
+	}
+	return payload, nil
+}
+
+// UnknownFieldNames returns the dotted names of all unknown fields in the payload.
+func (r WebhookRequest) UnknownFieldNames() []string {
+	var names []string
+	for prefix, fields := range map[string]map[string]json.RawMessage{
+		"":         r.Unknown,
+		"message.": r.Message.Unknown,
+		"sender.":  r.Sender.Unknown,
+		"user.":    r.User.Unknown,
+	} {
+		for name := range fields {
+			names = append(names, prefix+name)
+		}
+	}
+	return names
+}
+
+// nestedUnknownFields returns the unknown fields of a nested JSON object.
+func nestedUnknownFields(raw json.RawMessage, v any) (map[string]json.RawMessage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	return unknownFields(fields, v), nil
+}
+
+// unknownFields returns the entries of fields that do not match a JSON tag of v's struct type.
+func unknownFields(fields map[string]json.RawMessage, v any) map[string]json.RawMessage {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	var unknown map[string]json.RawMessage
+	for name, value := range fields {
+		if known[name] {
+			continue
+		}
+		if unknown == nil {
+			unknown = make(map[string]json.RawMessage)
+		}
+		unknown[name] = value
+	}
+	return unknown
 }
 
 // WebhookResponse represents a Viber webhook set response.
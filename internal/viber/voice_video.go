@@ -4,89 +4,231 @@ package viber
 import (
 	"context"
 	"fmt"
-	"io"
-	"net/http"
+	"mime"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/example/mautrix-viber/internal/logger"
+	"github.com/example/mautrix-viber/internal/media"
 )
 
-// HandleVoiceMessage handles a Viber voice message and forwards it to Matrix.
-func (c *Client) HandleVoiceMessage(ctx context.Context, mediaURL string, duration int, size int64) error {
+// voiceFilename is the name of bridged voice messages, without extension.
+const voiceFilename = "viber-voice"
+
+// viberVoiceMime is what Matrix voice messages are converted to for Viber: AAC in MP4,
+// which Viber plays as a video, unlike the Ogg Opus that Matrix clients record.
+const viberVoiceMime = "audio/mp4"
+
+// decodedAudioMime is what voice messages are decoded to for measuring their waveform.
+const decodedAudioMime = "audio/wav"
+
+// SetTranscoder sets the transcoder used to convert voice messages and inspect videos,
+// e.g. a *media.FFmpeg. Without one, Matrix voice messages are sent to Viber as files,
+// videos without thumbnail get none, and only WAV voice messages get a waveform.
+func (c *Client) SetTranscoder(t media.Transcoder) {
+	c.transcoder = t
+}
+
+// HandleVoiceMessage forwards a Viber voice message to the target Matrix room as an MSC3245
+// voice message, which clients show as a playable voice bubble with a waveform.
+// duration is in seconds and only used when the audio's own duration cannot be read.
+func (c *Client) HandleVoiceMessage(ctx context.Context, t Target, mediaURL string, duration int) (id.EventID, error) {
 	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
+		return "", fmt.Errorf("matrix client not configured")
 	}
-
-	// Download voice message
-	resp, err := c.httpClient.Get(mediaURL)
+	if t.RoomID == "" {
+		return "", fmt.Errorf("no matrix room for viber sender %s", t.Sender.ID)
+	}
+	data, mimeType, err := c.downloadMedia(ctx, mediaURL, "audio/ogg")
 	if err != nil {
-		return fmt.Errorf("download voice: %w", err)
+		return "", fmt.Errorf("forward voice message: %w", err)
 	}
-	defer func() { _ = resp.Body.Close() }()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed: status %d", resp.StatusCode)
+	info := &event.FileInfo{MimeType: mimeType, Size: len(data), Duration: duration * 1000}
+	var waveform []int
+	if audio, err := c.analyzeVoice(ctx, data, mimeType); err == nil {
+		info.MimeType = audio.MimeType
+		if audio.Duration > 0 {
+			info.Duration = int(audio.Duration.Milliseconds())
+		}
+		waveform = audio.Waveform
+	} else {
+		// Still a voice message, just without a waveform
+		logger.DebugWithContext(ctx, "failed to analyze viber voice message",
+			"error", err,
+			"mime_type", mimeType,
+		)
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	uri, err := c.matrix.UploadMediaAs(ctx, t.Ghost, data, info.MimeType)
 	if err != nil {
-		return fmt.Errorf("read voice data: %w", err)
+		return "", fmt.Errorf("forward voice message: %w", err)
 	}
+	return c.matrix.SendVoiceAs(ctx, t.RoomID, t.Ghost, voiceFilename+audioExtension(info.MimeType), uri, info, waveform)
+}
 
-	mimeType := resp.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = "audio/ogg" // Default for voice messages
+// analyzeVoice returns the MIME type, duration and waveform of a voice message. The duration and
+// waveform are measured on audio decoded by the transcoder when it can, and read from the file
+// itself otherwise, which only has a waveform when it is WAV.
+func (c *Client) analyzeVoice(ctx context.Context, data []byte, mimeType string) (*media.AudioInfo, error) {
+	info, err := media.AnalyzeAudio(data)
+	if !media.Supports(c.transcoder, media.TranscodeTo(decodedAudioMime)) {
+		return info, err
 	}
-
-	// Upload to Matrix and send as m.audio
-	// Audio forwarding requires Matrix client SendAudio method implementation
-	// For now, send as file
-	return c.matrix.SendImage(ctx, fmt.Sprintf("voice_%d.ogg", duration), mimeType, data, nil)
+	decoded, decodeErr := c.transcoder.Transcode(ctx, data, mimeType, decodedAudioMime)
+	var measured *media.AudioInfo
+	if decodeErr == nil {
+		measured, decodeErr = media.AnalyzeAudio(decoded)
+	}
+	if decodeErr != nil {
+		logger.DebugWithContext(ctx, "failed to decode viber voice message",
+			"error", decodeErr,
+			"mime_type", mimeType,
+		)
+		return info, err
+	}
+	if info == nil {
+		info = &media.AudioInfo{MimeType: mimeType}
+	}
+	info.Duration, info.Waveform = measured.Duration, measured.Waveform
+	return info, nil
 }
 
-// HandleVideoMessage handles a Viber video message and forwards it to Matrix.
-func (c *Client) HandleVideoMessage(ctx context.Context, mediaURL, thumbnailURL string, duration int, size int64) error {
-	if c.matrix == nil {
-		return fmt.Errorf("matrix client not configured")
+// transcodeVoice converts a Matrix voice message to viberVoiceMime and uploads the result.
+// Returns a URL Viber can download it from, its size in bytes and its duration in seconds.
+func (c *Client) transcodeVoice(ctx context.Context, msg *event.MessageEventContent) (string, int64, int, error) {
+	fromMime, duration := "audio/ogg", 0
+	if msg.Info != nil {
+		if msg.Info.MimeType != "" {
+			fromMime = msg.Info.MimeType
+		}
+		duration = msg.Info.Duration
+	}
+	if duration == 0 && msg.MSC1767Audio != nil {
+		duration = msg.MSC1767Audio.Duration
 	}
 
-	// Download video
-	resp, err := c.httpClient.Get(mediaURL)
+	data, err := c.matrix.DownloadMedia(ctx, msg.URL, c.maxMediaSize())
 	if err != nil {
-		return fmt.Errorf("download video: %w", err)
+		return "", 0, 0, err
 	}
-	defer func() { _ = resp.Body.Close() }()
+	converted, err := c.transcoder.Transcode(ctx, data, fromMime, viberVoiceMime)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("transcode voice message: %w", err)
+	}
+	if duration == 0 && media.Supports(c.transcoder, media.CapabilityDuration) {
+		if length, err := c.transcoder.Duration(ctx, converted, viberVoiceMime); err == nil {
+			duration = int(length.Milliseconds())
+		}
+	}
+	uri, err := c.matrix.UploadMediaAs(ctx, "", converted, viberVoiceMime)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	mediaURL, err := c.mediaURL(uri.CUString(), voiceFilename+audioExtension(viberVoiceMime))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return mediaURL, int64(len(converted)), (duration + 500) / 1000, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed: status %d", resp.StatusCode)
+// completeVideo fills in the thumbnail, duration and size Viber shows for a Matrix video whose
+// info block lacks them, using the transcoder. Failures are logged and leave the values unset.
+func (c *Client) completeVideo(ctx context.Context, msg *event.MessageEventContent, thumbnailURL *string, duration *int, size *int64) {
+	needThumbnail := *thumbnailURL == "" && media.Supports(c.transcoder, media.CapabilityThumbnail)
+	needDuration := *duration == 0 && media.Supports(c.transcoder, media.CapabilityDuration)
+	if !needThumbnail && !needDuration {
+		return
+	}
+	mimeType := "video/mp4"
+	if msg.Info != nil && msg.Info.MimeType != "" {
+		mimeType = msg.Info.MimeType
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	err := func() error {
+		data, err := c.matrix.DownloadMedia(ctx, msg.URL, c.maxMediaSize())
+		if err != nil {
+			return err
+		}
+		if *size == 0 {
+			*size = int64(len(data))
+		}
+		if needDuration {
+			length, err := c.transcoder.Duration(ctx, data, mimeType)
+			if err != nil {
+				return err
+			}
+			*duration = int(length.Round(time.Second) / time.Second)
+		}
+		if needThumbnail {
+			thumbnail, err := c.transcoder.Thumbnail(ctx, data, mimeType)
+			if err != nil {
+				return err
+			}
+			uri, err := c.matrix.UploadMediaAs(ctx, "", thumbnail, "image/jpeg")
+			if err != nil {
+				return err
+			}
+			if *thumbnailURL, err = c.mediaURL(uri.CUString(), "thumbnail.jpg"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
 	if err != nil {
-		return fmt.Errorf("read video data: %w", err)
+		logger.WarnWithContext(ctx, "failed to complete video details for viber",
+			"error", err,
+			"mxc", msg.URL,
+		)
 	}
+}
 
-	mimeType := resp.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = "video/mp4" // Default
+// audioExtension returns the usual file extension of an audio MIME type, or "" when unknown.
+func audioExtension(mimeType string) string {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	switch mediaType {
+	case "audio/ogg", "audio/opus", "application/ogg":
+		return ".ogg"
+	case "audio/mp4", "audio/aac", "audio/x-m4a":
+		return ".m4a"
+	case "audio/mpeg":
+		return ".mp3"
+	case "audio/wav", "audio/x-wav", "audio/wave":
+		return ".wav"
+	default:
+		return ""
 	}
+}
 
-	// Upload to Matrix and send as m.video
-	// Video forwarding requires Matrix client SendVideo method implementation
-	// For now, send as file
-	return c.matrix.SendImage(ctx, fmt.Sprintf("video_%d.mp4", duration), mimeType, data, nil)
+// HandleVideoMessage streams a Viber video message to the default Matrix room as m.video.
+// duration is in seconds.
+func (c *Client) HandleVideoMessage(ctx context.Context, mediaURL, thumbnailURL string, duration int, size int64) error {
+	if c.matrix == nil {
+		return fmt.Errorf("matrix client not configured")
+	}
+	t := Target{RoomID: id.RoomID(c.matrix.GetDefaultRoomID())}
+	if t.RoomID == "" {
+		return fmt.Errorf("default room ID not configured")
+	}
+	info := &event.FileInfo{MimeType: "video/mp4", Duration: duration * 1000}
+	c.attachThumbnail(ctx, "", info, thumbnailURL)
+	if _, err := c.streamMediaTo(ctx, t, event.MsgVideo, mediaURL, fmt.Sprintf("video_%d.mp4", duration), info, nil); err != nil {
+		return fmt.Errorf("forward video message: %w", err)
+	}
+	return nil
 }
 
-// TranscodeIfNeeded transcodes media if needed for Matrix compatibility.
-// Media transcoding requires external tools (ffmpeg) and is not currently implemented.
+// TranscodeIfNeeded converts audio from inputMime to outputMime with the configured transcoder.
+// Data already in outputMime is returned as is; conversions the transcoder cannot do fail with
+// media.ErrUnsupported.
 func (c *Client) TranscodeIfNeeded(ctx context.Context, inputData []byte, inputMime, outputMime string) ([]byte, error) {
 	if inputMime == outputMime {
 		return inputData, nil
 	}
-
-	// Transcoding requires external media processing tools (ffmpeg, imagemagick, etc.)
-	// Implementation would need to:
-	// 1. Detect available transcoding tools
-	// 2. Execute transcoding commands
-	// 3. Handle transcoding errors gracefully
-	// For now, return error indicating transcoding is required but not available
-	_ = ctx
-	return nil, fmt.Errorf("media transcoding from %s to %s requires external tools (ffmpeg) - not currently implemented", inputMime, outputMime)
+	if !media.Supports(c.transcoder, media.TranscodeTo(outputMime)) {
+		return nil, fmt.Errorf("%w: transcode %s to %s", media.ErrUnsupported, inputMime, outputMime)
+	}
+	return c.transcoder.Transcode(ctx, inputData, inputMime, outputMime)
 }